@@ -0,0 +1,80 @@
+// Package authz implements authorization of principals to perform operations that require a scope
+package authz
+
+import (
+	"crypto/subtle"
+	"sync/atomic"
+)
+
+// ScopeWrite is the scope required to modify documents
+const ScopeWrite = "write"
+
+// Rules define the scopes granted to principals
+type Rules struct {
+	// Members maps principal names to their roles
+	Members map[string]string
+	// Scopes maps role names to the scopes granted to their members
+	Scopes map[string][]string
+	// Passwords maps user names to passwords they are required to use Basic authentication with to
+	// be granted a scope
+	Passwords map[string]string
+}
+
+// Granted returns true if the principal is a member of a role the scope is granted to
+func (r Rules) Granted(principal, scope string) bool {
+	role, ok := r.Members[principal]
+	if !ok {
+		return false
+	}
+
+	for _, s := range r.Scopes[role] {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticate returns true if there is a password configured for the user and it matches provided one
+func (r Rules) Authenticate(user, password string) bool {
+	expected, ok := r.Passwords[user]
+	if !ok || expected == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// Store holds a set of rules that can be safely replaced while in use
+type Store struct {
+	v atomic.Value
+}
+
+// NewStore returns a new store holding r
+func NewStore(r Rules) *Store {
+	s := &Store{}
+	s.Store(r)
+
+	return s
+}
+
+// Store replaces the rules
+func (s *Store) Store(r Rules) {
+	s.v.Store(r)
+}
+
+// Load returns current rules
+func (s *Store) Load() Rules {
+	return s.v.Load().(Rules)
+}
+
+// Granted returns true if the principal is a member of a role the scope is granted to
+func (s *Store) Granted(principal, scope string) bool {
+	return s.Load().Granted(principal, scope)
+}
+
+// Authenticate returns true if there is a password configured for the user and it matches provided one
+func (s *Store) Authenticate(user, password string) bool {
+	return s.Load().Authenticate(user, password)
+}
@@ -0,0 +1,50 @@
+package authz_test
+
+import (
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/authz"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules_Granted(t *testing.T) {
+	r := authz.Rules{
+		Members: map[string]string{
+			"importer": "catalog",
+			"user1":    "partner",
+		},
+		Scopes: map[string][]string{
+			"catalog": {authz.ScopeWrite},
+		},
+	}
+
+	assert.True(t, r.Granted("importer", authz.ScopeWrite))
+	assert.False(t, r.Granted("user1", authz.ScopeWrite))
+	assert.False(t, r.Granted("user2", authz.ScopeWrite))
+}
+
+func TestRules_Authenticate(t *testing.T) {
+	r := authz.Rules{
+		Passwords: map[string]string{
+			"importer": "secret",
+			"user1":    "",
+		},
+	}
+
+	assert.True(t, r.Authenticate("importer", "secret"))
+	assert.False(t, r.Authenticate("importer", "wrong"))
+	assert.False(t, r.Authenticate("user1", ""))
+	assert.False(t, r.Authenticate("user2", "secret"))
+}
+
+func TestStore(t *testing.T) {
+	s := authz.NewStore(authz.Rules{})
+	assert.False(t, s.Granted("importer", authz.ScopeWrite))
+
+	s.Store(authz.Rules{
+		Members: map[string]string{"importer": "catalog"},
+		Scopes:  map[string][]string{"catalog": {authz.ScopeWrite}},
+	})
+	assert.True(t, s.Granted("importer", authz.ScopeWrite))
+}
@@ -0,0 +1,234 @@
+// Package breaker implements a circuit breaker that fails fast while a downstream service is unhealthy
+package breaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+)
+
+var (
+	breakerState = metrics.NewGaugeVec(
+		"search_service_circuit_breaker_state",
+		"Circuit breaker state: 0 - closed, 1 - half-open, 2 - open.",
+		"name",
+	)
+	breakerRejected = metrics.NewCounterVec(
+		"search_service_circuit_breaker_rejected_total",
+		"Total number of calls rejected by an open circuit breaker.",
+		"name",
+	)
+)
+
+func init() {
+	metrics.Default.MustRegister(breakerState, breakerRejected)
+}
+
+// State is the circuit breaker state
+type State int
+
+// Circuit breaker states
+const (
+	// Closed lets all calls through
+	Closed State = iota
+	// HalfOpen lets a limited number of probe calls through to check whether the service has recovered
+	HalfOpen
+	// Open rejects all calls
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Settings configure the circuit breaker
+type Settings struct {
+	// FailureThreshold is the number of consecutive failed calls that opens the breaker
+	FailureThreshold int
+	// SlowCallThreshold is the call duration above which a successful call is considered failed.
+	// A zero value disables latency tracking
+	SlowCallThreshold time.Duration
+	// OpenTimeout is the time the breaker stays open before letting probe calls through
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of successful probe calls required to close the breaker.
+	// It defaults to 1
+	HalfOpenProbes int
+}
+
+// OpenError is returned for calls rejected by an open breaker
+type OpenError struct {
+	// RetryAfter is the time left until the breaker lets probe calls through
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return "circuit breaker is open"
+}
+
+// ignoredError wraps an error that says nothing about the service health
+type ignoredError struct {
+	err error
+}
+
+func (e ignoredError) Error() string {
+	return e.err.Error()
+}
+
+// Ignore wraps an error returned by a call that should be recorded as neither a success nor a failure,
+// i.e. a cancelled or a rejected request. Do returns the original error in this case
+func Ignore(err error) error {
+	return ignoredError{err}
+}
+
+// Breaker is a circuit breaker. It opens after a number of consecutive failed calls and rejects
+// all calls with OpenError until the open timeout expires. After that, it lets a limited number
+// of probe calls through and closes if all of them succeed, otherwise it opens again
+type Breaker struct {
+	name     string
+	settings Settings
+	now      func() time.Time
+
+	mu        sync.Mutex
+	state     State
+	failures  int
+	openedAt  time.Time
+	probes    int // number of probe calls in flight or succeeded while half-open
+	successes int
+}
+
+// New returns a closed circuit breaker. The name is used to label the breaker metrics
+func New(name string, s Settings) *Breaker {
+	if s.HalfOpenProbes <= 0 {
+		s.HalfOpenProbes = 1
+	}
+
+	b := &Breaker{
+		name:     name,
+		settings: s,
+		now:      time.Now,
+	}
+	breakerState.With(name).Set(float64(Closed))
+
+	return b
+}
+
+// State returns current breaker state
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.currentState()
+}
+
+// Do calls fn if the breaker allows it and records the outcome, unless the error has been wrapped with Ignore.
+// If the breaker is open, it returns OpenError without calling fn. Otherwise it returns the error returned by fn
+func (b *Breaker) Do(fn func() error) error {
+	if err := b.allow(); err != nil {
+		breakerRejected.With(b.name).Inc()
+		return err
+	}
+
+	start := b.now()
+	err := fn()
+
+	if e, ok := err.(ignoredError); ok {
+		b.release()
+		return e.err
+	}
+
+	failed := err != nil
+	if b.settings.SlowCallThreshold > 0 && b.now().Sub(start) > b.settings.SlowCallThreshold {
+		failed = true
+	}
+	b.record(failed)
+
+	return err
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case Open:
+		return &OpenError{RetryAfter: b.openedAt.Add(b.settings.OpenTimeout).Sub(b.now())}
+	case HalfOpen:
+		if b.probes >= b.settings.HalfOpenProbes {
+			// wait for the probes in flight to complete
+			return &OpenError{RetryAfter: time.Second}
+		}
+		b.probes++
+	}
+
+	return nil
+}
+
+func (b *Breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case Closed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+
+		b.failures++
+		if b.failures >= b.settings.FailureThreshold {
+			b.setState(Open)
+		}
+	case HalfOpen:
+		if failed {
+			b.setState(Open)
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.settings.HalfOpenProbes {
+			b.setState(Closed)
+		}
+	}
+}
+
+// release frees the probe slot taken by a call whose outcome has been ignored
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.currentState() == HalfOpen && b.probes > b.successes {
+		b.probes--
+	}
+}
+
+// currentState returns the breaker state moving it from open to half-open once the open timeout
+// has expired. It must be called with b.mu held
+func (b *Breaker) currentState() State {
+	if b.state == Open && !b.now().Before(b.openedAt.Add(b.settings.OpenTimeout)) {
+		b.setState(HalfOpen)
+	}
+
+	return b.state
+}
+
+// setState must be called with b.mu held
+func (b *Breaker) setState(s State) {
+	b.state = s
+	b.failures, b.probes, b.successes = 0, 0, 0
+	if s == Open {
+		b.openedAt = b.now()
+	}
+
+	breakerState.With(b.name).Set(float64(s))
+}
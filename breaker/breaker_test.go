@@ -0,0 +1,110 @@
+package breaker_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/breaker"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errFailed = errors.New("failed")
+
+func succeed() error { return nil }
+func fail() error    { return errFailed }
+
+func TestBreaker_OpensAfterConsecutiveFailures(t *testing.T) {
+	b := breaker.New("test", breaker.Settings{FailureThreshold: 2, OpenTimeout: time.Minute})
+
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.NoError(t, b.Do(succeed)) // resets the failure counter
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, breaker.Closed, b.State())
+
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, breaker.Open, b.State())
+
+	called := false
+	err := b.Do(func() error {
+		called = true
+		return nil
+	})
+	assert.False(t, called)
+
+	require.IsType(t, &breaker.OpenError{}, err)
+	assert.InDelta(t, time.Minute, err.(*breaker.OpenError).RetryAfter, float64(time.Second))
+}
+
+func TestBreaker_SlowCalls(t *testing.T) {
+	b := breaker.New("test", breaker.Settings{FailureThreshold: 1, SlowCallThreshold: time.Millisecond, OpenTimeout: time.Minute})
+
+	assert.NoError(t, b.Do(func() error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}))
+	assert.Equal(t, breaker.Open, b.State())
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	b := breaker.New("test", breaker.Settings{FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond, HalfOpenProbes: 2})
+
+	b.Do(fail)
+	require.Equal(t, breaker.Open, b.State())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, breaker.HalfOpen, b.State())
+
+	// a failed probe opens the breaker again
+	assert.Equal(t, errFailed, b.Do(fail))
+	assert.Equal(t, breaker.Open, b.State())
+
+	time.Sleep(30 * time.Millisecond)
+
+	assert.NoError(t, b.Do(succeed))
+	assert.Equal(t, breaker.HalfOpen, b.State())
+
+	assert.NoError(t, b.Do(succeed))
+	assert.Equal(t, breaker.Closed, b.State())
+}
+
+func TestBreaker_HalfOpen_LimitsProbes(t *testing.T) {
+	b := breaker.New("test", breaker.Settings{FailureThreshold: 1, OpenTimeout: 10 * time.Millisecond})
+
+	b.Do(fail)
+	time.Sleep(20 * time.Millisecond)
+
+	probing, done := make(chan struct{}), make(chan struct{})
+	go b.Do(func() error {
+		close(probing)
+		<-done
+		return nil
+	})
+	<-probing
+
+	assert.IsType(t, &breaker.OpenError{}, b.Do(succeed))
+	close(done)
+}
+
+func TestBreaker_Ignore(t *testing.T) {
+	b := breaker.New("test", breaker.Settings{FailureThreshold: 2, OpenTimeout: 10 * time.Millisecond})
+
+	ignore := func() error { return breaker.Ignore(errFailed) }
+
+	// ignored calls do not reset the failure counter
+	b.Do(fail)
+	assert.Equal(t, errFailed, b.Do(ignore))
+	b.Do(fail)
+	require.Equal(t, breaker.Open, b.State())
+
+	time.Sleep(20 * time.Millisecond)
+
+	// an ignored probe neither closes nor opens the breaker, and lets another probe through
+	assert.Equal(t, errFailed, b.Do(ignore))
+	assert.Equal(t, breaker.HalfOpen, b.State())
+
+	assert.NoError(t, b.Do(succeed))
+	assert.Equal(t, breaker.Closed, b.State())
+}
@@ -0,0 +1,48 @@
+package cache
+
+import "sync"
+
+// Group collapses concurrent calls with the same key into one
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// Do calls fn and returns its results. If there is a call with the same key in flight, Do waits for
+// it to complete and returns its results instead, in which case shared is true
+func (g *Group) Do(key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+
+		return c.value, c.err, true
+	}
+
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+
+		c.wg.Done()
+	}()
+
+	c.value, c.err = fn()
+
+	return c.value, c.err, false
+}
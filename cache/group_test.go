@@ -0,0 +1,54 @@
+package cache_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/cache"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup_Do(t *testing.T) {
+	var (
+		g       cache.Group
+		calls   int32
+		wg      sync.WaitGroup
+		release = make(chan struct{})
+	)
+
+	results := make([]interface{}, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			v, err, _ := g.Do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+
+				return "value", nil
+			})
+			require.NoError(t, err)
+			results[i] = v
+		}(i)
+	}
+
+	// let all goroutines join the call in flight
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, calls)
+	for _, v := range results {
+		assert.Equal(t, "value", v)
+	}
+
+	// subsequent calls are not collapsed
+	v, _, shared := g.Do("key", func() (interface{}, error) { return "another value", nil })
+	assert.Equal(t, "another value", v)
+	assert.False(t, shared)
+}
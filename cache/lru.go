@@ -0,0 +1,150 @@
+// Package cache implements an in-memory LRU cache with expiration and request collapsing
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU is a cache bounded by the total size of its entries. Once the limit is reached, the least
+// recently used entries are evicted. Entries expire after the TTL, but are kept for the stale TTL
+// to be retrieved with GetStale
+type LRU struct {
+	maxSize  int64
+	ttl      time.Duration
+	staleTTL time.Duration
+	now      func() time.Time
+
+	// OnEvict, if set, is called with the number of entries evicted to free space
+	OnEvict func(n int)
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently used
+}
+
+type entry struct {
+	Key      string
+	Value    interface{}
+	Size     int64
+	StoredAt time.Time
+}
+
+// NewLRU returns a new cache holding up to maxSize bytes of entries for the ttl. Expired
+// entries are retained for another staleTTL
+func NewLRU(maxSize int64, ttl, staleTTL time.Duration) *LRU {
+	return &LRU{
+		maxSize:  maxSize,
+		ttl:      ttl,
+		staleTTL: staleTTL,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the value stored under the key if it has not expired yet
+func (c *LRU) Get(key string) (interface{}, bool) {
+	v, age, ok := c.get(key)
+	if !ok || age >= c.ttl {
+		return nil, false
+	}
+
+	return v, true
+}
+
+// GetStale returns the value stored under the key along with its age, even if it has expired
+// no longer than the stale TTL ago
+func (c *LRU) GetStale(key string) (interface{}, time.Duration, bool) {
+	return c.get(key)
+}
+
+func (c *LRU) get(key string) (interface{}, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+
+	e := el.Value.(*entry)
+	age := c.now().Sub(e.StoredAt)
+	if age >= c.ttl+c.staleTTL {
+		c.remove(el)
+		return nil, 0, false
+	}
+	c.order.MoveToFront(el)
+
+	return e.Value, age, true
+}
+
+// Set stores the value of given size under the key. Values larger than the cache size are not stored
+func (c *LRU) Set(key string, value interface{}, size int64) {
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{
+		Key:      key,
+		Value:    value,
+		Size:     size,
+		StoredAt: c.now(),
+	})
+	c.size += size
+
+	var evicted int
+	for c.size > c.maxSize {
+		c.remove(c.order.Back())
+		evicted++
+	}
+
+	if evicted > 0 && c.OnEvict != nil {
+		c.OnEvict(evicted)
+	}
+}
+
+// Purge removes all entries from the cache and returns their number
+func (c *LRU) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries)
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.size = 0
+
+	return n
+}
+
+// Len returns the number of entries in the cache including the expired ones
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// Size returns the total size of entries in the cache
+func (c *LRU) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// remove must be called with c.mu held
+func (c *LRU) remove(el *list.Element) {
+	e := c.order.Remove(el).(*entry)
+	delete(c.entries, e.Key)
+	c.size -= e.Size
+}
@@ -0,0 +1,109 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/cache"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU_GetSet(t *testing.T) {
+	c := cache.NewLRU(100, time.Minute, 0)
+
+	_, ok := c.Get("key1")
+	assert.False(t, ok)
+
+	c.Set("key1", "value1", 10)
+	c.Set("key2", "value2", 10)
+
+	v, ok := c.Get("key1")
+	assert.True(t, ok)
+	assert.Equal(t, "value1", v)
+
+	// overwrite
+	c.Set("key1", "value3", 20)
+
+	v, ok = c.Get("key1")
+	assert.True(t, ok)
+	assert.Equal(t, "value3", v)
+
+	assert.Equal(t, 2, c.Len())
+	assert.EqualValues(t, 30, c.Size())
+}
+
+func TestLRU_Eviction(t *testing.T) {
+	c := cache.NewLRU(30, time.Minute, 0)
+
+	var evicted int
+	c.OnEvict = func(n int) { evicted += n }
+
+	c.Set("key1", "value1", 10)
+	c.Set("key2", "value2", 10)
+	c.Set("key3", "value3", 10)
+
+	c.Get("key1") // key2 is now the least recently used one
+	c.Set("key4", "value4", 10)
+
+	_, ok := c.Get("key2")
+	assert.False(t, ok)
+
+	for _, key := range []string{"key1", "key3", "key4"} {
+		_, ok := c.Get(key)
+		assert.True(t, ok, key)
+	}
+
+	// too large to be cached
+	c.Set("key5", "value5", 31)
+	_, ok = c.Get("key5")
+	assert.False(t, ok)
+
+	assert.Equal(t, 1, evicted)
+}
+
+func TestLRU_Expiration(t *testing.T) {
+	c := cache.NewLRU(100, 10*time.Millisecond, 0)
+
+	c.Set("key1", "value1", 10)
+	time.Sleep(20 * time.Millisecond)
+
+	_, ok := c.Get("key1")
+	assert.False(t, ok)
+	assert.EqualValues(t, 0, c.Size())
+}
+
+func TestLRU_GetStale(t *testing.T) {
+	c := cache.NewLRU(100, 10*time.Millisecond, 20*time.Millisecond)
+
+	c.Set("key1", "value1", 10)
+	time.Sleep(15 * time.Millisecond)
+
+	_, ok := c.Get("key1")
+	assert.False(t, ok)
+
+	v, age, ok := c.GetStale("key1")
+	assert.True(t, ok)
+	assert.Equal(t, "value1", v)
+	assert.True(t, age >= 15*time.Millisecond, age)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, _, ok = c.GetStale("key1")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestLRU_Purge(t *testing.T) {
+	c := cache.NewLRU(100, time.Minute, 0)
+
+	c.Set("key1", "value1", 10)
+	c.Set("key2", "value2", 10)
+
+	assert.Equal(t, 2, c.Purge())
+	assert.Equal(t, 0, c.Len())
+	assert.EqualValues(t, 0, c.Size())
+
+	_, ok := c.Get("key1")
+	assert.False(t, ok)
+}
@@ -0,0 +1,321 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/andrewslotin/es-search-service/schema"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// maxReportedFailures is the maximum number of failed records listed in a report
+const maxReportedFailures = 100
+
+// scanPageSize is the number of documents fetched from the index at once to plan a sync
+const scanPageSize = 1000
+
+type catalogStore interface {
+	Bulk(ctx context.Context, ops []storage.BulkOperation) ([]storage.BulkResult, error)
+	Scan(ctx context.Context, size int, fn func(id string, doc json.RawMessage) error) error
+}
+
+type documentValidator interface {
+	Validate(doc []byte, partial bool) []schema.Violation
+}
+
+// Settings limit the size of bulk requests
+type Settings struct {
+	MaxBatchSize      int
+	MaxBatchDocuments int
+}
+
+// Failure is a record that could not be written
+type Failure struct {
+	// Line is the snapshot line of the record, zero for deletions
+	Line  int
+	ID    string
+	Error string
+}
+
+func (f Failure) String() string {
+	if f.Line == 0 {
+		return fmt.Sprintf("id %s: %s", f.ID, f.Error)
+	}
+
+	if f.ID == "" {
+		return fmt.Sprintf("line %d: %s", f.Line, f.Error)
+	}
+
+	return fmt.Sprintf("line %d, id %s: %s", f.Line, f.ID, f.Error)
+}
+
+// Report is the outcome of an import
+type Report struct {
+	// Indexed is the number of documents created or replaced
+	Indexed int
+	// Deleted is the number of documents deleted
+	Deleted int
+	// Failed is the number of records that could not be read, validated or written
+	Failed int
+	// Failures are the first failed records
+	Failures []Failure
+}
+
+func (r *Report) fail(f Failure) {
+	r.Failed++
+	if len(r.Failures) < maxReportedFailures {
+		r.Failures = append(r.Failures, f)
+	}
+}
+
+// Importer writes product snapshots to the index
+type Importer struct {
+	st       catalogStore
+	v        documentValidator
+	settings Settings
+}
+
+// NewImporter returns a new Importer validating documents against the schema
+func NewImporter(st catalogStore, v documentValidator, settings Settings) *Importer {
+	return &Importer{st: st, v: v, settings: settings}
+}
+
+// Import indexes all records of the snapshot replacing existing documents with the same IDs
+func (im *Importer) Import(ctx context.Context, r *Reader) (Report, error) {
+	return im.write(ctx, r, nil, nil)
+}
+
+// Sync indexes the records changed according to the plan and deletes the documents missing in the snapshot.
+// The snapshot is expected to be the same the plan has been made for
+func (im *Importer) Sync(ctx context.Context, r *Reader, p Plan) (Report, error) {
+	return im.write(ctx, r, p.changed, p.Deleted)
+}
+
+// write indexes the snapshot records, if changed is not nil only the records with IDs in it are indexed,
+// and deletes documents with given IDs
+func (im *Importer) write(ctx context.Context, r *Reader, changed map[string]bool, deleted []string) (Report, error) {
+	var (
+		report    Report
+		ops       []storage.BulkOperation
+		lines     []int
+		batchSize int
+	)
+
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+
+		results, err := im.st.Bulk(ctx, ops)
+		if err != nil {
+			return fmt.Errorf("failed to write a batch of %d documents: %s", len(ops), err)
+		}
+
+		for i, res := range results {
+			switch {
+			case ops[i].Action == storage.BulkDelete && (res.Status < http.StatusMultipleChoices || res.Status == http.StatusNotFound):
+				report.Deleted++
+			case res.Status >= http.StatusMultipleChoices:
+				report.fail(Failure{Line: lines[i], ID: ops[i].ID, Error: res.Error})
+			default:
+				report.Indexed++
+			}
+		}
+
+		ops, lines, batchSize = ops[:0], lines[:0], 0
+
+		return nil
+	}
+
+	add := func(line int, op storage.BulkOperation) error {
+		if batchSize+len(op.Doc) > im.settings.MaxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		ops, lines = append(ops, op), append(lines, line)
+		batchSize += len(op.Doc)
+
+		if len(ops) >= im.settings.MaxBatchDocuments {
+			return flush()
+		}
+
+		return nil
+	}
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return report, fmt.Errorf("failed to read snapshot: %s", err)
+		}
+
+		if changed != nil && !changed[rec.ID] {
+			continue
+		}
+
+		if rec.Error = im.validate(rec); rec.Error != "" {
+			report.fail(Failure{Line: rec.Line, ID: rec.ID, Error: rec.Error})
+			continue
+		}
+
+		if err := add(rec.Line, storage.BulkOperation{Action: storage.BulkIndex, ID: rec.ID, Doc: rec.Doc}); err != nil {
+			return report, err
+		}
+	}
+
+	for _, id := range deleted {
+		if err := add(0, storage.BulkOperation{Action: storage.BulkDelete, ID: id}); err != nil {
+			return report, err
+		}
+	}
+
+	if err := flush(); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// validate returns the reason the record can't be indexed
+func (im *Importer) validate(rec Record) string {
+	if rec.Error != "" {
+		return rec.Error
+	}
+
+	if vs := im.v.Validate(rec.Doc, false); len(vs) > 0 {
+		return fmt.Sprintf("%s: %s", vs[0].Pointer, vs[0].Message)
+	}
+
+	return ""
+}
+
+// Plan is the list of changes required to synchronize the index with a snapshot
+type Plan struct {
+	// Indexed is the number of documents in the index
+	Indexed int
+	// Records is the number of records in the snapshot
+	Records int
+	// Created is the number of records missing in the index
+	Created int
+	// Updated is the number of records with content different from the indexed one
+	Updated int
+	// Unchanged is the number of records matching the indexed documents
+	Unchanged int
+	// Deleted are the IDs of indexed documents missing in the snapshot
+	Deleted []string
+	// Failed is the number of records that could not be read or validated
+	Failed int
+	// Failures are the first failed records
+	Failures []Failure
+
+	changed map[string]bool
+}
+
+// DeletedPercent returns the share of indexed documents to be deleted
+func (p Plan) DeletedPercent() float64 {
+	if p.Indexed == 0 {
+		return 0
+	}
+
+	return float64(len(p.Deleted)) * 100 / float64(p.Indexed)
+}
+
+// Plan compares the snapshot with the indexed documents by ID and content hash. Documents are only deleted
+// if there is no record with their ID in the snapshot, including the invalid ones. A missing index is
+// treated as an empty one
+func (im *Importer) Plan(ctx context.Context, r *Reader) (Plan, error) {
+	indexed := make(map[string][sha256.Size]byte)
+	err := im.st.Scan(ctx, scanPageSize, func(id string, doc json.RawMessage) error {
+		h, err := contentHash(doc)
+		if err != nil {
+			log.Printf("failed to parse indexed document %s, it will be replaced: %s", id, err)
+		}
+		indexed[id] = h
+
+		return nil
+	})
+	// the index is created by the first write, so a missing one is the same as an empty one
+	if err != nil && err != storage.ErrNotFound && err != storage.ErrIndexNotFound {
+		return Plan{}, fmt.Errorf("failed to scan the index: %s", err)
+	}
+
+	p := Plan{Indexed: len(indexed), changed: make(map[string]bool)}
+	seen := make(map[string]bool, len(indexed))
+
+	var report Report
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return Plan{}, fmt.Errorf("failed to read snapshot: %s", err)
+		}
+		p.Records++
+
+		if rec.ID != "" {
+			seen[rec.ID] = true
+		}
+
+		if rec.Error = im.validate(rec); rec.Error != "" {
+			report.fail(Failure{Line: rec.Line, ID: rec.ID, Error: rec.Error})
+			continue
+		}
+
+		h, err := contentHash(rec.Doc)
+		if err != nil {
+			report.fail(Failure{Line: rec.Line, ID: rec.ID, Error: err.Error()})
+			continue
+		}
+
+		switch ih, ok := indexed[rec.ID]; {
+		case p.changed[rec.ID]:
+			// the record has been seen before, the last one wins
+		case !ok:
+			p.Created++
+		case ih != h:
+			p.Updated++
+		default:
+			p.Unchanged++
+			continue
+		}
+
+		p.changed[rec.ID] = true
+	}
+	p.Failed, p.Failures = report.Failed, report.Failures
+
+	for id := range indexed {
+		if !seen[id] {
+			p.Deleted = append(p.Deleted, id)
+		}
+	}
+	sort.Strings(p.Deleted)
+
+	return p, nil
+}
+
+// contentHash returns the hash of the document that does not depend on the order of fields and formatting
+func contentHash(doc json.RawMessage) ([sha256.Size]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	return sha256.Sum256(mustMarshal(v)), nil
+}
@@ -0,0 +1,207 @@
+package catalog_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/catalog"
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/schema"
+	"github.com/andrewslotin/es-search-service/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testSettings = catalog.Settings{MaxBatchSize: 1 << 20, MaxBatchDocuments: 2}
+	testSchema   = schema.Schema{
+		Fields: map[string]schema.Field{
+			"title": {Type: schema.TypeString, Required: true},
+			"price": {Type: schema.TypeInteger},
+		},
+	}
+)
+
+func TestImporter_Import(t *testing.T) {
+	st := newCatalogStoreMock(map[string]string{
+		"abc": `{"title": "AirMax", "price": 1000}`,
+	})
+	st.Reject = map[string]string{"jkl": "mapper_parsing_exception"}
+
+	snapshot := `{"id": "abc", "title": "AirMax", "price": 1500}
+{"id": "def", "title": "Pegasus"}
+{"id": "ghi", "price": 1200}
+{"id": "jkl", "title": "Gel-Kayano"}
+{"id": "mno", "title": "SuperStar"}
+`
+
+	report, err := catalog.NewImporter(st, testSchema, testSettings).Import(context.Background(), newReader(t, snapshot))
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, report.Indexed)
+	assert.Equal(t, 2, report.Failed)
+	assert.Equal(t, []string{
+		"line 3, id ghi: /title: is required",
+		"line 4, id jkl: mapper_parsing_exception",
+	}, failures(report.Failures))
+
+	assert.Equal(t, 2, st.Batches)
+	assert.JSONEq(t, `{"title": "AirMax", "price": 1500}`, st.Docs["abc"])
+	assert.JSONEq(t, `{"title": "Pegasus"}`, st.Docs["def"])
+	assert.JSONEq(t, `{"title": "SuperStar"}`, st.Docs["mno"])
+}
+
+func TestImporter_Sync(t *testing.T) {
+	st := newCatalogStoreMock(map[string]string{
+		"abc": `{"title": "AirMax", "price": 1500}`,
+		"def": `{"title": "Pegasus", "price": 1000}`,
+		"ghi": `{"title": "Gel-Kayano"}`,
+		"jkl": `{"title": "SuperStar"}`,
+		"mno": `{"title": "Ultraboost"}`,
+	})
+
+	// abc is unchanged, but the fields are in different order, def is updated, ghi is invalid and kept,
+	// jkl and mno are deleted, pqr is created
+	snapshot := `{"id": "abc", "price": 1500, "title": "AirMax"}
+{"id": "def", "title": "Pegasus", "price": 1200}
+{"id": "ghi", "title": 42}
+{"id": "pqr", "title": "Nimbus"}
+`
+
+	im := catalog.NewImporter(st, testSchema, testSettings)
+
+	plan, err := im.Plan(context.Background(), newReader(t, snapshot))
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, plan.Indexed)
+	assert.Equal(t, 4, plan.Records)
+	assert.Equal(t, 1, plan.Created)
+	assert.Equal(t, 1, plan.Updated)
+	assert.Equal(t, 1, plan.Unchanged)
+	assert.Equal(t, []string{"jkl", "mno"}, plan.Deleted)
+	assert.Equal(t, 40.0, plan.DeletedPercent())
+	assert.Equal(t, 1, plan.Failed)
+	assert.Equal(t, []string{"line 3, id ghi: /title: must be a string"}, failures(plan.Failures))
+
+	// the index has not been changed yet
+	assert.Len(t, st.Docs, 5)
+	assert.Equal(t, 0, st.Batches)
+
+	// mno has been deleted in the meantime
+	delete(st.Docs, "mno")
+
+	report, err := im.Sync(context.Background(), newReader(t, snapshot), plan)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Indexed)
+	assert.Equal(t, 2, report.Deleted)
+	assert.Equal(t, 0, report.Failed)
+
+	var ids []string
+	for id := range st.Docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	assert.Equal(t, []string{"abc", "def", "ghi", "pqr"}, ids)
+	assert.JSONEq(t, `{"title": "Pegasus", "price": 1200}`, st.Docs["def"])
+	assert.JSONEq(t, `{"title": "Nimbus"}`, st.Docs["pqr"])
+}
+
+func TestImporter_Sync_MissingIndex(t *testing.T) {
+	st := newCatalogStoreMock(map[string]string{})
+	st.Missing = true
+
+	snapshot := `{"id": "abc", "title": "AirMax"}
+{"id": "def", "title": "Pegasus"}
+`
+
+	im := catalog.NewImporter(st, testSchema, testSettings)
+
+	plan, err := im.Plan(context.Background(), newReader(t, snapshot))
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, plan.Indexed)
+	assert.Equal(t, 2, plan.Created)
+	assert.Empty(t, plan.Deleted)
+
+	report, err := im.Sync(context.Background(), newReader(t, snapshot), plan)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Indexed)
+	assert.Len(t, st.Docs, 2)
+}
+
+func newReader(t *testing.T, snapshot string) *catalog.Reader {
+	r, err := catalog.NewReader(strings.NewReader(snapshot), catalog.FormatJSONL, "id", mapping.Products)
+	require.NoError(t, err)
+
+	return r
+}
+
+func failures(fs []catalog.Failure) []string {
+	var s []string
+	for _, f := range fs {
+		s = append(s, f.String())
+	}
+
+	return s
+}
+
+type catalogStoreMock struct {
+	Docs    map[string]string
+	Reject  map[string]string
+	Missing bool
+	Batches int
+}
+
+func newCatalogStoreMock(docs map[string]string) *catalogStoreMock {
+	return &catalogStoreMock{Docs: docs}
+}
+
+func (m *catalogStoreMock) Bulk(ctx context.Context, ops []storage.BulkOperation) ([]storage.BulkResult, error) {
+	m.Batches++
+
+	results := make([]storage.BulkResult, len(ops))
+	for i, op := range ops {
+		if reason, ok := m.Reject[op.ID]; ok {
+			results[i] = storage.BulkResult{Status: http.StatusBadRequest, Error: reason}
+			continue
+		}
+
+		switch op.Action {
+		case storage.BulkIndex:
+			m.Docs[op.ID] = string(op.Doc)
+			results[i] = storage.BulkResult{Status: http.StatusOK, WriteResult: storage.WriteResult{ID: op.ID, Result: "updated"}}
+		case storage.BulkDelete:
+			if _, ok := m.Docs[op.ID]; !ok {
+				results[i] = storage.BulkResult{Status: http.StatusNotFound, Error: "not_found"}
+				continue
+			}
+
+			delete(m.Docs, op.ID)
+			results[i] = storage.BulkResult{Status: http.StatusOK, WriteResult: storage.WriteResult{ID: op.ID, Result: "deleted"}}
+		}
+	}
+
+	return results, nil
+}
+
+func (m *catalogStoreMock) Scan(ctx context.Context, size int, fn func(id string, doc json.RawMessage) error) error {
+	if m.Missing {
+		return storage.ErrNotFound
+	}
+
+	for id, doc := range m.Docs {
+		if err := fn(id, json.RawMessage(doc)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
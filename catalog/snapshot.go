@@ -0,0 +1,236 @@
+// Package catalog imports product snapshots exported by the source of truth and synchronizes the index with them
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/andrewslotin/es-search-service/mapping"
+)
+
+// Snapshot formats
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// DetectFormat returns the snapshot format based on the file extension
+func DetectFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson", ".json":
+		return FormatJSONL, nil
+	case ".csv":
+		return FormatCSV, nil
+	default:
+		return "", fmt.Errorf("failed to detect the format of %s, expected either .jsonl or .csv file", path)
+	}
+}
+
+// Record is a product document read from a snapshot
+type Record struct {
+	// Line is the line number of the record, or the row number for CSV snapshots
+	Line int
+	// ID is the product ID
+	ID string
+	// Doc is the product document without the ID field
+	Doc json.RawMessage
+	// Error is the reason the record could not be read, in this case Doc is empty
+	Error string
+}
+
+// Reader reads product records from a snapshot
+type Reader struct {
+	idField string
+	next    func() (Record, error)
+}
+
+// NewReader returns a reader of the snapshot in given format. The product ID is taken from the idField
+// and removed from the document. CSV values are converted to the types of the mapping fields
+func NewReader(r io.Reader, format, idField string, def mapping.Definition) (*Reader, error) {
+	sr := &Reader{idField: idField}
+
+	switch format {
+	case FormatJSONL:
+		sr.next = sr.jsonl(bufio.NewReader(r))
+	case FormatCSV:
+		next, err := sr.csv(csv.NewReader(r), def)
+		if err != nil {
+			return nil, err
+		}
+		sr.next = next
+	default:
+		return nil, fmt.Errorf("unknown snapshot format %q, expected either jsonl or csv", format)
+	}
+
+	return sr, nil
+}
+
+// Next returns the next record or io.EOF if there are none left. Records that could not be parsed are
+// returned with Error set, the error is only returned if the snapshot could not be read
+func (sr *Reader) Next() (Record, error) {
+	return sr.next()
+}
+
+func (sr *Reader) jsonl(r *bufio.Reader) func() (Record, error) {
+	var line int
+	return func() (Record, error) {
+		for {
+			b, err := r.ReadBytes('\n')
+			if err != nil && (err != io.EOF || len(b) == 0) {
+				return Record{}, err
+			}
+			line++
+
+			if b = bytes.TrimSpace(b); len(b) == 0 {
+				continue
+			}
+
+			rec := Record{Line: line}
+
+			var doc map[string]json.RawMessage
+			if err := json.Unmarshal(b, &doc); err != nil {
+				rec.Error = "malformed JSON"
+				return rec, nil
+			}
+
+			if rec.ID, err = documentID(doc[sr.idField]); err != nil {
+				rec.Error = sr.idField + ": " + err.Error()
+				return rec, nil
+			}
+			delete(doc, sr.idField)
+
+			rec.Doc = mustMarshal(doc)
+
+			return rec, nil
+		}
+	}
+}
+
+func (sr *Reader) csv(r *csv.Reader, def mapping.Definition) (func() (Record, error), error) {
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %s", err)
+	}
+	header = append([]string(nil), header...)
+
+	idColumn := -1
+	for i, name := range header {
+		if name == sr.idField {
+			idColumn = i
+		}
+	}
+
+	if idColumn < 0 {
+		return nil, fmt.Errorf("CSV header has no %s column", sr.idField)
+	}
+
+	row := 1
+	return func() (Record, error) {
+		values, err := r.Read()
+		if err == io.EOF {
+			return Record{}, err
+		}
+		row++
+
+		if e, ok := err.(*csv.ParseError); ok {
+			return Record{Line: row, Error: e.Err.Error()}, nil
+		}
+
+		if err != nil {
+			return Record{}, err
+		}
+
+		rec := Record{Line: row, ID: values[idColumn]}
+		if rec.ID == "" {
+			rec.Error = sr.idField + ": missing"
+			return rec, nil
+		}
+
+		doc := make(map[string]interface{}, len(header)-1)
+		for i, name := range header {
+			if i == idColumn || values[i] == "" {
+				continue
+			}
+
+			v, err := csvValue(values[i], def.Properties[name].Type)
+			if err != nil {
+				rec.Error = name + ": " + err.Error()
+				return rec, nil
+			}
+
+			doc[name] = v
+		}
+
+		rec.Doc = mustMarshal(doc)
+
+		return rec, nil
+	}, nil
+}
+
+// documentID returns the string representation of a string or numeric ID
+func documentID(v json.RawMessage) (string, error) {
+	if len(v) == 0 {
+		return "", errors.New("missing")
+	}
+
+	var id interface{}
+	dec := json.NewDecoder(bytes.NewReader(v))
+	dec.UseNumber()
+	if err := dec.Decode(&id); err != nil {
+		return "", err
+	}
+
+	switch id := id.(type) {
+	case string:
+		if id == "" {
+			return "", errors.New("missing")
+		}
+
+		return id, nil
+	case json.Number:
+		return id.String(), nil
+	default:
+		return "", errors.New("expected string or number")
+	}
+}
+
+// csvValue converts the CSV value to the type of the mapping field
+func csvValue(s, typ string) (interface{}, error) {
+	switch typ {
+	case "long", "integer", "short", "byte":
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, fmt.Errorf("expected integer, got %q", s)
+		}
+
+		return json.Number(s), nil
+	case "double", "float", "half_float", "scaled_float":
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return nil, fmt.Errorf("expected number, got %q", s)
+		}
+
+		return json.Number(s), nil
+	case "boolean":
+		return strconv.ParseBool(s)
+	default:
+		return s, nil
+	}
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
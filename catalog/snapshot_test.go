@@ -0,0 +1,105 @@
+package catalog_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/catalog"
+	"github.com/andrewslotin/es-search-service/mapping"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	testCases := map[string]struct {
+		Format   string
+		Snapshot string
+		Expected []catalog.Record
+	}{
+		"jsonl": {
+			Format: catalog.FormatJSONL,
+			Snapshot: `{"id": "abc", "title": "AirMax", "price": 1500}
+
+{"id": 42, "title": "Pegasus"}
+{"title": "Gel-Kayano"}
+{"id": "def", "title":
+{"id": true}
+{"id": "ghi", "stock": 3}`,
+			Expected: []catalog.Record{
+				{Line: 1, ID: "abc", Doc: []byte(`{"price":1500,"title":"AirMax"}`)},
+				{Line: 3, ID: "42", Doc: []byte(`{"title":"Pegasus"}`)},
+				{Line: 4, Error: "id: missing"},
+				{Line: 5, Error: "malformed JSON"},
+				{Line: 6, Error: "id: expected string or number"},
+				{Line: 7, ID: "ghi", Doc: []byte(`{"stock":3}`)},
+			},
+		},
+		"csv": {
+			Format: catalog.FormatCSV,
+			Snapshot: `title,id,brand,price,stock
+AirMax,abc,Nike,1500,10
+"Gel-Kayano, 26",def,Asics,,
+Pegasus,,Nike,1200,1
+SuperStar,ghi,Adidas,cheap,5
+Ultraboost,jkl,Adidas,1800
+`,
+			Expected: []catalog.Record{
+				{Line: 2, ID: "abc", Doc: []byte(`{"brand":"Nike","price":1500,"stock":10,"title":"AirMax"}`)},
+				{Line: 3, ID: "def", Doc: []byte(`{"brand":"Asics","title":"Gel-Kayano, 26"}`)},
+				{Line: 4, ID: "", Error: "id: missing"},
+				{Line: 5, ID: "ghi", Error: `price: expected integer, got "cheap"`},
+				{Line: 6, Error: "wrong number of fields"},
+			},
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r, err := catalog.NewReader(strings.NewReader(testCase.Snapshot), testCase.Format, "id", mapping.Products)
+			require.NoError(t, err)
+
+			var records []catalog.Record
+			for {
+				rec, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+
+				records = append(records, rec)
+			}
+
+			require.Len(t, records, len(testCase.Expected))
+			for i, rec := range records {
+				expected := testCase.Expected[i]
+
+				assert.Equal(t, expected.Line, rec.Line, "record %d", i)
+				assert.Equal(t, expected.ID, rec.ID, "record %d", i)
+				assert.Equal(t, expected.Error, rec.Error, "record %d", i)
+				if expected.Doc != nil {
+					assert.JSONEq(t, string(expected.Doc), string(rec.Doc), "record %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestNewReader_CSVWithoutIDColumn(t *testing.T) {
+	_, err := catalog.NewReader(strings.NewReader("sku,title\nabc,AirMax\n"), catalog.FormatCSV, "id", mapping.Products)
+	assert.EqualError(t, err, "CSV header has no id column")
+}
+
+func TestDetectFormat(t *testing.T) {
+	format, err := catalog.DetectFormat("/var/exports/products-2019-09-01.JSONL")
+	require.NoError(t, err)
+	assert.Equal(t, catalog.FormatJSONL, format)
+
+	format, err = catalog.DetectFormat("products.csv")
+	require.NoError(t, err)
+	assert.Equal(t, catalog.FormatCSV, format)
+
+	_, err = catalog.DetectFormat("products.xml")
+	assert.Error(t, err)
+}
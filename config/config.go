@@ -0,0 +1,748 @@
+// Package config defines the search service configuration and loads it from a file,
+// env variables and command-line flags
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/authz"
+	"github.com/andrewslotin/es-search-service/breaker"
+	"github.com/andrewslotin/es-search-service/catalog"
+	"github.com/andrewslotin/es-search-service/ingest"
+	"github.com/andrewslotin/es-search-service/ratelimit"
+	"github.com/andrewslotin/es-search-service/reindex"
+	"github.com/andrewslotin/es-search-service/schema"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// Log levels
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// SchemaProducts is the name of the product documents schema
+const SchemaProducts = "products"
+
+// DefaultProductSchema validates product documents unless the products schema is configured. It lists the fields
+// of the product index, keep it in sync with mapping.Products
+var DefaultProductSchema = schema.Schema{
+	Fields: map[string]schema.Field{
+		"title": {Type: schema.TypeString, Required: true, MinLength: intPtr(1)},
+		"brand": {Type: schema.TypeString},
+		"price": {Type: schema.TypeInteger, Minimum: floatPtr(0)},
+		"stock": {Type: schema.TypeInteger, Minimum: floatPtr(0)},
+	},
+}
+
+// Config is the search service configuration
+type Config struct {
+	Listen        Listen                   `yaml:"listen"`
+	Elasticsearch Elasticsearch            `yaml:"elasticsearch"`
+	Shadow        Shadow                   `yaml:"shadow"`
+	RateLimits    RateLimits               `yaml:"rate_limits"`
+	Roles         map[string]string        `yaml:"roles"`
+	Scopes        map[string][]string      `yaml:"scopes"`
+	Passwords     map[string]string        `yaml:"passwords"`
+	Schemas       map[string]schema.Schema `yaml:"schemas"`
+	Search        Search                   `yaml:"search"`
+	Bulk          Bulk                     `yaml:"bulk"`
+	Idempotency   Idempotency              `yaml:"idempotency"`
+	Ingest        Ingest                   `yaml:"ingest"`
+	Mapping       Mapping                  `yaml:"mapping"`
+	Reindex       Reindex                  `yaml:"reindex"`
+	Cache         Cache                    `yaml:"cache"`
+	Admin         Admin                    `yaml:"admin"`
+	Metrics       Metrics                  `yaml:"metrics"`
+	Tracing       Tracing                  `yaml:"tracing"`
+	Log           Log                      `yaml:"log"`
+}
+
+// Listen configures the HTTP server
+type Listen struct {
+	Addr                string   `yaml:"addr"`
+	ReadTimeout         Duration `yaml:"read_timeout"`
+	WriteTimeout        Duration `yaml:"write_timeout"`
+	IdleTimeout         Duration `yaml:"idle_timeout"`
+	ShutdownDelay       Duration `yaml:"shutdown_delay"`
+	ShutdownGracePeriod Duration `yaml:"shutdown_grace_period"`
+	TLS                 TLS      `yaml:"tls"`
+}
+
+// TLS configures TLS termination
+type TLS struct {
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	ClientCA   string `yaml:"client_ca"`
+	ClientAuth string `yaml:"client_auth"`
+}
+
+// Elasticsearch configures the connection to the primary Elasticsearch cluster and the clusters
+// to fail over to
+type Elasticsearch struct {
+	// Name identifies the primary cluster in response headers, logs and metrics
+	Name       string `yaml:"name"`
+	Connection `yaml:",inline"`
+
+	MaxIdleConnsPerHost   int      `yaml:"max_idle_conns_per_host"`
+	ResponseHeaderTimeout Duration `yaml:"response_header_timeout"`
+	ConnTimeout           Duration `yaml:"conn_timeout"`
+	Index                 string   `yaml:"index"`
+	MinHealthStatus       string   `yaml:"min_health_status"`
+	WaitForStatus         string   `yaml:"wait_for_status"`
+
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
+
+	// Failover is the list of clusters to route search requests to if the primary one is unavailable
+	Failover []Cluster `yaml:"failover"`
+	// HealthCheckInterval is the interval between cluster health checks when there are failover clusters
+	HealthCheckInterval Duration `yaml:"health_check_interval"`
+	// MaxErrorRate is the share of failed requests above which a cluster is considered degraded
+	MaxErrorRate float64 `yaml:"max_error_rate"`
+}
+
+// Connection configures the connection to an Elasticsearch cluster
+type Connection struct {
+	Nodes           StringList `yaml:"nodes"`
+	CloudID         string     `yaml:"cloud_id"`
+	Username        string     `yaml:"username"`
+	Password        string     `yaml:"password"`
+	PasswordFile    string     `yaml:"password_file"`
+	APIKey          string     `yaml:"api_key"`
+	APIKeyFile      string     `yaml:"api_key_file"`
+	CACert          string     `yaml:"ca_cert"`
+	CertFingerprint string     `yaml:"cert_fingerprint"`
+	ClientCert      string     `yaml:"client_cert"`
+	ClientKey       string     `yaml:"client_key"`
+}
+
+// Cluster is an Elasticsearch cluster to fail over to
+type Cluster struct {
+	// Name identifies the cluster in response headers, logs and metrics
+	Name string `yaml:"name"`
+	// Priority defines the order clusters are preferred in, the lower the better. The primary
+	// cluster has priority 0
+	Priority   int `yaml:"priority"`
+	Connection `yaml:",inline"`
+}
+
+// Clusters returns the primary cluster followed by failover clusters
+func (es Elasticsearch) Clusters() []Cluster {
+	return append([]Cluster{{Name: es.Name, Connection: es.Connection}}, es.Failover...)
+}
+
+// CircuitBreaker configures the circuit breaker around Elasticsearch search requests
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failed requests that opens the breaker.
+	// A zero value disables the circuit breaker
+	FailureThreshold int `yaml:"failure_threshold"`
+	// SlowCallThreshold is the request duration above which the request is considered failed
+	SlowCallThreshold Duration `yaml:"slow_call_threshold"`
+	// OpenTimeout is the time the breaker stays open before letting probe requests through
+	OpenTimeout Duration `yaml:"open_timeout"`
+	// HalfOpenProbes is the number of successful probe requests required to close the breaker
+	HalfOpenProbes int `yaml:"half_open_probes"`
+}
+
+// Settings converts the configuration into circuit breaker settings
+func (cb CircuitBreaker) Settings() breaker.Settings {
+	return breaker.Settings{
+		FailureThreshold:  cb.FailureThreshold,
+		SlowCallThreshold: time.Duration(cb.SlowCallThreshold),
+		OpenTimeout:       time.Duration(cb.OpenTimeout),
+		HalfOpenProbes:    cb.HalfOpenProbes,
+	}
+}
+
+// Shadow configures mirroring of sampled search requests to a candidate cluster to compare its results
+// with the primary ones
+type Shadow struct {
+	// Name identifies the shadow cluster in logs and metrics
+	Name       string `yaml:"name"`
+	Connection `yaml:",inline"`
+	// Index is the index to search in, defaults to the primary cluster index
+	Index string `yaml:"index"`
+	// SampleRate is the share of search requests to mirror. A zero value disables mirroring
+	SampleRate float64 `yaml:"sample_rate"`
+	// TopN is the number of top documents to compare
+	TopN int `yaml:"top_n"`
+	// MaxInFlight is the maximum number of concurrent mirrored requests, the excess ones are dropped
+	MaxInFlight int `yaml:"max_in_flight"`
+	// Timeout is the time the shadow cluster is given to respond
+	Timeout Duration `yaml:"timeout"`
+	// ReportInterval is the interval between logging the worst divergences
+	ReportInterval Duration `yaml:"report_interval"`
+	// MaxReported is the number of the worst divergences to log on each report
+	MaxReported int `yaml:"max_reported"`
+}
+
+// Enabled returns true if search requests are to be mirrored
+func (s Shadow) Enabled() bool {
+	return s.SampleRate > 0
+}
+
+// Settings converts the configuration into shadow storage settings
+func (s Shadow) Settings() storage.ShadowSettings {
+	return storage.ShadowSettings{
+		SampleRate:  s.SampleRate,
+		TopN:        s.TopN,
+		MaxInFlight: s.MaxInFlight,
+		Timeout:     time.Duration(s.Timeout),
+		MaxReported: s.MaxReported,
+	}
+}
+
+// RateLimits configures per-user rate limiting
+type RateLimits struct {
+	Default RateLimit            `yaml:"default"`
+	Roles   map[string]RateLimit `yaml:"roles"`
+}
+
+// Search configures search requests
+type Search struct {
+	// DefaultTimeout is the search timeout used if the request does not specify one
+	DefaultTimeout Duration `yaml:"default_timeout"`
+	// MaxTimeout is the maximum search timeout a request can specify. A zero value means no limit
+	MaxTimeout Duration `yaml:"max_timeout"`
+	// RefreshInterval is the index refresh interval, a search sent with a consistency token waits for this long
+	// after the write to make sure it's visible
+	RefreshInterval Duration `yaml:"refresh_interval"`
+}
+
+// Bulk configures the bulk write API
+type Bulk struct {
+	// MaxBatchSize is the maximum size of documents sent to Elasticsearch in a single bulk request in bytes
+	MaxBatchSize int `yaml:"max_batch_size"`
+	// MaxBatchDocuments is the maximum number of operations sent to Elasticsearch in a single bulk request
+	MaxBatchDocuments int `yaml:"max_batch_documents"`
+}
+
+// Idempotency configures replaying responses to retried write requests
+type Idempotency struct {
+	// TTL is the time responses are kept for. A zero value disables idempotency keys
+	TTL Duration `yaml:"ttl"`
+	// MaxSize is the maximum size of kept responses in bytes
+	MaxSize int `yaml:"max_size"`
+}
+
+// Enabled returns true if write requests with idempotency keys are to be replayed
+func (c Idempotency) Enabled() bool {
+	return c.TTL > 0
+}
+
+// Ingest configures queueing of writes in a durable log
+type Ingest struct {
+	// Dir is the directory to keep the queue log in. An empty value disables queueing, so that
+	// writes are sent to Elasticsearch synchronously
+	Dir string `yaml:"dir"`
+	// MinBackoff is the delay before the first retry of a failed flush
+	MinBackoff Duration `yaml:"min_backoff"`
+	// MaxBackoff is the maximum delay between retries of a failed flush
+	MaxBackoff Duration `yaml:"max_backoff"`
+}
+
+// Enabled returns true if writes are to be queued
+func (c Ingest) Enabled() bool {
+	return c.Dir != ""
+}
+
+// Mapping configures the index mappings check
+type Mapping struct {
+	// AllowDrift lets the service start even if the live index mappings do not match the expected ones
+	AllowDrift bool `yaml:"allow_drift"`
+}
+
+// Reindex configures copying documents into a new versioned index
+type Reindex struct {
+	// Keep is the number of previous versioned indices to keep for rollback
+	Keep int `yaml:"keep"`
+	// PollInterval is the interval between reindex progress checks
+	PollInterval Duration `yaml:"poll_interval"`
+}
+
+// Cache configures search results caching
+type Cache struct {
+	// TTL is the time search results are cached for. A zero value disables caching
+	TTL Duration `yaml:"ttl"`
+	// MaxSize is the maximum size of cached results in bytes
+	MaxSize int `yaml:"max_size"`
+	// MaxStale is the time expired results are kept for to be served in case Elasticsearch is
+	// unavailable. A zero value disables serving stale results
+	MaxStale Duration `yaml:"max_stale"`
+}
+
+// Enabled returns true if search results are to be cached
+func (c Cache) Enabled() bool {
+	return c.TTL > 0 || c.MaxStale > 0
+}
+
+// Admin configures the administrative endpoints
+type Admin struct {
+	// Auth is the user:password pair required to access administrative endpoints. These endpoints
+	// are disabled if not set
+	Auth string `yaml:"auth"`
+}
+
+// Metrics configures the metrics endpoint
+type Metrics struct {
+	// Auth is the user:password pair required to access metrics
+	Auth string `yaml:"auth"`
+}
+
+// Tracing configures span export
+type Tracing struct {
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+}
+
+// Log configures logging
+type Log struct {
+	// Level is the minimum level of messages to log. Access log is written with info level
+	Level string `yaml:"level"`
+}
+
+// Default returns the default configuration
+func Default() Config {
+	return Config{
+		Listen: Listen{
+			Addr:                ":8080",
+			ReadTimeout:         Duration(10 * time.Second),
+			WriteTimeout:        Duration(60 * time.Second),
+			IdleTimeout:         Duration(120 * time.Second),
+			ShutdownDelay:       Duration(5 * time.Second),
+			ShutdownGracePeriod: Duration(30 * time.Second),
+			TLS: TLS{
+				ClientAuth: "optional",
+			},
+		},
+		Elasticsearch: Elasticsearch{
+			Name:                "primary",
+			HealthCheckInterval: Duration(5 * time.Second),
+			MaxErrorRate:        0.5,
+			MaxIdleConnsPerHost: 10,
+			Index:               "products",
+			MinHealthStatus:     "yellow",
+			CircuitBreaker: CircuitBreaker{
+				FailureThreshold: 5,
+				OpenTimeout:      Duration(30 * time.Second),
+				HalfOpenProbes:   1,
+			},
+		},
+		Shadow: Shadow{
+			Name:           "shadow",
+			TopN:           10,
+			MaxInFlight:    10,
+			Timeout:        Duration(10 * time.Second),
+			ReportInterval: Duration(time.Minute),
+			MaxReported:    5,
+		},
+		Search: Search{
+			DefaultTimeout:  Duration(10 * time.Second),
+			MaxTimeout:      Duration(30 * time.Second),
+			RefreshInterval: Duration(time.Second),
+		},
+		Bulk: Bulk{
+			MaxBatchSize:      5 << 20,
+			MaxBatchDocuments: 1000,
+		},
+		Idempotency: Idempotency{
+			TTL:     Duration(24 * time.Hour),
+			MaxSize: 64 << 20,
+		},
+		Ingest: Ingest{
+			MinBackoff: Duration(100 * time.Millisecond),
+			MaxBackoff: Duration(30 * time.Second),
+		},
+		Reindex: Reindex{
+			Keep:         2,
+			PollInterval: Duration(5 * time.Second),
+		},
+		Cache: Cache{
+			MaxSize: 64 << 20,
+		},
+		Log: Log{
+			Level: LogLevelInfo,
+		},
+	}
+}
+
+// Validate checks the configuration and returns an error listing all problems found
+func (c Config) Validate() error {
+	var errs []string
+	addError := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.Listen.Addr == "" {
+		addError("listen.addr: must not be empty")
+	}
+
+	for name, d := range map[string]Duration{
+		"listen.read_timeout":                               c.Listen.ReadTimeout,
+		"listen.write_timeout":                              c.Listen.WriteTimeout,
+		"listen.idle_timeout":                               c.Listen.IdleTimeout,
+		"listen.shutdown_delay":                             c.Listen.ShutdownDelay,
+		"listen.shutdown_grace_period":                      c.Listen.ShutdownGracePeriod,
+		"elasticsearch.response_header_timeout":             c.Elasticsearch.ResponseHeaderTimeout,
+		"elasticsearch.conn_timeout":                        c.Elasticsearch.ConnTimeout,
+		"elasticsearch.health_check_interval":               c.Elasticsearch.HealthCheckInterval,
+		"elasticsearch.circuit_breaker.slow_call_threshold": c.Elasticsearch.CircuitBreaker.SlowCallThreshold,
+		"elasticsearch.circuit_breaker.open_timeout":        c.Elasticsearch.CircuitBreaker.OpenTimeout,
+		"shadow.timeout":                                    c.Shadow.Timeout,
+		"search.default_timeout":                            c.Search.DefaultTimeout,
+		"search.max_timeout":                                c.Search.MaxTimeout,
+		"search.refresh_interval":                           c.Search.RefreshInterval,
+		"idempotency.ttl":                                   c.Idempotency.TTL,
+		"cache.ttl":                                         c.Cache.TTL,
+		"cache.max_stale":                                   c.Cache.MaxStale,
+	} {
+		if d < 0 {
+			addError("%s: must not be negative", name)
+		}
+	}
+
+	if (c.Listen.TLS.Cert == "") != (c.Listen.TLS.Key == "") {
+		addError("listen.tls: both cert and key are required")
+	}
+
+	if c.Listen.TLS.ClientCA != "" && c.Listen.TLS.Cert == "" {
+		addError("listen.tls.client_ca: client certificate verification requires cert and key")
+	}
+
+	if mode := c.Listen.TLS.ClientAuth; mode != "optional" && mode != "required" {
+		addError("listen.tls.client_auth: unknown mode %q, expected either optional or required", mode)
+	}
+
+	es := c.Elasticsearch
+	if len(es.Nodes) == 0 && es.CloudID == "" {
+		addError("elasticsearch.nodes: there were no elasticsearch nodes provided, did you forget to populate ELASTICSEARCH_NODES=?")
+	}
+
+	names := make(map[string]bool)
+	for i, cl := range es.Clusters() {
+		prefix := "elasticsearch"
+		if i > 0 {
+			prefix = fmt.Sprintf("elasticsearch.failover[%d]", i-1)
+			if len(cl.Nodes) == 0 && cl.CloudID == "" {
+				addError("%s.nodes: either nodes or cloud_id is required", prefix)
+			}
+		}
+
+		switch {
+		case cl.Name == "":
+			addError("%s.name: must not be empty", prefix)
+		case names[cl.Name]:
+			addError("%s.name: duplicate cluster name %q", prefix, cl.Name)
+		}
+		names[cl.Name] = true
+
+		if cl.Priority < 0 {
+			addError("%s.priority: must not be negative", prefix)
+		}
+
+		for _, msg := range validateConnection(cl.Connection) {
+			addError("%s: %s", prefix, msg)
+		}
+	}
+
+	if es.MaxErrorRate <= 0 || es.MaxErrorRate > 1 {
+		addError("elasticsearch.max_error_rate: must be within (0, 1]")
+	}
+
+	if es.MaxIdleConnsPerHost < 0 {
+		addError("elasticsearch.max_idle_conns_per_host: must not be negative")
+	}
+
+	if s := es.MinHealthStatus; s != "green" && s != "yellow" {
+		addError("elasticsearch.min_health_status: invalid cluster health status %q, expected either green or yellow", s)
+	}
+
+	if s := es.WaitForStatus; s != "" && s != "green" && s != "yellow" {
+		addError("elasticsearch.wait_for_status: invalid cluster health status %q, expected either green or yellow", s)
+	}
+
+	if cb := es.CircuitBreaker; cb.FailureThreshold < 0 {
+		addError("elasticsearch.circuit_breaker.failure_threshold: must not be negative")
+	} else if cb.FailureThreshold > 0 && cb.HalfOpenProbes < 1 {
+		addError("elasticsearch.circuit_breaker.half_open_probes: must be at least 1")
+	}
+
+	if sh := c.Shadow; sh.SampleRate < 0 || sh.SampleRate > 1 {
+		addError("shadow.sample_rate: must be within [0, 1]")
+	} else if sh.Enabled() {
+		if len(sh.Nodes) == 0 && sh.CloudID == "" {
+			addError("shadow.nodes: either nodes or cloud_id is required")
+		}
+
+		for _, msg := range validateConnection(sh.Connection) {
+			addError("shadow: %s", msg)
+		}
+
+		switch {
+		case sh.Name == "":
+			addError("shadow.name: must not be empty")
+		case names[sh.Name]:
+			addError("shadow.name: duplicate cluster name %q", sh.Name)
+		}
+
+		if sh.TopN < 1 {
+			addError("shadow.top_n: must be at least 1")
+		}
+
+		if sh.MaxInFlight < 1 {
+			addError("shadow.max_in_flight: must be at least 1")
+		}
+
+		if sh.ReportInterval <= 0 {
+			addError("shadow.report_interval: must be positive")
+		}
+
+		if sh.MaxReported < 0 {
+			addError("shadow.max_reported: must not be negative")
+		}
+	}
+
+	if err := validateRateLimit(c.RateLimits.Default); err != nil {
+		addError("rate_limits.default: %s", err)
+	}
+
+	for role, rl := range c.RateLimits.Roles {
+		if err := validateRateLimit(rl); err != nil {
+			addError("rate_limits.roles.%s: %s", role, err)
+		}
+	}
+
+	for user, role := range c.Roles {
+		if role == "" {
+			addError("roles.%s: role must not be empty", user)
+		}
+	}
+
+	for role, scopes := range c.Scopes {
+		for _, scope := range scopes {
+			if scope != authz.ScopeWrite {
+				addError("scopes.%s: unknown scope %q, expected %s", role, scope, authz.ScopeWrite)
+			}
+		}
+	}
+
+	for user, password := range c.Passwords {
+		if password == "" {
+			addError("passwords.%s: password must not be empty", user)
+		}
+	}
+
+	for name, sch := range c.Schemas {
+		if name != SchemaProducts {
+			addError("schemas.%s: unknown resource, expected %s", name, SchemaProducts)
+			continue
+		}
+
+		if err := sch.Check(); err != nil {
+			addError("schemas.%s: %s", name, err)
+		}
+	}
+
+	if s := c.Search; s.MaxTimeout > 0 && s.DefaultTimeout > s.MaxTimeout {
+		addError("search.default_timeout: must not exceed search.max_timeout")
+	}
+
+	if c.Bulk.MaxBatchSize <= 0 {
+		addError("bulk.max_batch_size: must be positive")
+	}
+
+	if c.Bulk.MaxBatchDocuments <= 0 {
+		addError("bulk.max_batch_documents: must be positive")
+	}
+
+	if c.Idempotency.Enabled() && c.Idempotency.MaxSize <= 0 {
+		addError("idempotency.max_size: must be positive")
+	}
+
+	if c.Ingest.Enabled() {
+		if c.Ingest.MinBackoff <= 0 {
+			addError("ingest.min_backoff: must be positive")
+		}
+
+		if c.Ingest.MaxBackoff < c.Ingest.MinBackoff {
+			addError("ingest.max_backoff: must not be less than ingest.min_backoff")
+		}
+	}
+
+	if c.Reindex.Keep < 0 {
+		addError("reindex.keep: must not be negative")
+	}
+
+	if c.Reindex.PollInterval <= 0 {
+		addError("reindex.poll_interval: must be positive")
+	}
+
+	if c.Cache.Enabled() && c.Cache.MaxSize <= 0 {
+		addError("cache.max_size: must be positive")
+	}
+
+	if c.Admin.Auth != "" && !strings.Contains(c.Admin.Auth, ":") {
+		addError("admin.auth: malformed credentials, expected user:password")
+	}
+
+	if c.Metrics.Auth != "" && !strings.Contains(c.Metrics.Auth, ":") {
+		addError("metrics.auth: malformed credentials, expected user:password")
+	}
+
+	switch c.Log.Level {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+	default:
+		addError("log.level: unknown level %q, expected one of debug, info, warn or error", c.Log.Level)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errors.New("invalid configuration:\n\t" + strings.Join(errs, "\n\t"))
+}
+
+func validateConnection(conn Connection) []string {
+	var errs []string
+
+	if len(conn.Nodes) > 0 && conn.CloudID != "" {
+		errs = append(errs, "nodes and cloud_id are mutually exclusive")
+	}
+
+	if conn.Password != "" && conn.PasswordFile != "" {
+		errs = append(errs, "password and password_file are mutually exclusive")
+	}
+
+	if conn.APIKey != "" && conn.APIKeyFile != "" {
+		errs = append(errs, "api_key and api_key_file are mutually exclusive")
+	}
+
+	// a pinned fingerprint replaces the CA verification, so the CA bundle would be silently ignored
+	if conn.CACert != "" && conn.CertFingerprint != "" {
+		errs = append(errs, "ca_cert and cert_fingerprint are mutually exclusive")
+	}
+
+	if (conn.ClientCert == "") != (conn.ClientKey == "") {
+		errs = append(errs, "both client_cert and client_key are required")
+	}
+
+	return errs
+}
+
+func validateRateLimit(rl RateLimit) error {
+	if rl.Rate < 0 || rl.Burst < 0 || rl.Daily < 0 {
+		return errors.New("rate limit settings must not be negative")
+	}
+
+	return nil
+}
+
+// RateLimitPolicies returns the rate limiting policies for users and roles
+func (c Config) RateLimitPolicies() ratelimit.Policies {
+	ps := ratelimit.Policies{
+		Default: c.RateLimits.Default.Policy(),
+		Roles:   make(map[string]ratelimit.Policy, len(c.RateLimits.Roles)),
+		Members: make(map[string]string, len(c.Roles)),
+	}
+
+	for role, rl := range c.RateLimits.Roles {
+		ps.Roles[role] = rl.Policy()
+	}
+
+	for user, role := range c.Roles {
+		ps.Members[user] = role
+	}
+
+	return ps
+}
+
+// IngestSettings returns the settings of the write queue. Queued writes are flushed in batches limited
+// the same way as the ones sent via the bulk API
+func (c Config) IngestSettings() ingest.Settings {
+	return ingest.Settings{
+		MaxBatchSize:      c.Bulk.MaxBatchSize,
+		MaxBatchDocuments: c.Bulk.MaxBatchDocuments,
+		MinBackoff:        time.Duration(c.Ingest.MinBackoff),
+		MaxBackoff:        time.Duration(c.Ingest.MaxBackoff),
+	}
+}
+
+// ImportSettings returns the settings of the catalog import, which sends documents in batches limited
+// the same way as the ones sent via the bulk API
+func (c Config) ImportSettings() catalog.Settings {
+	return catalog.Settings{
+		MaxBatchSize:      c.Bulk.MaxBatchSize,
+		MaxBatchDocuments: c.Bulk.MaxBatchDocuments,
+	}
+}
+
+// ProductSchema returns the schema product documents are validated against, which is the default one
+// unless configured in schemas.products
+func (c Config) ProductSchema() schema.Schema {
+	if sch, ok := c.Schemas[SchemaProducts]; ok {
+		return sch
+	}
+
+	return DefaultProductSchema
+}
+
+// ReindexSettings returns the settings of the reindex
+func (c Config) ReindexSettings() reindex.Settings {
+	return reindex.Settings{
+		Keep:         c.Reindex.Keep,
+		PollInterval: time.Duration(c.Reindex.PollInterval),
+	}
+}
+
+// AuthzRules returns the rules granting scopes to users and roles
+func (c Config) AuthzRules() authz.Rules {
+	r := authz.Rules{
+		Members:   make(map[string]string, len(c.Roles)),
+		Scopes:    make(map[string][]string, len(c.Scopes)),
+		Passwords: make(map[string]string, len(c.Passwords)),
+	}
+
+	for user, role := range c.Roles {
+		r.Members[user] = role
+	}
+
+	for role, scopes := range c.Scopes {
+		r.Scopes[role] = append([]string(nil), scopes...)
+	}
+
+	for user, password := range c.Passwords {
+		r.Passwords[user] = password
+	}
+
+	return r
+}
+
+// RequiresRestart returns true if the difference between old and new configurations
+// can't be applied without restarting the service
+func RequiresRestart(old, new Config) bool {
+	return !reflect.DeepEqual(withoutReloadable(old), withoutReloadable(new))
+}
+
+// withoutReloadable returns a copy of c with settings that can be applied at runtime reset
+func withoutReloadable(c Config) Config {
+	c.RateLimits = RateLimits{}
+	c.Roles = nil
+	c.Scopes = nil
+	c.Passwords = nil
+	c.Log.Level = ""
+
+	return c
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
@@ -0,0 +1,228 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/authz"
+	"github.com/andrewslotin/es-search-service/config"
+	"github.com/andrewslotin/es-search-service/ratelimit"
+	"github.com/andrewslotin/es-search-service/schema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	c := config.Default()
+	c.Elasticsearch.Nodes = config.StringList{"http://localhost:9200"}
+
+	assert.NoError(t, c.Validate())
+}
+
+func TestConfig_Validate_Invalid(t *testing.T) {
+	testCases := map[string]struct {
+		Modify   func(c *config.Config)
+		Expected string
+	}{
+		"no nodes": {
+			Modify:   func(c *config.Config) { c.Elasticsearch.Nodes = nil },
+			Expected: "elasticsearch.nodes",
+		},
+		"nodes and cloud id": {
+			Modify:   func(c *config.Config) { c.Elasticsearch.CloudID = "deployment:abc" },
+			Expected: "mutually exclusive",
+		},
+		"ca cert and fingerprint": {
+			Modify: func(c *config.Config) {
+				c.Elasticsearch.CACert, c.Elasticsearch.CertFingerprint = "/etc/ssl/es-ca.pem", "ab:cd"
+			},
+			Expected: "elasticsearch: ca_cert and cert_fingerprint are mutually exclusive",
+		},
+		"failover cluster without nodes": {
+			Modify:   func(c *config.Config) { c.Elasticsearch.Failover = []config.Cluster{{Name: "dr", Priority: 1}} },
+			Expected: "elasticsearch.failover[0].nodes",
+		},
+		"duplicate cluster name": {
+			Modify: func(c *config.Config) {
+				c.Elasticsearch.Failover = []config.Cluster{{Name: "primary", Connection: config.Connection{Nodes: config.StringList{"http://dr:9200"}}}}
+			},
+			Expected: "elasticsearch.failover[0].name",
+		},
+		"max error rate": {
+			Modify:   func(c *config.Config) { c.Elasticsearch.MaxErrorRate = 2 },
+			Expected: "elasticsearch.max_error_rate",
+		},
+		"shadow sample rate": {
+			Modify:   func(c *config.Config) { c.Shadow.SampleRate = 1.5 },
+			Expected: "shadow.sample_rate",
+		},
+		"shadow cluster without nodes": {
+			Modify:   func(c *config.Config) { c.Shadow.SampleRate = 0.1 },
+			Expected: "shadow.nodes",
+		},
+		"shadow cluster name": {
+			Modify: func(c *config.Config) {
+				c.Shadow.SampleRate, c.Shadow.Nodes, c.Shadow.Name = 0.1, config.StringList{"http://candidate:9200"}, "primary"
+			},
+			Expected: "shadow.name",
+		},
+		"tls key missing": {
+			Modify:   func(c *config.Config) { c.Listen.TLS.Cert = "server.crt" },
+			Expected: "listen.tls",
+		},
+		"client auth mode": {
+			Modify:   func(c *config.Config) { c.Listen.TLS.ClientAuth = "always" },
+			Expected: "listen.tls.client_auth",
+		},
+		"health status": {
+			Modify:   func(c *config.Config) { c.Elasticsearch.MinHealthStatus = "red" },
+			Expected: "elasticsearch.min_health_status",
+		},
+		"negative timeout": {
+			Modify:   func(c *config.Config) { c.Listen.ReadTimeout = -1 },
+			Expected: "listen.read_timeout",
+		},
+		"negative rate limit": {
+			Modify:   func(c *config.Config) { c.RateLimits.Roles = map[string]config.RateLimit{"partner": {Rate: -1}} },
+			Expected: "rate_limits.roles.partner",
+		},
+		"unknown scope": {
+			Modify:   func(c *config.Config) { c.Scopes = map[string][]string{"catalog": {"admin"}} },
+			Expected: "scopes.catalog",
+		},
+		"empty password": {
+			Modify:   func(c *config.Config) { c.Passwords = map[string]string{"importer": ""} },
+			Expected: "passwords.importer",
+		},
+		"unknown schema": {
+			Modify:   func(c *config.Config) { c.Schemas = map[string]schema.Schema{"orders": {}} },
+			Expected: "schemas.orders",
+		},
+		"invalid schema": {
+			Modify: func(c *config.Config) {
+				c.Schemas = map[string]schema.Schema{
+					"products": {Fields: map[string]schema.Field{"price": {Type: "money"}}},
+				}
+			},
+			Expected: "schemas.products: price",
+		},
+		"bulk batch size": {
+			Modify:   func(c *config.Config) { c.Bulk.MaxBatchSize = 0 },
+			Expected: "bulk.max_batch_size",
+		},
+		"bulk batch documents": {
+			Modify:   func(c *config.Config) { c.Bulk.MaxBatchDocuments = -1 },
+			Expected: "bulk.max_batch_documents",
+		},
+		"idempotency max size": {
+			Modify:   func(c *config.Config) { c.Idempotency.MaxSize = 0 },
+			Expected: "idempotency.max_size",
+		},
+		"ingest min backoff": {
+			Modify: func(c *config.Config) {
+				c.Ingest.Dir = "/var/lib/search"
+				c.Ingest.MinBackoff = 0
+			},
+			Expected: "ingest.min_backoff",
+		},
+		"ingest max backoff": {
+			Modify: func(c *config.Config) {
+				c.Ingest.Dir = "/var/lib/search"
+				c.Ingest.MaxBackoff = config.Duration(time.Millisecond)
+			},
+			Expected: "ingest.max_backoff",
+		},
+		"reindex keep": {
+			Modify:   func(c *config.Config) { c.Reindex.Keep = -1 },
+			Expected: "reindex.keep",
+		},
+		"reindex poll interval": {
+			Modify:   func(c *config.Config) { c.Reindex.PollInterval = 0 },
+			Expected: "reindex.poll_interval",
+		},
+		"metrics auth": {
+			Modify:   func(c *config.Config) { c.Metrics.Auth = "admin" },
+			Expected: "metrics.auth",
+		},
+		"log level": {
+			Modify:   func(c *config.Config) { c.Log.Level = "verbose" },
+			Expected: "log.level",
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c := config.Default()
+			c.Elasticsearch.Nodes = config.StringList{"http://localhost:9200"}
+			testCase.Modify(&c)
+
+			err := c.Validate()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), testCase.Expected)
+		})
+	}
+}
+
+func TestConfig_Validate_ReportsAllErrors(t *testing.T) {
+	c := config.Default()
+	c.Log.Level = "verbose"
+
+	err := c.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "elasticsearch.nodes")
+	assert.Contains(t, err.Error(), "log.level")
+}
+
+func TestConfig_RateLimitPolicies(t *testing.T) {
+	c := config.Default()
+	c.RateLimits = config.RateLimits{
+		Default: config.RateLimit{Rate: 10, Burst: 20},
+		Roles: map[string]config.RateLimit{
+			"partner": {Rate: 1, Daily: 1000},
+		},
+	}
+	c.Roles = map[string]string{"user1": "partner"}
+
+	ps := c.RateLimitPolicies()
+	assert.Equal(t, ratelimit.Policy{Rate: 10, Burst: 20}, ps.For("user2"))
+	assert.Equal(t, ratelimit.Policy{Rate: 1, DailyQuota: 1000}, ps.For("user1"))
+}
+
+func TestConfig_AuthzRules(t *testing.T) {
+	c := config.Default()
+	c.Roles = map[string]string{"importer": "catalog", "user1": "partner"}
+	c.Scopes = map[string][]string{"catalog": {authz.ScopeWrite}}
+	c.Passwords = map[string]string{"importer": "secret"}
+
+	r := c.AuthzRules()
+	assert.True(t, r.Granted("importer", authz.ScopeWrite))
+	assert.False(t, r.Granted("user1", authz.ScopeWrite))
+	assert.True(t, r.Authenticate("importer", "secret"))
+}
+
+func TestConfig_ProductSchema(t *testing.T) {
+	c := config.Default()
+
+	vs := c.ProductSchema().Validate([]byte(`{"title": "AirMax", "prce": "1500"}`), false)
+	assert.Equal(t, []schema.Violation{{Pointer: "/prce", Message: "unknown field"}}, vs)
+
+	c.Schemas = map[string]schema.Schema{config.SchemaProducts: {AdditionalFields: true}}
+	assert.Empty(t, c.ProductSchema().Validate([]byte(`{"title": "AirMax", "prce": "1500"}`), false))
+}
+
+func TestRequiresRestart(t *testing.T) {
+	old := config.Default()
+
+	reloadable := old
+	reloadable.RateLimits.Default = config.RateLimit{Rate: 1}
+	reloadable.Roles = map[string]string{"user1": "partner"}
+	reloadable.Scopes = map[string][]string{"partner": {authz.ScopeWrite}}
+	reloadable.Passwords = map[string]string{"user1": "secret"}
+	reloadable.Log.Level = config.LogLevelError
+	assert.False(t, config.RequiresRestart(old, reloadable))
+
+	changed := old
+	changed.Listen.Addr = ":9090"
+	assert.True(t, config.RequiresRestart(old, changed))
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// setting is a configuration option that can be overridden with an env variable or a command-line flag.
+// Settings with an empty Env can only be set with a flag
+type setting struct {
+	Flag, Env, Usage string
+	Value            func(c *Config) flag.Value
+}
+
+var settings = []setting{
+	{"l", "LISTEN_ADDR", "Host and port to listen on", func(c *Config) flag.Value { return (*stringValue)(&c.Listen.Addr) }},
+	{"read-timeout", "HTTP_READ_TIMEOUT", "Maximum duration for reading the entire request", func(c *Config) flag.Value { return &c.Listen.ReadTimeout }},
+	{"write-timeout", "HTTP_WRITE_TIMEOUT", "Maximum duration before timing out writes of the response", func(c *Config) flag.Value { return &c.Listen.WriteTimeout }},
+	{"idle-timeout", "HTTP_IDLE_TIMEOUT", "Maximum amount of time to wait for the next request on a keep-alive connection", func(c *Config) flag.Value { return &c.Listen.IdleTimeout }},
+	{"shutdown-delay", "SHUTDOWN_DELAY", "Time between reporting the service as not ready and stopping accepting new connections on shutdown", func(c *Config) flag.Value { return &c.Listen.ShutdownDelay }},
+	{"shutdown-grace-period", "SHUTDOWN_GRACE_PERIOD", "Maximum time to wait for in-flight requests to complete on shutdown", func(c *Config) flag.Value { return &c.Listen.ShutdownGracePeriod }},
+	{"tls-cert", "TLS_CERT_FILE", "PEM-encoded TLS certificate file to serve HTTPS", func(c *Config) flag.Value { return (*stringValue)(&c.Listen.TLS.Cert) }},
+	{"tls-key", "TLS_KEY_FILE", "PEM-encoded TLS private key file", func(c *Config) flag.Value { return (*stringValue)(&c.Listen.TLS.Key) }},
+	{"tls-client-ca", "TLS_CLIENT_CA_FILE", "PEM-encoded CA bundle to verify client certificates against", func(c *Config) flag.Value { return (*stringValue)(&c.Listen.TLS.ClientCA) }},
+	{"tls-client-auth", "TLS_CLIENT_AUTH", "Whether client certificate is optional or required if --tls-client-ca is set", func(c *Config) flag.Value { return (*stringValue)(&c.Listen.TLS.ClientAuth) }},
+	{"es-cluster-name", "ELASTICSEARCH_CLUSTER_NAME", "Name of the primary Elasticsearch cluster to be reported in response headers and metrics", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.Name) }},
+	{"nodes", "ELASTICSEARCH_NODES", "Comma-separated list of Elasticsearch cluster nodes", func(c *Config) flag.Value { return &c.Elasticsearch.Nodes }},
+	{"timeout", "ELASTICSEARCH_CONN_TIMEOUT", "Elasticsearch cluster connection timeout", func(c *Config) flag.Value { return &c.Elasticsearch.ConnTimeout }},
+	{"index", "ELASTICSEARCH_INDEX", "Elasticsearch index to search in", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.Index) }},
+	{"min-health-status", "ELASTICSEARCH_MIN_HEALTH_STATUS", "Minimum cluster health status (green/yellow) required for the service to report readiness", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.MinHealthStatus) }},
+	{"wait-for-status", "ELASTICSEARCH_WAIT_FOR_STATUS", "Cluster health status (green/yellow) to wait for on startup", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.WaitForStatus) }},
+	{"es-cloud-id", "ELASTICSEARCH_CLOUD_ID", "Elastic Cloud deployment ID to connect to instead of --nodes", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.CloudID) }},
+	{"es-username", "ELASTICSEARCH_USERNAME", "Elasticsearch username", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.Username) }},
+	{"es-password", "ELASTICSEARCH_PASSWORD", "Elasticsearch password", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.Password) }},
+	{"es-password-file", "ELASTICSEARCH_PASSWORD_FILE", "File to read Elasticsearch password from", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.PasswordFile) }},
+	{"es-api-key", "ELASTICSEARCH_API_KEY", "Base64-encoded Elasticsearch API key, takes precedence over username and password", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.APIKey) }},
+	{"es-api-key-file", "ELASTICSEARCH_API_KEY_FILE", "File to read Elasticsearch API key from", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.APIKeyFile) }},
+	{"es-ca-cert", "ELASTICSEARCH_CA_CERT", "PEM-encoded CA bundle to verify Elasticsearch node certificates against", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.CACert) }},
+	{"es-cert-fingerprint", "ELASTICSEARCH_CERT_FINGERPRINT", "SHA-256 fingerprint of Elasticsearch node certificate", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.CertFingerprint) }},
+	{"es-client-cert", "ELASTICSEARCH_CLIENT_CERT", "PEM-encoded client certificate to present to Elasticsearch", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.ClientCert) }},
+	{"es-client-key", "ELASTICSEARCH_CLIENT_KEY", "PEM-encoded client certificate key", func(c *Config) flag.Value { return (*stringValue)(&c.Elasticsearch.ClientKey) }},
+	{"es-max-idle-conns-per-host", "ELASTICSEARCH_MAX_IDLE_CONNS_PER_HOST", "Maximum number of idle connections to keep per Elasticsearch node", func(c *Config) flag.Value { return (*intValue)(&c.Elasticsearch.MaxIdleConnsPerHost) }},
+	{"es-response-header-timeout", "ELASTICSEARCH_RESPONSE_HEADER_TIMEOUT", "Time to wait for Elasticsearch response headers, zero means no timeout", func(c *Config) flag.Value { return &c.Elasticsearch.ResponseHeaderTimeout }},
+	{"circuit-breaker-failure-threshold", "CIRCUIT_BREAKER_FAILURE_THRESHOLD", "Number of consecutive failed Elasticsearch requests that opens the circuit breaker, zero disables it", func(c *Config) flag.Value { return (*intValue)(&c.Elasticsearch.CircuitBreaker.FailureThreshold) }},
+	{"circuit-breaker-slow-call-threshold", "CIRCUIT_BREAKER_SLOW_CALL_THRESHOLD", "Elasticsearch request duration above which the request is considered failed, zero means no threshold", func(c *Config) flag.Value { return &c.Elasticsearch.CircuitBreaker.SlowCallThreshold }},
+	{"circuit-breaker-open-timeout", "CIRCUIT_BREAKER_OPEN_TIMEOUT", "Time the circuit breaker stays open before letting probe requests through", func(c *Config) flag.Value { return &c.Elasticsearch.CircuitBreaker.OpenTimeout }},
+	{"circuit-breaker-half-open-probes", "CIRCUIT_BREAKER_HALF_OPEN_PROBES", "Number of successful probe requests required to close the circuit breaker", func(c *Config) flag.Value { return (*intValue)(&c.Elasticsearch.CircuitBreaker.HalfOpenProbes) }},
+	{"shadow-nodes", "SHADOW_ELASTICSEARCH_NODES", "Comma-separated list of shadow Elasticsearch cluster nodes to mirror search requests to", func(c *Config) flag.Value { return &c.Shadow.Nodes }},
+	{"shadow-index", "SHADOW_ELASTICSEARCH_INDEX", "Shadow Elasticsearch cluster index to search in, defaults to --index", func(c *Config) flag.Value { return (*stringValue)(&c.Shadow.Index) }},
+	{"shadow-sample-rate", "SHADOW_SAMPLE_RATE", "Share of search requests to mirror to the shadow cluster, zero disables mirroring", func(c *Config) flag.Value { return (*floatValue)(&c.Shadow.SampleRate) }},
+	{"rate-limit", "RATE_LIMIT", "Default per-user rate limit, i.e. rate=10,burst=20,daily=100000", func(c *Config) flag.Value { return &c.RateLimits.Default }},
+	{"role-rate-limit", "", "Rate limit for a role, i.e. partner=rate=5,burst=10, can be repeated", func(c *Config) flag.Value { return (*RoleRateLimits)(&c.RateLimits.Roles) }},
+	{"role", "", "Role assignment for a user, i.e. user1=partner, can be repeated", func(c *Config) flag.Value { return (*RoleAssignments)(&c.Roles) }},
+	{"search-timeout", "SEARCH_TIMEOUT", "Default search timeout, zero means no timeout", func(c *Config) flag.Value { return &c.Search.DefaultTimeout }},
+	{"search-max-timeout", "SEARCH_MAX_TIMEOUT", "Maximum search timeout a request can specify, zero means no limit", func(c *Config) flag.Value { return &c.Search.MaxTimeout }},
+	{"ingest-dir", "INGEST_DIR", "Directory to queue writes in before flushing them to Elasticsearch, empty value disables queueing", func(c *Config) flag.Value { return (*stringValue)(&c.Ingest.Dir) }},
+	{"allow-mapping-drift", "ALLOW_MAPPING_DRIFT", "Start even if the index mappings do not match the ones expected by the service", func(c *Config) flag.Value { return (*boolValue)(&c.Mapping.AllowDrift) }},
+	{"reindex-keep", "REINDEX_KEEP", "Number of previous versioned indices to keep for rollback after reindexing", func(c *Config) flag.Value { return (*intValue)(&c.Reindex.Keep) }},
+	{"cache-ttl", "CACHE_TTL", "Time to cache search results for, zero disables caching", func(c *Config) flag.Value { return &c.Cache.TTL }},
+	{"cache-max-size", "CACHE_MAX_SIZE", "Maximum size of cached search results in bytes", func(c *Config) flag.Value { return (*intValue)(&c.Cache.MaxSize) }},
+	{"cache-max-stale", "CACHE_MAX_STALE", "Time to keep expired search results for to serve them if Elasticsearch is unavailable, zero disables serving stale results", func(c *Config) flag.Value { return &c.Cache.MaxStale }},
+	{"admin-auth", "ADMIN_AUTH", "Credentials in user:password format required to access /admin/ endpoints, these endpoints are disabled if not set", func(c *Config) flag.Value { return (*stringValue)(&c.Admin.Auth) }},
+	{"metrics-auth", "METRICS_AUTH", "Credentials in user:password format required to access /metrics", func(c *Config) flag.Value { return (*stringValue)(&c.Metrics.Auth) }},
+	{"otlp-endpoint", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTLP/HTTP endpoint to export traces to, i.e. http://localhost:4318/v1/traces", func(c *Config) flag.Value { return (*stringValue)(&c.Tracing.OTLPEndpoint) }},
+	{"log-level", "LOG_LEVEL", "Minimum log level (debug/info/warn/error), access log is written with info level", func(c *Config) flag.Value { return (*stringValue)(&c.Log.Level) }},
+}
+
+// BindFlags defines command-line flags that override configuration settings in c
+func BindFlags(fs *flag.FlagSet, c *Config) {
+	for _, s := range settings {
+		usage := s.Usage
+		if s.Env != "" {
+			usage += ", overrides " + s.Env + "="
+		}
+
+		fs.Var(s.Value(c), s.Flag, usage)
+	}
+}
+
+// LoadFile reads YAML or JSON configuration file into c. Settings missing in the file are left intact
+func LoadFile(fName string, c *Config) error {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return err
+	}
+
+	// JSON is a subset of YAML, so both formats are handled by the YAML parser
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("failed to parse %s: %s", fName, err)
+	}
+
+	return nil
+}
+
+// ApplyEnv overrides settings in c with values of env variables returned by getenv
+func ApplyEnv(c *Config, getenv func(string) string) error {
+	for _, s := range settings {
+		if s.Env == "" {
+			continue
+		}
+
+		v := getenv(s.Env)
+		if v == "" {
+			continue
+		}
+
+		if err := s.Value(c).Set(v); err != nil {
+			return fmt.Errorf("invalid %s= value %q: %s", s.Env, v, err)
+		}
+	}
+
+	return nil
+}
+
+// listValue is a flag.Value collecting the values of a repeated flag
+type listValue interface {
+	flag.Value
+	List() []string
+}
+
+// ApplyFlags overrides settings in c with the values of flags that were explicitly set in fs.
+// Repeated flags add to the values set by previous sources
+func ApplyFlags(c *Config, fs *flag.FlagSet) error {
+	dst := flag.NewFlagSet("", flag.ContinueOnError)
+	BindFlags(dst, c)
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil || dst.Lookup(f.Name) == nil {
+			return
+		}
+
+		values := []string{f.Value.String()}
+		if lv, ok := f.Value.(listValue); ok {
+			values = lv.List()
+		}
+
+		for _, v := range values {
+			if e := dst.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid -%s value: %s", f.Name, e)
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+// Load builds the configuration from defaults, the file (if fName is not empty), env variables
+// and command-line flags set in fs, each source taking precedence over the previous one.
+// The resulting configuration is validated
+func Load(fName string, getenv func(string) string, fs *flag.FlagSet) (Config, error) {
+	c := Default()
+
+	if fName != "" {
+		if err := LoadFile(fName, &c); err != nil {
+			return c, err
+		}
+	}
+
+	if err := ApplyEnv(&c, getenv); err != nil {
+		return c, err
+	}
+
+	if fs != nil {
+		if err := ApplyFlags(&c, fs); err != nil {
+			return c, err
+		}
+	}
+
+	return c, c.Validate()
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string {
+	return string(*v)
+}
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+
+	*v = intValue(n)
+
+	return nil
+}
+
+func (v *intValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+
+	*v = boolValue(b)
+
+	return nil
+}
+
+func (v *boolValue) String() string {
+	return strconv.FormatBool(bool(*v))
+}
+
+// IsBoolFlag allows to set the flag without a value
+func (v *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+type floatValue float64
+
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+
+	*v = floatValue(f)
+
+	return nil
+}
+
+func (v *floatValue) String() string {
+	return strconv.FormatFloat(float64(*v), 'g', -1, 64)
+}
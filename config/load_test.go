@@ -0,0 +1,118 @@
+package config_test
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/config"
+	"github.com/andrewslotin/es-search-service/schema"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFile(t *testing.T) {
+	c := config.Default()
+	require.NoError(t, config.LoadFile("testdata/config.yaml", &c))
+
+	assert.Equal(t, ":9090", c.Listen.Addr)
+	assert.Equal(t, config.Duration(5*time.Second), c.Listen.ReadTimeout)
+	assert.Equal(t, config.Duration(60*time.Second), c.Listen.WriteTimeout)
+	assert.Equal(t, config.StringList{"http://es1:9200", "http://es2:9200"}, c.Elasticsearch.Nodes)
+	assert.Equal(t, "catalog", c.Elasticsearch.Index)
+	assert.Equal(t, []config.Cluster{
+		{Name: "primary", Connection: config.Connection{Nodes: config.StringList{"http://es1:9200", "http://es2:9200"}}},
+		{Name: "dr", Priority: 1, Connection: config.Connection{Nodes: config.StringList{"https://dr-es1:9200"}, APIKeyFile: "/run/secrets/dr_api_key"}},
+	}, c.Elasticsearch.Clusters())
+	assert.True(t, c.Shadow.Enabled())
+	assert.Equal(t, "shadow", c.Shadow.Name)
+	assert.Equal(t, config.StringList{"http://candidate-es1:9200"}, c.Shadow.Nodes)
+	assert.Equal(t, "catalog-v2", c.Shadow.Index)
+	assert.Equal(t, 0.05, c.Shadow.SampleRate)
+	assert.Equal(t, config.RateLimit{Rate: 10, Burst: 20}, c.RateLimits.Default)
+	assert.Equal(t, map[string]config.RateLimit{"partner": {Rate: 1, Daily: 1000}}, c.RateLimits.Roles)
+	assert.Equal(t, map[string]string{"user1": "partner"}, c.Roles)
+	require.Contains(t, c.Schemas, config.SchemaProducts)
+	assert.Equal(t, schema.TypeString, c.Schemas[config.SchemaProducts].Fields["title"].Type)
+	assert.True(t, c.Schemas[config.SchemaProducts].Fields["title"].Required)
+	assert.Equal(t, schema.TypeString, c.Schemas[config.SchemaProducts].Fields["tags"].Items.Type)
+	assert.Equal(t, config.LogLevelWarn, c.Log.Level)
+}
+
+func TestLoadFile_JSON(t *testing.T) {
+	c := config.Default()
+	require.NoError(t, config.LoadFile("testdata/config.json", &c))
+
+	assert.Equal(t, ":9090", c.Listen.Addr)
+	assert.Equal(t, config.StringList{"http://es1:9200"}, c.Elasticsearch.Nodes)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	env := map[string]string{
+		"LISTEN_ADDR":         ":7070",
+		"ELASTICSEARCH_INDEX": "env-index",
+	}
+
+	var scratch config.Config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config.BindFlags(fs, &scratch)
+	require.NoError(t, fs.Parse([]string{"-index=flag-index", "-rate-limit=rate=5", "-shadow-sample-rate=0.5", "-allow-mapping-drift"}))
+
+	c, err := config.Load("testdata/config.yaml", func(k string) string { return env[k] }, fs)
+	require.NoError(t, err)
+
+	assert.Equal(t, ":7070", c.Listen.Addr)
+	assert.Equal(t, "flag-index", c.Elasticsearch.Index)
+	assert.Equal(t, config.RateLimit{Rate: 5}, c.RateLimits.Default)
+	assert.Equal(t, 0.5, c.Shadow.SampleRate)
+	assert.True(t, c.Mapping.AllowDrift)
+	assert.Equal(t, config.Duration(5*time.Second), c.Listen.ReadTimeout)
+}
+
+func TestLoad_RoleFlags(t *testing.T) {
+	var scratch config.Config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config.BindFlags(fs, &scratch)
+	require.NoError(t, fs.Parse([]string{
+		"-role-rate-limit=partner=rate=2,burst=5",
+		"-role-rate-limit=internal=rate=100",
+		"-role=user2=partner",
+		"-role=user3=internal",
+	}))
+
+	c, err := config.Load("testdata/config.yaml", func(string) string { return "" }, fs)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]config.RateLimit{
+		"partner":  {Rate: 2, Burst: 5},
+		"internal": {Rate: 100},
+	}, c.RateLimits.Roles)
+	assert.Equal(t, map[string]string{"user1": "partner", "user2": "partner", "user3": "internal"}, c.Roles)
+
+	require.Error(t, fs.Parse([]string{"-role=user4"}))
+}
+
+func TestLoad_EmptyNodesList(t *testing.T) {
+	env := map[string]string{"ELASTICSEARCH_NODES": " , "}
+
+	_, err := config.Load("", func(k string) string { return env[k] }, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "elasticsearch.nodes")
+}
+
+func TestLoad_InvalidEnv(t *testing.T) {
+	env := map[string]string{
+		"ELASTICSEARCH_NODES":        "http://localhost:9200",
+		"ELASTICSEARCH_CONN_TIMEOUT": "soon",
+	}
+
+	_, err := config.Load("", func(k string) string { return env[k] }, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ELASTICSEARCH_CONN_TIMEOUT")
+}
+
+func TestLoadFile_UnknownSetting(t *testing.T) {
+	c := config.Default()
+	assert.Error(t, config.LoadFile("testdata/unknown.yaml", &c))
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/ratelimit"
+)
+
+// Duration is a time.Duration that can be unmarshaled from a string, i.e. "10s"
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.Set(s)
+}
+
+// Set implements flag.Value
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+
+	return nil
+}
+
+// String implements flag.Value
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+// StringList is a list of strings that can be set from a comma-separated string.
+// Empty items are omitted
+type StringList []string
+
+// Set implements flag.Value
+func (l *StringList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
+
+// String implements flag.Value
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// RateLimit is a rate limiting policy. It can be set from a comma-separated list of settings,
+// i.e. "rate=10,burst=20,daily=100000"
+type RateLimit struct {
+	// Rate is the number of requests per second
+	Rate float64 `yaml:"rate"`
+	// Burst is the maximum number of requests that can be made at once
+	Burst int `yaml:"burst"`
+	// Daily is the maximum number of requests per UTC day
+	Daily int `yaml:"daily"`
+}
+
+// Policy converts the rate limit into a rate limiting policy
+func (rl RateLimit) Policy() ratelimit.Policy {
+	return ratelimit.Policy{
+		Rate:       rl.Rate,
+		Burst:      rl.Burst,
+		DailyQuota: rl.Daily,
+	}
+}
+
+// Set implements flag.Value
+func (rl *RateLimit) Set(s string) error {
+	p, err := ratelimit.ParsePolicy(s)
+	if err != nil {
+		return err
+	}
+
+	*rl = RateLimit{Rate: p.Rate, Burst: p.Burst, Daily: p.DailyQuota}
+
+	return nil
+}
+
+// String implements flag.Value
+func (rl *RateLimit) String() string {
+	if *rl == (RateLimit{}) {
+		return ""
+	}
+
+	return fmt.Sprintf("rate=%s,burst=%d,daily=%d", strconv.FormatFloat(rl.Rate, 'g', -1, 64), rl.Burst, rl.Daily)
+}
+
+// RoleRateLimits is a set of role rate limits that can be extended with "<role>=<policy>" values,
+// i.e. "partner=rate=1,burst=5"
+type RoleRateLimits map[string]RateLimit
+
+// Set implements flag.Value
+func (rl *RoleRateLimits) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("malformed role rate limit %q, expected <role>=<policy>", s)
+	}
+
+	var p RateLimit
+	if err := p.Set(kv[1]); err != nil {
+		return fmt.Errorf("role %s: %s", kv[0], err)
+	}
+
+	if *rl == nil {
+		*rl = make(RoleRateLimits)
+	}
+	(*rl)[kv[0]] = p
+
+	return nil
+}
+
+// String implements flag.Value
+func (rl *RoleRateLimits) String() string {
+	return strings.Join(rl.List(), " ")
+}
+
+// List returns the role rate limits in "<role>=<policy>" format sorted by role
+func (rl *RoleRateLimits) List() []string {
+	var items []string
+	for role, p := range *rl {
+		items = append(items, role+"="+p.String())
+	}
+	sort.Strings(items)
+
+	return items
+}
+
+// RoleAssignments maps users to their roles. It can be extended with "<user>=<role>" values
+type RoleAssignments map[string]string
+
+// Set implements flag.Value
+func (ra *RoleAssignments) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("malformed role assignment %q, expected <user>=<role>", s)
+	}
+
+	if *ra == nil {
+		*ra = make(RoleAssignments)
+	}
+	(*ra)[kv[0]] = kv[1]
+
+	return nil
+}
+
+// String implements flag.Value
+func (ra *RoleAssignments) String() string {
+	return strings.Join(ra.List(), " ")
+}
+
+// List returns the role assignments in "<user>=<role>" format sorted by user
+func (ra *RoleAssignments) List() []string {
+	var items []string
+	for user, role := range *ra {
+		items = append(items, user+"="+role)
+	}
+	sort.Strings(items)
+
+	return items
+}
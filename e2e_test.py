@@ -5,44 +5,65 @@ from base64 import b64encode
 
 ELASTICSEARCH_URL = os.environ.get("ELASTICSEARCH_NODES", "localhost:9200")
 SERVICE_URL = os.environ.get("LISTEN_ADDR", "localhost:8080")
-DATA = ('{"index": {"_index": "products", "_type": "product"}}\n'
+DATA = ('{"index": {"_index": "products"}}\n'
         '{"title": "AirMax", "brand": "Nike", "price": 1000, "stock": 10}\n'
-        '{"index": {"_index": "products", "_type": "product"}}\n'
+        '{"index": {"_index": "products"}}\n'
         '{"title": "Pegasus Shield", "brand": "Nike", "price": 1500, "stock": 12}\n'
-        '{"index": {"_index": "products", "_type": "product"}}\n'
+        '{"index": {"_index": "products"}}\n'
         '{"title": "Pegasus Shield", "brand": "Nike", "price": 2000, "stock": 20}\n'
-        '{"index": {"_index": "products", "_type": "product"}}\n'
+        '{"index": {"_index": "products"}}\n'
         '{"title": "Zoom", "brand": "Nike", "price": 2000, "stock": 1}\n'
-        '{"index": {"_index": "products", "_type": "product"}}\n'
+        '{"index": {"_index": "products"}}\n'
         '{"title": "SuperStar", "brand": "Adidas", "price": 999, "stock": 5}\n'
         
 )
-MAPPINGS = """
+# Keep in sync with mapping.Products in mapping/mapping.go, which is the source of truth
+INDEX = """
 {
-  "properties": {
-    "title": {
-      "type": "text",
-      "fielddata": true
-    },
-    "brand": {
-      "type": "text",
-      "fielddata": true
-    },
-    "price": {
-      "type": "long"
+  "settings": {
+    "index": {
+      "number_of_shards": "1"
+    }
+  },
+  "mappings": {
+    "_meta": {
+      "version": 1
     },
-    "stock": {
-      "type": "long"
+    "properties": {
+      "title": {
+        "type": "text",
+        "fields": {
+          "keyword": {
+            "type": "keyword",
+            "ignore_above": 256
+          }
+        }
+      },
+      "brand": {
+        "type": "text",
+        "fields": {
+          "keyword": {
+            "type": "keyword",
+            "ignore_above": 256
+          }
+        }
+      },
+      "price": {
+        "type": "long"
+      },
+      "stock": {
+        "type": "long"
+      }
     }
   }
 }
 """
 
-def seed(data, mappings):
+def seed(data, index):
     print("Uploading seed data")
     
     conn = http.client.HTTPConnection(ELASTICSEARCH_URL)
-    conn.request("POST", "/_bulk", data, headers={"Content-Type": "application/x-ndjson"})
+    conn.request("PUT", "/products", index, headers={"Content-Type": "application/json"})
 
     resp = conn.getresponse()
     if resp.status >= 400:
@@ -51,11 +72,16 @@ def seed(data, mappings):
     conn.close()
 
     conn = http.client.HTTPConnection(ELASTICSEARCH_URL)
-    conn.request("PUT", "/products/_mapping", mappings, headers={"Content-Type": "application/json"})
+    conn.request("POST", "/_bulk", data, headers={"Content-Type": "application/x-ndjson"})
 
     resp = conn.getresponse()
+    body = resp.read()
     if resp.status >= 400:
-        raise BaseException("failed to seed cluster: " + str(resp.read()))
+        raise BaseException("failed to seed cluster: " + str(body))
+
+    # bulk requests succeed even if some of the items have been rejected
+    if json.loads(body).get("errors"):
+        raise BaseException("failed to seed cluster: " + str(body))
 
     conn.close()
 
@@ -106,7 +132,7 @@ def test(name, query, expected):
 
 
 failed = 0
-seed(DATA, MAPPINGS)
+seed(DATA, INDEX)
 time.sleep(2) # give ES a chance to index
 
 try:
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/config"
+	"github.com/andrewslotin/es-search-service/metrics"
+	"github.com/andrewslotin/es-search-service/storage"
+	"github.com/andrewslotin/es-search-service/tlsutil"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+)
+
+var esClusterConnected = metrics.NewGaugeVec(
+	"search_service_elasticsearch_cluster_connected",
+	"Whether the Elasticsearch cluster was reachable on the last check.",
+	"cluster",
+)
+
+func init() {
+	metrics.Default.MustRegister(esClusterConnected)
+}
+
+// waitForElasticsearch ensures that Elasticsearch cluster is up and running. If waitForStatus is not empty,
+// the cluster health status is also required to be the same or better. If there is a non-nil context
+// provided, this function will keep retrying to connect to cluster in case of an error until the supplied
+// context is done.
+func waitForElasticsearch(ctx context.Context, name string, c *elasticsearch.Client, waitForStatus string) error {
+	pingCtx := ctx
+	if pingCtx == nil {
+		pingCtx = context.Background()
+	}
+
+	err := pingElasticsearch(pingCtx, c, waitForStatus)
+	if err != nil && ctx == nil {
+		esClusterConnected.With(name).Set(0)
+		// do not retry if there was no context provided for cancellation/timeout
+		return err
+	}
+
+	// return immediately if connection succeeded
+	if err == nil {
+		esClusterConnected.With(name).Set(1)
+		return nil
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	// attempt to reach the cluster each 100ms until success or the context is cancelled
+	for {
+		select {
+		case <-ticker.C:
+			err = pingElasticsearch(ctx, c, waitForStatus)
+			if err == nil {
+				esClusterConnected.With(name).Set(1)
+				return nil
+			}
+		case <-ctx.Done():
+			esClusterConnected.With(name).Set(0)
+			return fmt.Errorf("%s: %s", ctx.Err(), err)
+		}
+	}
+}
+
+// watchClusters checks whether the clusters are reachable with given interval until stop channel is closed,
+// so that the connection status reported on startup is kept up to date
+func watchClusters(clusters []esCluster, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+
+			var wg sync.WaitGroup
+			for _, cl := range clusters {
+				wg.Add(1)
+				go func(cl esCluster) {
+					defer wg.Done()
+
+					if err := pingElasticsearch(ctx, cl.Client, ""); err != nil {
+						esClusterConnected.With(cl.Name).Set(0)
+						return
+					}
+					esClusterConnected.With(cl.Name).Set(1)
+				}(cl)
+			}
+			wg.Wait()
+
+			cancel()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// esCluster is a connection to a named Elasticsearch cluster
+type esCluster struct {
+	Name      string
+	Priority  int
+	Client    *elasticsearch.Client
+	Transport *http.Transport
+}
+
+// connectClusters connects to the primary and failover Elasticsearch clusters and waits for them
+// to become available until ctx is done. It fails only if none of the clusters is available, so that
+// the service could start while some of them are down
+func connectClusters(ctx context.Context, cfg config.Elasticsearch) ([]esCluster, error) {
+	var clusters []esCluster
+	for _, cl := range cfg.Clusters() {
+		c, err := newESCluster(cl.Name, cl.Connection, cfg)
+		if err != nil {
+			return nil, err
+		}
+		c.Priority = cl.Priority
+
+		clusters = append(clusters, c)
+	}
+
+	errs := make([]error, len(clusters))
+
+	var wg sync.WaitGroup
+	for i, cl := range clusters {
+		wg.Add(1)
+		go func(i int, cl esCluster) {
+			defer wg.Done()
+			errs[i] = waitForElasticsearch(ctx, cl.Name, cl.Client, cfg.WaitForStatus)
+		}(i, cl)
+	}
+	wg.Wait()
+
+	var available int
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("failed to connect to %s elasticsearch cluster: %s", clusters[i].Name, err)
+			continue
+		}
+		available++
+	}
+
+	if available == 0 {
+		return nil, errs[0]
+	}
+
+	return clusters, nil
+}
+
+// connectShadow connects to the shadow Elasticsearch cluster and waits for it to become available
+// until ctx is done. The cluster is returned even if it's not available yet, since search requests
+// mirroring does not affect the service operation
+func connectShadow(ctx context.Context, cfg config.Shadow, esCfg config.Elasticsearch) (esCluster, error) {
+	cl, err := newESCluster(cfg.Name, cfg.Connection, esCfg)
+	if err != nil {
+		return cl, err
+	}
+
+	if err := waitForElasticsearch(ctx, cl.Name, cl.Client, ""); err != nil {
+		log.Printf("failed to connect to %s elasticsearch cluster: %s", cl.Name, err)
+	}
+
+	return cl, nil
+}
+
+// newESCluster creates a client for the named Elasticsearch cluster
+func newESCluster(name string, conn config.Connection, cfg config.Elasticsearch) (esCluster, error) {
+	opts, err := newESOptions(conn, cfg)
+	if err != nil {
+		return esCluster{}, fmt.Errorf("%s cluster: %s", name, err)
+	}
+
+	transport, err := opts.Transport()
+	if err != nil {
+		return esCluster{}, fmt.Errorf("invalid %s cluster connection settings: %s", name, err)
+	}
+
+	c, err := elasticsearch.NewClient(opts.Config(transport))
+	if err != nil {
+		return esCluster{}, fmt.Errorf("invalid %s cluster connection settings: %s", name, err)
+	}
+
+	return esCluster{Name: name, Client: c, Transport: transport}, nil
+}
+
+// esOptions define how the service connects to the Elasticsearch cluster
+type esOptions struct {
+	Nodes    []string
+	CloudID  string
+	Username string
+	Password string
+	APIKey   string
+
+	TLS tlsutil.ClientOptions
+
+	MaxIdleConnsPerHost   int
+	ResponseHeaderTimeout time.Duration
+}
+
+// Config returns the Elasticsearch client configuration using provided transport
+func (opts esOptions) Config(transport http.RoundTripper) elasticsearch.Config {
+	return elasticsearch.Config{
+		Addresses: opts.Nodes,
+		CloudID:   opts.CloudID,
+		Username:  opts.Username,
+		Password:  opts.Password,
+		APIKey:    opts.APIKey,
+		Transport: transport,
+	}
+}
+
+// Transport returns an HTTP transport to be used by Elasticsearch client. It's created explicitly
+// to apply TLS settings and to be able to release idle connections on shutdown
+func (opts esOptions) Transport() (*http.Transport, error) {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if !opts.TLS.Empty() {
+		cfg, err := tlsutil.ClientConfig(opts.TLS)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = cfg
+	}
+
+	return t, nil
+}
+
+// newESOptions returns the options to connect to an Elasticsearch cluster reading secrets from files
+// if necessary
+func newESOptions(conn config.Connection, cfg config.Elasticsearch) (esOptions, error) {
+	opts := esOptions{
+		Nodes:    conn.Nodes,
+		CloudID:  conn.CloudID,
+		Username: conn.Username,
+		TLS: tlsutil.ClientOptions{
+			CAFile:          conn.CACert,
+			CertFingerprint: conn.CertFingerprint,
+			CertFile:        conn.ClientCert,
+			KeyFile:         conn.ClientKey,
+		},
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout),
+	}
+
+	var err error
+	if opts.Password, err = readSecret(conn.Password, conn.PasswordFile); err != nil {
+		return opts, fmt.Errorf("failed to read elasticsearch password: %s", err)
+	}
+
+	if opts.APIKey, err = readSecret(conn.APIKey, conn.APIKeyFile); err != nil {
+		return opts, fmt.Errorf("failed to read elasticsearch api key: %s", err)
+	}
+
+	return opts, nil
+}
+
+// readSecret returns the value if it's not empty, otherwise it reads the secret from file
+// trimming the trailing whitespace
+func readSecret(value, fName string) (string, error) {
+	if value != "" || fName == "" {
+		return value, nil
+	}
+
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n\t "), nil
+}
+
+// pingElasticsearch checks whether the cluster is reachable and, if minStatus is not empty,
+// its health status is at least minStatus
+func pingElasticsearch(ctx context.Context, c *elasticsearch.Client, minStatus string) error {
+	resp, err := c.Info(c.Info.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.IsError() {
+		return fmt.Errorf("elasticsearch responded with %s", resp.Status())
+	}
+
+	if minStatus == "" {
+		return nil
+	}
+
+	h, err := storage.New(c, "").Health(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !storage.StatusAtLeast(h.ClusterStatus, minStatus) {
+		return fmt.Errorf("cluster status is %s, want at least %s", h.ClusterStatus, minStatus)
+	}
+
+	return nil
+}
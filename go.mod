@@ -5,4 +5,5 @@ go 1.12
 require (
 	github.com/elastic/go-elasticsearch/v7 v7.3.0
 	github.com/stretchr/testify v1.4.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,52 @@
+// Package idempotency keeps responses to write requests, so that retried requests can be answered
+// without repeating the write
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrInProgress is returned when a request with the same key is still being processed
+var ErrInProgress = errors.New("request with the same key is in progress")
+
+// Response is a recorded response to a request
+type Response struct {
+	// Method is the HTTP method of the request
+	Method string
+	// Path is the URL path of the request
+	Path string
+	// BodyHash is the hex-encoded SHA-256 hash of the request body
+	BodyHash string
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+	// Header contains the response headers
+	Header http.Header
+	// Body is the response body
+	Body []byte
+}
+
+// Size returns the approximate size of the response in bytes
+func (resp Response) Size() int64 {
+	n := len(resp.Method) + len(resp.Path) + len(resp.BodyHash) + len(resp.Body)
+	for k, vs := range resp.Header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+
+	return int64(n)
+}
+
+// Store keeps track of requests and their responses by idempotency key
+type Store interface {
+	// Begin reserves the key for a new request. If a response has already been saved for the key,
+	// it is returned instead. ErrInProgress is returned if the key is reserved by another request
+	Begin(ctx context.Context, key string) (*Response, error)
+	// Save stores the response for the key and releases the reservation
+	Save(ctx context.Context, key string, resp Response) error
+	// Cancel releases the reservation without storing the response, so that the request can be retried
+	Cancel(ctx context.Context, key string) error
+}
@@ -0,0 +1,65 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/cache"
+)
+
+// MemoryStore is an in-process Store. Responses are kept in an LRU cache, so once it's full the
+// least recently used ones are evicted before their time. The state is not shared between service instances
+type MemoryStore struct {
+	responses *cache.LRU
+
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+}
+
+// NewMemoryStore returns a new instance of in-memory store that keeps up to maxSize bytes of responses for the ttl
+func NewMemoryStore(maxSize int64, ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		responses: cache.NewLRU(maxSize, ttl, 0),
+		inFlight:  make(map[string]struct{}),
+	}
+}
+
+// Begin reserves the key unless there is a response stored for it already or the key is in use
+func (s *MemoryStore) Begin(ctx context.Context, key string) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.responses.Get(key); ok {
+		resp := v.(Response)
+		return &resp, nil
+	}
+
+	if _, ok := s.inFlight[key]; ok {
+		return nil, ErrInProgress
+	}
+	s.inFlight[key] = struct{}{}
+
+	return nil, nil
+}
+
+// Save stores the response for the key and releases the reservation
+func (s *MemoryStore) Save(ctx context.Context, key string, resp Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses.Set(key, resp, resp.Size())
+	delete(s.inFlight, key)
+
+	return nil
+}
+
+// Cancel releases the reservation
+func (s *MemoryStore) Cancel(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inFlight, key)
+
+	return nil
+}
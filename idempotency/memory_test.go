@@ -0,0 +1,74 @@
+package idempotency_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/idempotency"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := idempotency.NewMemoryStore(1<<20, time.Minute)
+	ctx := context.Background()
+
+	resp, err := s.Begin(ctx, "key1")
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+
+	// the key is reserved until the response is saved
+	_, err = s.Begin(ctx, "key1")
+	assert.Equal(t, idempotency.ErrInProgress, err)
+
+	// other keys are not affected
+	resp, err = s.Begin(ctx, "key2")
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+
+	expected := idempotency.Response{
+		Method:     http.MethodPost,
+		Path:       "/v1/products",
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Location": {"/v1/products/abc"}},
+		Body:       []byte(`{"status":"success"}`),
+	}
+	require.NoError(t, s.Save(ctx, "key1", expected))
+
+	resp, err = s.Begin(ctx, "key1")
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, expected, *resp)
+}
+
+func TestMemoryStore_Cancel(t *testing.T) {
+	s := idempotency.NewMemoryStore(1<<20, time.Minute)
+	ctx := context.Background()
+
+	_, err := s.Begin(ctx, "key1")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Cancel(ctx, "key1"))
+
+	resp, err := s.Begin(ctx, "key1")
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestMemoryStore_Expiration(t *testing.T) {
+	s := idempotency.NewMemoryStore(1<<20, 10*time.Millisecond)
+	ctx := context.Background()
+
+	_, err := s.Begin(ctx, "key1")
+	require.NoError(t, err)
+	require.NoError(t, s.Save(ctx, "key1", idempotency.Response{StatusCode: http.StatusOK}))
+
+	time.Sleep(20 * time.Millisecond)
+
+	resp, err := s.Begin(ctx, "key1")
+	require.NoError(t, err)
+	assert.Nil(t, resp)
+}
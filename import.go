@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/catalog"
+	"github.com/andrewslotin/es-search-service/config"
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// maxListedDeletions is the number of product IDs to be deleted listed in the sync report
+const maxListedDeletions = 20
+
+// importOptions are the flags of the import command
+type importOptions struct {
+	Format    string
+	IDField   string
+	Sync      bool
+	DryRun    bool
+	MaxDelete float64
+}
+
+// bindImportFlags defines the flags of the import command in fs
+func bindImportFlags(fs *flag.FlagSet) *importOptions {
+	opts := &importOptions{}
+
+	fs.StringVar(&opts.Format, "format", "", "Snapshot format (jsonl/csv), detected by the file extension if not set")
+	fs.StringVar(&opts.IDField, "id-field", "id", "Snapshot field holding the product ID")
+	fs.BoolVar(&opts.Sync, "sync", false, "Index changed products only and delete the ones missing in the snapshot")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Report the changes to be made by --sync without applying them")
+	fs.Float64Var(&opts.MaxDelete, "max-delete", 10, "Abort --sync if more than this percentage of indexed products would be deleted")
+
+	return opts
+}
+
+// importCatalog indexes products from the snapshot file into the primary cluster
+func importCatalog(cfg config.Config, opts importOptions, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(flag.CommandLine.Output(), "expected a single snapshot file to import")
+		usage()
+		os.Exit(2)
+	}
+	path := args[0]
+
+	if opts.DryRun && !opts.Sync {
+		log.Fatal("--dry-run requires --sync")
+	}
+
+	format := opts.Format
+	if format == "" {
+		var err error
+		if format, err = catalog.DetectFormat(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	open := func() (*catalog.Reader, io.Closer) {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("failed to open snapshot: %s", err)
+		}
+
+		r, err := catalog.NewReader(f, format, opts.IDField, mapping.Products)
+		if err != nil {
+			f.Close()
+			log.Fatalf("failed to read snapshot: %s", err)
+		}
+
+		return r, f
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Elasticsearch.ConnTimeout))
+	clusters, err := connectClusters(ctx, cfg.Elasticsearch)
+	cancel()
+	if err != nil {
+		log.Fatalf("failed to connect to elasticsearch cluster: %s", err)
+	}
+
+	st := storage.New(clusters[0].Client, cfg.Elasticsearch.Index)
+	im := catalog.NewImporter(st, cfg.ProductSchema(), cfg.ImportSettings())
+
+	var report catalog.Report
+	if opts.Sync {
+		r, f := open()
+		plan, err := im.Plan(context.Background(), r)
+		f.Close()
+		if err != nil {
+			log.Fatalf("failed to plan sync of %s with %s: %s", cfg.Elasticsearch.Index, path, err)
+		}
+
+		printPlan(os.Stdout, plan)
+
+		if plan.DeletedPercent() > opts.MaxDelete {
+			log.Fatalf("refusing to delete %.1f%% of indexed products, the limit is %.1f%%, use --max-delete to raise it", plan.DeletedPercent(), opts.MaxDelete)
+		}
+
+		if opts.DryRun {
+			return
+		}
+
+		r, f = open()
+		report, err = im.Sync(context.Background(), r, plan)
+		f.Close()
+		if err != nil {
+			log.Fatalf("failed to sync %s with %s: %s", cfg.Elasticsearch.Index, path, err)
+		}
+	} else {
+		r, f := open()
+		report, err = im.Import(context.Background(), r)
+		f.Close()
+		if err != nil {
+			log.Fatalf("failed to import %s into %s: %s", path, cfg.Elasticsearch.Index, err)
+		}
+	}
+
+	printReport(os.Stdout, report)
+
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// printPlan writes the summary of changes to be made by a sync
+func printPlan(w io.Writer, p catalog.Plan) {
+	fmt.Fprintf(w, "snapshot:  %d records, %d invalid\n", p.Records, p.Failed)
+	fmt.Fprintf(w, "index:     %d products\n", p.Indexed)
+	fmt.Fprintf(w, "create:    %d\n", p.Created)
+	fmt.Fprintf(w, "update:    %d\n", p.Updated)
+	fmt.Fprintf(w, "unchanged: %d\n", p.Unchanged)
+	fmt.Fprintf(w, "delete:    %d (%.1f%% of the index)\n", len(p.Deleted), p.DeletedPercent())
+
+	for i, id := range p.Deleted {
+		if i == maxListedDeletions {
+			fmt.Fprintf(w, "  ... and %d more\n", len(p.Deleted)-i)
+			break
+		}
+
+		fmt.Fprintf(w, "  %s\n", id)
+	}
+
+	printFailures(w, "invalid records", p.Failed, p.Failures)
+}
+
+// printReport writes the summary of an import or a sync
+func printReport(w io.Writer, r catalog.Report) {
+	fmt.Fprintf(w, "indexed: %d\n", r.Indexed)
+	fmt.Fprintf(w, "deleted: %d\n", r.Deleted)
+	fmt.Fprintf(w, "failed:  %d\n", r.Failed)
+
+	printFailures(w, "failures", r.Failed, r.Failures)
+}
+
+func printFailures(w io.Writer, title string, n int, failures []catalog.Failure) {
+	if n == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, f := range failures {
+		fmt.Fprintf(w, "  %s\n", f)
+	}
+
+	if n > len(failures) {
+		fmt.Fprintf(w, "  ... and %d more\n", n-len(failures))
+	}
+}
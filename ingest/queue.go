@@ -0,0 +1,420 @@
+// Package ingest implements a durable queue of document writes that are flushed to Elasticsearch
+// in the background
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// ResultQueued is the write result reported for operations accepted by the queue
+const ResultQueued = "queued"
+
+const (
+	logFile        = "queue.log"
+	offsetFile     = "queue.offset"
+	deadLetterFile = "dead-letter.log"
+)
+
+// compactThreshold is the size the log is allowed to grow to before it's truncated once all
+// entries have been flushed
+const compactThreshold = 64 << 20
+
+// ErrClosed is returned on attempt to enqueue a write after the queue has been closed
+var ErrClosed = errors.New("ingest queue is closed")
+
+// ErrConditionalWrite is returned on attempt to enqueue a write expecting a document revision. Since queued
+// writes are acknowledged before they are sent to Elasticsearch, a conflict could not be reported to the client
+var ErrConditionalWrite = errors.New("conditional writes can't be queued")
+
+var (
+	queueDepth = metrics.NewGaugeVec(
+		"search_service_ingest_queue_depth",
+		"Number of queued writes waiting to be flushed to Elasticsearch.",
+	)
+	queueLag = metrics.NewGaugeVec(
+		"search_service_ingest_lag_seconds",
+		"Time the oldest queued write has been waiting to be flushed to Elasticsearch.",
+	)
+	queueItems = metrics.NewCounterVec(
+		"search_service_ingest_items_total",
+		"Total number of queued writes by flush result.",
+		"result",
+	)
+)
+
+func init() {
+	metrics.Default.MustRegister(queueDepth, queueLag, queueItems)
+}
+
+type bulkWriter interface {
+	Bulk(ctx context.Context, ops []storage.BulkOperation) ([]storage.BulkResult, error)
+}
+
+// Settings configure flushing of queued writes
+type Settings struct {
+	// MaxBatchSize is the maximum size of documents flushed in a single bulk request in bytes
+	MaxBatchSize int
+	// MaxBatchDocuments is the maximum number of writes flushed in a single bulk request
+	MaxBatchDocuments int
+	// MinBackoff is the delay before the first retry of a failed flush
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum delay between retries, the delay doubles with each attempt until it's reached
+	MaxBackoff time.Duration
+}
+
+// entry is a queued write as stored in the log
+type entry struct {
+	Time        time.Time       `json:"time"`
+	Action      string          `json:"action"`
+	ID          string          `json:"id"`
+	Doc         json.RawMessage `json:"doc,omitempty"`
+	SeqNo       int64           `json:"if_seq_no,omitempty"`
+	PrimaryTerm int64           `json:"if_primary_term,omitempty"`
+}
+
+func (e entry) operation() storage.BulkOperation {
+	return storage.BulkOperation{
+		Action:   e.Action,
+		ID:       e.ID,
+		Doc:      e.Doc,
+		Revision: storage.Revision{SeqNo: e.SeqNo, PrimaryTerm: e.PrimaryTerm},
+	}
+}
+
+// Queue is a write-ahead log of document writes. Writes are appended to a file and acknowledged once
+// they are synced to disk, while a background worker sends them to Elasticsearch in bulk requests.
+// Writes that have not been flushed are replayed after a restart, so each write is delivered at least once
+type Queue struct {
+	st       bulkWriter
+	settings Settings
+	dir      string
+
+	mu     sync.Mutex
+	log    *os.File
+	size   int64 // offset of the end of the last complete entry
+	depth  int
+	closed bool
+
+	offset     int64 // offset of the first entry that has not been flushed, only accessed by the worker
+	deadLetter *os.File
+
+	notify  chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Open opens the queue stored in dir and starts flushing writes to st, including the ones left over
+// from the previous run. The directory is created if it does not exist
+func Open(dir string, st bulkWriter, s Settings) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %s", err)
+	}
+
+	offset, err := readOffset(filepath.Join(dir, offsetFile))
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open queue log: %s", err)
+	}
+
+	fi, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("failed to open queue log: %s", err)
+	}
+
+	// the log is truncated before the offset is reset during compaction
+	if offset > fi.Size() {
+		offset = 0
+	}
+
+	size, depth, err := recoverLog(wal, offset, fi.Size())
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	deadLetter, err := os.OpenFile(filepath.Join(dir, deadLetterFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("failed to open dead letter file: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		st:         st,
+		settings:   s,
+		dir:        dir,
+		log:        wal,
+		size:       size,
+		depth:      depth,
+		offset:     offset,
+		deadLetter: deadLetter,
+		notify:     make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	queueDepth.With().Set(float64(depth))
+
+	go q.run()
+
+	return q, nil
+}
+
+// Enqueue appends writes to the log and returns once they are synced to disk. All operations
+// are expected to have IDs. It returns ErrConditionalWrite if any of operations expects a revision
+func (q *Queue) Enqueue(ops []storage.BulkOperation) error {
+	for _, op := range ops {
+		if !op.Revision.IsZero() {
+			return ErrConditionalWrite
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+
+	now := time.Now()
+	for _, op := range ops {
+		if err := enc.Encode(entry{
+			Time:        now,
+			Action:      op.Action,
+			ID:          op.ID,
+			Doc:         op.Doc,
+			SeqNo:       op.Revision.SeqNo,
+			PrimaryTerm: op.Revision.PrimaryTerm,
+		}); err != nil {
+			return fmt.Errorf("failed to encode %s operation: %s", op.Action, err)
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	if _, err := q.log.Write(buf.Bytes()); err != nil {
+		q.log.Truncate(q.size)
+		return fmt.Errorf("failed to append to queue log: %s", err)
+	}
+
+	if err := q.log.Sync(); err != nil {
+		q.log.Truncate(q.size)
+		return fmt.Errorf("failed to sync queue log: %s", err)
+	}
+
+	q.size += int64(buf.Len())
+	q.depth += len(ops)
+	queueDepth.With().Set(float64(q.depth))
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Create queues the document to be indexed under a newly generated ID
+func (q *Queue) Create(ctx context.Context, doc json.RawMessage) (storage.WriteResult, error) {
+	return q.write(storage.BulkOperation{Action: storage.BulkIndex, ID: newID(), Doc: doc})
+}
+
+// Replace queues the document to be indexed under given ID
+func (q *Queue) Replace(ctx context.Context, id string, doc json.RawMessage, rev storage.Revision) (storage.WriteResult, error) {
+	return q.write(storage.BulkOperation{Action: storage.BulkIndex, ID: id, Doc: doc, Revision: rev})
+}
+
+// Update queues the partial document to be merged into the existing one with given ID
+func (q *Queue) Update(ctx context.Context, id string, partial json.RawMessage, rev storage.Revision) (storage.WriteResult, error) {
+	return q.write(storage.BulkOperation{Action: storage.BulkUpdate, ID: id, Doc: partial, Revision: rev})
+}
+
+// Delete queues removal of the document with given ID
+func (q *Queue) Delete(ctx context.Context, id string, rev storage.Revision) (storage.WriteResult, error) {
+	return q.write(storage.BulkOperation{Action: storage.BulkDelete, ID: id, Revision: rev})
+}
+
+// Bulk queues operations assigning IDs to the ones that do not have it. All operations are reported
+// as accepted with HTTP 202
+func (q *Queue) Bulk(ctx context.Context, ops []storage.BulkOperation) ([]storage.BulkResult, error) {
+	ops = append([]storage.BulkOperation(nil), ops...)
+	for i := range ops {
+		if ops[i].ID == "" {
+			ops[i].ID = newID()
+		}
+	}
+
+	if err := q.Enqueue(ops); err != nil {
+		return nil, err
+	}
+
+	results := make([]storage.BulkResult, len(ops))
+	for i, op := range ops {
+		results[i] = storage.BulkResult{
+			WriteResult: storage.WriteResult{ID: op.ID, Result: ResultQueued},
+			Status:      202,
+		}
+	}
+
+	return results, nil
+}
+
+func (q *Queue) write(op storage.BulkOperation) (storage.WriteResult, error) {
+	if err := q.Enqueue([]storage.BulkOperation{op}); err != nil {
+		return storage.WriteResult{}, err
+	}
+
+	return storage.WriteResult{ID: op.ID, Result: ResultQueued}, nil
+}
+
+// Depth returns the number of writes waiting to be flushed
+func (q *Queue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.depth
+}
+
+// Close stops the worker and closes the queue files. Writes that have not been flushed yet remain
+// in the log to be replayed once the queue is opened again
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mu.Unlock()
+
+	close(q.closing)
+	q.cancel()
+	<-q.done
+
+	if err := q.deadLetter.Close(); err != nil {
+		q.log.Close()
+		return fmt.Errorf("failed to close dead letter file: %s", err)
+	}
+
+	if err := q.log.Close(); err != nil {
+		return fmt.Errorf("failed to close queue log: %s", err)
+	}
+
+	return nil
+}
+
+// recoverLog truncates the incomplete entry left at the end of the log by a crash and returns
+// the log size along with the number of entries following the offset
+func recoverLog(f *os.File, offset, fileSize int64) (int64, int, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("failed to read queue log: %s", err)
+	}
+
+	var (
+		size  = offset
+		depth int
+	)
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read queue log: %s", err)
+		}
+
+		size += int64(len(line))
+		depth++
+	}
+
+	if fileSize > size {
+		if err := f.Truncate(size); err != nil {
+			return 0, 0, fmt.Errorf("failed to truncate incomplete queue log entry: %s", err)
+		}
+	}
+
+	return size, depth, nil
+}
+
+// readOffset reads the offset of the first pending entry. A missing file means that nothing has been flushed yet
+func readOffset(path string) (int64, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to read queue offset: %s", err)
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("malformed queue offset %q", b)
+	}
+
+	return offset, nil
+}
+
+// writeOffset atomically replaces the offset file
+func writeOffset(path string, offset int64) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// newID generates a random document ID similar to the ones assigned by Elasticsearch. IDs are assigned
+// before writes are queued, so that replaying a write does not create a duplicate document
+func newID() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,364 @@
+package ingest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/ingest"
+	"github.com/andrewslotin/es-search-service/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSettings = ingest.Settings{
+	MaxBatchSize:      1 << 20,
+	MaxBatchDocuments: 100,
+	MinBackoff:        time.Millisecond,
+	MaxBackoff:        10 * time.Millisecond,
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := &bulkWriterMock{}
+	q, err := ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	ctx := context.Background()
+
+	res, err := q.Create(ctx, json.RawMessage(`{"title": "AirMax"}`))
+	require.NoError(t, err)
+	assert.NotEmpty(t, res.ID)
+	assert.Equal(t, ingest.ResultQueued, res.Result)
+
+	_, err = q.Update(ctx, "abc", json.RawMessage(`{"price": 1500}`), storage.Revision{})
+	require.NoError(t, err)
+
+	_, err = q.Delete(ctx, "def", storage.Revision{})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(st.Operations()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, []storage.BulkOperation{
+		{Action: storage.BulkIndex, ID: res.ID, Doc: json.RawMessage(`{"title":"AirMax"}`)},
+		{Action: storage.BulkUpdate, ID: "abc", Doc: json.RawMessage(`{"price":1500}`)},
+		{Action: storage.BulkDelete, ID: "def"},
+	}, st.Operations())
+
+	assert.Eventually(t, func() bool {
+		return q.Depth() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueue_Bulk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := &bulkWriterMock{}
+	q, err := ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	results, err := q.Bulk(context.Background(), []storage.BulkOperation{
+		{Action: storage.BulkIndex, Doc: json.RawMessage(`{"title": "AirMax"}`)},
+		{Action: storage.BulkDelete, ID: "abc"},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	assert.NotEmpty(t, results[0].ID)
+	assert.Equal(t, "abc", results[1].ID)
+	for _, res := range results {
+		assert.Equal(t, http.StatusAccepted, res.Status)
+		assert.Equal(t, ingest.ResultQueued, res.Result)
+	}
+
+	assert.Eventually(t, func() bool {
+		return len(st.Operations()) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueue_Retry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := &bulkWriterMock{
+		Failures: 2,
+		Statuses: map[string][]int{"abc": {http.StatusTooManyRequests, http.StatusServiceUnavailable}},
+	}
+	q, err := ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	_, err = q.Delete(context.Background(), "abc", storage.Revision{})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return q.Depth() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// 2 failed requests + 2 retriable item errors + 1 successful attempt
+	assert.Equal(t, 5, st.Calls())
+	assert.Len(t, st.Operations(), 1)
+}
+
+func TestQueue_Retry_Order(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := &bulkWriterMock{
+		Statuses: map[string][]int{"abc": {http.StatusTooManyRequests}},
+	}
+	q, err := ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	_, err = q.Bulk(context.Background(), []storage.BulkOperation{
+		{Action: storage.BulkIndex, ID: "abc", Doc: json.RawMessage(`{"title": "AirMax"}`)},
+		{Action: storage.BulkDelete, ID: "def"},
+		{Action: storage.BulkUpdate, ID: "abc", Doc: json.RawMessage(`{"price": 1500}`)},
+	})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return q.Depth() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the update is not sent until the retried write is flushed
+	assert.Equal(t, []storage.BulkOperation{
+		{Action: storage.BulkDelete, ID: "def"},
+		{Action: storage.BulkIndex, ID: "abc", Doc: json.RawMessage(`{"title":"AirMax"}`)},
+		{Action: storage.BulkUpdate, ID: "abc", Doc: json.RawMessage(`{"price":1500}`)},
+	}, st.Operations())
+}
+
+func TestQueue_Retry_WriteBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := &bulkWriterMock{
+		Statuses: map[string][]int{"abc": {http.StatusForbidden, http.StatusForbidden}},
+		Reasons: map[int]string{
+			http.StatusForbidden: "cluster_block_exception: index [products_v1] blocked by: [FORBIDDEN/8/index write (api)];",
+		},
+	}
+	q, err := ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	_, err = q.Replace(context.Background(), "abc", json.RawMessage(`{"title": "AirMax"}`), storage.Revision{})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return q.Depth() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// writes to an index being reindexed are retried instead of being dead lettered
+	assert.Equal(t, 3, st.Calls())
+	assert.Len(t, st.Operations(), 1)
+}
+
+func TestQueue_ConditionalWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := &bulkWriterMock{}
+	q, err := ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	rev := storage.Revision{SeqNo: 1, PrimaryTerm: 1}
+
+	_, err = q.Replace(context.Background(), "abc", json.RawMessage(`{"title": "AirMax"}`), rev)
+	assert.Equal(t, ingest.ErrConditionalWrite, err)
+
+	_, err = q.Update(context.Background(), "abc", json.RawMessage(`{"price": 1500}`), rev)
+	assert.Equal(t, ingest.ErrConditionalWrite, err)
+
+	_, err = q.Delete(context.Background(), "abc", rev)
+	assert.Equal(t, ingest.ErrConditionalWrite, err)
+
+	// a conflict at flush time could not be reported to the client, so nothing is queued
+	assert.Equal(t, 0, q.Depth())
+}
+
+func TestQueue_DeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a conditional write queued by a version that used to accept them
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(dir, "queue.log"),
+		[]byte(`{"time":"2019-10-01T00:00:00Z","action":"index","id":"abc","doc":{"title": "AirMax"},"if_seq_no":1,"if_primary_term":1}`+"\n"),
+		0600,
+	))
+
+	st := &bulkWriterMock{
+		Statuses: map[string][]int{"abc": {http.StatusConflict}},
+	}
+	q, err := ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+
+	_, err = q.Replace(context.Background(), "def", json.RawMessage(`{"title": "Superstar"}`), storage.Revision{})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return q.Depth() == 0
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, q.Close())
+
+	assert.Len(t, st.Operations(), 1)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dead-letter.log"))
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 1)
+
+	var dl struct {
+		Action string          `json:"action"`
+		ID     string          `json:"id"`
+		Doc    json.RawMessage `json:"doc"`
+		Status int             `json:"status"`
+		Error  string          `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &dl))
+
+	assert.Equal(t, storage.BulkIndex, dl.Action)
+	assert.Equal(t, "abc", dl.ID)
+	assert.JSONEq(t, `{"title": "AirMax"}`, string(dl.Doc))
+	assert.Equal(t, http.StatusConflict, dl.Status)
+	assert.NotEmpty(t, dl.Error)
+}
+
+func TestQueue_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Elasticsearch is unavailable, so writes stay in the log
+	st := &bulkWriterMock{Failures: -1}
+	q, err := ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+
+	_, err = q.Delete(context.Background(), "abc", storage.Revision{})
+	require.NoError(t, err)
+
+	_, err = q.Delete(context.Background(), "def", storage.Revision{})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Close())
+	assert.Equal(t, ingest.ErrClosed, q.Enqueue(nil))
+
+	// simulate a crash in the middle of an append
+	f, err := os.OpenFile(filepath.Join(dir, "queue.log"), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"time":"2019-10-01T00:00:00Z","action":"delete","id":"gh`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	st = &bulkWriterMock{}
+	q, err = ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	assert.Eventually(t, func() bool {
+		return q.Depth() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, []storage.BulkOperation{
+		{Action: storage.BulkDelete, ID: "abc"},
+		{Action: storage.BulkDelete, ID: "def"},
+	}, st.Operations())
+
+	// flushed writes are not replayed again
+	require.NoError(t, q.Close())
+
+	st = &bulkWriterMock{}
+	q, err = ingest.Open(dir, st, testSettings)
+	require.NoError(t, err)
+	defer q.Close()
+
+	assert.Equal(t, 0, q.Depth())
+}
+
+type bulkWriterMock struct {
+	// Failures is the number of bulk requests to fail, -1 fails all of them
+	Failures int
+	// Statuses are the item statuses to return for a document ID before succeeding
+	Statuses map[string][]int
+	// Reasons are the item errors to return for a status instead of its text
+	Reasons map[int]string
+
+	mu    sync.Mutex
+	calls int
+	ops   []storage.BulkOperation
+}
+
+func (m *bulkWriterMock) Bulk(ctx context.Context, ops []storage.BulkOperation) ([]storage.BulkResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls++
+	if m.Failures != 0 {
+		if m.Failures > 0 {
+			m.Failures--
+		}
+
+		return nil, errors.New("connection refused")
+	}
+
+	results := make([]storage.BulkResult, len(ops))
+	for i, op := range ops {
+		results[i] = storage.BulkResult{WriteResult: storage.WriteResult{ID: op.ID}, Status: http.StatusOK}
+
+		if statuses := m.Statuses[op.ID]; len(statuses) > 0 {
+			results[i].Status, results[i].Error = statuses[0], http.StatusText(statuses[0])
+			if reason, ok := m.Reasons[statuses[0]]; ok {
+				results[i].Error = reason
+			}
+			m.Statuses[op.ID] = statuses[1:]
+
+			continue
+		}
+
+		m.ops = append(m.ops, op)
+	}
+
+	return results, nil
+}
+
+func (m *bulkWriterMock) Calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.calls
+}
+
+func (m *bulkWriterMock) Operations() []storage.BulkOperation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]storage.BulkOperation(nil), m.ops...)
+}
@@ -0,0 +1,243 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// deadLetter is a write that has been rejected by Elasticsearch
+type deadLetter struct {
+	entry
+	FailedAt time.Time `json:"failed_at"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error"`
+	Raw      string    `json:"raw,omitempty"`
+}
+
+// run flushes queued writes to Elasticsearch until the queue is closed
+func (q *Queue) run() {
+	defer close(q.done)
+
+	r, err := os.Open(filepath.Join(q.dir, logFile))
+	if err != nil {
+		log.Printf("failed to open queue log for reading, queued writes will not be flushed: %s", err)
+		return
+	}
+	defer r.Close()
+
+	backoff := q.settings.MinBackoff
+	for {
+		entries, end, n, err := q.read(r)
+		if err != nil {
+			log.Printf("failed to read queue log, retrying in %s: %s", backoff, err)
+			if !q.sleep(backoff) {
+				return
+			}
+			backoff = q.nextBackoff(backoff)
+
+			continue
+		}
+		backoff = q.settings.MinBackoff
+
+		if len(entries) == 0 && end == q.offset {
+			queueLag.With().Set(0)
+
+			select {
+			case <-q.notify:
+				continue
+			case <-q.closing:
+				return
+			}
+		}
+
+		if len(entries) > 0 {
+			queueLag.With().Set(time.Since(entries[0].Time).Seconds())
+			if !q.flush(entries) {
+				return
+			}
+		}
+
+		if err := q.commit(end, n); err != nil {
+			log.Printf("failed to commit queue offset, flushed writes will be replayed after restart: %s", err)
+		}
+	}
+}
+
+// read returns the next batch of pending entries along with the offset following them and the number
+// of log lines consumed. A batch has at most one write per document. Malformed entries are moved to the
+// dead letter file
+func (q *Queue) read(r io.ReaderAt) ([]entry, int64, int, error) {
+	q.mu.Lock()
+	size := q.size
+	q.mu.Unlock()
+
+	var (
+		entries   []entry
+		end       = q.offset
+		n         int
+		batchSize int
+		ids       = make(map[string]bool)
+	)
+
+	br := bufio.NewReader(io.NewSectionReader(r, q.offset, size-q.offset))
+	for len(entries) < q.settings.MaxBatchDocuments {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			q.reject(deadLetter{Error: "malformed queue entry: " + err.Error(), Raw: string(line)})
+			end += int64(len(line))
+			n++
+
+			continue
+		}
+
+		if len(entries) > 0 && batchSize+len(e.Doc) > q.settings.MaxBatchSize {
+			break
+		}
+
+		// writes to the same document are sent in separate batches, so that a retried write can't
+		// overtake the one that follows it in the log
+		if e.ID != "" && ids[e.ID] {
+			break
+		}
+		ids[e.ID] = true
+
+		entries = append(entries, e)
+		end += int64(len(line))
+		n++
+		batchSize += len(e.Doc)
+	}
+
+	return entries, end, n, nil
+}
+
+// flush sends entries to Elasticsearch retrying the failed ones with exponential backoff. Writes rejected
+// with a client error, other than a write block, are moved to the dead letter file. It returns false if the queue has been closed
+// before all entries were flushed
+func (q *Queue) flush(entries []entry) bool {
+	backoff := q.settings.MinBackoff
+	for {
+		ops := make([]storage.BulkOperation, len(entries))
+		for i, e := range entries {
+			ops[i] = e.operation()
+		}
+
+		results, err := q.st.Bulk(q.ctx, ops)
+		if err != nil {
+			queueItems.With("retried").Add(float64(len(entries)))
+			log.Printf("failed to flush %d queued writes, retrying in %s: %s", len(entries), backoff, err)
+		} else {
+			var retry []entry
+			for i, res := range results {
+				switch {
+				case res.Status < http.StatusMultipleChoices,
+					res.Status == http.StatusNotFound && entries[i].Action == storage.BulkDelete:
+					queueItems.With("flushed").Inc()
+				case res.Status == http.StatusTooManyRequests, res.Status >= http.StatusInternalServerError,
+					res.Blocked():
+					queueItems.With("retried").Inc()
+					retry = append(retry, entries[i])
+				default:
+					q.reject(deadLetter{entry: entries[i], Status: res.Status, Error: res.Error})
+				}
+			}
+
+			if len(retry) == 0 {
+				return true
+			}
+			entries = retry
+
+			log.Printf("%d queued writes have been rejected temporarily, retrying in %s", len(entries), backoff)
+		}
+
+		if !q.sleep(backoff) {
+			return false
+		}
+		backoff = q.nextBackoff(backoff)
+	}
+}
+
+// reject appends the write to the dead letter file
+func (q *Queue) reject(dl deadLetter) {
+	queueItems.With("dead_lettered").Inc()
+
+	dl.FailedAt = time.Now()
+	b, err := json.Marshal(dl)
+	if err != nil {
+		log.Printf("failed to encode dead letter for %s %s: %s", dl.Action, dl.ID, err)
+		return
+	}
+
+	if _, err := q.deadLetter.Write(append(b, '\n')); err != nil {
+		log.Printf("failed to write dead letter for %s %s: %s", dl.Action, dl.ID, err)
+		return
+	}
+
+	if err := q.deadLetter.Sync(); err != nil {
+		log.Printf("failed to sync dead letter file: %s", err)
+	}
+}
+
+// commit marks entries up to the offset as flushed. The log is truncated once it's grown over the
+// compaction threshold and there are no pending entries left
+func (q *Queue) commit(offset int64, n int) error {
+	if err := writeOffset(filepath.Join(q.dir, offsetFile), offset); err != nil {
+		return err
+	}
+	q.offset = offset
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.depth -= n
+	queueDepth.With().Set(float64(q.depth))
+
+	if q.offset < q.size || q.size < compactThreshold {
+		return nil
+	}
+
+	if err := q.log.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate queue log: %s", err)
+	}
+	q.size, q.offset = 0, 0
+
+	return writeOffset(filepath.Join(q.dir, offsetFile), 0)
+}
+
+// sleep waits for d and returns false if the queue has been closed in the meantime
+func (q *Queue) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-q.closing:
+		return false
+	}
+}
+
+func (q *Queue) nextBackoff(d time.Duration) time.Duration {
+	if d *= 2; d > q.settings.MaxBackoff {
+		return q.settings.MaxBackoff
+	}
+
+	return d
+}
@@ -2,102 +2,416 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/andrewslotin/es-search-service/authz"
+	"github.com/andrewslotin/es-search-service/breaker"
+	"github.com/andrewslotin/es-search-service/config"
+	"github.com/andrewslotin/es-search-service/idempotency"
+	"github.com/andrewslotin/es-search-service/ingest"
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/metrics"
+	"github.com/andrewslotin/es-search-service/ratelimit"
+	"github.com/andrewslotin/es-search-service/reindex"
 	"github.com/andrewslotin/es-search-service/storage"
+	"github.com/andrewslotin/es-search-service/tlsutil"
+	"github.com/andrewslotin/es-search-service/tracing"
 	"github.com/andrewslotin/es-search-service/web"
-
-	elasticsearch "github.com/elastic/go-elasticsearch/v7"
 )
 
-const defaultListenAddr = ":8080"
+const (
+	serviceName = "es-search-service"
 
-var args struct {
-	NodesList   string
-	ConnTimeout time.Duration
-	ListenAddr  string
-}
+	certReloadInterval    = 10 * time.Second
+	configReloadInterval  = 10 * time.Second
+	mappingReloadInterval = 10 * time.Second
+)
 
 func main() {
-	if timeout := os.Getenv("ELASTICSEARCH_CONN_TIMEOUT"); timeout != "" {
-		dur, err := time.ParseDuration(timeout)
-		if err != nil {
-			log.Fatalf("invalid elasticsearch cluster connection timeout value: %s", timeout)
-		}
+	// flags are bound to a copy of defaults to show them in usage, the actual values are applied by config.Load()
+	defaults := config.Default()
+
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON configuration file, overrides CONFIG_FILE=")
+	config.BindFlags(flag.CommandLine, &defaults)
+	flag.Usage = usage
 
-		args.ConnTimeout = dur
+	// the service is started unless a command is given as the first argument
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	flag.StringVar(&args.NodesList, "nodes", os.Getenv("ELASTICSEARCH_NODES"), "Comma-separated list of Elasticsearch cluster nodes, overrides ELASTICSEARCH_NODES=")
-	flag.DurationVar(&args.ConnTimeout, "timeout", args.ConnTimeout, "Elastisearch cluster connection timeout, overrides ELASTICSEARCH_CONN_TIMEOUT=")
-	flag.StringVar(&args.ListenAddr, "l", os.Getenv("LISTEN_ADDR"), "Host and port to listen on, overrides LISTEN_ADDR=")
-	flag.Parse()
+	var importOpts *importOptions
+	if command == "import" {
+		importOpts = bindImportFlags(flag.CommandLine)
+	}
+	flag.CommandLine.Parse(args)
 
-	nodes := strings.Split(args.NodesList, ",")
-	if len(nodes) == 0 {
-		log.Fatal("there were no elasticsearch nodes provided, did you forget to populate ELASTICSEARCH_NODES=?")
+	cfg, err := config.Load(*configFile, os.Getenv, flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if args.ListenAddr == "" {
-		log.Printf("no LISTEN_ADDR= provided, falling back to %s", defaultListenAddr)
-		args.ListenAddr = defaultListenAddr
+	switch command {
+	case "serve":
+	case "migrate":
+		migrate(cfg)
+		return
+	case "reindex":
+		reindexProducts(cfg)
+		return
+	case "import":
+		importCatalog(cfg, *importOpts, flag.CommandLine.Args())
+		return
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "unknown command %q\n", command)
+		usage()
+		os.Exit(2)
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), args.ConnTimeout)
-	c, err := DialElasticsearch(ctx, nodes)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Elasticsearch.ConnTimeout))
+	clusters, err := connectClusters(ctx, cfg.Elasticsearch)
+	cancel()
 	if err != nil {
 		log.Fatalf("failed to connect to elasticsearch cluster: %s", err)
 	}
 
-	http.Handle("/v1/products", web.AuthMiddleware(web.SearchHandler(storage.New(c))))
-	http.Handle("/", web.IndexHandler(http.MethodGet, "/v1/products"))
+	stop := make(chan struct{})
 
-	log.Printf("starting up search service on %s", args.ListenAddr)
-	if err := http.ListenAndServe(args.ListenAddr, nil); err != nil {
-		log.Fatalf("failed to listen on %s: %s", args.ListenAddr, err)
+	// searches are routed even if there is only one cluster, so that its name is always reported
+	members := make([]storage.Cluster, len(clusters))
+	for i, cl := range clusters {
+		members[i] = storage.Cluster{Name: cl.Name, Priority: cl.Priority, Storage: clusterStorage(cl, cfg.Elasticsearch)}
 	}
+
+	router := storage.NewRouter(members, cfg.Elasticsearch.MinHealthStatus, cfg.Elasticsearch.MaxErrorRate)
+	go router.Watch(time.Duration(cfg.Elasticsearch.HealthCheckInterval), stop)
+
+	var searcher searchStorage = router
+
+	var searchCache *storage.CachedStorage
+	if cfg.Cache.Enabled() {
+		searchCache = storage.WithCache(searcher, int64(cfg.Cache.MaxSize), time.Duration(cfg.Cache.TTL), time.Duration(cfg.Cache.MaxStale))
+		searcher = searchCache
+	}
+
+	// requests are sampled before the cache lookup, so that popular queries are mirrored as well
+	var shadow *storage.ShadowStorage
+	if cfg.Shadow.Enabled() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Elasticsearch.ConnTimeout))
+		cl, err := connectShadow(ctx, cfg.Shadow, cfg.Elasticsearch)
+		cancel()
+		if err != nil {
+			log.Fatalf("failed to configure shadow elasticsearch cluster: %s", err)
+		}
+		clusters = append(clusters, cl)
+
+		index := cfg.Shadow.Index
+		if index == "" {
+			index = cfg.Elasticsearch.Index
+		}
+
+		shadow = storage.WithShadow(searcher, storage.New(cl.Client, index), cfg.Shadow.Settings())
+		go shadow.Report(time.Duration(cfg.Shadow.ReportInterval), stop)
+
+		searcher = shadow
+	}
+	go watchClusters(clusters, time.Duration(cfg.Elasticsearch.HealthCheckInterval), stop)
+
+	readiness := web.NewShutdownGuard(searcher)
+	limiter := ratelimit.NewMemoryLimiter()
+
+	policies := ratelimit.NewPolicyStore(cfg.RateLimitPolicies())
+	classify := principalClassifier(policies)
+
+	rules := authz.NewStore(cfg.AuthzRules())
+	// documents are written to the primary cluster, failover clusters are expected to be replicated from it
+	writer := storage.New(clusters[0].Client, cfg.Elasticsearch.Index)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(cfg.Elasticsearch.ConnTimeout))
+	liveMapping := mapping.NewStore(checkMapping(ctx, writer, cfg.Mapping.AllowDrift))
+	cancel()
+	go watchMapping(writer, liveMapping, mappingReloadInterval, stop)
+
+	productSchema := cfg.ProductSchema()
+
+	var (
+		writes productWriter = writer
+		queue  *ingest.Queue
+	)
+	if cfg.Ingest.Enabled() {
+		if queue, err = ingest.Open(cfg.Ingest.Dir, writer, cfg.IngestSettings()); err != nil {
+			log.Fatalln(err)
+		}
+		writes = queue
+
+		log.Printf("queueing writes in %s, %d writes left from the previous run", cfg.Ingest.Dir, queue.Depth())
+	}
+
+	var idempotencyKeys idempotency.Store
+	if cfg.Idempotency.Enabled() {
+		idempotencyKeys = idempotency.NewMemoryStore(int64(cfg.Idempotency.MaxSize), time.Duration(cfg.Idempotency.TTL))
+	}
+
+	accessLog := newLevelWriter(os.Stdout, config.LogLevelInfo, cfg.Log.Level)
+
+	var (
+		exporter     tracing.Exporter
+		otlpExporter *tracing.OTLPExporter
+	)
+	if cfg.Tracing.OTLPEndpoint != "" {
+		otlpExporter = tracing.NewOTLPExporter(cfg.Tracing.OTLPEndpoint, serviceName)
+		exporter = otlpExporter
+	}
+	tracer := tracing.NewTracer(exporter)
+
+	api := func(route string, h web.SecureHandler) http.Handler {
+		return web.RequestIDMiddleware(web.TracingMiddleware(tracer, route, web.AccessLogMiddleware(accessLog, web.MetricsMiddleware(route, classify, web.AuthMiddleware(web.RateLimitMiddleware(limiter, policies, rules, h))))))
+	}
+
+	// write requires the write scope, replays responses to retried requests and applies the requested refresh policy.
+	// Request bodies larger than maxBodySize are not read unless it's zero
+	write := func(maxBodySize int64, h web.SecureHandler) web.SecureHandler {
+		h = web.RefreshMiddleware(queue != nil, h)
+		if idempotencyKeys != nil {
+			h = web.IdempotencyMiddleware(idempotencyKeys, maxBodySize, h)
+		}
+
+		return web.ScopeMiddleware(authz.ScopeWrite, rules, h)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/products", api("/v1/products", web.Methods(map[string]web.SecureHandler{
+		http.MethodGet:  web.ConsistencyMiddleware(router, time.Duration(cfg.Search.RefreshInterval), rules, web.SearchHandler(searcher, liveMapping, time.Duration(cfg.Search.DefaultTimeout), time.Duration(cfg.Search.MaxTimeout))),
+		http.MethodPost: write(web.MaxDocumentSize, web.CreateHandler(writes, productSchema, "/v1/products/")),
+	})))
+	mux.Handle("/v1/products/_bulk", api("/v1/products/_bulk", web.Methods(map[string]web.SecureHandler{
+		http.MethodPost: write(0, web.BulkHandler(writes, productSchema, cfg.Bulk.MaxBatchSize, cfg.Bulk.MaxBatchDocuments)),
+	})))
+	documents := write(web.MaxDocumentSize, web.DocumentHandler(writes, productSchema, "/v1/products/"))
+	mux.Handle("/v1/products/", api("/v1/products/{id}", web.Methods(map[string]web.SecureHandler{
+		http.MethodGet:    web.GetDocumentHandler(writer, "/v1/products/"),
+		http.MethodPut:    documents,
+		http.MethodPatch:  documents,
+		http.MethodDelete: documents,
+	})))
+	mux.Handle("/metrics", metricsHandler(cfg.Metrics.Auth))
+	if cfg.Admin.Auth != "" && searchCache != nil {
+		mux.Handle("/admin/cache", credentialsMiddleware(cfg.Admin.Auth, web.CachePurgeHandler(searchCache)))
+	}
+	if cfg.Admin.Auth != "" {
+		mux.Handle("/admin/reindex", credentialsMiddleware(cfg.Admin.Auth, web.ReindexHandler(reindex.New(writer, mapping.Products, cfg.ReindexSettings()))))
+	}
+	mux.Handle("/healthz", web.LivenessHandler())
+	mux.Handle("/readyz", web.ReadinessHandler(readiness, cfg.Elasticsearch.MinHealthStatus))
+	mux.Handle("/", web.IndexHandler(http.MethodGet, "/v1/products"))
+
+	srv := &http.Server{
+		Addr:         cfg.Listen.Addr,
+		Handler:      mux,
+		ReadTimeout:  time.Duration(cfg.Listen.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.Listen.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.Listen.IdleTimeout),
+	}
+
+	if tlsCfg := cfg.Listen.TLS; tlsCfg.Cert != "" {
+		srv.TLSConfig, err = serverTLSConfig(tlsCfg.Cert, tlsCfg.Key, tlsCfg.ClientCA, tlsCfg.ClientAuth, stop)
+		if err != nil {
+			log.Fatalf("failed to configure TLS: %s", err)
+		}
+	}
+
+	reloader := &configReloader{
+		File:     *configFile,
+		Flags:    flag.CommandLine,
+		Current:  cfg,
+		Policies: policies,
+		Rules:    rules,
+		Log:      accessLog,
+	}
+	go reloader.Watch(configReloadInterval, stop)
+
+	shutdownComplete := make(chan struct{})
+	go func() {
+		defer close(shutdownComplete)
+		defer close(stop)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		log.Printf("received %s, shutting down", <-sig)
+
+		// report the service as not ready first to let load balancers stop routing new requests to it
+		readiness.Shutdown()
+		time.Sleep(time.Duration(cfg.Listen.ShutdownDelay))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Listen.ShutdownGracePeriod))
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("failed to drain in-flight requests: %s", err)
+		}
+
+		// writes that have not been flushed yet are replayed on the next start
+		if queue != nil {
+			if err := queue.Close(); err != nil {
+				log.Printf("failed to close write queue: %s", err)
+			}
+		}
+
+		if otlpExporter != nil {
+			if err := otlpExporter.Shutdown(ctx); err != nil {
+				log.Printf("failed to flush pending spans: %s", err)
+			}
+		}
+
+		if shadow != nil {
+			shadow.Wait()
+		}
+
+		for _, cl := range clusters {
+			cl.Transport.CloseIdleConnections()
+		}
+	}()
+
+	log.Printf("starting up search service on %s", cfg.Listen.Addr)
+
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+
+	if err != http.ErrServerClosed {
+		log.Fatalf("failed to listen on %s: %s", cfg.Listen.Addr, err)
+	}
+
+	<-shutdownComplete
+	log.Println("search service has been shut down")
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [command] [flags] [file]
+
+Commands:
+  serve    start the service (default)
+  migrate  create the index or update its mappings
+  reindex  copy documents into a new index and move the index alias to it
+  import   index products from a JSONL or CSV snapshot file, see import -h for its flags
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// clusterStorage returns the storage for the cluster guarded with a circuit breaker if it's enabled
+func clusterStorage(cl esCluster, cfg config.Elasticsearch) searchStorage {
+	st := storage.New(cl.Client, cfg.Index)
+	if cfg.CircuitBreaker.FailureThreshold == 0 {
+		return st
+	}
+
+	return storage.WithCircuitBreaker(st, breaker.New(cl.Name, cfg.CircuitBreaker.Settings()))
+}
+
+// searchStorage is the storage used to serve search requests and report readiness
+type searchStorage interface {
+	Search(ctx context.Context, query string, opts storage.SearchOptions) (storage.SearchResults, error)
+	Health(ctx context.Context) (storage.Health, error)
 }
 
-// DialElasticsearch establishes connection with Elasticsearch cluster and ensures that it's
-// up and running. If there is a non-nil context provided, this function will keep retrying to
-// connect to cluster in case of an error until the supplied context is done.
-func DialElasticsearch(ctx context.Context, nodes []string) (*elasticsearch.Client, error) {
-	c, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses: nodes,
-	})
+// productWriter writes product documents either directly to Elasticsearch or via the ingest queue
+type productWriter interface {
+	Create(ctx context.Context, doc json.RawMessage) (storage.WriteResult, error)
+	Replace(ctx context.Context, id string, doc json.RawMessage, rev storage.Revision) (storage.WriteResult, error)
+	Update(ctx context.Context, id string, partial json.RawMessage, rev storage.Revision) (storage.WriteResult, error)
+	Delete(ctx context.Context, id string, rev storage.Revision) (storage.WriteResult, error)
+	Bulk(ctx context.Context, ops []storage.BulkOperation) ([]storage.BulkResult, error)
+}
+
+// serverTLSConfig returns the TLS configuration for the service with certificate being reloaded on
+// file change until stop channel is closed. If clientCA is not empty, the client certificates are
+// verified against it
+func serverTLSConfig(certFile, keyFile, clientCA, clientAuth string, stop <-chan struct{}) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both certificate and private key files are required")
+	}
+
+	reloader, err := tlsutil.NewCertReloader(certFile, keyFile)
 	if err != nil {
 		return nil, err
 	}
+	go reloader.Watch(certReloadInterval, stop)
 
-	_, err = c.Info()
-	if err != nil && ctx == nil {
-		// do not retry if there was no context provided for cancellation/timeout
-		return nil, err
+	cfg := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCA == "" {
+		return cfg, nil
 	}
 
-	// return immediately if connection succeeded
-	if err == nil {
-		return c, nil
+	if cfg.ClientCAs, err = tlsutil.LoadCertPool(clientCA); err != nil {
+		return nil, fmt.Errorf("failed to load client CA bundle: %s", err)
 	}
 
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+	switch clientAuth {
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "required":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q, expected either optional or required", clientAuth)
+	}
 
-	// attempt to reach the cluster each 100ms until success or the context is cancelled
-	for {
-		select {
-		case <-ticker.C:
-			_, err := c.Info()
-			if err == nil {
-				return c, nil
-			}
-		case <-ctx.Done():
-			return nil, ctx.Err()
+	return cfg, nil
+}
+
+// principalClassifier returns a web.PrincipalClassifier that labels requests with the role of
+// the user making them
+func principalClassifier(policies *ratelimit.PolicyStore) web.PrincipalClassifier {
+	return func(req *http.Request) string {
+		user, ok := web.Principal(req)
+		if !ok {
+			return "anonymous"
+		}
+
+		if role, ok := policies.Load().Members[user]; ok {
+			return role
 		}
+
+		return "default"
 	}
 }
+
+// metricsHandler returns the Prometheus metrics handler, optionally protected with
+// credentials provided in user:password format
+func metricsHandler(credentials string) http.Handler {
+	h := metrics.Handler(metrics.Default)
+	if credentials == "" {
+		return h
+	}
+
+	return credentialsMiddleware(credentials, h)
+}
+
+// credentialsMiddleware protects h with credentials provided in user:password format
+func credentialsMiddleware(credentials string, h http.Handler) http.Handler {
+	kv := strings.SplitN(credentials, ":", 2)
+	if len(kv) != 2 {
+		log.Fatal("malformed credentials, expected user:password")
+	}
+
+	return web.CredentialsMiddleware(kv[0], kv[1], h)
+}
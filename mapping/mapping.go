@@ -0,0 +1,268 @@
+// Package mapping defines the settings and mappings of the Elasticsearch indices owned by the service
+// and detects drift between them and the live ones
+package mapping
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// KeywordSubfield is the name of the keyword subfield added to text fields for sorting and aggregations
+const KeywordSubfield = "keyword"
+
+// Field is a field mapping
+type Field struct {
+	// Type is the Elasticsearch field type
+	Type string `json:"type"`
+	// Analyzer is the analyzer of a text field, an empty value means the default one
+	Analyzer string `json:"analyzer,omitempty"`
+	// IgnoreAbove is the maximum length of keyword values to be indexed
+	IgnoreAbove int `json:"ignore_above,omitempty"`
+	// Fielddata enables in-memory fielddata for a text field
+	Fielddata bool `json:"fielddata,omitempty"`
+	// Fields are the multi-fields indexing the same value differently
+	Fields map[string]Field `json:"fields,omitempty"`
+}
+
+// Definition is a versioned definition of index settings and mappings
+type Definition struct {
+	// Version is stored in the mappings metadata to tell which definition the index has been created from
+	Version int
+	// Shards is the number of primary shards
+	Shards int
+	// Properties are the document fields
+	Properties map[string]Field
+}
+
+// Products is the definition of the product index. The version must be increased with every change
+var Products = Definition{
+	Version: 1,
+	Shards:  1,
+	Properties: map[string]Field{
+		"title": textField(),
+		"brand": textField(),
+		"price": {Type: "long"},
+		"stock": {Type: "long"},
+	},
+}
+
+// textField returns a full-text field with the keyword subfield
+func textField() Field {
+	return Field{
+		Type: "text",
+		Fields: map[string]Field{
+			KeywordSubfield: {Type: "keyword", IgnoreAbove: 256},
+		},
+	}
+}
+
+// mappings is the index mappings as stored in Elasticsearch
+type mappings struct {
+	Meta struct {
+		Version int `json:"version"`
+	} `json:"_meta"`
+	Properties map[string]Field `json:"properties"`
+}
+
+// settings is the subset of index settings managed by the service. Elasticsearch reports setting values as strings
+type settings struct {
+	Index struct {
+		Shards string `json:"number_of_shards"`
+	} `json:"index"`
+}
+
+// Index returns the index settings and mappings
+func (d Definition) Index() storage.IndexDefinition {
+	var s settings
+	s.Index.Shards = strconv.Itoa(d.Shards)
+
+	return storage.IndexDefinition{
+		Settings: mustMarshal(s),
+		Mappings: d.Mappings(),
+	}
+}
+
+// Mappings returns the index mappings including the definition version
+func (d Definition) Mappings() json.RawMessage {
+	var m mappings
+	m.Meta.Version, m.Properties = d.Version, d.Properties
+
+	return mustMarshal(m)
+}
+
+// SortField returns the field to sort by the given one. Text fields are sorted by their keyword subfield
+func (d Definition) SortField(name string) string {
+	f, ok := d.Properties[name]
+	if !ok || f.Type != "text" {
+		return name
+	}
+
+	if _, ok := f.Fields[KeywordSubfield]; !ok {
+		return name
+	}
+
+	return name + "." + KeywordSubfield
+}
+
+// Parse returns the definition of the live index. Fields present in the mappings are kept, while the settings
+// not managed by the service are ignored
+func Parse(live storage.IndexDefinition) (Definition, error) {
+	var (
+		m mappings
+		s settings
+	)
+
+	if len(live.Mappings) > 0 {
+		if err := json.Unmarshal(live.Mappings, &m); err != nil {
+			return Definition{}, fmt.Errorf("failed to parse index mappings: %s", err)
+		}
+	}
+
+	if len(live.Settings) > 0 {
+		if err := json.Unmarshal(live.Settings, &s); err != nil {
+			return Definition{}, fmt.Errorf("failed to parse index settings: %s", err)
+		}
+	}
+
+	d := Definition{Version: m.Meta.Version, Properties: m.Properties}
+	if s.Index.Shards != "" {
+		n, err := strconv.Atoi(s.Index.Shards)
+		if err != nil {
+			return Definition{}, fmt.Errorf("failed to parse index settings: malformed number_of_shards %q", s.Index.Shards)
+		}
+		d.Shards = n
+	}
+
+	return d, nil
+}
+
+// Drift is a difference between the definition and the live index
+type Drift struct {
+	// Path is the setting or the field path
+	Path string
+	// Problem describes the difference
+	Problem string
+	// Compatible drift can be fixed by updating the live mappings, otherwise the index needs to be recreated
+	Compatible bool
+}
+
+func (d Drift) String() string {
+	return d.Path + ": " + d.Problem
+}
+
+// Diff compares the live index with the definition and returns the differences sorted by path. Fields present
+// in the live index only are ignored
+func (d Definition) Diff(live storage.IndexDefinition) ([]Drift, error) {
+	ld, err := Parse(live)
+	if err != nil {
+		return nil, err
+	}
+
+	var drift []Drift
+
+	// the number of shards is not reported if the settings were not requested
+	if ld.Shards != 0 && ld.Shards != d.Shards {
+		drift = append(drift, Drift{
+			Path:    "settings.number_of_shards",
+			Problem: fmt.Sprintf("expected %d, got %d", d.Shards, ld.Shards),
+		})
+	}
+
+	switch {
+	case ld.Version < d.Version:
+		drift = append(drift, Drift{
+			Path:       "_meta.version",
+			Problem:    fmt.Sprintf("expected %d, got %d", d.Version, ld.Version),
+			Compatible: true,
+		})
+	case ld.Version > d.Version:
+		drift = append(drift, Drift{
+			Path:    "_meta.version",
+			Problem: fmt.Sprintf("expected %d, got %d, the index has been migrated by a newer version", d.Version, ld.Version),
+		})
+	}
+
+	drift = append(drift, diffFields("properties.", d.Properties, ld.Properties, false)...)
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Path < drift[j].Path })
+
+	return drift, nil
+}
+
+// Compatible returns true if all differences can be fixed by updating the live mappings
+func Compatible(drift []Drift) bool {
+	for _, d := range drift {
+		if !d.Compatible {
+			return false
+		}
+	}
+
+	return true
+}
+
+// diffFields compares expected field mappings with the live ones. New fields can be added to an existing index
+// as well as some mapping parameters can be changed, while changing field types and analyzers requires reindexing.
+// New multi-fields require reindexing as well, since Elasticsearch does not index existing documents into them
+func diffFields(prefix string, expected, live map[string]Field, multi bool) []Drift {
+	var drift []Drift
+	for name, ef := range expected {
+		path := prefix + name
+
+		lf, ok := live[name]
+		if !ok && multi {
+			drift = append(drift, Drift{Path: path, Problem: "missing, existing documents need to be reindexed"})
+			continue
+		}
+
+		if !ok {
+			drift = append(drift, Drift{Path: path, Problem: "missing", Compatible: true})
+			continue
+		}
+
+		if lf.Type == "" {
+			lf.Type = "object"
+		}
+
+		if ef.Type != lf.Type {
+			drift = append(drift, Drift{Path: path, Problem: fmt.Sprintf("expected type %s, got %s", ef.Type, lf.Type)})
+			continue
+		}
+
+		if ef.Analyzer != lf.Analyzer {
+			drift = append(drift, Drift{Path: path, Problem: fmt.Sprintf("expected analyzer %s, got %s", analyzerName(ef.Analyzer), analyzerName(lf.Analyzer))})
+		}
+
+		if ef.IgnoreAbove != lf.IgnoreAbove {
+			drift = append(drift, Drift{Path: path, Problem: fmt.Sprintf("expected ignore_above %d, got %d", ef.IgnoreAbove, lf.IgnoreAbove), Compatible: true})
+		}
+
+		if ef.Fielddata != lf.Fielddata {
+			drift = append(drift, Drift{Path: path, Problem: fmt.Sprintf("expected fielddata %t, got %t", ef.Fielddata, lf.Fielddata), Compatible: true})
+		}
+
+		drift = append(drift, diffFields(path+".fields.", ef.Fields, lf.Fields, true)...)
+	}
+
+	return drift
+}
+
+func analyzerName(s string) string {
+	if s == "" {
+		return "default"
+	}
+
+	return strings.ToLower(s)
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
@@ -0,0 +1,158 @@
+package mapping_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testDefinition = mapping.Definition{
+	Version: 2,
+	Shards:  1,
+	Properties: map[string]mapping.Field{
+		"title": {Type: "text", Fields: map[string]mapping.Field{"keyword": {Type: "keyword", IgnoreAbove: 256}}},
+		"price": {Type: "long"},
+	},
+}
+
+func TestDefinition_Index(t *testing.T) {
+	def := testDefinition.Index()
+
+	assert.JSONEq(t, `{"index": {"number_of_shards": "1"}}`, string(def.Settings))
+	assert.JSONEq(t, `{
+		"_meta": {"version": 2},
+		"properties": {
+			"title": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+			"price": {"type": "long"}
+		}
+	}`, string(def.Mappings))
+
+	// a live index created from the definition does not drift
+	drift, err := testDefinition.Diff(def)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+}
+
+func TestDefinition_Diff(t *testing.T) {
+	testCases := map[string]struct {
+		Settings   string
+		Mappings   string
+		Expected   []string
+		Compatible bool
+	}{
+		"up to date": {
+			Settings: `{"index": {"number_of_shards": "1", "number_of_replicas": "1"}}`,
+			Mappings: `{
+				"_meta": {"version": 2},
+				"properties": {
+					"title": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+					"price": {"type": "long"},
+					"stock": {"type": "long"}
+				}
+			}`,
+			Compatible: true,
+		},
+		"created by dynamic mapping": {
+			Mappings: `{
+				"properties": {
+					"title": {"type": "text", "fielddata": true},
+					"price": {"type": "long"}
+				}
+			}`,
+			Expected: []string{
+				"_meta.version: expected 2, got 0",
+				"properties.title: expected fielddata false, got true",
+				"properties.title.fields.keyword: missing, existing documents need to be reindexed",
+			},
+		},
+		"missing field": {
+			Mappings: `{"_meta": {"version": 1}, "properties": {"title": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}}}}`,
+			Expected: []string{
+				"_meta.version: expected 2, got 1",
+				"properties.price: missing",
+			},
+			Compatible: true,
+		},
+		"changed type": {
+			Mappings: `{
+				"_meta": {"version": 2},
+				"properties": {
+					"title": {"type": "text", "analyzer": "english", "fields": {"keyword": {"type": "text"}}},
+					"price": {"type": "float"}
+				}
+			}`,
+			Expected: []string{
+				"properties.price: expected type long, got float",
+				"properties.title: expected analyzer default, got english",
+				"properties.title.fields.keyword: expected type keyword, got text",
+			},
+		},
+		"changed shards": {
+			Settings: `{"index": {"number_of_shards": "5"}}`,
+			Mappings: `{
+				"_meta": {"version": 2},
+				"properties": {
+					"title": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+					"price": {"type": "long"}
+				}
+			}`,
+			Expected: []string{"settings.number_of_shards: expected 1, got 5"},
+		},
+		"newer version": {
+			Mappings: `{
+				"_meta": {"version": 3},
+				"properties": {
+					"title": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}},
+					"price": {"type": "long"}
+				}
+			}`,
+			Expected: []string{"_meta.version: expected 2, got 3, the index has been migrated by a newer version"},
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			live := storage.IndexDefinition{Mappings: json.RawMessage(testCase.Mappings)}
+			if testCase.Settings != "" {
+				live.Settings = json.RawMessage(testCase.Settings)
+			}
+
+			drift, err := testDefinition.Diff(live)
+			require.NoError(t, err)
+
+			var problems []string
+			for _, d := range drift {
+				problems = append(problems, d.String())
+			}
+
+			assert.Equal(t, testCase.Expected, problems)
+			assert.Equal(t, testCase.Compatible, mapping.Compatible(drift))
+		})
+	}
+}
+
+func TestDefinition_SortField(t *testing.T) {
+	assert.Equal(t, "title.keyword", testDefinition.SortField("title"))
+	assert.Equal(t, "price", testDefinition.SortField("price"))
+	assert.Equal(t, "_score", testDefinition.SortField("_score"))
+}
+
+func TestParse(t *testing.T) {
+	def, err := mapping.Parse(storage.IndexDefinition{
+		Settings: json.RawMessage(`{"index": {"number_of_shards": "3"}}`),
+		Mappings: json.RawMessage(`{"_meta": {"version": 1}, "properties": {"title": {"type": "text"}, "price": {"type": "long"}}}`),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, def.Version)
+	assert.Equal(t, 3, def.Shards)
+	assert.Equal(t, map[string]mapping.Field{"title": {Type: "text"}, "price": {Type: "long"}}, def.Properties)
+
+	// text fields without the keyword subfield are sorted as is
+	assert.Equal(t, "title", def.SortField("title"))
+}
@@ -0,0 +1,157 @@
+package mapping
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+type indexManager interface {
+	Index() string
+	GetIndex(ctx context.Context) (storage.IndexDefinition, error)
+	CreateIndex(ctx context.Context, def storage.IndexDefinition) error
+	PutMapping(ctx context.Context, mappings json.RawMessage) error
+	GetTemplate(ctx context.Context, name string) (storage.IndexDefinition, error)
+	PutTemplate(ctx context.Context, name string, def storage.IndexDefinition) error
+}
+
+// IncompatibleError is returned by Migrate if the live index can't be updated to match the definition
+type IncompatibleError struct {
+	Drift []Drift
+}
+
+func (e *IncompatibleError) Error() string {
+	var problems []string
+	for _, d := range e.Drift {
+		if !d.Compatible {
+			problems = append(problems, d.String())
+		}
+	}
+
+	return "index mappings are incompatible, reindexing is required: " + strings.Join(problems, ", ")
+}
+
+// Result is the outcome of a migration
+type Result struct {
+	// Created is true if the index or the index template has been created
+	Created bool
+	// Updated are the differences that have been fixed
+	Updated []Drift
+}
+
+// Check compares the live index with the definition. If the storage index name is a pattern, the index template
+// is compared instead. It returns storage.ErrIndexNotFound if neither exists
+func Check(ctx context.Context, st indexManager, d Definition) ([]Drift, error) {
+	live, err := get(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Diff(live)
+}
+
+// Live returns the definition of the live index. If the storage index name is a pattern, the definition of
+// the index template is returned instead. It returns storage.ErrIndexNotFound if neither exists
+func Live(ctx context.Context, st indexManager) (Definition, error) {
+	live, err := get(ctx, st)
+	if err != nil {
+		return Definition{}, err
+	}
+
+	return Parse(live)
+}
+
+// Migrate creates the index if it does not exist and updates the mappings of an existing one. It returns
+// IncompatibleError if there are differences that can't be fixed without reindexing. If the storage index name
+// is a pattern, i.e. products-*, an index template named after it is created or replaced instead
+func Migrate(ctx context.Context, st indexManager, d Definition) (Result, error) {
+	if pattern := st.Index(); IsPattern(pattern) {
+		return migrateTemplate(ctx, st, pattern, d)
+	}
+
+	live, err := st.GetIndex(ctx)
+	if err == storage.ErrIndexNotFound {
+		if err := st.CreateIndex(ctx, d.Index()); err != nil {
+			return Result{}, err
+		}
+
+		return Result{Created: true}, nil
+	}
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	drift, err := d.Diff(live)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if !Compatible(drift) {
+		return Result{}, &IncompatibleError{Drift: drift}
+	}
+
+	if len(drift) == 0 {
+		return Result{}, nil
+	}
+
+	if err := st.PutMapping(ctx, d.Mappings()); err != nil {
+		return Result{}, err
+	}
+
+	return Result{Updated: drift}, nil
+}
+
+// migrateTemplate replaces the index template if it's different from the definition. Since templates are
+// only applied to new indices, any difference can be fixed this way
+func migrateTemplate(ctx context.Context, st indexManager, pattern string, d Definition) (Result, error) {
+	name := TemplateName(pattern)
+
+	var res Result
+
+	live, err := st.GetTemplate(ctx, name)
+	switch err {
+	case nil:
+		if res.Updated, err = d.Diff(live); err != nil {
+			return Result{}, err
+		}
+
+		if len(res.Updated) == 0 {
+			return res, nil
+		}
+	case storage.ErrIndexNotFound:
+		res.Created = true
+	default:
+		return Result{}, err
+	}
+
+	def := d.Index()
+	def.IndexPatterns = []string{pattern}
+
+	if err := st.PutTemplate(ctx, name, def); err != nil {
+		return Result{}, err
+	}
+
+	return res, nil
+}
+
+// get returns the live definition of the index or the index template if the index name is a pattern
+func get(ctx context.Context, st indexManager) (storage.IndexDefinition, error) {
+	if pattern := st.Index(); IsPattern(pattern) {
+		return st.GetTemplate(ctx, TemplateName(pattern))
+	}
+
+	return st.GetIndex(ctx)
+}
+
+// IsPattern returns true if the index name contains wildcards
+func IsPattern(index string) bool {
+	return strings.ContainsAny(index, "*?")
+}
+
+// TemplateName returns the name of the index template for the index name pattern
+func TemplateName(pattern string) string {
+	return strings.Trim(strings.NewReplacer("*", "", "?", "").Replace(pattern), "-_.")
+}
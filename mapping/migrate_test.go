@@ -0,0 +1,142 @@
+package mapping_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate_CreateIndex(t *testing.T) {
+	m := &indexManagerMock{Name: "products"}
+
+	res, err := mapping.Migrate(context.Background(), m, testDefinition)
+	require.NoError(t, err)
+
+	assert.True(t, res.Created)
+	require.NotNil(t, m.Live)
+	assert.Equal(t, testDefinition.Index(), *m.Live)
+}
+
+func TestMigrate_UpdateMappings(t *testing.T) {
+	m := &indexManagerMock{
+		Name: "products",
+		Live: &storage.IndexDefinition{
+			Mappings: json.RawMessage(`{"properties": {"title": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}}}}`),
+		},
+	}
+
+	res, err := mapping.Migrate(context.Background(), m, testDefinition)
+	require.NoError(t, err)
+
+	assert.False(t, res.Created)
+	assert.Len(t, res.Updated, 2)
+	assert.JSONEq(t, string(testDefinition.Mappings()), string(m.PutMappings))
+
+	// the index is up to date
+	m.Live.Mappings, m.PutMappings = m.PutMappings, nil
+
+	res, err = mapping.Migrate(context.Background(), m, testDefinition)
+	require.NoError(t, err)
+
+	assert.Equal(t, mapping.Result{}, res)
+	assert.Nil(t, m.PutMappings)
+}
+
+func TestMigrate_Incompatible(t *testing.T) {
+	m := &indexManagerMock{
+		Name: "products",
+		Live: &storage.IndexDefinition{
+			Mappings: json.RawMessage(`{"properties": {"title": {"type": "keyword"}}}`),
+		},
+	}
+
+	_, err := mapping.Migrate(context.Background(), m, testDefinition)
+	require.Error(t, err)
+
+	e, ok := err.(*mapping.IncompatibleError)
+	require.True(t, ok)
+	assert.Len(t, e.Drift, 3)
+	assert.Contains(t, e.Error(), "properties.title: expected type text, got keyword")
+	assert.NotContains(t, e.Error(), "properties.price")
+	assert.Nil(t, m.PutMappings)
+}
+
+func TestMigrate_Template(t *testing.T) {
+	m := &indexManagerMock{Name: "products-*"}
+
+	res, err := mapping.Migrate(context.Background(), m, testDefinition)
+	require.NoError(t, err)
+
+	assert.True(t, res.Created)
+	assert.Equal(t, "products", m.TemplateName)
+	require.NotNil(t, m.Template)
+	assert.Equal(t, []string{"products-*"}, m.Template.IndexPatterns)
+
+	drift, err := mapping.Check(context.Background(), m, testDefinition)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+
+	// templates are replaced even if the changes are incompatible with existing indices
+	m.Template.Mappings = json.RawMessage(`{"properties": {"price": {"type": "float"}}}`)
+
+	res, err = mapping.Migrate(context.Background(), m, testDefinition)
+	require.NoError(t, err)
+
+	assert.False(t, res.Created)
+	assert.NotEmpty(t, res.Updated)
+	assert.JSONEq(t, string(testDefinition.Mappings()), string(m.Template.Mappings))
+}
+
+func TestCheck_IndexNotFound(t *testing.T) {
+	_, err := mapping.Check(context.Background(), &indexManagerMock{Name: "products"}, testDefinition)
+	assert.Equal(t, storage.ErrIndexNotFound, err)
+}
+
+type indexManagerMock struct {
+	Name         string
+	Live         *storage.IndexDefinition
+	PutMappings  json.RawMessage
+	TemplateName string
+	Template     *storage.IndexDefinition
+}
+
+func (m *indexManagerMock) Index() string {
+	return m.Name
+}
+
+func (m *indexManagerMock) GetIndex(ctx context.Context) (storage.IndexDefinition, error) {
+	if m.Live == nil {
+		return storage.IndexDefinition{}, storage.ErrIndexNotFound
+	}
+
+	return *m.Live, nil
+}
+
+func (m *indexManagerMock) CreateIndex(ctx context.Context, def storage.IndexDefinition) error {
+	m.Live = &def
+	return nil
+}
+
+func (m *indexManagerMock) PutMapping(ctx context.Context, mappings json.RawMessage) error {
+	m.PutMappings = mappings
+	return nil
+}
+
+func (m *indexManagerMock) GetTemplate(ctx context.Context, name string) (storage.IndexDefinition, error) {
+	if m.Template == nil || name != m.TemplateName {
+		return storage.IndexDefinition{}, storage.ErrIndexNotFound
+	}
+
+	return *m.Template, nil
+}
+
+func (m *indexManagerMock) PutTemplate(ctx context.Context, name string, def storage.IndexDefinition) error {
+	m.TemplateName, m.Template = name, &def
+	return nil
+}
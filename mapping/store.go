@@ -0,0 +1,32 @@
+package mapping
+
+import "sync/atomic"
+
+// Store holds a definition that can be safely replaced while in use, i.e. the definition of the live index
+// that changes after a migration or a reindex
+type Store struct {
+	v atomic.Value
+}
+
+// NewStore returns a new store holding d
+func NewStore(d Definition) *Store {
+	s := &Store{}
+	s.Store(d)
+
+	return s
+}
+
+// Store replaces the definition
+func (s *Store) Store(d Definition) {
+	s.v.Store(d)
+}
+
+// Load returns current definition
+func (s *Store) Load() Definition {
+	return s.v.Load().(Definition)
+}
+
+// SortField returns the field to sort by the given one according to current definition
+func (s *Store) SortField(name string) string {
+	return s.Load().SortField(name)
+}
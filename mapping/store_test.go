@@ -0,0 +1,20 @@
+package mapping_test
+
+import (
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/mapping"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_SortField(t *testing.T) {
+	s := mapping.NewStore(mapping.Definition{
+		Properties: map[string]mapping.Field{"title": {Type: "text"}},
+	})
+	assert.Equal(t, "title", s.SortField("title"))
+
+	// the keyword subfield has been added by a reindex
+	s.Store(testDefinition)
+	assert.Equal(t, "title.keyword", s.SortField("title"))
+}
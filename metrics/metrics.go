@@ -0,0 +1,337 @@
+// Package metrics implements a minimal set of Prometheus metric types along with
+// the text exposition format handler
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the default histogram buckets suitable for measuring request latency in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector is a metric family that can be exposed via Registry
+type Collector interface {
+	writeTo(w io.Writer)
+}
+
+// Registry is a set of metric families to be exposed
+type Registry struct {
+	mu         sync.RWMutex
+	collectors []Collector
+}
+
+// Default is the registry used by the service components to register their metrics
+var Default = &Registry{}
+
+// MustRegister adds collectors to the registry
+func (r *Registry) MustRegister(cs ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, cs...)
+}
+
+// Write writes all registered metrics to w in Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range r.collectors {
+		c.writeTo(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler returns an http.Handler that serves registry metrics
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// vec is a family of time series sharing the same name and label names
+type vec struct {
+	name, help, typ string
+	labels          []string
+
+	mu     sync.RWMutex
+	series map[string]interface{}
+	values map[string][]string
+	new    func() interface{}
+}
+
+func newVec(name, help, typ string, labels []string, new func() interface{}) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+		new:    new,
+	}
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+
+	if ok {
+		return s
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+
+	s = v.new()
+	v.series[key] = s
+	v.values[key] = append([]string(nil), values...)
+
+	return s
+}
+
+func (v *vec) writeTo(w io.Writer, sample func(w io.Writer, labels string, s interface{})) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, strings.Replace(v.help, "\n", `\n`, -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		sample(w, formatLabels(v.labels, v.values[k]), v.series[k])
+	}
+}
+
+// CounterVec is a family of monotonically increasing counters
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec creates a new family of counters partitioned by given labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, "counter", labels, func() interface{} { return &Counter{} })}
+}
+
+// With returns the counter for the given label values
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values).(*Counter)
+}
+
+func (cv *CounterVec) writeTo(w io.Writer) {
+	cv.vec.writeTo(w, func(w io.Writer, labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, labels, formatFloat(s.(*Counter).Value()))
+	})
+}
+
+// Counter is a metric that can only be increased
+type Counter struct {
+	bits uint64
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by a non-negative value
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// GaugeVec is a family of gauges
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec creates a new family of gauges partitioned by given labels
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, "gauge", labels, func() interface{} { return &Gauge{} })}
+}
+
+// With returns the gauge for the given label values
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return gv.with(values).(*Gauge)
+}
+
+func (gv *GaugeVec) writeTo(w io.Writer) {
+	gv.vec.writeTo(w, func(w io.Writer, labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", gv.name, labels, formatFloat(s.(*Gauge).Value()))
+	})
+}
+
+// Gauge is a metric that can arbitrarily go up and down
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the gauge value
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Inc increments the gauge by 1
+func (g *Gauge) Inc() {
+	addFloat(&g.bits, 1)
+}
+
+// Dec decrements the gauge by 1
+func (g *Gauge) Dec() {
+	addFloat(&g.bits, -1)
+}
+
+// Add adds v to the gauge value
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// HistogramVec is a family of histograms
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogramVec creates a new family of histograms with given upper bucket bounds partitioned by given labels
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &HistogramVec{
+		vec: newVec(name, help, "histogram", labels, func() interface{} {
+			return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		}),
+		buckets: buckets,
+	}
+}
+
+// With returns the histogram for the given label values
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values).(*Histogram)
+}
+
+func (hv *HistogramVec) writeTo(w io.Writer) {
+	hv.vec.writeTo(w, func(w io.Writer, labels string, s interface{}) {
+		h := s.(*Histogram)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, withLabel(labels, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, withLabel(labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, labels, h.count)
+	})
+}
+
+// Histogram samples observations and counts them in configurable buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Observe adds a single observation to the histogram
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		if atomic.CompareAndSwapUint64(bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueReplacer.Replace(values[i]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + value + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
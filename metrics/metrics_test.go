@@ -0,0 +1,75 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	counter := metrics.NewCounterVec("requests_total", "Total requests.", "route", "code")
+	gauge := metrics.NewGaugeVec("in_flight", "In-flight requests.")
+	histogram := metrics.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.5}, "route")
+
+	r := &metrics.Registry{}
+	r.MustRegister(counter, gauge, histogram)
+
+	counter.With("/b", "200").Inc()
+	counter.With("/a", "500").Add(2)
+	counter.With(`/"q"`, "200").Inc()
+
+	gauge.With().Inc()
+	gauge.With().Inc()
+	gauge.With().Dec()
+
+	histogram.With("/a").Observe(0.3)
+	histogram.With("/a").Observe(0.5)
+	histogram.With("/a").Observe(2)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+
+	assert.Equal(t, `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{route="/\"q\"",code="200"} 1
+requests_total{route="/a",code="500"} 2
+requests_total{route="/b",code="200"} 1
+# HELP in_flight In-flight requests.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.5"} 2
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 2.8
+latency_seconds_count{route="/a"} 3
+`, buf.String())
+}
+
+func TestCounterVec_With_WrongLabels(t *testing.T) {
+	counter := metrics.NewCounterVec("requests_total", "Total requests.", "route")
+
+	assert.Panics(t, func() { counter.With("/", "200") })
+}
+
+func TestHandler(t *testing.T) {
+	counter := metrics.NewCounterVec("requests_total", "Total requests.")
+	counter.With().Inc()
+
+	r := &metrics.Registry{}
+	r.MustRegister(counter)
+
+	rec := httptest.NewRecorder()
+	metrics.Handler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+	assert.Contains(t, rec.Body.String(), "requests_total 1\n")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/config"
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// migrate creates the product index or updates its mappings on the primary cluster
+func migrate(cfg config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Elasticsearch.ConnTimeout))
+	defer cancel()
+
+	clusters, err := connectClusters(ctx, cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("failed to connect to elasticsearch cluster: %s", err)
+	}
+
+	st := storage.New(clusters[0].Client, cfg.Elasticsearch.Index)
+
+	res, err := mapping.Migrate(ctx, st, mapping.Products)
+	if err != nil {
+		log.Fatalf("failed to migrate %s: %s", cfg.Elasticsearch.Index, err)
+	}
+
+	kind := "index"
+	if mapping.IsPattern(cfg.Elasticsearch.Index) {
+		kind = "index template " + mapping.TemplateName(cfg.Elasticsearch.Index) + " for"
+	}
+
+	switch {
+	case res.Created:
+		log.Printf("created %s %s, mappings version %d", kind, cfg.Elasticsearch.Index, mapping.Products.Version)
+	case len(res.Updated) > 0:
+		log.Printf("updated %s %s to mappings version %d: %s", kind, cfg.Elasticsearch.Index, mapping.Products.Version, driftSummary(res.Updated))
+	default:
+		log.Printf("%s %s is up to date, mappings version %d", kind, cfg.Elasticsearch.Index, mapping.Products.Version)
+	}
+}
+
+// checkMapping compares the live index mappings with the expected ones and stops the service if they do not
+// match, unless the drift is allowed. A missing index is reported, but does not prevent the service from starting.
+// It returns the live index definition, or the expected one if the live definition can't be read
+func checkMapping(ctx context.Context, st *storage.Storage, allowDrift bool) mapping.Definition {
+	drift, err := mapping.Check(ctx, st, mapping.Products)
+	if err == storage.ErrIndexNotFound {
+		log.Printf("index %s does not exist, run the migrate command to create it", st.Index())
+		return mapping.Products
+	}
+
+	if err != nil {
+		log.Printf("failed to check %s mappings: %s", st.Index(), err)
+		return mapping.Products
+	}
+
+	if len(drift) == 0 {
+		return mapping.Products
+	}
+
+	if !allowDrift {
+		log.Fatalf("%s mappings do not match the expected ones, run the migrate command or start with --allow-mapping-drift: %s", st.Index(), driftSummary(drift))
+	}
+
+	log.Printf("%s mappings do not match the expected ones: %s", st.Index(), driftSummary(drift))
+
+	live, err := mapping.Live(ctx, st)
+	if err != nil {
+		log.Printf("failed to read %s mappings: %s", st.Index(), err)
+		return mapping.Products
+	}
+
+	return live
+}
+
+// watchMapping periodically reads the live index definition into s, so that the changes made by a migration
+// or a reindex are picked up without a restart
+func watchMapping(st *storage.Storage, s *mapping.Store, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			def, err := mapping.Live(ctx, st)
+			cancel()
+
+			switch {
+			case err == storage.ErrIndexNotFound:
+			case err != nil:
+				log.Printf("failed to read %s mappings: %s", st.Index(), err)
+			default:
+				s.Store(def)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func driftSummary(drift []mapping.Drift) string {
+	s := make([]string, len(drift))
+	for i, d := range drift {
+		s[i] = d.String()
+	}
+
+	return strings.Join(s, ", ")
+}
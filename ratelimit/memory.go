@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+type bucket struct {
+	Tokens   float64
+	LastSeen time.Time
+	Day      time.Time
+	Used     int
+}
+
+// MemoryLimiter is an in-process token bucket Limiter. Its state is not shared between
+// service instances
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryLimiter returns a new instance of in-memory limiter
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow consumes a token from the principal bucket and counts the request towards the daily quota
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, p Policy) (Decision, error) {
+	if p.Unlimited() {
+		return Decision{Allowed: true}, nil
+	}
+
+	now := l.now()
+	day := now.UTC().Truncate(24 * time.Hour)
+	burst := float64(p.burst())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{Tokens: burst, LastSeen: now, Day: day}
+		l.buckets[key] = b
+	}
+
+	if p.Rate > 0 {
+		b.Tokens = math.Min(burst, b.Tokens+now.Sub(b.LastSeen).Seconds()*p.Rate)
+	}
+	b.LastSeen = now
+
+	if !b.Day.Equal(day) {
+		b.Day, b.Used = day, 0
+	}
+
+	var d Decision
+	if p.Rate > 0 {
+		d.Limit = int(burst)
+		d.Remaining = int(b.Tokens)
+		d.Reset = time.Duration((burst - b.Tokens) / p.Rate * float64(time.Second))
+	}
+
+	quotaReset := day.Add(24 * time.Hour).Sub(now)
+	if p.DailyQuota > 0 && (p.Rate <= 0 || p.DailyQuota-b.Used < d.Remaining) {
+		d.Limit = p.DailyQuota
+		d.Remaining = p.DailyQuota - b.Used
+		d.Reset = quotaReset
+	}
+
+	switch {
+	case p.DailyQuota > 0 && b.Used >= p.DailyQuota:
+		d.RetryAfter = quotaReset
+	case p.Rate > 0 && b.Tokens < 1:
+		d.RetryAfter = time.Duration((1 - b.Tokens) / p.Rate * float64(time.Second))
+	default:
+		d.Allowed = true
+		b.Used++
+		if p.Rate > 0 {
+			b.Tokens--
+		}
+		d.Remaining--
+	}
+
+	return d, nil
+}
+
+// sweep removes buckets that have been idle for longer than a day, so that
+// the limiter does not grow indefinitely. The caller is expected to hold the lock
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for k, b := range l.buckets {
+		if now.Sub(b.LastSeen) > 24*time.Hour {
+			delete(l.buckets, k)
+		}
+	}
+}
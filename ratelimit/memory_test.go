@@ -0,0 +1,69 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryLimiter_Allow_Rate(t *testing.T) {
+	l := ratelimit.NewMemoryLimiter()
+	p := ratelimit.Policy{Rate: 0.1, Burst: 2}
+
+	for i := 1; i >= 0; i-- {
+		d, err := l.Allow(context.Background(), "user1", p)
+		require.NoError(t, err)
+
+		assert.True(t, d.Allowed)
+		assert.Equal(t, 2, d.Limit)
+		assert.Equal(t, i, d.Remaining)
+	}
+
+	d, err := l.Allow(context.Background(), "user1", p)
+	require.NoError(t, err)
+
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+	assert.InDelta(t, 10*time.Second, d.RetryAfter, float64(time.Second))
+
+	// other principals have their own buckets
+	d, err = l.Allow(context.Background(), "user2", p)
+	require.NoError(t, err)
+	assert.True(t, d.Allowed)
+}
+
+func TestMemoryLimiter_Allow_DailyQuota(t *testing.T) {
+	l := ratelimit.NewMemoryLimiter()
+	p := ratelimit.Policy{Rate: 100, DailyQuota: 2}
+
+	for i := 1; i >= 0; i-- {
+		d, err := l.Allow(context.Background(), "user1", p)
+		require.NoError(t, err)
+
+		assert.True(t, d.Allowed)
+		assert.Equal(t, 2, d.Limit)
+		assert.Equal(t, i, d.Remaining)
+	}
+
+	d, err := l.Allow(context.Background(), "user1", p)
+	require.NoError(t, err)
+
+	assert.False(t, d.Allowed)
+	assert.True(t, d.RetryAfter > 0 && d.RetryAfter <= 24*time.Hour)
+	assert.Equal(t, d.Reset, d.RetryAfter)
+}
+
+func TestMemoryLimiter_Allow_Unlimited(t *testing.T) {
+	l := ratelimit.NewMemoryLimiter()
+
+	for i := 0; i < 100; i++ {
+		d, err := l.Allow(context.Background(), "user1", ratelimit.Policy{})
+		require.NoError(t, err)
+		assert.True(t, d.Allowed)
+	}
+}
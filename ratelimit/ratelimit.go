@@ -0,0 +1,151 @@
+// Package ratelimit implements per-principal request rate limiting and quotas
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Policy defines the limits applied to requests made on behalf of a single principal
+type Policy struct {
+	// Rate is the number of requests per second a principal is allowed to make on average.
+	// A zero or negative value disables rate limiting.
+	Rate float64
+	// Burst is the maximum number of requests that can be made at once. If not set, it defaults
+	// to the rate rounded up
+	Burst int
+	// DailyQuota is the maximum number of requests a principal can make within a UTC day.
+	// A zero value means there is no quota
+	DailyQuota int
+}
+
+// Unlimited returns true if policy does not impose any limits
+func (p Policy) Unlimited() bool {
+	return p.Rate <= 0 && p.DailyQuota <= 0
+}
+
+func (p Policy) burst() int {
+	if p.Burst > 0 {
+		return p.Burst
+	}
+
+	if b := int(p.Rate); float64(b) < p.Rate {
+		return b + 1
+	} else if b > 0 {
+		return b
+	}
+
+	return 1
+}
+
+// ParsePolicy parses a comma-separated list of policy settings, i.e. "rate=10,burst=20,daily=100000"
+func ParsePolicy(s string) (Policy, error) {
+	var p Policy
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("malformed rate limit setting %q, expected key=value", field)
+		}
+
+		var err error
+		switch key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); key {
+		case "rate":
+			p.Rate, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			p.Burst, err = strconv.Atoi(value)
+		case "daily":
+			p.DailyQuota, err = strconv.Atoi(value)
+		default:
+			return p, fmt.Errorf("unknown rate limit setting %q", key)
+		}
+
+		if err != nil {
+			return p, fmt.Errorf("malformed rate limit setting %q: %s", field, err)
+		}
+	}
+
+	if p.Rate < 0 || p.Burst < 0 || p.DailyQuota < 0 {
+		return p, fmt.Errorf("rate limit settings must not be negative")
+	}
+
+	return p, nil
+}
+
+// Policies maps principals to the rate limiting policies of their roles
+type Policies struct {
+	// Default is the policy applied to principals without a role or with a role that has no policy
+	Default Policy
+	// Roles is a set of policies by role name
+	Roles map[string]Policy
+	// Members maps principal names to their roles
+	Members map[string]string
+}
+
+// For returns the policy to be applied to the principal
+func (ps Policies) For(principal string) Policy {
+	if role, ok := ps.Members[principal]; ok {
+		if p, ok := ps.Roles[role]; ok {
+			return p
+		}
+	}
+
+	return ps.Default
+}
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	// Allowed is true if the request is permitted
+	Allowed bool
+	// Limit is the maximum number of requests within the current window
+	Limit int
+	// Remaining is the number of requests left within the current window
+	Remaining int
+	// Reset is the time left until the current window is reset
+	Reset time.Duration
+	// RetryAfter is the time to wait before making the next request in case it was not allowed
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether a request made on behalf of a principal identified by key
+// should be permitted according to the policy
+type Limiter interface {
+	Allow(ctx context.Context, key string, p Policy) (Decision, error)
+}
+
+// PolicyStore holds a set of policies that can be safely replaced while in use
+type PolicyStore struct {
+	v atomic.Value
+}
+
+// NewPolicyStore returns a new store holding ps
+func NewPolicyStore(ps Policies) *PolicyStore {
+	s := &PolicyStore{}
+	s.Store(ps)
+
+	return s
+}
+
+// Store replaces the policies
+func (s *PolicyStore) Store(ps Policies) {
+	s.v.Store(ps)
+}
+
+// Load returns current policies
+func (s *PolicyStore) Load() Policies {
+	return s.v.Load().(Policies)
+}
+
+// For returns the policy to be applied to the principal
+func (s *PolicyStore) For(principal string) Policy {
+	return s.Load().For(principal)
+}
@@ -0,0 +1,73 @@
+package ratelimit_test
+
+import (
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicy(t *testing.T) {
+	testCases := map[string]struct {
+		Spec     string
+		Expected ratelimit.Policy
+	}{
+		"empty":      {Spec: "", Expected: ratelimit.Policy{}},
+		"rate":       {Spec: "rate=2.5", Expected: ratelimit.Policy{Rate: 2.5}},
+		"all fields": {Spec: "rate=10, burst=20,daily=1000", Expected: ratelimit.Policy{Rate: 10, Burst: 20, DailyQuota: 1000}},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			p, err := ratelimit.ParsePolicy(testCase.Spec)
+			require.NoError(t, err)
+			assert.Equal(t, testCase.Expected, p)
+		})
+	}
+}
+
+func TestParsePolicy_Malformed(t *testing.T) {
+	for _, spec := range []string{"rate", "rate=abc", "speed=10", "daily=-1"} {
+		t.Run(spec, func(t *testing.T) {
+			_, err := ratelimit.ParsePolicy(spec)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPolicies_For(t *testing.T) {
+	ps := ratelimit.Policies{
+		Default: ratelimit.Policy{Rate: 10},
+		Roles: map[string]ratelimit.Policy{
+			"partner": {Rate: 1},
+		},
+		Members: map[string]string{
+			"user1": "partner",
+			"user2": "unknown",
+		},
+	}
+
+	assert.Equal(t, ratelimit.Policy{Rate: 1}, ps.For("user1"))
+	assert.Equal(t, ratelimit.Policy{Rate: 10}, ps.For("user2"))
+	assert.Equal(t, ratelimit.Policy{Rate: 10}, ps.For("user3"))
+}
+
+func TestPolicyStore(t *testing.T) {
+	s := ratelimit.NewPolicyStore(ratelimit.Policies{
+		Default: ratelimit.Policy{Rate: 10},
+	})
+	assert.Equal(t, ratelimit.Policy{Rate: 10}, s.For("user1"))
+
+	s.Store(ratelimit.Policies{
+		Default: ratelimit.Policy{Rate: 10},
+		Roles: map[string]ratelimit.Policy{
+			"partner": {Rate: 1},
+		},
+		Members: map[string]string{
+			"user1": "partner",
+		},
+	})
+	assert.Equal(t, ratelimit.Policy{Rate: 1}, s.For("user1"))
+}
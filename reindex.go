@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/config"
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/reindex"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// reindexProducts copies product documents into a new index on the primary cluster and moves the
+// index alias to it
+func reindexProducts(cfg config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Elasticsearch.ConnTimeout))
+	clusters, err := connectClusters(ctx, cfg.Elasticsearch)
+	cancel()
+	if err != nil {
+		log.Fatalf("failed to connect to elasticsearch cluster: %s", err)
+	}
+
+	st := storage.New(clusters[0].Client, cfg.Elasticsearch.Index)
+
+	status, err := reindex.New(st, mapping.Products, cfg.ReindexSettings()).Run(context.Background())
+	if err != nil {
+		log.Fatalf("failed to reindex %s: %s", cfg.Elasticsearch.Index, err)
+	}
+
+	log.Printf("reindexed %d documents into %s in %s", status.Copied, status.Target, status.FinishedAt.Sub(status.StartedAt).Round(time.Millisecond))
+}
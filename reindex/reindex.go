@@ -0,0 +1,394 @@
+// Package reindex copies documents into a new versioned index created from the managed mappings and
+// atomically points the read alias to it
+package reindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/metrics"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// Reindex states
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+// ErrRunning is returned on attempt to start a reindex while another one is in progress
+var ErrRunning = errors.New("reindex is already in progress")
+
+var reindexProgress = metrics.NewGaugeVec(
+	"search_service_reindex_progress_ratio",
+	"Share of documents copied by the running reindex.",
+)
+
+func init() {
+	metrics.Default.MustRegister(reindexProgress)
+}
+
+// Settings configure the reindex
+type Settings struct {
+	// Keep is the number of previous versioned indices to keep for rollback
+	Keep int
+	// PollInterval is the interval between reindex progress checks
+	PollInterval time.Duration
+}
+
+// Status is the progress of a reindex
+type Status struct {
+	State  string `json:"state"`
+	Alias  string `json:"alias"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Total is the number of documents to copy
+	Total int `json:"total"`
+	// Copied is the number of documents copied so far
+	Copied int `json:"copied"`
+	// Deleted are the previous indices removed after the alias has been moved
+	Deleted    []string   `json:"deleted,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type indexStore interface {
+	Index() string
+	ResolveAlias(ctx context.Context) ([]string, bool, error)
+	ListIndices(ctx context.Context, pattern string) ([]string, error)
+	CreateNamedIndex(ctx context.Context, name string, def storage.IndexDefinition) error
+	DeleteIndex(ctx context.Context, name string) error
+	StartReindex(ctx context.Context, source, dest string) (string, error)
+	ReindexStatus(ctx context.Context, taskID string) (storage.ReindexProgress, error)
+	CountDocuments(ctx context.Context, index string) (int, error)
+	BlockWrites(ctx context.Context, index string, block bool) error
+	MoveAlias(ctx context.Context, index string, from []string, replaceIndex bool) error
+}
+
+// Reindexer moves the storage index alias to a new index created from the definition
+type Reindexer struct {
+	st       indexStore
+	def      mapping.Definition
+	settings Settings
+
+	mu     sync.Mutex
+	status *Status
+}
+
+// New returns a new Reindexer for the storage index, which is to be an alias
+func New(st indexStore, def mapping.Definition, settings Settings) *Reindexer {
+	return &Reindexer{st: st, def: def, settings: settings}
+}
+
+// Run reindexes the storage index and returns the final status
+func (r *Reindexer) Run(ctx context.Context) (Status, error) {
+	if err := r.begin(); err != nil {
+		return Status{}, err
+	}
+
+	err := r.run(ctx)
+	r.finish(err)
+
+	status, _ := r.Status()
+
+	return status, err
+}
+
+// Start reindexes the storage index in background and returns the initial status. The progress can be
+// tracked with Status
+func (r *Reindexer) Start() (Status, error) {
+	if err := r.begin(); err != nil {
+		return Status{}, err
+	}
+
+	go func() {
+		err := r.run(context.Background())
+		if err != nil {
+			log.Printf("failed to reindex %s: %s", r.st.Index(), err)
+		}
+		r.finish(err)
+	}()
+
+	status, _ := r.Status()
+
+	return status, nil
+}
+
+// Status returns the status of the last reindex. It returns false if there were none
+func (r *Reindexer) Status() (Status, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == nil {
+		return Status{}, false
+	}
+
+	status := *r.status
+	status.Deleted = append([]string(nil), r.status.Deleted...)
+
+	return status, true
+}
+
+func (r *Reindexer) begin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status != nil && r.status.State == StateRunning {
+		return ErrRunning
+	}
+
+	r.status = &Status{
+		State:     StateRunning,
+		Alias:     r.st.Index(),
+		StartedAt: time.Now(),
+	}
+	reindexProgress.With().Set(0)
+
+	return nil
+}
+
+func (r *Reindexer) update(fn func(s *Status)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fn(r.status)
+}
+
+func (r *Reindexer) finish(err error) {
+	now := time.Now()
+	r.update(func(s *Status) {
+		s.State, s.FinishedAt = StateSucceeded, &now
+		if err != nil {
+			s.State, s.Error = StateFailed, err.Error()
+		}
+	})
+}
+
+func (r *Reindexer) run(ctx context.Context) error {
+	alias := r.st.Index()
+	if mapping.IsPattern(alias) {
+		return fmt.Errorf("%s is an index name pattern, expected an alias", alias)
+	}
+
+	indices, isAlias, err := r.st.ResolveAlias(ctx)
+	switch {
+	case err == storage.ErrIndexNotFound:
+	case err != nil:
+		return fmt.Errorf("failed to resolve %s: %s", alias, err)
+	case len(indices) > 1:
+		return fmt.Errorf("%s points to several indices: %s", alias, strings.Join(indices, ", "))
+	}
+
+	var source string
+	if len(indices) > 0 {
+		source = indices[0]
+	}
+
+	versions, err := r.versions(ctx, alias)
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+
+	target := versionedName(alias, next)
+	r.update(func(s *Status) { s.Source, s.Target = source, target })
+
+	if err := r.st.CreateNamedIndex(ctx, target, r.def.Index()); err != nil {
+		return fmt.Errorf("failed to create %s: %s", target, err)
+	}
+	log.Printf("created index %s, mappings version %d", target, r.def.Version)
+
+	if source != "" {
+		// documents written during the copy would not make it to the target index, so the source one is
+		// read-only until the alias is moved. Rejected queued writes are retried and land in the target index
+		if err := r.st.BlockWrites(ctx, source, true); err != nil {
+			r.abort("", target)
+			return fmt.Errorf("failed to block writes to %s: %s", source, err)
+		}
+		log.Printf("blocked writes to %s", source)
+
+		if err := r.copy(ctx, source, target); err != nil {
+			r.abort(source, target)
+			return err
+		}
+	}
+
+	if !isAlias {
+		// a concrete index with the alias name is replaced in the same request, there is nothing to roll back to
+		indices = nil
+	}
+
+	if err := r.st.MoveAlias(ctx, target, indices, source != "" && !isAlias); err != nil {
+		r.abort(source, target)
+		return fmt.Errorf("failed to point %s to %s: %s", alias, target, err)
+	}
+	log.Printf("%s now points to %s", alias, target)
+
+	if source != "" && isAlias {
+		// the previous version is writable again in case the alias is moved back to it
+		r.unblock(context.Background(), source)
+	}
+
+	r.cleanup(ctx, alias, target)
+
+	return nil
+}
+
+// copy copies documents from source to target and verifies that both indices contain the same number of them
+func (r *Reindexer) copy(ctx context.Context, source, target string) error {
+	taskID, err := r.st.StartReindex(ctx, source, target)
+	if err != nil {
+		return fmt.Errorf("failed to start copying documents from %s to %s: %s", source, target, err)
+	}
+	log.Printf("copying documents from %s to %s, task %s", source, target, taskID)
+
+	ticker := time.NewTicker(r.settings.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for task %s to complete: %s", taskID, ctx.Err())
+		}
+
+		progress, err := r.st.ReindexStatus(ctx, taskID)
+		if err != nil {
+			log.Printf("failed to check the progress of task %s: %s", taskID, err)
+			continue
+		}
+
+		r.update(func(s *Status) { s.Total, s.Copied = progress.Total, progress.Copied })
+		if progress.Total > 0 {
+			reindexProgress.With().Set(float64(progress.Copied) / float64(progress.Total))
+		}
+		log.Printf("copied %d of %d documents from %s to %s", progress.Copied, progress.Total, source, target)
+
+		if !progress.Completed {
+			continue
+		}
+
+		if len(progress.Failures) > 0 {
+			return fmt.Errorf("failed to copy documents from %s to %s: %s", source, target, strings.Join(progress.Failures, ", "))
+		}
+
+		break
+	}
+
+	sourceCount, err := r.st.CountDocuments(ctx, source)
+	if err != nil {
+		return fmt.Errorf("failed to count documents in %s: %s", source, err)
+	}
+
+	targetCount, err := r.st.CountDocuments(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to count documents in %s: %s", target, err)
+	}
+
+	if sourceCount != targetCount {
+		return fmt.Errorf("document count mismatch: %d in %s, %d in %s", sourceCount, source, targetCount, target)
+	}
+
+	return nil
+}
+
+// abort lifts the write block from the source index and deletes the target one after a failed reindex.
+// It does not use the reindex context, since it may have been cancelled
+func (r *Reindexer) abort(source, target string) {
+	ctx := context.Background()
+
+	if source != "" {
+		r.unblock(ctx, source)
+	}
+
+	if err := r.st.DeleteIndex(ctx, target); err != nil {
+		log.Printf("failed to delete %s: %s", target, err)
+		return
+	}
+	log.Printf("deleted index %s", target)
+}
+
+func (r *Reindexer) unblock(ctx context.Context, index string) {
+	if err := r.st.BlockWrites(ctx, index, false); err != nil {
+		log.Printf("failed to unblock writes to %s: %s", index, err)
+		return
+	}
+	log.Printf("unblocked writes to %s", index)
+}
+
+// cleanup deletes versioned indices except the target and the configured number of previous ones
+func (r *Reindexer) cleanup(ctx context.Context, alias, target string) {
+	versions, err := r.versions(ctx, alias)
+	if err != nil {
+		log.Printf("failed to list previous versions of %s: %s", alias, err)
+		return
+	}
+
+	var previous []string
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Name != target {
+			previous = append(previous, versions[i].Name)
+		}
+	}
+
+	if len(previous) <= r.settings.Keep {
+		return
+	}
+
+	for _, name := range previous[r.settings.Keep:] {
+		if err := r.st.DeleteIndex(ctx, name); err != nil {
+			log.Printf("failed to delete %s: %s", name, err)
+			continue
+		}
+		log.Printf("deleted index %s", name)
+
+		r.update(func(s *Status) { s.Deleted = append(s.Deleted, name) })
+	}
+}
+
+type version struct {
+	Name    string
+	Version int
+}
+
+// versions returns the versioned indices of the alias sorted by version
+func (r *Reindexer) versions(ctx context.Context, alias string) ([]version, error) {
+	indices, err := r.st.ListIndices(ctx, alias+"_v*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of %s: %s", alias, err)
+	}
+
+	prefix := alias + "_v"
+
+	var versions []version
+	for _, name := range indices {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err != nil || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		versions = append(versions, version{Name: name, Version: n})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	return versions, nil
+}
+
+// versionedName returns the name of the index version n
+func versionedName(alias string, n int) string {
+	return alias + "_v" + strconv.Itoa(n)
+}
@@ -0,0 +1,277 @@
+package reindex_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/reindex"
+	"github.com/andrewslotin/es-search-service/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSettings = reindex.Settings{Keep: 1, PollInterval: 10 * time.Millisecond}
+
+func TestReindexer_Run_ConcreteIndex(t *testing.T) {
+	st := newIndexStoreMock("products")
+	st.Docs["products"] = 3
+
+	status, err := reindex.New(st, mapping.Products, testSettings).Run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, reindex.StateSucceeded, status.State)
+	assert.Equal(t, "products", status.Source)
+	assert.Equal(t, "products_v1", status.Target)
+	assert.Equal(t, 3, status.Total)
+	assert.Equal(t, 3, status.Copied)
+	assert.NotNil(t, status.FinishedAt)
+
+	// the concrete index is replaced with the alias
+	assert.Equal(t, []string{"products_v1"}, st.Indices())
+	assert.Equal(t, "products_v1", st.Alias)
+	assert.Equal(t, 3, st.Docs["products_v1"])
+	assert.Equal(t, mapping.Products.Index(), st.Definitions["products_v1"])
+	assert.Empty(t, st.Blocked)
+}
+
+func TestReindexer_Run_Alias(t *testing.T) {
+	st := newIndexStoreMock("products")
+	st.Docs["products_v1"], st.Docs["products_v2"], st.Docs["products_v10"] = 1, 2, 5
+	st.Alias = "products_v10"
+
+	status, err := reindex.New(st, mapping.Products, testSettings).Run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, reindex.StateSucceeded, status.State)
+	assert.Equal(t, "products_v10", status.Source)
+	assert.Equal(t, "products_v11", status.Target)
+	assert.Equal(t, []string{"products_v2", "products_v1"}, status.Deleted)
+
+	// the previous version is kept for rollback
+	assert.Equal(t, []string{"products_v10", "products_v11"}, st.Indices())
+	assert.Equal(t, "products_v11", st.Alias)
+	assert.Equal(t, 5, st.Docs["products_v11"])
+	assert.Empty(t, st.Blocked)
+}
+
+func TestReindexer_Run_IndexNotFound(t *testing.T) {
+	st := newIndexStoreMock("products")
+
+	status, err := reindex.New(st, mapping.Products, testSettings).Run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, reindex.StateSucceeded, status.State)
+	assert.Empty(t, status.Source)
+	assert.Equal(t, "products_v1", status.Target)
+	assert.Equal(t, "products_v1", st.Alias)
+}
+
+func TestReindexer_Run_CountMismatch(t *testing.T) {
+	st := newIndexStoreMock("products")
+	st.Docs["products_v1"] = 3
+	st.Alias = "products_v1"
+	st.Lost = 1
+
+	status, err := reindex.New(st, mapping.Products, testSettings).Run(context.Background())
+	require.Error(t, err)
+
+	assert.Equal(t, reindex.StateFailed, status.State)
+	assert.Equal(t, "document count mismatch: 3 in products_v1, 2 in products_v2", status.Error)
+
+	// the alias is not moved, the target index is deleted and the source one is writable again
+	assert.Equal(t, "products_v1", st.Alias)
+	assert.Equal(t, []string{"products_v1"}, st.Indices())
+	assert.Empty(t, st.Blocked)
+}
+
+func TestReindexer_Start(t *testing.T) {
+	st := newIndexStoreMock("products")
+	st.Docs["products_v1"] = 3
+	st.Alias = "products_v1"
+	st.Block = make(chan struct{})
+
+	r := reindex.New(st, mapping.Products, testSettings)
+
+	_, ok := r.Status()
+	assert.False(t, ok)
+
+	status, err := r.Start()
+	require.NoError(t, err)
+	assert.Equal(t, reindex.StateRunning, status.State)
+	assert.Equal(t, "products", status.Alias)
+
+	_, err = r.Start()
+	assert.Equal(t, reindex.ErrRunning, err)
+
+	close(st.Block)
+
+	assert.Eventually(t, func() bool {
+		status, _ := r.Status()
+		return status.State == reindex.StateSucceeded
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "products_v2", st.Alias)
+}
+
+// indexStoreMock keeps the number of documents in each index. The reindex task completes on the
+// second status check
+type indexStoreMock struct {
+	Name        string
+	Alias       string
+	Docs        map[string]int
+	Definitions map[string]storage.IndexDefinition
+	// Lost is the number of documents the reindex task fails to copy without reporting failures
+	Lost int
+	// Block delays the start of the reindex task until closed
+	Block chan struct{}
+	// Blocked are the indices writes to which are blocked
+	Blocked map[string]bool
+
+	mu     sync.Mutex
+	checks int
+	task   [2]string
+}
+
+func newIndexStoreMock(name string) *indexStoreMock {
+	return &indexStoreMock{
+		Name:        name,
+		Docs:        make(map[string]int),
+		Definitions: make(map[string]storage.IndexDefinition),
+		Blocked:     make(map[string]bool),
+	}
+}
+
+func (m *indexStoreMock) Indices() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var indices []string
+	for name := range m.Docs {
+		indices = append(indices, name)
+	}
+	sort.Strings(indices)
+
+	return indices
+}
+
+func (m *indexStoreMock) Index() string {
+	return m.Name
+}
+
+func (m *indexStoreMock) ResolveAlias(ctx context.Context) ([]string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Alias != "" {
+		return []string{m.Alias}, true, nil
+	}
+
+	if _, ok := m.Docs[m.Name]; ok {
+		return []string{m.Name}, false, nil
+	}
+
+	return nil, false, storage.ErrIndexNotFound
+}
+
+func (m *indexStoreMock) ListIndices(ctx context.Context, pattern string) ([]string, error) {
+	var indices []string
+	for _, name := range m.Indices() {
+		if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+			indices = append(indices, name)
+		}
+	}
+
+	return indices, nil
+}
+
+func (m *indexStoreMock) CreateNamedIndex(ctx context.Context, name string, def storage.IndexDefinition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Docs[name], m.Definitions[name] = 0, def
+
+	return nil
+}
+
+func (m *indexStoreMock) DeleteIndex(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.Docs, name)
+
+	return nil
+}
+
+func (m *indexStoreMock) StartReindex(ctx context.Context, source, dest string) (string, error) {
+	if m.Block != nil {
+		<-m.Block
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.Blocked[source] {
+		return "", errors.New("writes to " + source + " are not blocked")
+	}
+
+	m.task = [2]string{source, dest}
+
+	return "node:1", nil
+}
+
+func (m *indexStoreMock) ReindexStatus(ctx context.Context, taskID string) (storage.ReindexProgress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.checks++
+
+	total := m.Docs[m.task[0]]
+	if m.checks < 2 {
+		return storage.ReindexProgress{Total: total, Copied: total / 2}, nil
+	}
+
+	m.Docs[m.task[1]] = total - m.Lost
+
+	return storage.ReindexProgress{Total: total, Copied: total, Completed: true}, nil
+}
+
+func (m *indexStoreMock) CountDocuments(ctx context.Context, index string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.Docs[index], nil
+}
+
+func (m *indexStoreMock) MoveAlias(ctx context.Context, index string, from []string, replaceIndex bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if replaceIndex {
+		delete(m.Docs, m.Name)
+		delete(m.Blocked, m.Name)
+	}
+	m.Alias = index
+
+	return nil
+}
+
+func (m *indexStoreMock) BlockWrites(ctx context.Context, index string, block bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !block {
+		delete(m.Blocked, index)
+		return nil
+	}
+
+	m.Blocked[index] = true
+
+	return nil
+}
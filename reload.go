@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/authz"
+	"github.com/andrewslotin/es-search-service/config"
+	"github.com/andrewslotin/es-search-service/ratelimit"
+)
+
+// configReloader re-reads the configuration on SIGHUP or configuration file change and applies
+// settings that can be changed at runtime
+type configReloader struct {
+	File     string
+	Flags    *flag.FlagSet
+	Current  config.Config
+	Policies *ratelimit.PolicyStore
+	Rules    *authz.Store
+	Log      *levelWriter
+}
+
+// Watch reloads the configuration on SIGHUP and checks the configuration file for changes
+// with given interval until stop channel is closed
+func (r *configReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modTime := r.modTime()
+	for {
+		select {
+		case <-hup:
+			log.Println("received SIGHUP, reloading configuration")
+		case <-ticker.C:
+			if r.modTime().Equal(modTime) {
+				continue
+			}
+			log.Printf("%s has been changed, reloading configuration", r.File)
+		case <-stop:
+			return
+		}
+
+		modTime = r.modTime()
+		if err := r.Reload(); err != nil {
+			log.Printf("failed to reload configuration, keeping the current one: %s", err)
+		}
+	}
+}
+
+// Reload loads and validates the configuration and applies the settings that can be changed at runtime
+func (r *configReloader) Reload() error {
+	cfg, err := config.Load(r.File, os.Getenv, r.Flags)
+	if err != nil {
+		return err
+	}
+
+	if config.RequiresRestart(r.Current, cfg) {
+		log.Println("some of the configuration changes require the service to be restarted to take effect")
+	}
+
+	r.Policies.Store(cfg.RateLimitPolicies())
+	r.Rules.Store(cfg.AuthzRules())
+	r.Log.SetLevel(cfg.Log.Level)
+	r.Current = cfg
+
+	log.Println("configuration has been reloaded")
+
+	return nil
+}
+
+func (r *configReloader) modTime() time.Time {
+	if r.File == "" {
+		return time.Time{}
+	}
+
+	fi, err := os.Stat(r.File)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
+
+var logLevels = map[string]int{
+	config.LogLevelDebug: 0,
+	config.LogLevelInfo:  1,
+	config.LogLevelWarn:  2,
+	config.LogLevelError: 3,
+}
+
+// levelWriter is an io.Writer that discards the output if the current log level is above its own
+type levelWriter struct {
+	w     io.Writer
+	level string
+
+	mu      sync.RWMutex
+	enabled bool
+}
+
+func newLevelWriter(w io.Writer, level, current string) *levelWriter {
+	lw := &levelWriter{w: w, level: level}
+	lw.SetLevel(current)
+
+	return lw
+}
+
+// SetLevel changes the current log level
+func (lw *levelWriter) SetLevel(current string) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	lw.enabled = logLevels[lw.level] >= logLevels[current]
+}
+
+func (lw *levelWriter) Write(p []byte) (int, error) {
+	lw.mu.RLock()
+	defer lw.mu.RUnlock()
+
+	if !lw.enabled {
+		return len(p), nil
+	}
+
+	return lw.w.Write(p)
+}
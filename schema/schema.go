@@ -0,0 +1,258 @@
+// Package schema validates JSON documents against a declarative field specification
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Field types
+const (
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+	TypeObject  = "object"
+	TypeArray   = "array"
+)
+
+// Field describes the constraints a document field value must satisfy
+type Field struct {
+	// Type is the JSON type of the value, i.e. string, integer, number, boolean, object or array
+	Type string `yaml:"type"`
+	// Required fields must be present in the document
+	Required bool `yaml:"required"`
+	// Minimum and Maximum limit the range of numeric values
+	Minimum *float64 `yaml:"minimum"`
+	Maximum *float64 `yaml:"maximum"`
+	// MinLength and MaxLength limit the number of characters in string values and items in arrays
+	MinLength *int `yaml:"min_length"`
+	MaxLength *int `yaml:"max_length"`
+	// Fields describe the fields of an object value
+	Fields map[string]Field `yaml:"fields"`
+	// Items describes the items of an array value
+	Items *Field `yaml:"items"`
+}
+
+// Schema describes the fields of a document
+type Schema struct {
+	Fields map[string]Field `yaml:"fields"`
+	// AdditionalFields allows fields not listed in the schema
+	AdditionalFields bool `yaml:"additional_fields"`
+}
+
+// Violation is a mismatch between a document and its schema
+type Violation struct {
+	// Pointer is the JSON pointer to the offending value
+	Pointer string `json:"pointer"`
+	// Message describes the problem
+	Message string `json:"message"`
+}
+
+// Empty returns true if the schema has no fields defined, in this case any document is valid
+func (s Schema) Empty() bool {
+	return len(s.Fields) == 0
+}
+
+// Validate checks the JSON document against the schema and returns all violations found. If partial is true,
+// the document is treated as an update to an existing one, so the fields required at the top level may be missing
+func (s Schema) Validate(doc []byte, partial bool) []Violation {
+	if s.Empty() {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return []Violation{{Pointer: "", Message: "malformed JSON"}}
+	}
+
+	var vs []Violation
+	validateObject(&vs, "", v, s.Fields, s.AdditionalFields, !partial)
+	sort.SliceStable(vs, func(i, j int) bool { return vs[i].Pointer < vs[j].Pointer })
+
+	return vs
+}
+
+func validateObject(vs *[]Violation, ptr string, v interface{}, fields map[string]Field, additional, required bool) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		addViolation(vs, ptr, "must be an object")
+		return
+	}
+
+	for name, value := range obj {
+		f, ok := fields[name]
+		if !ok {
+			if !additional {
+				addViolation(vs, pointer(ptr, name), "unknown field")
+			}
+			continue
+		}
+
+		validateValue(vs, pointer(ptr, name), value, f)
+	}
+
+	if !required {
+		return
+	}
+
+	for name, f := range fields {
+		if _, ok := obj[name]; f.Required && !ok {
+			addViolation(vs, pointer(ptr, name), "is required")
+		}
+	}
+}
+
+func validateValue(vs *[]Violation, ptr string, v interface{}, f Field) {
+	switch f.Type {
+	case TypeString:
+		s, ok := v.(string)
+		if !ok {
+			addViolation(vs, ptr, "must be a string")
+			return
+		}
+		validateLength(vs, ptr, utf8.RuneCountInString(s), f, "characters")
+	case TypeInteger, TypeNumber:
+		n, ok := v.(json.Number)
+		if !ok && f.Type == TypeInteger {
+			addViolation(vs, ptr, "must be an integer")
+			return
+		} else if !ok {
+			addViolation(vs, ptr, "must be a number")
+			return
+		}
+
+		if _, err := n.Int64(); f.Type == TypeInteger && err != nil {
+			addViolation(vs, ptr, "must be an integer")
+			return
+		}
+
+		x, err := n.Float64()
+		if err != nil {
+			addViolation(vs, ptr, "must be a number")
+			return
+		}
+
+		if f.Minimum != nil && x < *f.Minimum {
+			addViolation(vs, ptr, fmt.Sprintf("must be at least %v", *f.Minimum))
+		}
+
+		if f.Maximum != nil && x > *f.Maximum {
+			addViolation(vs, ptr, fmt.Sprintf("must be at most %v", *f.Maximum))
+		}
+	case TypeBoolean:
+		if _, ok := v.(bool); !ok {
+			addViolation(vs, ptr, "must be a boolean")
+		}
+	case TypeObject:
+		// objects without nested fields defined may contain anything
+		validateObject(vs, ptr, v, f.Fields, len(f.Fields) == 0, true)
+	case TypeArray:
+		items, ok := v.([]interface{})
+		if !ok {
+			addViolation(vs, ptr, "must be an array")
+			return
+		}
+		validateLength(vs, ptr, len(items), f, "items")
+
+		if f.Items == nil {
+			return
+		}
+
+		for i, item := range items {
+			validateValue(vs, pointer(ptr, fmt.Sprint(i)), item, *f.Items)
+		}
+	}
+}
+
+func validateLength(vs *[]Violation, ptr string, n int, f Field, unit string) {
+	if f.MinLength != nil && n < *f.MinLength {
+		addViolation(vs, ptr, fmt.Sprintf("must contain at least %d %s", *f.MinLength, unit))
+	}
+
+	if f.MaxLength != nil && n > *f.MaxLength {
+		addViolation(vs, ptr, fmt.Sprintf("must contain at most %d %s", *f.MaxLength, unit))
+	}
+}
+
+func addViolation(vs *[]Violation, ptr, msg string) {
+	*vs = append(*vs, Violation{Pointer: ptr, Message: msg})
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// pointer appends the reference token to the JSON pointer escaping it as defined by RFC 6901
+func pointer(ptr, token string) string {
+	return ptr + "/" + pointerEscaper.Replace(token)
+}
+
+// Check returns an error if the schema definition is invalid
+func (s Schema) Check() error {
+	return checkFields("", s.Fields)
+}
+
+func checkFields(path string, fields map[string]Field) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := checkField(path+name, fields[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkField(path string, f Field) error {
+	switch f.Type {
+	case TypeString, TypeArray:
+		if f.Minimum != nil || f.Maximum != nil {
+			return fmt.Errorf("%s: minimum and maximum are only allowed for numeric fields", path)
+		}
+	case TypeInteger, TypeNumber:
+		if f.MinLength != nil || f.MaxLength != nil {
+			return fmt.Errorf("%s: min_length and max_length are only allowed for string and array fields", path)
+		}
+
+		if f.Minimum != nil && f.Maximum != nil && *f.Minimum > *f.Maximum {
+			return fmt.Errorf("%s: minimum must not exceed maximum", path)
+		}
+	case TypeBoolean, TypeObject:
+		if f.Minimum != nil || f.Maximum != nil || f.MinLength != nil || f.MaxLength != nil {
+			return fmt.Errorf("%s: range constraints are not allowed for %s fields", path, f.Type)
+		}
+	default:
+		return fmt.Errorf("%s: unknown type %q, expected one of string, integer, number, boolean, object or array", path, f.Type)
+	}
+
+	if f.MinLength != nil && f.MaxLength != nil && *f.MinLength > *f.MaxLength {
+		return fmt.Errorf("%s: min_length must not exceed max_length", path)
+	}
+
+	if len(f.Fields) > 0 && f.Type != TypeObject {
+		return fmt.Errorf("%s: nested fields are only allowed for object fields", path)
+	}
+
+	if f.Items != nil {
+		if f.Type != TypeArray {
+			return fmt.Errorf("%s: items are only allowed for array fields", path)
+		}
+
+		if err := checkField(path+"[]", *f.Items); err != nil {
+			return err
+		}
+	}
+
+	return checkFields(path+".", f.Fields)
+}
@@ -0,0 +1,171 @@
+package schema_test
+
+import (
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/schema"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSchema_Validate(t *testing.T) {
+	s := productSchema(t)
+
+	testCases := map[string]struct {
+		Doc      string
+		Partial  bool
+		Expected []schema.Violation
+	}{
+		"valid": {
+			Doc: `{"title": "AirMax", "brand": "Nike", "price": 1000, "rating": 4.5, "available": true, "tags": ["running"], "dimensions": {"weight": 0.3}}`,
+		},
+		"typo": {
+			Doc: `{"title": "AirMax", "prce": "1500"}`,
+			Expected: []schema.Violation{
+				{Pointer: "/prce", Message: "unknown field"},
+				{Pointer: "/price", Message: "is required"},
+			},
+		},
+		"types": {
+			Doc: `{"title": 1, "price": "1500", "rating": "high", "available": "yes", "tags": "running", "dimensions": []}`,
+			Expected: []schema.Violation{
+				{Pointer: "/available", Message: "must be a boolean"},
+				{Pointer: "/dimensions", Message: "must be an object"},
+				{Pointer: "/price", Message: "must be an integer"},
+				{Pointer: "/rating", Message: "must be a number"},
+				{Pointer: "/tags", Message: "must be an array"},
+				{Pointer: "/title", Message: "must be a string"},
+			},
+		},
+		"not an integer": {
+			Doc: `{"title": "AirMax", "price": 10.5}`,
+			Expected: []schema.Violation{
+				{Pointer: "/price", Message: "must be an integer"},
+			},
+		},
+		"ranges and lengths": {
+			Doc: `{"title": "", "price": -1, "rating": 6, "tags": ["a", "b", "c"]}`,
+			Expected: []schema.Violation{
+				{Pointer: "/price", Message: "must be at least 0"},
+				{Pointer: "/rating", Message: "must be at most 5"},
+				{Pointer: "/tags", Message: "must contain at most 2 items"},
+				{Pointer: "/title", Message: "must contain at least 1 characters"},
+			},
+		},
+		"nested": {
+			Doc: `{"title": "AirMax", "price": 1000, "tags": ["running", 42], "dimensions": {"weight": "heavy", "a/b~c": 1}}`,
+			Expected: []schema.Violation{
+				{Pointer: "/dimensions/a~1b~0c", Message: "unknown field"},
+				{Pointer: "/dimensions/weight", Message: "must be a number"},
+				{Pointer: "/tags/1", Message: "must be a string"},
+			},
+		},
+		"partial update": {
+			Doc:     `{"price": 1500}`,
+			Partial: true,
+		},
+		"partial update with violations": {
+			Doc:     `{"prce": 1500}`,
+			Partial: true,
+			Expected: []schema.Violation{
+				{Pointer: "/prce", Message: "unknown field"},
+			},
+		},
+		"not an object": {
+			Doc: `[]`,
+			Expected: []schema.Violation{
+				{Pointer: "", Message: "must be an object"},
+			},
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, testCase.Expected, s.Validate([]byte(testCase.Doc), testCase.Partial))
+		})
+	}
+}
+
+func TestSchema_Validate_Empty(t *testing.T) {
+	assert.Empty(t, schema.Schema{}.Validate([]byte(`{"prce": "1500"}`), false))
+}
+
+func TestSchema_Validate_AdditionalFields(t *testing.T) {
+	s := schema.Schema{
+		Fields:           map[string]schema.Field{"title": {Type: schema.TypeString}},
+		AdditionalFields: true,
+	}
+
+	assert.Empty(t, s.Validate([]byte(`{"title": "AirMax", "color": "red"}`), false))
+}
+
+func TestSchema_Check(t *testing.T) {
+	assert.NoError(t, productSchema(t).Check())
+
+	testCases := map[string]struct {
+		Definition string
+		Expected   string
+	}{
+		"unknown type": {
+			Definition: `fields: {price: {type: money}}`,
+			Expected:   `price: unknown type "money"`,
+		},
+		"range for string": {
+			Definition: `fields: {title: {type: string, minimum: 1}}`,
+			Expected:   "title: minimum and maximum are only allowed for numeric fields",
+		},
+		"invalid range": {
+			Definition: `fields: {price: {type: integer, minimum: 10, maximum: 1}}`,
+			Expected:   "price: minimum must not exceed maximum",
+		},
+		"nested fields for string": {
+			Definition: `fields: {title: {type: string, fields: {a: {type: string}}}}`,
+			Expected:   "title: nested fields are only allowed for object fields",
+		},
+		"invalid nested field": {
+			Definition: `fields: {dimensions: {type: object, fields: {weight: {type: float}}}}`,
+			Expected:   `dimensions.weight: unknown type "float"`,
+		},
+		"invalid items": {
+			Definition: `fields: {tags: {type: array, items: {type: string, min_length: 5, max_length: 1}}}`,
+			Expected:   "tags[]: min_length must not exceed max_length",
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var s schema.Schema
+			if err := yaml.UnmarshalStrict([]byte(testCase.Definition), &s); err != nil {
+				t.Fatal(err)
+			}
+
+			err := s.Check()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), testCase.Expected)
+			}
+		})
+	}
+}
+
+func productSchema(t *testing.T) schema.Schema {
+	var s schema.Schema
+	err := yaml.UnmarshalStrict([]byte(`
+fields:
+  title: {type: string, required: true, min_length: 1, max_length: 200}
+  brand: {type: string}
+  price: {type: integer, required: true, minimum: 0}
+  rating: {type: number, minimum: 0, maximum: 5}
+  available: {type: boolean}
+  tags: {type: array, max_length: 2, items: {type: string}}
+  dimensions:
+    type: object
+    fields:
+      weight: {type: number}
+`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/andrewslotin/es-search-service/breaker"
+)
+
+// GuardedStorage is a Storage that stops sending search requests to Elasticsearch while
+// the circuit breaker is open
+type GuardedStorage struct {
+	backend
+	cb *breaker.Breaker
+}
+
+// WithCircuitBreaker wraps st calls into the circuit breaker
+func WithCircuitBreaker(st backend, cb *breaker.Breaker) *GuardedStorage {
+	return &GuardedStorage{backend: st, cb: cb}
+}
+
+// Search queries the Elasticsearch cluster if the circuit breaker allows it, otherwise it returns
+// *breaker.OpenError. Cancelled requests and rejected queries count as neither failures nor successes
+func (gs *GuardedStorage) Search(ctx context.Context, query string, opts SearchOptions) (SearchResults, error) {
+	var results SearchResults
+
+	err := gs.cb.Do(func() error {
+		var err error
+
+		results, err = gs.backend.Search(ctx, query, opts)
+		if err != nil && (ctx.Err() == context.Canceled || isClientError(err)) {
+			return breaker.Ignore(err)
+		}
+
+		return err
+	})
+
+	return results, err
+}
+
+// Health returns the storage health along with the circuit breaker state
+func (gs *GuardedStorage) Health(ctx context.Context) (Health, error) {
+	h, err := gs.backend.Health(ctx)
+	h.CircuitBreaker = gs.cb.State().String()
+
+	return h, err
+}
+
+// Refresh refreshes the index regardless of the circuit breaker state, since it's not a search request
+func (gs *GuardedStorage) Refresh(ctx context.Context) error {
+	rf, ok := gs.backend.(refresher)
+	if !ok {
+		return errors.New("storage does not support refresh")
+	}
+
+	return rf.Refresh(ctx)
+}
+
+// BreakerState returns the state of the circuit breaker
+func (gs *GuardedStorage) BreakerState() breaker.State {
+	return gs.cb.State()
+}
+
+func isClientError(err error) bool {
+	e, ok := err.(*ResponseError)
+	return ok && e.StatusCode >= http.StatusBadRequest && e.StatusCode < http.StatusInternalServerError
+}
@@ -0,0 +1,86 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/breaker"
+	"github.com/andrewslotin/es-search-service/storage"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardedStorage_Search(t *testing.T) {
+	testCases := map[string]struct {
+		Status        int
+		ExpectedState breaker.State
+	}{
+		"server error":   {Status: http.StatusServiceUnavailable, ExpectedState: breaker.Open},
+		"rejected query": {Status: http.StatusBadRequest, ExpectedState: breaker.Closed},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			node, mux, teardown := setupTS()
+			defer teardown()
+
+			var numRequests int
+			mux.Handle("/_search", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				numRequests++
+				http.Error(w, `{"error": "search_phase_execution_exception"}`, testCase.Status)
+			}))
+
+			c, err := elasticsearch.NewClient(elasticsearch.Config{
+				Addresses: []string{node},
+			})
+			require.NoError(t, err)
+
+			cb := breaker.New("test", breaker.Settings{FailureThreshold: 2, OpenTimeout: time.Minute})
+			st := storage.WithCircuitBreaker(storage.New(c, ""), cb)
+
+			for i := 0; i < 2; i++ {
+				_, err = st.Search(context.Background(), "search term", storage.SearchOptions{})
+				require.IsType(t, &storage.ResponseError{}, err)
+				assert.Equal(t, testCase.Status, err.(*storage.ResponseError).StatusCode)
+			}
+			assert.Equal(t, testCase.ExpectedState, cb.State())
+
+			_, err = st.Search(context.Background(), "search term", storage.SearchOptions{})
+			assert.Error(t, err)
+
+			if testCase.ExpectedState == breaker.Open {
+				assert.IsType(t, &breaker.OpenError{}, err)
+				assert.Equal(t, 2, numRequests)
+			} else {
+				assert.Equal(t, 3, numRequests)
+			}
+		})
+	}
+}
+
+func TestGuardedStorage_Search_Cancelled(t *testing.T) {
+	b := &backendMock{Error: errors.New("connection refused")}
+	cb := breaker.New("test", breaker.Settings{FailureThreshold: 1, OpenTimeout: 10 * time.Millisecond})
+	st := storage.WithCircuitBreaker(b, cb)
+
+	_, err := st.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.Error(t, err)
+	require.Equal(t, breaker.Open, cb.State())
+
+	time.Sleep(20 * time.Millisecond)
+
+	// a probe cancelled by the client does not close the breaker while the cluster is still down
+	b.Error, b.Delay = nil, time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = st.Search(ctx, "search term", storage.SearchOptions{})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, breaker.HalfOpen, cb.State())
+}
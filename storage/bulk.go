@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/tracing"
+
+	esapi "github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// Bulk actions
+const (
+	BulkIndex  = "index"
+	BulkCreate = "create"
+	BulkUpdate = "update"
+	BulkDelete = "delete"
+)
+
+// BulkOperation is a single document write sent within a bulk request
+type BulkOperation struct {
+	// Action is one of BulkIndex, BulkCreate, BulkUpdate or BulkDelete
+	Action string
+	// ID is the document ID. It can be omitted for index and create actions to let Elasticsearch generate one
+	ID string
+	// Doc is the document for index and create actions and the partial document for update
+	Doc json.RawMessage
+	// Revision, if not zero, is the revision the document is expected to be at
+	Revision Revision
+}
+
+// BulkResult is the outcome of a single bulk operation
+type BulkResult struct {
+	WriteResult
+	// Status is the HTTP status code of the operation
+	Status int
+	// Error is the reason the operation has failed
+	Error string
+}
+
+// Blocked returns true if the operation has been rejected because the index is read-only, i.e. while it's
+// being reindexed
+func (r BulkResult) Blocked() bool {
+	return r.Status == http.StatusForbidden && strings.HasPrefix(r.Error, clusterBlockException+":")
+}
+
+// Bulk sends operations to Elasticsearch in a single request and returns their results in the same order.
+// An error is only returned if the request as a whole has failed
+func (st *Storage) Bulk(ctx context.Context, ops []BulkOperation) ([]BulkResult, error) {
+	if st.index == "" {
+		return nil, errNoIndex
+	}
+
+	var body bytes.Buffer
+	for _, op := range ops {
+		if err := writeBulkOperation(&body, op); err != nil {
+			return nil, fmt.Errorf("failed to build bulk request: %s", err)
+		}
+	}
+
+	ctx, span := tracing.StartSpan(ctx, "elasticsearch.bulk", tracing.SpanKindClient)
+	defer span.End()
+
+	span.SetAttribute("db.system", "elasticsearch")
+	span.SetAttribute("db.operation", "bulk")
+	span.SetAttribute("db.elasticsearch.index", st.index)
+	span.SetAttribute("db.elasticsearch.operations", len(ops))
+
+	opts := []func(*esapi.BulkRequest){
+		st.es.Bulk.WithIndex(st.index),
+		st.es.Bulk.WithContext(ctx),
+		st.es.Bulk.WithHeader(requestHeaders(ctx)),
+	}
+
+	if p := RefreshPolicy(ctx); p != "" {
+		opts = append(opts, st.es.Bulk.WithRefresh(p))
+	}
+
+	start := time.Now()
+	resp, err := st.es.Bulk(&body, opts...)
+	esRequestDuration.With("bulk").Observe(time.Since(start).Seconds())
+	if err != nil {
+		esRequestErrors.With("bulk").Inc()
+		span.SetError(err)
+		return nil, fmt.Errorf("failed to send bulk request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.IsError() {
+		esRequestErrors.With("bulk").Inc()
+		err := &ResponseError{StatusCode: resp.StatusCode, Status: resp.Status()}
+		span.SetError(err)
+		return nil, err
+	}
+
+	var bulkResponse struct {
+		Items []map[string]struct {
+			ID      string `json:"_id"`
+			Result  string `json:"result"`
+			Version int64  `json:"_version"`
+			Status  int    `json:"status"`
+			Error   *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&bulkResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse bulk response: %s", err)
+	}
+
+	if len(bulkResponse.Items) != len(ops) {
+		return nil, fmt.Errorf("unexpected number of items in bulk response, expected %d, got %d", len(ops), len(bulkResponse.Items))
+	}
+
+	results := make([]BulkResult, len(ops))
+	for i, item := range bulkResponse.Items {
+		for _, res := range item {
+			results[i] = BulkResult{
+				WriteResult: WriteResult{
+					ID:      res.ID,
+					Result:  res.Result,
+					Version: res.Version,
+				},
+				Status: res.Status,
+			}
+
+			if res.Error != nil {
+				results[i].Error = res.Error.Type + ": " + res.Error.Reason
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// writeBulkOperation appends the action and the source lines of a bulk operation to buf
+func writeBulkOperation(buf *bytes.Buffer, op BulkOperation) error {
+	meta := struct {
+		ID            string `json:"_id,omitempty"`
+		IfSeqNo       *int64 `json:"if_seq_no,omitempty"`
+		IfPrimaryTerm *int64 `json:"if_primary_term,omitempty"`
+	}{ID: op.ID}
+
+	if !op.Revision.IsZero() {
+		meta.IfSeqNo, meta.IfPrimaryTerm = &op.Revision.SeqNo, &op.Revision.PrimaryTerm
+	}
+
+	action, err := json.Marshal(map[string]interface{}{op.Action: meta})
+	if err != nil {
+		return err
+	}
+
+	buf.Write(action)
+	buf.WriteByte('\n')
+
+	switch op.Action {
+	case BulkDelete:
+		return nil
+	case BulkUpdate:
+		buf.WriteString(`{"doc":`)
+		if err := json.Compact(buf, op.Doc); err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+	default:
+		if err := json.Compact(buf, op.Doc); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('\n')
+
+	return nil
+}
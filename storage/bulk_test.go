@@ -0,0 +1,90 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/storage"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElasticsearchStorage_Bulk(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	var path, body string
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		path, body = req.URL.Path, string(b)
+
+		w.Write([]byte(`{
+			"took": 30,
+			"errors": true,
+			"items": [
+				{"index": {"_id": "gen1", "result": "created", "_version": 1, "status": 201}},
+				{"create": {"_id": "abc", "status": 409, "error": {"type": "version_conflict_engine_exception", "reason": "document already exists"}}},
+				{"update": {"_id": "def", "result": "updated", "_version": 3, "status": 200}},
+				{"delete": {"_id": "ghi", "result": "not_found", "_version": 1, "status": 404}}
+			]
+		}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	res, err := storage.New(c, "products").Bulk(context.Background(), []storage.BulkOperation{
+		{Action: storage.BulkIndex, Doc: json.RawMessage(`{"title": "AirMax"}`)},
+		{Action: storage.BulkCreate, ID: "abc", Doc: json.RawMessage(`{"title": "Superstar"}`)},
+		{Action: storage.BulkUpdate, ID: "def", Doc: json.RawMessage(`{"price": 1500}`)},
+		{Action: storage.BulkDelete, ID: "ghi", Revision: storage.Revision{SeqNo: 0, PrimaryTerm: 1}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "/products/_bulk", path)
+	assert.Equal(t, `{"index":{}}
+{"title":"AirMax"}
+{"create":{"_id":"abc"}}
+{"title":"Superstar"}
+{"update":{"_id":"def"}}
+{"doc":{"price":1500}}
+{"delete":{"_id":"ghi","if_seq_no":0,"if_primary_term":1}}
+`, body)
+
+	assert.Equal(t, []storage.BulkResult{
+		{WriteResult: storage.WriteResult{ID: "gen1", Result: "created", Version: 1}, Status: http.StatusCreated},
+		{WriteResult: storage.WriteResult{ID: "abc"}, Status: http.StatusConflict, Error: "version_conflict_engine_exception: document already exists"},
+		{WriteResult: storage.WriteResult{ID: "def", Result: "updated", Version: 3}, Status: http.StatusOK},
+		{WriteResult: storage.WriteResult{ID: "ghi", Result: "not_found", Version: 1}, Status: http.StatusNotFound},
+	}, res)
+}
+
+func TestElasticsearchStorage_Bulk_ErrorResponse(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"error": "illegal_argument_exception"}`, http.StatusBadRequest)
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	_, err = storage.New(c, "products").Bulk(context.Background(), []storage.BulkOperation{
+		{Action: storage.BulkDelete, ID: "abc"},
+	})
+	require.Error(t, err)
+
+	e, ok := err.(*storage.ResponseError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, e.StatusCode)
+}
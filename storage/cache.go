@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/cache"
+	"github.com/andrewslotin/es-search-service/metrics"
+)
+
+// cacheEntryOverhead is the approximate memory used by a cache entry in addition to the documents
+const cacheEntryOverhead = 256
+
+// maxSharedSearchDuration bounds a shared search made without a timeout, since it's not cancelled along
+// with the requests waiting for it
+const maxSharedSearchDuration = 30 * time.Second
+
+var (
+	cacheRequests = metrics.NewCounterVec(
+		"search_service_search_cache_requests_total",
+		"Total number of search cache lookups by result: hit, miss, shared with a concurrent identical request, stale or bypass for consistent reads.",
+		"result",
+	)
+	cacheEvictions = metrics.NewCounterVec(
+		"search_service_search_cache_evictions_total",
+		"Total number of search cache entries evicted to free space.",
+	)
+	cacheSize = metrics.NewGaugeVec(
+		"search_service_search_cache_size_bytes",
+		"Approximate size of the search cache.",
+	)
+)
+
+func init() {
+	metrics.Default.MustRegister(cacheRequests, cacheEvictions, cacheSize)
+}
+
+type backend interface {
+	Search(ctx context.Context, query string, opts SearchOptions) (SearchResults, error)
+	Health(ctx context.Context) (Health, error)
+}
+
+// CachedStorage caches search results of the underlying storage and collapses concurrent
+// identical search requests into one
+type CachedStorage struct {
+	backend
+	cache *cache.LRU
+	group cache.Group
+}
+
+// WithCache wraps st into a cache that keeps up to maxSize bytes of search results for the ttl.
+// If maxStale is positive, expired results are kept for another maxStale to be served in case
+// the underlying storage fails
+func WithCache(st backend, maxSize int64, ttl, maxStale time.Duration) *CachedStorage {
+	cs := &CachedStorage{
+		backend: st,
+		cache:   cache.NewLRU(maxSize, ttl, maxStale),
+	}
+	cs.cache.OnEvict = func(n int) { cacheEvictions.With().Add(float64(n)) }
+
+	return cs
+}
+
+// Search returns cached results for the query if there are any, otherwise it queries the
+// underlying storage and caches the results. Errors and partial results are not cached. If the underlying storage
+// is unavailable, Search returns expired results marked as stale if they are not older than maxStale. Consistent
+// reads always query the underlying storage and replace the cached results
+func (cs *CachedStorage) Search(ctx context.Context, query string, opts SearchOptions) (SearchResults, error) {
+	key := cacheKey(ctx, query, opts)
+
+	if ConsistentRead(ctx) {
+		cacheRequests.With("bypass").Inc()
+
+		results, err := cs.backend.Search(ctx, query, opts)
+		if err == nil && !results.Partial() {
+			cs.cache.Set(key, results, resultsSize(key, results))
+			cacheSize.With().Set(float64(cs.cache.Size()))
+		}
+
+		return results, err
+	}
+
+	if v, ok := cs.cache.Get(key); ok {
+		cacheRequests.With("hit").Inc()
+
+		results := v.(SearchResults)
+		results.Cached = true
+
+		return results, nil
+	}
+
+	// the search is shared with concurrent requests, so it's not cancelled along with the request that started it
+	// and is only bounded by the search timeout instead. Requests with different timeouts are not collapsed
+	groupKey := key + "/" + opts.Timeout.String()
+	v, err, shared := cs.group.Do(groupKey, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, sharedSearchTimeout(opts.Timeout))
+		defer cancel()
+
+		results, err := cs.backend.Search(ctx, query, opts)
+		if err != nil || results.Partial() {
+			return results, err
+		}
+
+		cs.cache.Set(key, results, resultsSize(key, results))
+		cacheSize.With().Set(float64(cs.cache.Size()))
+
+		return results, nil
+	})
+
+	if shared {
+		cacheRequests.With("shared").Inc()
+	} else {
+		cacheRequests.With("miss").Inc()
+	}
+
+	if err != nil && ctx.Err() != context.Canceled && !isClientError(err) {
+		if v, age, ok := cs.cache.GetStale(key); ok {
+			cacheRequests.With("stale").Inc()
+			log.Printf("serving stale search results %s old: %s", age, err)
+
+			results := v.(SearchResults)
+			results.Cached, results.Stale, results.Age = true, true, age
+
+			return results, nil
+		}
+	}
+
+	return v.(SearchResults), err
+}
+
+// sharedSearchTimeout returns the time a shared search is allowed to take. Since Elasticsearch responds with
+// partial results once the search timeout has passed, the response is given twice as much time to arrive
+func sharedSearchTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 || 2*timeout > maxSharedSearchDuration {
+		return maxSharedSearchDuration
+	}
+
+	return 2 * timeout
+}
+
+// Purge removes all cached results and returns the number of removed entries
+func (cs *CachedStorage) Purge() int {
+	n := cs.cache.Purge()
+	cacheSize.With().Set(0)
+
+	return n
+}
+
+// cacheKey returns the cache key for the query made within the security scope stored in ctx.
+// Insignificant whitespace in query and options is ignored
+func cacheKey(ctx context.Context, query string, opts SearchOptions) string {
+	sort := make([]string, len(opts.Sort))
+	for i, s := range opts.Sort {
+		sort[i] = normalizeQuery(s)
+	}
+
+	key, _ := json.Marshal(struct {
+		Scope  string   `json:"scope"`
+		Query  string   `json:"q"`
+		Filter string   `json:"filter"`
+		From   int      `json:"from"`
+		Size   int      `json:"size"`
+		Sort   []string `json:"sort"`
+	}{
+		Scope:  SecurityScope(ctx),
+		Query:  normalizeQuery(query),
+		Filter: normalizeQuery(opts.Filter),
+		From:   opts.From,
+		Size:   opts.Size,
+		Sort:   sort,
+	})
+
+	return string(key)
+}
+
+func normalizeQuery(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func resultsSize(key string, results SearchResults) int64 {
+	size := int64(len(key) + cacheEntryOverhead)
+	for _, doc := range results.Documents {
+		size += int64(len(doc))
+	}
+
+	return size
+}
+
+// detachedContext carries the values of the parent context, but is never cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+type securityScopeKey struct{}
+
+// WithSecurityScope returns a copy of ctx carrying the security scope of the request. Requests
+// made within different scopes may see different documents and never share cached results
+func WithSecurityScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, securityScopeKey{}, scope)
+}
+
+// SecurityScope returns the security scope stored in ctx
+func SecurityScope(ctx context.Context) string {
+	scope, _ := ctx.Value(securityScopeKey{}).(string)
+	return scope
+}
@@ -0,0 +1,250 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedStorage_Search(t *testing.T) {
+	b := &backendMock{
+		Results: storage.SearchResults{
+			Documents: []json.RawMessage{json.RawMessage(`{"key": "value"}`)},
+		},
+	}
+	st := storage.WithCache(b, 1<<20, time.Minute, 0)
+
+	res, err := st.Search(context.Background(), "search  term", storage.SearchOptions{Sort: []string{"a:asc"}})
+	require.NoError(t, err)
+	assert.False(t, res.Cached)
+	assert.Equal(t, b.Results.Documents, res.Documents)
+
+	// insignificant whitespace is ignored
+	res, err = st.Search(context.Background(), " search term ", storage.SearchOptions{Sort: []string{" a:asc"}})
+	require.NoError(t, err)
+	assert.True(t, res.Cached)
+	assert.Equal(t, b.Results.Documents, res.Documents)
+	assert.EqualValues(t, 1, b.Calls)
+
+	// different options
+	_, err = st.Search(context.Background(), "search term", storage.SearchOptions{Sort: []string{"a:desc"}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, b.Calls)
+
+	// different security scope
+	_, err = st.Search(storage.WithSecurityScope(context.Background(), "user1"), "search term", storage.SearchOptions{Sort: []string{"a:asc"}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, b.Calls)
+
+	assert.Equal(t, 3, st.Purge())
+
+	res, err = st.Search(context.Background(), "search term", storage.SearchOptions{Sort: []string{"a:asc"}})
+	require.NoError(t, err)
+	assert.False(t, res.Cached)
+	assert.EqualValues(t, 4, b.Calls)
+}
+
+func TestCachedStorage_Search_ConsistentRead(t *testing.T) {
+	b := &backendMock{
+		Results: storage.SearchResults{
+			Documents: []json.RawMessage{json.RawMessage(`{"key": "value"}`)},
+		},
+	}
+	st := storage.WithCache(b, 1<<20, time.Minute, 0)
+
+	_, err := st.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+
+	b.Results.Documents = []json.RawMessage{json.RawMessage(`{"key": "updated"}`)}
+
+	res, err := st.Search(storage.WithConsistentRead(context.Background()), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.False(t, res.Cached)
+	assert.Equal(t, b.Results.Documents, res.Documents)
+	assert.EqualValues(t, 2, b.Calls)
+
+	// cached results are replaced
+	res, err = st.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.True(t, res.Cached)
+	assert.Equal(t, b.Results.Documents, res.Documents)
+	assert.EqualValues(t, 2, b.Calls)
+}
+
+func TestCachedStorage_Search_Error(t *testing.T) {
+	b := &backendMock{Error: errors.New("connection refused")}
+	st := storage.WithCache(b, 1<<20, time.Minute, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err := st.Search(context.Background(), "search term", storage.SearchOptions{})
+		assert.Error(t, err)
+	}
+
+	// errors are not cached
+	assert.EqualValues(t, 2, b.Calls)
+}
+
+func TestCachedStorage_Search_Partial(t *testing.T) {
+	b := &backendMock{
+		Results: storage.SearchResults{TimedOut: true},
+	}
+	st := storage.WithCache(b, 1<<20, time.Minute, 0)
+
+	for i := 0; i < 2; i++ {
+		res, err := st.Search(context.Background(), "search term", storage.SearchOptions{})
+		require.NoError(t, err)
+		assert.True(t, res.TimedOut)
+	}
+
+	// partial results are not cached
+	assert.EqualValues(t, 2, b.Calls)
+}
+
+func TestCachedStorage_Search_Stale(t *testing.T) {
+	testCases := map[string]struct {
+		Error         error
+		ExpectedStale bool
+	}{
+		"connection error": {Error: errors.New("connection refused"), ExpectedStale: true},
+		"server error":     {Error: &storage.ResponseError{StatusCode: 503, Status: "503 Service Unavailable"}, ExpectedStale: true},
+		"rejected query":   {Error: &storage.ResponseError{StatusCode: 400, Status: "400 Bad Request"}},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b := &backendMock{
+				Results: storage.SearchResults{
+					Documents: []json.RawMessage{json.RawMessage(`{"key": "value"}`)},
+				},
+			}
+			st := storage.WithCache(b, 1<<20, 10*time.Millisecond, time.Minute)
+
+			_, err := st.Search(context.Background(), "search term", storage.SearchOptions{})
+			require.NoError(t, err)
+
+			time.Sleep(20 * time.Millisecond)
+			b.Error = testCase.Error
+
+			res, err := st.Search(context.Background(), "search term", storage.SearchOptions{})
+			if !testCase.ExpectedStale {
+				assert.Equal(t, testCase.Error, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.True(t, res.Stale)
+			assert.True(t, res.Cached)
+			assert.True(t, res.Age >= 20*time.Millisecond, res.Age)
+			assert.Equal(t, b.Results.Documents, res.Documents)
+
+			// another query
+			_, err = st.Search(context.Background(), "another search term", storage.SearchOptions{})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCachedStorage_Search_Concurrent(t *testing.T) {
+	b := &backendMock{Delay: 50 * time.Millisecond}
+	st := storage.WithCache(b, 1<<20, time.Minute, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := st.Search(context.Background(), "search term", storage.SearchOptions{})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 1, b.Calls)
+}
+
+func TestCachedStorage_Search_Concurrent_LeaderCancelled(t *testing.T) {
+	b := &backendMock{
+		Results: storage.SearchResults{
+			Documents: []json.RawMessage{json.RawMessage(`{"key": "value"}`)},
+		},
+		Delay: 50 * time.Millisecond,
+	}
+	st := storage.WithCache(b, 1<<20, time.Minute, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		st.Search(ctx, "search term", storage.SearchOptions{})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	// the waiter is not affected by the cancellation of the request that started the search
+	res, err := st.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, b.Results.Documents, res.Documents)
+	assert.EqualValues(t, 1, b.Calls)
+
+	<-leaderDone
+}
+
+func TestCachedStorage_Search_Concurrent_Deadline(t *testing.T) {
+	b := &backendMock{Delay: time.Minute}
+	st := storage.WithCache(b, 1<<20, time.Minute, 0)
+
+	// the shared search is not cancelled along with the request, but is still bounded by its timeout
+	start := time.Now()
+	_, err := st.Search(context.Background(), "search term", storage.SearchOptions{Timeout: 10 * time.Millisecond})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second, time.Since(start))
+}
+
+type backendMock struct {
+	Results storage.SearchResults
+	Error   error
+	Delay   time.Duration
+	Calls   int32
+	// Refreshes is the number of Refresh calls
+	Refreshes int32
+
+	HealthResult storage.Health
+	HealthError  error
+}
+
+func (m *backendMock) Search(ctx context.Context, query string, opts storage.SearchOptions) (storage.SearchResults, error) {
+	atomic.AddInt32(&m.Calls, 1)
+
+	select {
+	case <-time.After(m.Delay):
+	case <-ctx.Done():
+		return storage.SearchResults{}, ctx.Err()
+	}
+
+	return m.Results, m.Error
+}
+
+func (m *backendMock) Health(ctx context.Context) (storage.Health, error) {
+	return m.HealthResult, m.HealthError
+}
+
+func (m *backendMock) Refresh(ctx context.Context) error {
+	atomic.AddInt32(&m.Refreshes, 1)
+	return nil
+}
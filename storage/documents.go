@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/tracing"
+
+	esapi "github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// ErrNotFound is returned when the document does not exist
+var ErrNotFound = errors.New("document not found")
+
+// ErrConflict is returned when the document has been modified since the expected revision
+var ErrConflict = errors.New("document has been modified")
+
+// ErrIndexBlocked is returned on attempt to write to a read-only index, i.e. while it's being reindexed
+var ErrIndexBlocked = errors.New("index is read-only")
+
+// clusterBlockException is the type of error Elasticsearch rejects writes to a read-only index with
+const clusterBlockException = "cluster_block_exception"
+
+// errNoIndex is returned on attempt to write to a storage that is not bound to an index
+var errNoIndex = errors.New("storage is not bound to an index")
+
+// Revision identifies the state of a document by the sequence number and the primary term of the
+// last operation that has changed it. Since primary terms start from 1, a zero value means any revision
+type Revision struct {
+	SeqNo       int64
+	PrimaryTerm int64
+}
+
+// IsZero returns true if r does not refer to any specific revision
+func (r Revision) IsZero() bool {
+	return r.PrimaryTerm == 0
+}
+
+// Document is a stored document along with its metadata
+type Document struct {
+	// ID is the document ID
+	ID string
+	// Source is the JSON document
+	Source json.RawMessage
+	// Version is the document version
+	Version int64
+	// Revision is the current document revision
+	Revision Revision
+}
+
+// WriteResult is the outcome of a document write operation
+type WriteResult struct {
+	// ID is the document ID
+	ID string
+	// Result is the operation result reported by Elasticsearch, i.e. created, updated, deleted or noop
+	Result string
+	// Version is the document version after the operation
+	Version int64
+	// Revision is the document revision after the operation
+	Revision Revision
+}
+
+// Get returns the document with given ID. It returns ErrNotFound if there is no such document
+func (st *Storage) Get(ctx context.Context, id string) (Document, error) {
+	var result struct {
+		ID          string          `json:"_id"`
+		Version     int64           `json:"_version"`
+		SeqNo       int64           `json:"_seq_no"`
+		PrimaryTerm int64           `json:"_primary_term"`
+		Source      json.RawMessage `json:"_source"`
+	}
+
+	err := st.do(ctx, "get", id, func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Get(
+			st.index,
+			id,
+			st.es.Get.WithContext(ctx),
+			st.es.Get.WithHeader(headers),
+		)
+	}, &result)
+	if err != nil {
+		return Document{}, err
+	}
+
+	return Document{
+		ID:       result.ID,
+		Source:   result.Source,
+		Version:  result.Version,
+		Revision: Revision{SeqNo: result.SeqNo, PrimaryTerm: result.PrimaryTerm},
+	}, nil
+}
+
+// Create adds a new document to the index and returns its generated ID
+func (st *Storage) Create(ctx context.Context, doc json.RawMessage) (WriteResult, error) {
+	return st.write(ctx, "index", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		opts := []func(*esapi.IndexRequest){
+			st.es.Index.WithContext(ctx),
+			st.es.Index.WithHeader(headers),
+		}
+
+		if p := RefreshPolicy(ctx); p != "" {
+			opts = append(opts, st.es.Index.WithRefresh(p))
+		}
+
+		return st.es.Index(st.index, bytes.NewReader(doc), opts...)
+	})
+}
+
+// Replace creates or replaces the document with given ID. If rev is not zero, the document is only
+// replaced if it has not been modified since then, otherwise ErrConflict is returned
+func (st *Storage) Replace(ctx context.Context, id string, doc json.RawMessage, rev Revision) (WriteResult, error) {
+	return st.write(ctx, "index", id, func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		opts := []func(*esapi.IndexRequest){
+			st.es.Index.WithDocumentID(id),
+			st.es.Index.WithContext(ctx),
+			st.es.Index.WithHeader(headers),
+		}
+
+		if p := RefreshPolicy(ctx); p != "" {
+			opts = append(opts, st.es.Index.WithRefresh(p))
+		}
+
+		if !rev.IsZero() {
+			opts = append(opts, st.es.Index.WithIfSeqNo(int(rev.SeqNo)), st.es.Index.WithIfPrimaryTerm(int(rev.PrimaryTerm)))
+		}
+
+		return st.es.Index(st.index, bytes.NewReader(doc), opts...)
+	})
+}
+
+// Update merges the partial document into the existing one with given ID. It returns ErrNotFound
+// if there is no such document and ErrConflict if the document has been modified since rev
+func (st *Storage) Update(ctx context.Context, id string, partial json.RawMessage, rev Revision) (WriteResult, error) {
+	body, err := json.Marshal(struct {
+		Doc json.RawMessage `json:"doc"`
+	}{partial})
+	if err != nil {
+		return WriteResult{}, fmt.Errorf("failed to build update request: %s", err)
+	}
+
+	return st.write(ctx, "update", id, func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		opts := []func(*esapi.UpdateRequest){
+			st.es.Update.WithContext(ctx),
+			st.es.Update.WithHeader(headers),
+		}
+
+		if p := RefreshPolicy(ctx); p != "" {
+			opts = append(opts, st.es.Update.WithRefresh(p))
+		}
+
+		if !rev.IsZero() {
+			opts = append(opts, st.es.Update.WithIfSeqNo(int(rev.SeqNo)), st.es.Update.WithIfPrimaryTerm(int(rev.PrimaryTerm)))
+		}
+
+		return st.es.Update(st.index, id, bytes.NewReader(body), opts...)
+	})
+}
+
+// Delete removes the document with given ID. It returns ErrNotFound if there is no such document
+// and ErrConflict if the document has been modified since rev
+func (st *Storage) Delete(ctx context.Context, id string, rev Revision) (WriteResult, error) {
+	return st.write(ctx, "delete", id, func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		opts := []func(*esapi.DeleteRequest){
+			st.es.Delete.WithContext(ctx),
+			st.es.Delete.WithHeader(headers),
+		}
+
+		if p := RefreshPolicy(ctx); p != "" {
+			opts = append(opts, st.es.Delete.WithRefresh(p))
+		}
+
+		if !rev.IsZero() {
+			opts = append(opts, st.es.Delete.WithIfSeqNo(int(rev.SeqNo)), st.es.Delete.WithIfPrimaryTerm(int(rev.PrimaryTerm)))
+		}
+
+		return st.es.Delete(st.index, id, opts...)
+	})
+}
+
+// write sends a document write request to Elasticsearch and returns the operation result
+func (st *Storage) write(ctx context.Context, operation, id string, send func(context.Context, map[string]string) (*esapi.Response, error)) (WriteResult, error) {
+	var result struct {
+		ID          string `json:"_id"`
+		Result      string `json:"result"`
+		Version     int64  `json:"_version"`
+		SeqNo       int64  `json:"_seq_no"`
+		PrimaryTerm int64  `json:"_primary_term"`
+	}
+	if err := st.do(ctx, operation, id, send, &result); err != nil {
+		return WriteResult{}, err
+	}
+
+	return WriteResult{
+		ID:       result.ID,
+		Result:   result.Result,
+		Version:  result.Version,
+		Revision: Revision{SeqNo: result.SeqNo, PrimaryTerm: result.PrimaryTerm},
+	}, nil
+}
+
+// do sends a document request to Elasticsearch recording the operation metrics and span, and decodes
+// the response into v
+func (st *Storage) do(ctx context.Context, operation, id string, send func(context.Context, map[string]string) (*esapi.Response, error), v interface{}) error {
+	if st.index == "" {
+		return errNoIndex
+	}
+
+	ctx, span := tracing.StartSpan(ctx, "elasticsearch."+operation, tracing.SpanKindClient)
+	defer span.End()
+
+	span.SetAttribute("db.system", "elasticsearch")
+	span.SetAttribute("db.operation", operation)
+	span.SetAttribute("db.elasticsearch.index", st.index)
+	if id != "" {
+		span.SetAttribute("db.elasticsearch.doc_id", id)
+	}
+
+	start := time.Now()
+	resp, err := send(ctx, requestHeaders(ctx))
+	esRequestDuration.With(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		esRequestErrors.With(operation).Inc()
+		span.SetError(err)
+		return fmt.Errorf("failed to send %s request: %s", operation, err)
+	}
+	defer resp.Body.Close()
+
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	}
+
+	if resp.IsError() {
+		esRequestErrors.With(operation).Inc()
+
+		var err error = &ResponseError{StatusCode: resp.StatusCode, Status: resp.Status()}
+		if resp.StatusCode == http.StatusForbidden && errorType(resp.Body) == clusterBlockException {
+			err = ErrIndexBlocked
+		}
+		span.SetError(err)
+
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse %s response: %s", operation, err)
+	}
+
+	return nil
+}
+
+// errorType returns the type of the error from Elasticsearch error response body
+func errorType(body io.Reader) string {
+	var resp struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return ""
+	}
+
+	return resp.Error.Type
+}
@@ -0,0 +1,279 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/storage"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElasticsearchStorage_Write(t *testing.T) {
+	doc := json.RawMessage(`{"title":"AirMax"}`)
+
+	testCases := map[string]struct {
+		Write          func(st *storage.Storage) (storage.WriteResult, error)
+		ExpectedMethod string
+		ExpectedPath   string
+		ExpectedQuery  string
+		ExpectedBody   string
+		Response       string
+		Expected       storage.WriteResult
+	}{
+		"create": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Create(context.Background(), doc)
+			},
+			ExpectedMethod: http.MethodPost,
+			ExpectedPath:   "/products/_doc",
+			ExpectedBody:   `{"title":"AirMax"}`,
+			Response:       `{"_id":"abc","result":"created","_version":1}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "created", Version: 1},
+		},
+		"replace": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Replace(context.Background(), "abc", doc, storage.Revision{})
+			},
+			ExpectedMethod: http.MethodPut,
+			ExpectedPath:   "/products/_doc/abc",
+			ExpectedBody:   `{"title":"AirMax"}`,
+			Response:       `{"_id":"abc","result":"updated","_version":2,"_seq_no":5,"_primary_term":1}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "updated", Version: 2, Revision: storage.Revision{SeqNo: 5, PrimaryTerm: 1}},
+		},
+		"replace if not modified": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Replace(context.Background(), "abc", doc, storage.Revision{SeqNo: 5, PrimaryTerm: 1})
+			},
+			ExpectedMethod: http.MethodPut,
+			ExpectedPath:   "/products/_doc/abc",
+			ExpectedQuery:  "if_primary_term=1&if_seq_no=5",
+			ExpectedBody:   `{"title":"AirMax"}`,
+			Response:       `{"_id":"abc","result":"updated","_version":3,"_seq_no":6,"_primary_term":1}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "updated", Version: 3, Revision: storage.Revision{SeqNo: 6, PrimaryTerm: 1}},
+		},
+		"update": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Update(context.Background(), "abc", doc, storage.Revision{})
+			},
+			ExpectedMethod: http.MethodPost,
+			ExpectedPath:   "/products/_doc/abc/_update",
+			ExpectedBody:   `{"doc":{"title":"AirMax"}}`,
+			Response:       `{"_id":"abc","result":"updated","_version":3}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "updated", Version: 3},
+		},
+		"delete": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Delete(context.Background(), "abc", storage.Revision{})
+			},
+			ExpectedMethod: http.MethodDelete,
+			ExpectedPath:   "/products/_doc/abc",
+			Response:       `{"_id":"abc","result":"deleted","_version":4}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "deleted", Version: 4},
+		},
+		"update if not modified": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Update(context.Background(), "abc", doc, storage.Revision{SeqNo: 0, PrimaryTerm: 2})
+			},
+			ExpectedMethod: http.MethodPost,
+			ExpectedPath:   "/products/_doc/abc/_update",
+			ExpectedQuery:  "if_primary_term=2&if_seq_no=0",
+			ExpectedBody:   `{"doc":{"title":"AirMax"}}`,
+			Response:       `{"_id":"abc","result":"updated","_version":2}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "updated", Version: 2},
+		},
+		"delete if not modified": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Delete(context.Background(), "abc", storage.Revision{SeqNo: 7, PrimaryTerm: 1})
+			},
+			ExpectedMethod: http.MethodDelete,
+			ExpectedPath:   "/products/_doc/abc",
+			ExpectedQuery:  "if_primary_term=1&if_seq_no=7",
+			Response:       `{"_id":"abc","result":"deleted","_version":5}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "deleted", Version: 5},
+		},
+		"create and wait for refresh": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Create(storage.WithRefreshPolicy(context.Background(), storage.RefreshWaitFor), doc)
+			},
+			ExpectedMethod: http.MethodPost,
+			ExpectedPath:   "/products/_doc",
+			ExpectedQuery:  "refresh=wait_for",
+			ExpectedBody:   `{"title":"AirMax"}`,
+			Response:       `{"_id":"abc","result":"created","_version":1}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "created", Version: 1},
+		},
+		"update and refresh": {
+			Write: func(st *storage.Storage) (storage.WriteResult, error) {
+				return st.Update(storage.WithRefreshPolicy(context.Background(), storage.RefreshTrue), "abc", doc, storage.Revision{})
+			},
+			ExpectedMethod: http.MethodPost,
+			ExpectedPath:   "/products/_doc/abc/_update",
+			ExpectedQuery:  "refresh=true",
+			ExpectedBody:   `{"doc":{"title":"AirMax"}}`,
+			Response:       `{"_id":"abc","result":"updated","_version":3}`,
+			Expected:       storage.WriteResult{ID: "abc", Result: "updated", Version: 3},
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			node, mux, teardown := setupTS()
+			defer teardown()
+
+			var method, path, query, body string
+			mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, _ := ioutil.ReadAll(req.Body)
+				method, path, query, body = req.Method, req.URL.Path, req.URL.RawQuery, string(b)
+
+				w.Write([]byte(testCase.Response))
+			}))
+
+			c, err := elasticsearch.NewClient(elasticsearch.Config{
+				Addresses: []string{node},
+			})
+			require.NoError(t, err)
+
+			res, err := testCase.Write(storage.New(c, "products"))
+			require.NoError(t, err)
+
+			assert.Equal(t, testCase.ExpectedMethod, method)
+			assert.Equal(t, testCase.ExpectedPath, path)
+			assert.Equal(t, testCase.ExpectedQuery, query)
+			if testCase.ExpectedBody != "" {
+				assert.JSONEq(t, testCase.ExpectedBody, body)
+			}
+			assert.Equal(t, testCase.Expected, res)
+		})
+	}
+}
+
+func TestElasticsearchStorage_Get(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	var path string
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		w.Write([]byte(`{"_index":"products","_id":"abc","_version":3,"_seq_no":12,"_primary_term":2,"found":true,"_source":{"title":"AirMax"}}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	doc, err := storage.New(c, "products").Get(context.Background(), "abc")
+	require.NoError(t, err)
+
+	assert.Equal(t, "/products/_doc/abc", path)
+	assert.Equal(t, "abc", doc.ID)
+	assert.EqualValues(t, 3, doc.Version)
+	assert.Equal(t, storage.Revision{SeqNo: 12, PrimaryTerm: 2}, doc.Revision)
+	assert.JSONEq(t, `{"title":"AirMax"}`, string(doc.Source))
+}
+
+func TestElasticsearchStorage_Write_Conflict(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"error":{"type":"version_conflict_engine_exception"}}`, http.StatusConflict)
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	_, err = storage.New(c, "products").Replace(context.Background(), "abc", json.RawMessage(`{}`), storage.Revision{SeqNo: 1, PrimaryTerm: 1})
+	assert.Equal(t, storage.ErrConflict, err)
+}
+
+func TestElasticsearchStorage_Write_NotFound(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"_id":"abc","result":"not_found"}`, http.StatusNotFound)
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	st := storage.New(c, "products")
+
+	_, err = st.Delete(context.Background(), "abc", storage.Revision{})
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	_, err = st.Update(context.Background(), "abc", json.RawMessage(`{}`), storage.Revision{})
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	_, err = st.Get(context.Background(), "abc")
+	assert.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestElasticsearchStorage_Write_ErrorResponse(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"error": "mapper_parsing_exception"}`, http.StatusBadRequest)
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	_, err = storage.New(c, "products").Create(context.Background(), json.RawMessage(`{"price":"abc"}`))
+	require.Error(t, err)
+
+	e, ok := err.(*storage.ResponseError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, e.StatusCode)
+}
+
+func TestElasticsearchStorage_Write_IndexBlocked(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"error": {"type": "cluster_block_exception", "reason": "index [products_v1] blocked by: [FORBIDDEN/8/index write (api)];"}, "status": 403}`, http.StatusForbidden)
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	_, err = storage.New(c, "products").Replace(context.Background(), "abc", json.RawMessage(`{}`), storage.Revision{})
+	assert.Equal(t, storage.ErrIndexBlocked, err)
+}
+
+func TestElasticsearchStorage_Refresh(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	var method, path string
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		method, path = req.Method, req.URL.Path
+		w.Write([]byte(`{"_shards":{"total":2,"successful":2,"failed":0}}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, storage.New(c, "products").Refresh(context.Background()))
+	assert.Equal(t, http.MethodPost, method)
+	assert.Equal(t, "/products/_refresh", path)
+}
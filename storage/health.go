@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Cluster health statuses reported by Elasticsearch
+const (
+	StatusGreen  = "green"
+	StatusYellow = "yellow"
+	StatusRed    = "red"
+)
+
+var statusRanks = map[string]int{
+	StatusRed:    1,
+	StatusYellow: 2,
+	StatusGreen:  3,
+}
+
+// StatusAtLeast returns true if the cluster health status is the same or better than min
+func StatusAtLeast(status, min string) bool {
+	return statusRanks[status] >= statusRanks[min]
+}
+
+// Health describes the state of the storage
+type Health struct {
+	// ClusterStatus is the Elasticsearch cluster health status, i.e. green, yellow or red
+	ClusterStatus string
+	// Index is the name of the index used by the storage
+	Index string
+	// IndexExists is true if the storage index exists. It's always true if the storage
+	// is not bound to a specific index
+	IndexExists bool
+	// LastSuccessfulQuery is the time of the last successful search query. It's zero if
+	// there were no successful queries since startup
+	LastSuccessfulQuery time.Time
+	// CircuitBreaker is the state of the circuit breaker guarding the storage, if any
+	CircuitBreaker string
+	// Cluster is the name of the cluster the health was reported for, if there are several
+	Cluster string
+}
+
+// Health checks the Elasticsearch cluster health and whether the storage index exists
+func (st *Storage) Health(ctx context.Context) (Health, error) {
+	h := Health{
+		Index:       st.index,
+		IndexExists: true,
+	}
+
+	if ts := atomic.LoadInt64(&st.lastSuccessfulQuery); ts > 0 {
+		h.LastSuccessfulQuery = time.Unix(0, ts)
+	}
+
+	start := time.Now()
+	resp, err := st.es.Cluster.Health(st.es.Cluster.Health.WithContext(ctx))
+	esRequestDuration.With("cluster_health").Observe(time.Since(start).Seconds())
+	if err != nil {
+		esRequestErrors.With("cluster_health").Inc()
+		return h, fmt.Errorf("failed to fetch cluster health: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.IsError() {
+		esRequestErrors.With("cluster_health").Inc()
+		return h, fmt.Errorf("elasticsearch responded with %s", resp.Status())
+	}
+
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return h, fmt.Errorf("failed to parse cluster health: %s", err)
+	}
+	h.ClusterStatus = health.Status
+
+	if st.index == "" {
+		return h, nil
+	}
+
+	start = time.Now()
+	resp, err = st.es.Indices.Exists([]string{st.index}, st.es.Indices.Exists.WithContext(ctx))
+	esRequestDuration.With("index_exists").Observe(time.Since(start).Seconds())
+	if err != nil {
+		esRequestErrors.With("index_exists").Inc()
+		return h, fmt.Errorf("failed to check index existence: %s", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		h.IndexExists = true
+	case http.StatusNotFound:
+		h.IndexExists = false
+	default:
+		esRequestErrors.With("index_exists").Inc()
+		return h, fmt.Errorf("elasticsearch responded with %s", resp.Status())
+	}
+
+	return h, nil
+}
@@ -0,0 +1,91 @@
+package storage_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/storage"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElasticsearchStorage_Health(t *testing.T) {
+	testCases := map[string]struct {
+		IndexStatus         int
+		ExpectedIndexExists bool
+	}{
+		"index exists":  {IndexStatus: http.StatusOK, ExpectedIndexExists: true},
+		"index missing": {IndexStatus: http.StatusNotFound, ExpectedIndexExists: false},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			node, mux, teardown := setupTS()
+			defer teardown()
+
+			mux.Handle("/_cluster/health", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"cluster_name": "test", "status": "yellow"}`))
+			}))
+			mux.Handle("/products", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				assert.Equal(t, http.MethodHead, req.Method)
+				w.WriteHeader(testCase.IndexStatus)
+			}))
+			mux.Handle("/products/_search", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"hits": {"hits": []}}`))
+			}))
+
+			c, err := elasticsearch.NewClient(elasticsearch.Config{
+				Addresses: []string{node},
+			})
+			require.NoError(t, err)
+
+			st := storage.New(c, "products")
+
+			h, err := st.Health(context.Background())
+			require.NoError(t, err)
+
+			assert.Equal(t, "yellow", h.ClusterStatus)
+			assert.Equal(t, "products", h.Index)
+			assert.Equal(t, testCase.ExpectedIndexExists, h.IndexExists)
+			assert.True(t, h.LastSuccessfulQuery.IsZero())
+
+			_, err = st.Search(context.Background(), "search term", storage.SearchOptions{})
+			require.NoError(t, err)
+
+			h, err = st.Health(context.Background())
+			require.NoError(t, err)
+
+			assert.WithinDuration(t, time.Now(), h.LastSuccessfulQuery, time.Second)
+		})
+	}
+}
+
+func TestElasticsearchStorage_Health_ClusterUnavailable(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/_cluster/health", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"error": "master_not_discovered_exception"}`, http.StatusServiceUnavailable)
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	_, err = storage.New(c, "products").Health(context.Background())
+	assert.Error(t, err)
+}
+
+func TestStatusAtLeast(t *testing.T) {
+	assert.True(t, storage.StatusAtLeast(storage.StatusGreen, storage.StatusGreen))
+	assert.True(t, storage.StatusAtLeast(storage.StatusGreen, storage.StatusYellow))
+	assert.True(t, storage.StatusAtLeast(storage.StatusYellow, storage.StatusYellow))
+	assert.False(t, storage.StatusAtLeast(storage.StatusYellow, storage.StatusGreen))
+	assert.False(t, storage.StatusAtLeast(storage.StatusRed, storage.StatusYellow))
+	assert.False(t, storage.StatusAtLeast("", storage.StatusYellow))
+}
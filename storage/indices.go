@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	esapi "github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// ErrIndexNotFound is returned when the index or the index template does not exist
+var ErrIndexNotFound = errors.New("index not found")
+
+// IndexDefinition is the settings and mappings of an index or an index template
+type IndexDefinition struct {
+	// IndexPatterns are the names of indices the template is applied to, not set for indices
+	IndexPatterns []string `json:"index_patterns,omitempty"`
+	// Settings are the index settings
+	Settings json.RawMessage `json:"settings,omitempty"`
+	// Mappings are the index mappings
+	Mappings json.RawMessage `json:"mappings,omitempty"`
+}
+
+// Index returns the name of the index the storage operates on
+func (st *Storage) Index() string {
+	return st.index
+}
+
+// GetIndex returns the definition of the storage index. If the index name is an alias, the definition
+// of the index it points to is returned
+func (st *Storage) GetIndex(ctx context.Context) (IndexDefinition, error) {
+	var resp map[string]IndexDefinition
+	err := st.do(ctx, "get_index", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.Get(
+			[]string{st.index},
+			st.es.Indices.Get.WithContext(ctx),
+			st.es.Indices.Get.WithHeader(headers),
+		)
+	}, &resp)
+	if err == ErrNotFound {
+		return IndexDefinition{}, ErrIndexNotFound
+	}
+
+	if err != nil {
+		return IndexDefinition{}, err
+	}
+
+	for _, def := range resp {
+		return def, nil
+	}
+
+	return IndexDefinition{}, ErrIndexNotFound
+}
+
+// CreateIndex creates the storage index with given settings and mappings
+func (st *Storage) CreateIndex(ctx context.Context, def IndexDefinition) error {
+	return st.CreateNamedIndex(ctx, st.index, def)
+}
+
+// CreateNamedIndex creates an index with given name, settings and mappings
+func (st *Storage) CreateNamedIndex(ctx context.Context, name string, def IndexDefinition) error {
+	body, err := json.Marshal(def)
+	if err != nil {
+		return fmt.Errorf("failed to build create index request: %s", err)
+	}
+
+	return st.do(ctx, "create_index", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.Create(
+			name,
+			st.es.Indices.Create.WithBody(bytes.NewReader(body)),
+			st.es.Indices.Create.WithContext(ctx),
+			st.es.Indices.Create.WithHeader(headers),
+		)
+	}, &struct{}{})
+}
+
+// DeleteIndex deletes the index with given name
+func (st *Storage) DeleteIndex(ctx context.Context, name string) error {
+	return st.do(ctx, "delete_index", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.Delete(
+			[]string{name},
+			st.es.Indices.Delete.WithContext(ctx),
+			st.es.Indices.Delete.WithHeader(headers),
+		)
+	}, &struct{}{})
+}
+
+// PutMapping adds new fields to the storage index mappings and updates the parameters of existing ones
+func (st *Storage) PutMapping(ctx context.Context, mappings json.RawMessage) error {
+	return st.do(ctx, "put_mapping", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.PutMapping(
+			bytes.NewReader(mappings),
+			st.es.Indices.PutMapping.WithIndex(st.index),
+			st.es.Indices.PutMapping.WithContext(ctx),
+			st.es.Indices.PutMapping.WithHeader(headers),
+		)
+	}, &struct{}{})
+}
+
+// GetTemplate returns the index template with given name
+func (st *Storage) GetTemplate(ctx context.Context, name string) (IndexDefinition, error) {
+	var resp map[string]IndexDefinition
+	err := st.do(ctx, "get_template", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.GetTemplate(
+			st.es.Indices.GetTemplate.WithName(name),
+			st.es.Indices.GetTemplate.WithContext(ctx),
+			st.es.Indices.GetTemplate.WithHeader(headers),
+		)
+	}, &resp)
+	if err == ErrNotFound {
+		return IndexDefinition{}, ErrIndexNotFound
+	}
+
+	if err != nil {
+		return IndexDefinition{}, err
+	}
+
+	def, ok := resp[name]
+	if !ok {
+		return IndexDefinition{}, ErrIndexNotFound
+	}
+
+	return def, nil
+}
+
+// PutTemplate creates or replaces the index template with given name
+func (st *Storage) PutTemplate(ctx context.Context, name string, def IndexDefinition) error {
+	body, err := json.Marshal(def)
+	if err != nil {
+		return fmt.Errorf("failed to build put template request: %s", err)
+	}
+
+	return st.do(ctx, "put_template", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.PutTemplate(
+			name,
+			bytes.NewReader(body),
+			st.es.Indices.PutTemplate.WithContext(ctx),
+			st.es.Indices.PutTemplate.WithHeader(headers),
+		)
+	}, &struct{}{})
+}
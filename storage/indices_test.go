@@ -0,0 +1,130 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/storage"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElasticsearchStorage_GetIndex(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/products", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodGet, req.Method)
+
+		// products is an alias to products-v1
+		w.Write([]byte(`{
+			"products-v1": {
+				"aliases": {"products": {}},
+				"settings": {"index": {"number_of_shards": "1"}},
+				"mappings": {"properties": {"title": {"type": "text"}}}
+			}
+		}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	def, err := storage.New(c, "products").GetIndex(context.Background())
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{"index": {"number_of_shards": "1"}}`, string(def.Settings))
+	assert.JSONEq(t, `{"properties": {"title": {"type": "text"}}}`, string(def.Mappings))
+}
+
+func TestElasticsearchStorage_GetIndex_NotFound(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/products", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"type": "index_not_found_exception"}, "status": 404}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	_, err = storage.New(c, "products").GetIndex(context.Background())
+	assert.Equal(t, storage.ErrIndexNotFound, err)
+}
+
+func TestElasticsearchStorage_ManageIndex(t *testing.T) {
+	def := storage.IndexDefinition{
+		Settings: json.RawMessage(`{"index":{"number_of_shards":"1"}}`),
+		Mappings: json.RawMessage(`{"properties":{"title":{"type":"text"}}}`),
+	}
+
+	testCases := map[string]struct {
+		Call           func(st *storage.Storage) error
+		ExpectedMethod string
+		ExpectedPath   string
+		ExpectedBody   string
+	}{
+		"create index": {
+			Call: func(st *storage.Storage) error {
+				return st.CreateIndex(context.Background(), def)
+			},
+			ExpectedMethod: http.MethodPut,
+			ExpectedPath:   "/products",
+			ExpectedBody:   `{"settings":{"index":{"number_of_shards":"1"}},"mappings":{"properties":{"title":{"type":"text"}}}}`,
+		},
+		"put mapping": {
+			Call: func(st *storage.Storage) error {
+				return st.PutMapping(context.Background(), def.Mappings)
+			},
+			ExpectedMethod: http.MethodPut,
+			ExpectedPath:   "/products/_mapping",
+			ExpectedBody:   `{"properties":{"title":{"type":"text"}}}`,
+		},
+		"put template": {
+			Call: func(st *storage.Storage) error {
+				tmpl := def
+				tmpl.IndexPatterns = []string{"products-*"}
+
+				return st.PutTemplate(context.Background(), "products", tmpl)
+			},
+			ExpectedMethod: http.MethodPut,
+			ExpectedPath:   "/_template/products",
+			ExpectedBody:   `{"index_patterns":["products-*"],"settings":{"index":{"number_of_shards":"1"}},"mappings":{"properties":{"title":{"type":"text"}}}}`,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			node, mux, teardown := setupTS()
+			defer teardown()
+
+			var method, path, body string
+			mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, _ := ioutil.ReadAll(req.Body)
+				method, path, body = req.Method, req.URL.Path, string(b)
+
+				w.Write([]byte(`{"acknowledged": true}`))
+			}))
+
+			c, err := elasticsearch.NewClient(elasticsearch.Config{
+				Addresses: []string{node},
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, testCase.Call(storage.New(c, "products")))
+
+			assert.Equal(t, testCase.ExpectedMethod, method)
+			assert.Equal(t, testCase.ExpectedPath, path)
+			assert.JSONEq(t, testCase.ExpectedBody, body)
+		})
+	}
+}
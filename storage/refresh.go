@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/tracing"
+)
+
+// Refresh policies of document writes
+const (
+	// RefreshFalse does not make the write visible to search until the next periodic refresh
+	RefreshFalse = "false"
+	// RefreshTrue refreshes the affected shards right after the write
+	RefreshTrue = "true"
+	// RefreshWaitFor waits for the next periodic refresh before returning
+	RefreshWaitFor = "wait_for"
+)
+
+type refreshPolicyKey struct{}
+
+// WithRefreshPolicy returns a copy of ctx with the refresh policy to be applied to document writes made within it
+func WithRefreshPolicy(ctx context.Context, policy string) context.Context {
+	return context.WithValue(ctx, refreshPolicyKey{}, policy)
+}
+
+// RefreshPolicy returns the refresh policy stored in ctx, if any
+func RefreshPolicy(ctx context.Context) string {
+	policy, _ := ctx.Value(refreshPolicyKey{}).(string)
+	return policy
+}
+
+type consistentReadKey struct{}
+
+// WithConsistentRead returns a copy of ctx marking searches made within it as the ones that need to reflect
+// the latest writes, so that they are not served from the cache
+func WithConsistentRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistentReadKey{}, true)
+}
+
+// ConsistentRead returns true if ctx has been marked with WithConsistentRead
+func ConsistentRead(ctx context.Context) bool {
+	v, _ := ctx.Value(consistentReadKey{}).(bool)
+	return v
+}
+
+// Refresh makes all writes to the index performed so far visible to search
+func (st *Storage) Refresh(ctx context.Context) error {
+	if st.index == "" {
+		return errNoIndex
+	}
+
+	ctx, span := tracing.StartSpan(ctx, "elasticsearch.refresh", tracing.SpanKindClient)
+	defer span.End()
+
+	span.SetAttribute("db.system", "elasticsearch")
+	span.SetAttribute("db.operation", "refresh")
+	span.SetAttribute("db.elasticsearch.index", st.index)
+
+	start := time.Now()
+	resp, err := st.es.Indices.Refresh(
+		st.es.Indices.Refresh.WithIndex(st.index),
+		st.es.Indices.Refresh.WithContext(ctx),
+		st.es.Indices.Refresh.WithHeader(requestHeaders(ctx)),
+	)
+	esRequestDuration.With("refresh").Observe(time.Since(start).Seconds())
+	if err != nil {
+		esRequestErrors.With("refresh").Inc()
+		span.SetError(err)
+		return fmt.Errorf("failed to refresh index: %s", err)
+	}
+	defer resp.Body.Close()
+
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.IsError() {
+		esRequestErrors.With("refresh").Inc()
+		err := &ResponseError{StatusCode: resp.StatusCode, Status: resp.Status()}
+		span.SetError(err)
+		return err
+	}
+
+	return nil
+}
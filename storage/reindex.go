@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	esapi "github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// ReindexProgress is the status of a reindex task
+type ReindexProgress struct {
+	// Total is the number of documents to copy
+	Total int
+	// Copied is the number of documents processed so far
+	Copied int
+	// Completed is true when the task has finished
+	Completed bool
+	// Failures are the errors the task has finished with
+	Failures []string
+}
+
+// ResolveAlias returns the indices the storage index name refers to. If the name is an alias,
+// alias is set to true, otherwise the result contains the name itself
+func (st *Storage) ResolveAlias(ctx context.Context) (indices []string, alias bool, err error) {
+	indices, err = st.ListIndices(ctx, st.index)
+	if err == ErrNotFound {
+		return nil, false, ErrIndexNotFound
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(indices) == 0 {
+		return nil, false, ErrIndexNotFound
+	}
+
+	return indices, len(indices) > 1 || indices[0] != st.index, nil
+}
+
+// ListIndices returns the sorted names of indices matching the pattern
+func (st *Storage) ListIndices(ctx context.Context, pattern string) ([]string, error) {
+	var resp map[string]json.RawMessage
+	err := st.do(ctx, "get_alias", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.GetAlias(
+			st.es.Indices.GetAlias.WithIndex(pattern),
+			st.es.Indices.GetAlias.WithContext(ctx),
+			st.es.Indices.GetAlias.WithHeader(headers),
+		)
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := make([]string, 0, len(resp))
+	for name := range resp {
+		indices = append(indices, name)
+	}
+	sort.Strings(indices)
+
+	return indices, nil
+}
+
+// StartReindex starts copying all documents from the source index to the destination one in background
+// and returns the ID of the task to track its progress
+func (st *Storage) StartReindex(ctx context.Context, source, dest string) (string, error) {
+	var body struct {
+		Source struct {
+			Index string `json:"index"`
+		} `json:"source"`
+		Dest struct {
+			Index string `json:"index"`
+		} `json:"dest"`
+	}
+	body.Source.Index, body.Dest.Index = source, dest
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to build reindex request: %s", err)
+	}
+
+	var resp struct {
+		Task string `json:"task"`
+	}
+	err = st.do(ctx, "reindex", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Reindex(
+			bytes.NewReader(b),
+			st.es.Reindex.WithWaitForCompletion(false),
+			st.es.Reindex.WithContext(ctx),
+			st.es.Reindex.WithHeader(headers),
+		)
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Task, nil
+}
+
+// ReindexStatus returns the progress of the reindex task started with StartReindex
+func (st *Storage) ReindexStatus(ctx context.Context, taskID string) (ReindexProgress, error) {
+	var resp struct {
+		Completed bool `json:"completed"`
+		Task      struct {
+			Status struct {
+				Total   int `json:"total"`
+				Created int `json:"created"`
+				Updated int `json:"updated"`
+				Deleted int `json:"deleted"`
+				Noops   int `json:"noops"`
+			} `json:"status"`
+		} `json:"task"`
+		Response struct {
+			Failures []struct {
+				ID    string `json:"id"`
+				Cause struct {
+					Type   string `json:"type"`
+					Reason string `json:"reason"`
+				} `json:"cause"`
+			} `json:"failures"`
+		} `json:"response"`
+		Error *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	err := st.do(ctx, "get_task", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Tasks.Get(
+			taskID,
+			st.es.Tasks.Get.WithContext(ctx),
+			st.es.Tasks.Get.WithHeader(headers),
+		)
+	}, &resp)
+	if err != nil {
+		return ReindexProgress{}, err
+	}
+
+	status := resp.Task.Status
+	progress := ReindexProgress{
+		Total:     status.Total,
+		Copied:    status.Created + status.Updated + status.Deleted + status.Noops,
+		Completed: resp.Completed,
+	}
+
+	for _, f := range resp.Response.Failures {
+		progress.Failures = append(progress.Failures, f.ID+": "+f.Cause.Type+": "+f.Cause.Reason)
+	}
+
+	if resp.Error != nil {
+		progress.Failures = append(progress.Failures, resp.Error.Type+": "+resp.Error.Reason)
+	}
+
+	return progress, nil
+}
+
+// CountDocuments refreshes the index to make recent writes visible and returns the number of documents in it
+func (st *Storage) CountDocuments(ctx context.Context, index string) (int, error) {
+	err := st.do(ctx, "refresh", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.Refresh(
+			st.es.Indices.Refresh.WithIndex(index),
+			st.es.Indices.Refresh.WithContext(ctx),
+			st.es.Indices.Refresh.WithHeader(headers),
+		)
+	}, &struct{}{})
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		Count int `json:"count"`
+	}
+	err = st.do(ctx, "count", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Count(
+			st.es.Count.WithIndex(index),
+			st.es.Count.WithContext(ctx),
+			st.es.Count.WithHeader(headers),
+		)
+	}, &resp)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Count, nil
+}
+
+// BlockWrites makes the index read-only if block is set, and lifts the block otherwise. Writes to a blocked
+// index are rejected with 403 Forbidden
+func (st *Storage) BlockWrites(ctx context.Context, index string, block bool) error {
+	var body struct {
+		Block *bool `json:"index.blocks.write"` // null resets the setting
+	}
+	if block {
+		body.Block = &block
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to build update settings request: %s", err)
+	}
+
+	return st.do(ctx, "put_settings", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.PutSettings(
+			bytes.NewReader(b),
+			st.es.Indices.PutSettings.WithIndex(index),
+			st.es.Indices.PutSettings.WithContext(ctx),
+			st.es.Indices.PutSettings.WithHeader(headers),
+		)
+	}, &struct{}{})
+}
+
+// MoveAlias atomically points the storage index alias to the given index and removes it from the
+// indices it pointed to before. If replaceIndex is set, the concrete index with the alias name is deleted
+// within the same request to be replaced with the alias
+func (st *Storage) MoveAlias(ctx context.Context, index string, from []string, replaceIndex bool) error {
+	type aliasAction struct {
+		Index string `json:"index"`
+		Alias string `json:"alias,omitempty"`
+	}
+
+	var body struct {
+		Actions []map[string]aliasAction `json:"actions"`
+	}
+
+	for _, name := range from {
+		body.Actions = append(body.Actions, map[string]aliasAction{"remove": {Index: name, Alias: st.index}})
+	}
+
+	if replaceIndex {
+		body.Actions = append(body.Actions, map[string]aliasAction{"remove_index": {Index: st.index}})
+	}
+
+	body.Actions = append(body.Actions, map[string]aliasAction{"add": {Index: index, Alias: st.index}})
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to build update aliases request: %s", err)
+	}
+
+	return st.do(ctx, "update_aliases", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Indices.UpdateAliases(
+			bytes.NewReader(b),
+			st.es.Indices.UpdateAliases.WithContext(ctx),
+			st.es.Indices.UpdateAliases.WithHeader(headers),
+		)
+	}, &struct{}{})
+}
@@ -0,0 +1,213 @@
+package storage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/storage"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElasticsearchStorage_ResolveAlias(t *testing.T) {
+	testCases := map[string]struct {
+		Status          int
+		Response        string
+		ExpectedIndices []string
+		ExpectedAlias   bool
+		ExpectedError   error
+	}{
+		"alias": {
+			Status:          http.StatusOK,
+			Response:        `{"products_v2": {"aliases": {"products": {}}}}`,
+			ExpectedIndices: []string{"products_v2"},
+			ExpectedAlias:   true,
+		},
+		"concrete index": {
+			Status:          http.StatusOK,
+			Response:        `{"products": {"aliases": {}}}`,
+			ExpectedIndices: []string{"products"},
+		},
+		"not found": {
+			Status:        http.StatusNotFound,
+			Response:      `{"error": "alias [products] missing", "status": 404}`,
+			ExpectedError: storage.ErrIndexNotFound,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			node, mux, teardown := setupTS()
+			defer teardown()
+
+			mux.Handle("/products/_alias", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(testCase.Status)
+				w.Write([]byte(testCase.Response))
+			}))
+
+			c, err := elasticsearch.NewClient(elasticsearch.Config{
+				Addresses: []string{node},
+			})
+			require.NoError(t, err)
+
+			indices, alias, err := storage.New(c, "products").ResolveAlias(context.Background())
+			assert.Equal(t, testCase.ExpectedError, err)
+			assert.Equal(t, testCase.ExpectedIndices, indices)
+			assert.Equal(t, testCase.ExpectedAlias, alias)
+		})
+	}
+}
+
+func TestElasticsearchStorage_Reindex(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/_reindex", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "false", req.URL.Query().Get("wait_for_completion"))
+		assert.JSONEq(t, `{"source": {"index": "products_v1"}, "dest": {"index": "products_v2"}}`, string(b))
+
+		w.Write([]byte(`{"task": "node1:42"}`))
+	}))
+	mux.Handle("/_tasks/node1:42", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{
+			"completed": true,
+			"task": {"status": {"total": 10, "created": 6, "updated": 1, "deleted": 0, "noops": 0}},
+			"response": {"failures": [{"id": "abc", "cause": {"type": "mapper_parsing_exception", "reason": "failed to parse field [price]"}}]}
+		}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	st := storage.New(c, "products")
+
+	taskID, err := st.StartReindex(context.Background(), "products_v1", "products_v2")
+	require.NoError(t, err)
+	assert.Equal(t, "node1:42", taskID)
+
+	progress, err := st.ReindexStatus(context.Background(), taskID)
+	require.NoError(t, err)
+
+	assert.Equal(t, storage.ReindexProgress{
+		Total:     10,
+		Copied:    7,
+		Completed: true,
+		Failures:  []string{"abc: mapper_parsing_exception: failed to parse field [price]"},
+	}, progress)
+}
+
+func TestElasticsearchStorage_MoveAlias(t *testing.T) {
+	testCases := map[string]struct {
+		From         []string
+		ReplaceIndex bool
+		ExpectedBody string
+	}{
+		"from alias": {
+			From: []string{"products_v1"},
+			ExpectedBody: `{"actions": [
+				{"remove": {"index": "products_v1", "alias": "products"}},
+				{"add": {"index": "products_v2", "alias": "products"}}
+			]}`,
+		},
+		"replace index": {
+			ReplaceIndex: true,
+			ExpectedBody: `{"actions": [
+				{"remove_index": {"index": "products"}},
+				{"add": {"index": "products_v2", "alias": "products"}}
+			]}`,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			node, mux, teardown := setupTS()
+			defer teardown()
+
+			var method, body string
+			mux.Handle("/_aliases", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, _ := ioutil.ReadAll(req.Body)
+				method, body = req.Method, string(b)
+
+				w.Write([]byte(`{"acknowledged": true}`))
+			}))
+
+			c, err := elasticsearch.NewClient(elasticsearch.Config{
+				Addresses: []string{node},
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, storage.New(c, "products").MoveAlias(context.Background(), "products_v2", testCase.From, testCase.ReplaceIndex))
+
+			assert.Equal(t, http.MethodPost, method)
+			assert.JSONEq(t, testCase.ExpectedBody, body)
+		})
+	}
+}
+
+func TestElasticsearchStorage_CountDocuments(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	var refreshed bool
+	mux.Handle("/products_v2/_refresh", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		refreshed = true
+		w.Write([]byte(`{"_shards": {"total": 1, "successful": 1, "failed": 0}}`))
+	}))
+	mux.Handle("/products_v2/_count", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"count": 42}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	n, err := storage.New(c, "products").CountDocuments(context.Background(), "products_v2")
+	require.NoError(t, err)
+
+	assert.True(t, refreshed)
+	assert.Equal(t, 42, n)
+}
+
+func TestElasticsearchStorage_BlockWrites(t *testing.T) {
+	testCases := map[string]struct {
+		Block        bool
+		ExpectedBody string
+	}{
+		"block":   {Block: true, ExpectedBody: `{"index.blocks.write": true}`},
+		"unblock": {Block: false, ExpectedBody: `{"index.blocks.write": null}`},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			node, mux, teardown := setupTS()
+			defer teardown()
+
+			var method, body string
+			mux.Handle("/products_v1/_settings", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, _ := ioutil.ReadAll(req.Body)
+				method, body = req.Method, string(b)
+
+				w.Write([]byte(`{"acknowledged": true}`))
+			}))
+
+			c, err := elasticsearch.NewClient(elasticsearch.Config{
+				Addresses: []string{node},
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, storage.New(c, "products").BlockWrites(context.Background(), "products_v1", testCase.Block))
+			assert.Equal(t, http.MethodPut, method)
+			assert.JSONEq(t, testCase.ExpectedBody, body)
+		})
+	}
+}
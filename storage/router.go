@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/breaker"
+	"github.com/andrewslotin/es-search-service/metrics"
+)
+
+// errorRateWeight is the weight of a single request outcome in the cluster error rate
+const errorRateWeight = 0.1
+
+var (
+	clusterRequests = metrics.NewCounterVec(
+		"search_service_elasticsearch_cluster_requests_total",
+		"Total number of search requests served by Elasticsearch cluster.",
+		"cluster",
+	)
+	clusterHealthy = metrics.NewGaugeVec(
+		"search_service_elasticsearch_cluster_healthy",
+		"Whether the Elasticsearch cluster has passed the last health check.",
+		"cluster",
+	)
+)
+
+func init() {
+	metrics.Default.MustRegister(clusterRequests, clusterHealthy)
+}
+
+// Cluster is an Elasticsearch cluster search requests can be routed to
+type Cluster struct {
+	// Name identifies the cluster
+	Name string
+	// Priority defines the order clusters are preferred in, the lower the better
+	Priority int
+	// Storage provides access to the cluster
+	Storage backend
+}
+
+type refresher interface {
+	Refresh(ctx context.Context) error
+}
+
+type breakerStater interface {
+	BreakerState() breaker.State
+}
+
+// Router routes search requests to the most preferred available cluster. Clusters are ordered by
+// their health, error rate and priority. If a search request fails with a server error,
+// it's retried with the next cluster
+type Router struct {
+	minStatus    string
+	maxErrorRate float64
+	members      []*member
+}
+
+type member struct {
+	Cluster
+
+	mu        sync.Mutex
+	healthy   bool
+	errorRate float64 // exponentially weighted moving average of failed requests share
+}
+
+// NewRouter returns a router between clusters. Clusters with health status worse than minStatus
+// or with share of failed requests above maxErrorRate are considered degraded and are only used
+// if there are no healthy ones
+func NewRouter(clusters []Cluster, minStatus string, maxErrorRate float64) *Router {
+	r := &Router{
+		minStatus:    minStatus,
+		maxErrorRate: maxErrorRate,
+	}
+
+	for _, cl := range clusters {
+		r.members = append(r.members, &member{Cluster: cl, healthy: true})
+		clusterHealthy.With(cl.Name).Set(1)
+	}
+
+	return r
+}
+
+// Search performs the search on the most preferred available cluster, failing over to the next
+// one in case of a server error. The name of the cluster that served the request is returned
+// in the results
+func (r *Router) Search(ctx context.Context, query string, opts SearchOptions) (SearchResults, error) {
+	var lastErr error
+	for _, m := range r.ranked() {
+		results, err := m.Storage.Search(ctx, query, opts)
+		if err == nil {
+			m.record(false)
+			clusterRequests.With(m.Name).Inc()
+			results.Cluster = m.Name
+
+			return results, nil
+		}
+
+		// retrying cancelled requests, rejected or timed out queries won't bring any better results
+		if ctx.Err() == context.Canceled || isClientError(err) || err == ErrTimeout {
+			return results, err
+		}
+
+		if _, ok := err.(*breaker.OpenError); !ok {
+			m.record(true)
+			log.Printf("search request to %s cluster failed: %s", m.Name, err)
+		}
+		lastErr = err
+	}
+
+	return SearchResults{}, lastErr
+}
+
+// Refresh refreshes the index on the most preferred cluster, i.e. the one the next search request is routed
+// to. Writes are only visible on a failover cluster once they have been replicated to it
+func (r *Router) Refresh(ctx context.Context) error {
+	members := r.ranked()
+	if len(members) == 0 {
+		return fmt.Errorf("there are no clusters to refresh")
+	}
+
+	rf, ok := members[0].Storage.(refresher)
+	if !ok {
+		return fmt.Errorf("%s cluster does not support refresh", members[0].Name)
+	}
+
+	return rf.Refresh(ctx)
+}
+
+// Health returns the health of the most preferred healthy cluster, or of the most preferred one
+// if there are no healthy clusters
+func (r *Router) Health(ctx context.Context) (Health, error) {
+	var (
+		first    Health
+		firstErr error
+	)
+
+	for i, m := range r.ranked() {
+		h, err := m.Storage.Health(ctx)
+		h.Cluster = m.Name
+
+		if err == nil && h.IndexExists && StatusAtLeast(h.ClusterStatus, r.minStatus) {
+			return h, nil
+		}
+
+		if i == 0 {
+			first, firstErr = h, err
+		}
+	}
+
+	return first, firstErr
+}
+
+// CheckHealth checks the health of all clusters and decays their error rates, so that the recovered
+// clusters get requests again
+func (r *Router) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, m := range r.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+
+			h, err := m.Storage.Health(ctx)
+			healthy := err == nil && h.IndexExists && StatusAtLeast(h.ClusterStatus, r.minStatus)
+
+			m.mu.Lock()
+			if m.healthy != healthy {
+				log.Printf("%s cluster healthy: %t (status: %s, error: %v)", m.Name, healthy, h.ClusterStatus, err)
+			}
+			m.healthy = healthy
+			m.errorRate /= 2
+			m.mu.Unlock()
+
+			if healthy {
+				clusterHealthy.With(m.Name).Set(1)
+			} else {
+				clusterHealthy.With(m.Name).Set(0)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// Watch checks the health of clusters with given interval until stop channel is closed
+func (r *Router) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			r.CheckHealth(ctx)
+			cancel()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ranked returns cluster members in the order of preference
+func (r *Router) ranked() []*member {
+	type rank struct {
+		m         *member
+		degraded  bool
+		errorRate float64
+	}
+
+	ranks := make([]rank, len(r.members))
+	for i, m := range r.members {
+		m.mu.Lock()
+		ranks[i] = rank{
+			m:         m,
+			degraded:  !m.healthy || m.errorRate > r.maxErrorRate,
+			errorRate: m.errorRate,
+		}
+		m.mu.Unlock()
+
+		// a half-open breaker lets probe requests through, so that the cluster can recover
+		if bs, ok := m.Storage.(breakerStater); ok && bs.BreakerState() == breaker.Open {
+			ranks[i].degraded = true
+		}
+	}
+
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].degraded != ranks[j].degraded {
+			return !ranks[i].degraded
+		}
+
+		if ranks[i].m.Priority != ranks[j].m.Priority {
+			return ranks[i].m.Priority < ranks[j].m.Priority
+		}
+
+		return ranks[i].errorRate < ranks[j].errorRate
+	})
+
+	members := make([]*member, len(ranks))
+	for i, rk := range ranks {
+		members[i] = rk.m
+	}
+
+	return members
+}
+
+func (m *member) record(failed bool) {
+	var v float64
+	if failed {
+		v = 1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.errorRate = (1-errorRateWeight)*m.errorRate + errorRateWeight*v
+}
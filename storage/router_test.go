@@ -0,0 +1,194 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/breaker"
+	"github.com/andrewslotin/es-search-service/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var healthyCluster = storage.Health{ClusterStatus: storage.StatusGreen, IndexExists: true}
+
+func TestRouter_Search(t *testing.T) {
+	testCases := map[string]struct {
+		PrimaryError    error
+		ExpectedCluster string
+		ExpectedError   error
+		ExpectedDRCalls int32
+	}{
+		"primary available": {
+			ExpectedCluster: "primary",
+		},
+		"primary failed": {
+			PrimaryError:    errors.New("connection refused"),
+			ExpectedCluster: "dr",
+			ExpectedDRCalls: 1,
+		},
+		"query rejected": {
+			PrimaryError:  &storage.ResponseError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"},
+			ExpectedError: &storage.ResponseError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"},
+		},
+		"query timed out": {
+			PrimaryError:  storage.ErrTimeout,
+			ExpectedError: storage.ErrTimeout,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			primary := &backendMock{Error: testCase.PrimaryError}
+			dr := &backendMock{}
+
+			r := storage.NewRouter([]storage.Cluster{
+				{Name: "dr", Priority: 1, Storage: dr},
+				{Name: "primary", Priority: 0, Storage: primary},
+			}, storage.StatusYellow, 0.5)
+
+			res, err := r.Search(context.Background(), "search term", storage.SearchOptions{})
+			if testCase.ExpectedError != nil {
+				assert.Equal(t, testCase.ExpectedError, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, testCase.ExpectedCluster, res.Cluster)
+			}
+
+			assert.EqualValues(t, 1, primary.Calls)
+			assert.Equal(t, testCase.ExpectedDRCalls, dr.Calls)
+		})
+	}
+}
+
+func TestRouter_Search_SingleCluster(t *testing.T) {
+	r := storage.NewRouter([]storage.Cluster{{Name: "primary", Storage: &backendMock{}}}, storage.StatusYellow, 0.5)
+
+	res, err := r.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", res.Cluster)
+}
+
+func TestRouter_Search_AllFailed(t *testing.T) {
+	r := storage.NewRouter([]storage.Cluster{
+		{Name: "primary", Storage: &backendMock{Error: errors.New("connection refused")}},
+		{Name: "dr", Priority: 1, Storage: &backendMock{Error: errors.New("no route to host")}},
+	}, storage.StatusYellow, 0.5)
+
+	_, err := r.Search(context.Background(), "search term", storage.SearchOptions{})
+	assert.EqualError(t, err, "no route to host")
+}
+
+func TestRouter_Refresh(t *testing.T) {
+	primary := &backendMock{HealthResult: storage.Health{ClusterStatus: storage.StatusRed, IndexExists: true}}
+	dr := &backendMock{HealthResult: healthyCluster}
+	cb := breaker.New("dr", breaker.Settings{FailureThreshold: 1, OpenTimeout: time.Minute})
+
+	r := storage.NewRouter([]storage.Cluster{
+		{Name: "primary", Storage: primary},
+		{Name: "dr", Priority: 1, Storage: storage.WithCircuitBreaker(dr, cb)},
+	}, storage.StatusYellow, 0.5)
+
+	require.NoError(t, r.Refresh(context.Background()))
+	assert.EqualValues(t, 1, primary.Refreshes)
+
+	// the cluster that serves searches is refreshed
+	r.CheckHealth(context.Background())
+
+	require.NoError(t, r.Refresh(context.Background()))
+	assert.EqualValues(t, 1, primary.Refreshes)
+	assert.EqualValues(t, 1, dr.Refreshes)
+}
+
+func TestRouter_CheckHealth(t *testing.T) {
+	primary := &backendMock{HealthResult: storage.Health{ClusterStatus: storage.StatusRed, IndexExists: true}}
+	dr := &backendMock{HealthResult: healthyCluster}
+
+	r := storage.NewRouter([]storage.Cluster{
+		{Name: "primary", Storage: primary},
+		{Name: "dr", Priority: 1, Storage: dr},
+	}, storage.StatusYellow, 0.5)
+	r.CheckHealth(context.Background())
+
+	res, err := r.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "dr", res.Cluster)
+	assert.EqualValues(t, 0, primary.Calls)
+
+	h, err := r.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "dr", h.Cluster)
+
+	// failback
+	primary.HealthResult = healthyCluster
+	r.CheckHealth(context.Background())
+
+	res, err = r.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", res.Cluster)
+
+	h, err = r.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "primary", h.Cluster)
+}
+
+func TestRouter_Search_ErrorRate(t *testing.T) {
+	primary := &backendMock{Error: errors.New("connection refused"), HealthResult: healthyCluster}
+	dr := &backendMock{HealthResult: healthyCluster}
+
+	r := storage.NewRouter([]storage.Cluster{
+		{Name: "primary", Storage: primary},
+		{Name: "dr", Priority: 1, Storage: dr},
+	}, storage.StatusYellow, 0.1)
+
+	// the first failure brings the error rate up to the threshold
+	for i := 0; i < 3; i++ {
+		res, err := r.Search(context.Background(), "search term", storage.SearchOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "dr", res.Cluster)
+	}
+	assert.EqualValues(t, 2, primary.Calls)
+
+	// health checks decay the error rate
+	primary.Error = nil
+	r.CheckHealth(context.Background())
+
+	res, err := r.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", res.Cluster)
+}
+
+func TestRouter_Search_CircuitBreaker(t *testing.T) {
+	primary := &backendMock{Error: errors.New("connection refused"), HealthResult: healthyCluster}
+	dr := &backendMock{HealthResult: healthyCluster}
+	cb := breaker.New("primary", breaker.Settings{FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond})
+
+	r := storage.NewRouter([]storage.Cluster{
+		{Name: "primary", Storage: storage.WithCircuitBreaker(primary, cb)},
+		{Name: "dr", Priority: 1, Storage: dr},
+	}, storage.StatusYellow, 1)
+
+	res, err := r.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "dr", res.Cluster)
+	require.Equal(t, breaker.Open, cb.State())
+
+	// the primary cluster is not queried while the breaker is open
+	res, err = r.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "dr", res.Cluster)
+	assert.EqualValues(t, 1, primary.Calls)
+
+	// the probe request closes the breaker once the primary cluster recovers
+	primary.Error = nil
+	time.Sleep(30 * time.Millisecond)
+
+	res, err = r.Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "primary", res.Cluster)
+	assert.Equal(t, breaker.Closed, cb.State())
+}
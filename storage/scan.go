@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	esapi "github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// scrollKeepAlive is the time Elasticsearch keeps the scroll context between requests
+const scrollKeepAlive = time.Minute
+
+// scrollPage is a page of documents returned by the scroll API
+type scrollPage struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			ID     string          `json:"_id"`
+			Source json.RawMessage `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Scan calls fn for each document in the storage index fetching them in pages of given size. The iteration
+// stops if fn returns an error
+func (st *Storage) Scan(ctx context.Context, size int, fn func(id string, doc json.RawMessage) error) error {
+	var page scrollPage
+	err := st.do(ctx, "scroll", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+		return st.es.Search(
+			st.es.Search.WithIndex(st.index),
+			st.es.Search.WithScroll(scrollKeepAlive),
+			st.es.Search.WithSize(size),
+			st.es.Search.WithSort("_doc"),
+			st.es.Search.WithContext(ctx),
+			st.es.Search.WithHeader(headers),
+		)
+	}, &page)
+	if err != nil {
+		return err
+	}
+
+	scrollID := page.ScrollID
+	defer func() {
+		st.do(ctx, "clear_scroll", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+			return st.es.ClearScroll(
+				st.es.ClearScroll.WithScrollID(scrollID),
+				st.es.ClearScroll.WithContext(ctx),
+				st.es.ClearScroll.WithHeader(headers),
+			)
+		}, &struct{}{})
+	}()
+
+	for len(page.Hits.Hits) > 0 {
+		for _, hit := range page.Hits.Hits {
+			if err := fn(hit.ID, hit.Source); err != nil {
+				return err
+			}
+		}
+
+		page = scrollPage{}
+		err := st.do(ctx, "scroll", "", func(ctx context.Context, headers map[string]string) (*esapi.Response, error) {
+			return st.es.Scroll(
+				st.es.Scroll.WithScrollID(scrollID),
+				st.es.Scroll.WithScroll(scrollKeepAlive),
+				st.es.Scroll.WithContext(ctx),
+				st.es.Scroll.WithHeader(headers),
+			)
+		}, &page)
+		if err != nil {
+			return err
+		}
+
+		if page.ScrollID != "" {
+			scrollID = page.ScrollID
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/storage"
+
+	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElasticsearchStorage_Scan(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/products/_search", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "60000ms", req.URL.Query().Get("scroll"))
+		assert.Equal(t, "2", req.URL.Query().Get("size"))
+		assert.Equal(t, "_doc", req.URL.Query().Get("sort"))
+
+		w.Write([]byte(`{
+			"_scroll_id": "scroll1",
+			"hits": {"hits": [
+				{"_id": "abc", "_source": {"title": "AirMax"}},
+				{"_id": "def", "_source": {"title": "Pegasus"}}
+			]}
+		}`))
+	}))
+
+	var cleared string
+	mux.Handle("/_search/scroll/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodDelete, req.Method)
+
+		cleared = req.URL.Path
+		w.Write([]byte(`{"succeeded": true, "num_freed": 1}`))
+	}))
+	mux.Handle("/_search/scroll", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("scroll_id") {
+		case "scroll1":
+			w.Write([]byte(`{"_scroll_id": "scroll2", "hits": {"hits": [{"_id": "ghi", "_source": {"title": "Gel-Kayano"}}]}}`))
+		case "scroll2":
+			w.Write([]byte(`{"_scroll_id": "scroll2", "hits": {"hits": []}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	docs := make(map[string]string)
+	err = storage.New(c, "products").Scan(context.Background(), 2, func(id string, doc json.RawMessage) error {
+		docs[id] = string(doc)
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"abc": `{"title": "AirMax"}`,
+		"def": `{"title": "Pegasus"}`,
+		"ghi": `{"title": "Gel-Kayano"}`,
+	}, docs)
+	assert.Equal(t, "/_search/scroll/scroll2", cleared)
+}
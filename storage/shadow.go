@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+)
+
+var (
+	shadowRequests = metrics.NewCounterVec(
+		"search_service_shadow_requests_total",
+		"Total number of search requests mirrored to the shadow cluster by result: success, error or dropped due to too many in-flight requests.",
+		"result",
+	)
+	shadowJaccard = metrics.NewHistogramVec(
+		"search_service_shadow_top_n_jaccard",
+		"Jaccard similarity of top-N documents returned by the primary and the shadow clusters.",
+		[]float64{0, .1, .2, .3, .4, .5, .6, .7, .8, .9, 1},
+	)
+	shadowRankCorrelation = metrics.NewHistogramVec(
+		"search_service_shadow_rank_correlation",
+		"Spearman's rank correlation of top-N documents returned by both the primary and the shadow clusters.",
+		[]float64{-1, -.5, 0, .25, .5, .75, .9, 1},
+	)
+	shadowHitsDelta = metrics.NewHistogramVec(
+		"search_service_shadow_hits_delta",
+		"Difference between the number of documents matched by the shadow and the primary clusters.",
+		[]float64{-1000, -100, -10, -1, 0, 1, 10, 100, 1000},
+	)
+	shadowLatencyDelta = metrics.NewHistogramVec(
+		"search_service_shadow_latency_delta_seconds",
+		"Difference between the shadow and the primary cluster search latency.",
+		[]float64{-1, -.5, -.1, -.05, -.01, 0, .01, .05, .1, .5, 1},
+	)
+)
+
+func init() {
+	metrics.Default.MustRegister(shadowRequests, shadowJaccard, shadowRankCorrelation, shadowHitsDelta, shadowLatencyDelta)
+}
+
+// ShadowSettings configure search requests mirroring
+type ShadowSettings struct {
+	// SampleRate is the share of search requests to mirror
+	SampleRate float64
+	// TopN is the number of top documents to compare
+	TopN int
+	// MaxInFlight is the maximum number of concurrent mirrored requests. Requests exceeding this limit are dropped
+	MaxInFlight int
+	// Timeout is the time the shadow cluster is given to respond
+	Timeout time.Duration
+	// MaxReported is the number of the worst divergences to log on each report
+	MaxReported int
+}
+
+// Divergence is the difference between search results returned by the primary and the shadow clusters
+type Divergence struct {
+	Query, Filter string
+	// Jaccard is the size of intersection of top-N document sets divided by the size of their union
+	Jaccard float64
+	// Common is the number of documents found in both top-N lists
+	Common int
+	// RankCorrelation is Spearman's rank correlation of documents found in both top-N lists. It's only
+	// meaningful if there are at least two such documents
+	RankCorrelation float64
+	// HitsDelta is the number of documents matched by the shadow cluster minus the number of documents
+	// matched by the primary one
+	HitsDelta int
+	// LatencyDelta is the shadow search latency minus the primary search latency, zero if the primary results were cached
+	LatencyDelta time.Duration
+	// PrimaryIDs and ShadowIDs are the top-N document IDs
+	PrimaryIDs, ShadowIDs []string
+}
+
+// Compare returns the divergence between top-N documents of primary and shadow search results
+func Compare(primary, shadow SearchResults, topN int) Divergence {
+	d := Divergence{
+		PrimaryIDs:      top(primary.IDs, topN),
+		ShadowIDs:       top(shadow.IDs, topN),
+		HitsDelta:       shadow.Total - primary.Total,
+		Jaccard:         1,
+		RankCorrelation: 1,
+	}
+
+	shadowRanks := make(map[string]int, len(d.ShadowIDs))
+	for i, id := range d.ShadowIDs {
+		shadowRanks[id] = i
+	}
+
+	// common holds the ranks of documents found in both lists within the primary list intersection
+	// and within the shadow list
+	var common [][2]int
+	for _, id := range d.PrimaryIDs {
+		if j, ok := shadowRanks[id]; ok {
+			common = append(common, [2]int{len(common), j})
+		}
+	}
+	d.Common = len(common)
+
+	if union := len(d.PrimaryIDs) + len(d.ShadowIDs) - d.Common; union > 0 {
+		d.Jaccard = float64(d.Common) / float64(union)
+	}
+
+	if n := len(common); n > 1 {
+		sort.Slice(common, func(i, j int) bool { return common[i][1] < common[j][1] })
+
+		var sum float64
+		for shadowRank, c := range common {
+			diff := float64(c[0] - shadowRank)
+			sum += diff * diff
+		}
+
+		d.RankCorrelation = 1 - 6*sum/float64(n*(n*n-1))
+	}
+
+	return d
+}
+
+// worse returns true if d diverges more than other
+func (d Divergence) worse(other Divergence) bool {
+	if d.Jaccard != other.Jaccard {
+		return d.Jaccard < other.Jaccard
+	}
+
+	return d.RankCorrelation < other.RankCorrelation
+}
+
+func top(ids []string, n int) []string {
+	if n > 0 && len(ids) > n {
+		return ids[:n]
+	}
+
+	return ids
+}
+
+// ShadowStorage mirrors a sample of successful search requests to a shadow cluster in background and compares
+// the results. The shadow cluster response never affects the results returned to the caller. Partial and stale
+// results are not mirrored
+type ShadowStorage struct {
+	backend
+	shadow   backend
+	settings ShadowSettings
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	worst []Divergence
+}
+
+// WithShadow wraps st to mirror search requests to the shadow storage
+func WithShadow(st, shadow backend, s ShadowSettings) *ShadowStorage {
+	return &ShadowStorage{
+		backend:  st,
+		shadow:   shadow,
+		settings: s,
+		inFlight: make(chan struct{}, s.MaxInFlight),
+	}
+}
+
+// Search queries the underlying storage and, if the request is sampled, sends the same query to
+// the shadow cluster in background
+func (ss *ShadowStorage) Search(ctx context.Context, query string, opts SearchOptions) (SearchResults, error) {
+	start := time.Now()
+	results, err := ss.backend.Search(ctx, query, opts)
+	if err != nil || results.Partial() || results.Stale || rand.Float64() >= ss.settings.SampleRate {
+		return results, err
+	}
+	latency := time.Since(start)
+
+	select {
+	case ss.inFlight <- struct{}{}:
+	default:
+		shadowRequests.With("dropped").Inc()
+		return results, nil
+	}
+
+	ss.wg.Add(1)
+	go func() {
+		defer ss.wg.Done()
+		defer func() { <-ss.inFlight }()
+
+		ss.mirror(OpaqueID(ctx), query, opts, results, latency)
+	}()
+
+	return results, nil
+}
+
+// mirror sends the query to the shadow storage and records the divergence from the primary results
+func (ss *ShadowStorage) mirror(opaqueID, query string, opts SearchOptions, primary SearchResults, latency time.Duration) {
+	// the shadow request should not be cancelled once the response to the original one is sent
+	ctx, cancel := context.WithTimeout(WithOpaqueID(context.Background(), opaqueID), ss.settings.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	results, err := ss.shadow.Search(ctx, query, opts)
+	if err != nil {
+		shadowRequests.With("error").Inc()
+		log.Printf("shadow search request failed: %s", err)
+		return
+	}
+	shadowRequests.With("success").Inc()
+
+	d := Compare(primary, results, ss.settings.TopN)
+	d.Query, d.Filter = query, opts.Filter
+
+	shadowJaccard.With().Observe(d.Jaccard)
+	if d.Common > 1 {
+		shadowRankCorrelation.With().Observe(d.RankCorrelation)
+	}
+	shadowHitsDelta.With().Observe(float64(d.HitsDelta))
+
+	// the latency of cached results says nothing about the primary cluster
+	if !primary.Cached {
+		d.LatencyDelta = time.Since(start) - latency
+		shadowLatencyDelta.With().Observe(d.LatencyDelta.Seconds())
+	}
+
+	ss.record(d)
+}
+
+// record keeps d if it's among the worst divergences since the last report
+func (ss *ShadowStorage) record(d Divergence) {
+	if d.Jaccard == 1 && d.RankCorrelation == 1 {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	i := sort.Search(len(ss.worst), func(i int) bool { return d.worse(ss.worst[i]) })
+	if i >= ss.settings.MaxReported {
+		return
+	}
+
+	ss.worst = append(ss.worst, Divergence{})
+	copy(ss.worst[i+1:], ss.worst[i:])
+	ss.worst[i] = d
+
+	if len(ss.worst) > ss.settings.MaxReported {
+		ss.worst = ss.worst[:ss.settings.MaxReported]
+	}
+}
+
+// Divergences returns the worst divergences recorded since the last call, the worst first
+func (ss *ShadowStorage) Divergences() []Divergence {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	worst := ss.worst
+	ss.worst = nil
+
+	return worst
+}
+
+// Report logs the worst divergences with given interval until stop channel is closed
+func (ss *ShadowStorage) Report(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, d := range ss.Divergences() {
+				log.Printf(
+					"shadow search divergence: jaccard=%.2f rank_correlation=%.2f common=%d hits_delta=%d latency_delta=%s query=%q filter=%q primary=%v shadow=%v",
+					d.Jaccard, d.RankCorrelation, d.Common, d.HitsDelta, d.LatencyDelta, d.Query, d.Filter, d.PrimaryIDs, d.ShadowIDs,
+				)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Wait blocks until all mirrored requests are complete
+func (ss *ShadowStorage) Wait() {
+	ss.wg.Wait()
+}
@@ -0,0 +1,300 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	examples := map[string]struct {
+		Primary, Shadow storage.SearchResults
+		Jaccard         float64
+		Common          int
+		RankCorrelation float64
+		HitsDelta       int
+	}{
+		"same results": {
+			Primary:         storage.SearchResults{IDs: []string{"1", "2", "3"}, Total: 3},
+			Shadow:          storage.SearchResults{IDs: []string{"1", "2", "3"}, Total: 3},
+			Jaccard:         1,
+			Common:          3,
+			RankCorrelation: 1,
+		},
+		"reversed order": {
+			Primary:         storage.SearchResults{IDs: []string{"1", "2", "3"}, Total: 3},
+			Shadow:          storage.SearchResults{IDs: []string{"3", "2", "1"}, Total: 3},
+			Jaccard:         1,
+			Common:          3,
+			RankCorrelation: -1,
+		},
+		"partial overlap": {
+			Primary:         storage.SearchResults{IDs: []string{"1", "2", "3"}, Total: 10},
+			Shadow:          storage.SearchResults{IDs: []string{"4", "1", "2"}, Total: 7},
+			Jaccard:         0.5,
+			Common:          2,
+			RankCorrelation: 1,
+			HitsDelta:       -3,
+		},
+		"no overlap": {
+			Primary:         storage.SearchResults{IDs: []string{"1", "2"}, Total: 2},
+			Shadow:          storage.SearchResults{IDs: []string{"3"}, Total: 1},
+			Jaccard:         0,
+			RankCorrelation: 1,
+			HitsDelta:       -1,
+		},
+		"only top-n compared": {
+			Primary:         storage.SearchResults{IDs: []string{"1", "2", "3", "4"}, Total: 4},
+			Shadow:          storage.SearchResults{IDs: []string{"2", "1", "3", "5"}, Total: 5},
+			Jaccard:         1,
+			Common:          3,
+			RankCorrelation: 0.5,
+			HitsDelta:       1,
+		},
+		"no results": {
+			Jaccard:         1,
+			RankCorrelation: 1,
+		},
+	}
+
+	for name, example := range examples {
+		example := example
+		t.Run(name, func(t *testing.T) {
+			d := storage.Compare(example.Primary, example.Shadow, 3)
+			assert.InDelta(t, example.Jaccard, d.Jaccard, 0.001)
+			assert.Equal(t, example.Common, d.Common)
+			assert.InDelta(t, example.RankCorrelation, d.RankCorrelation, 0.001)
+			assert.Equal(t, example.HitsDelta, d.HitsDelta)
+		})
+	}
+}
+
+func TestShadowStorage_Search(t *testing.T) {
+	primary := &backendMock{
+		Results: storage.SearchResults{IDs: []string{"1", "2", "3"}, Total: 3},
+	}
+	shadow := &backendMock{
+		Results: storage.SearchResults{IDs: []string{"4", "2", "1"}, Total: 5},
+	}
+
+	st := storage.WithShadow(primary, shadow, storage.ShadowSettings{
+		SampleRate:  1,
+		TopN:        10,
+		MaxInFlight: 1,
+		Timeout:     time.Second,
+		MaxReported: 1,
+	})
+
+	res, err := st.Search(context.Background(), "query", storage.SearchOptions{Filter: "price:1500"})
+	require.NoError(t, err)
+	assert.Equal(t, primary.Results, res)
+
+	st.Wait()
+	assert.EqualValues(t, 1, shadow.Calls)
+
+	divergences := st.Divergences()
+	require.Len(t, divergences, 1)
+	assert.Equal(t, "query", divergences[0].Query)
+	assert.Equal(t, "price:1500", divergences[0].Filter)
+	assert.Equal(t, 2, divergences[0].Common)
+	assert.Equal(t, 2, divergences[0].HitsDelta)
+	assert.Equal(t, []string{"1", "2", "3"}, divergences[0].PrimaryIDs)
+	assert.Equal(t, []string{"4", "2", "1"}, divergences[0].ShadowIDs)
+
+	// divergences are reset once returned
+	assert.Empty(t, st.Divergences())
+}
+
+func TestShadowStorage_Search_Cached(t *testing.T) {
+	primary := &backendMock{
+		Results: storage.SearchResults{IDs: []string{"1", "2"}, Total: 2, Cached: true},
+	}
+	shadow := &backendMock{
+		Results: storage.SearchResults{IDs: []string{"2"}, Total: 1},
+		Delay:   10 * time.Millisecond,
+	}
+
+	st := storage.WithShadow(primary, shadow, storage.ShadowSettings{
+		SampleRate:  1,
+		TopN:        10,
+		MaxInFlight: 1,
+		Timeout:     time.Second,
+		MaxReported: 1,
+	})
+
+	_, err := st.Search(context.Background(), "query", storage.SearchOptions{})
+	require.NoError(t, err)
+
+	st.Wait()
+	assert.EqualValues(t, 1, shadow.Calls)
+
+	divergences := st.Divergences()
+	require.Len(t, divergences, 1)
+	assert.Equal(t, 0.5, divergences[0].Jaccard)
+	assert.Zero(t, divergences[0].LatencyDelta)
+
+	// stale results are not mirrored
+	primary.Results.Stale = true
+
+	_, err = st.Search(context.Background(), "query", storage.SearchOptions{})
+	require.NoError(t, err)
+
+	st.Wait()
+	assert.EqualValues(t, 1, shadow.Calls)
+}
+
+func TestShadowStorage_Search_WorstDivergences(t *testing.T) {
+	primary := &backendMock{
+		Results: storage.SearchResults{IDs: []string{"1", "2", "3", "4"}},
+	}
+	shadow := &shadowMock{
+		Results: []storage.SearchResults{
+			{IDs: []string{"1", "2", "3", "5"}},
+			{IDs: []string{"5", "6", "7", "8"}},
+			{IDs: []string{"1", "2", "3", "4"}},
+			{IDs: []string{"1", "5", "6", "7"}},
+		},
+	}
+
+	st := storage.WithShadow(primary, shadow, storage.ShadowSettings{
+		SampleRate:  1,
+		TopN:        10,
+		MaxInFlight: 1,
+		Timeout:     time.Second,
+		MaxReported: 2,
+	})
+
+	for range shadow.Results {
+		_, err := st.Search(context.Background(), "query", storage.SearchOptions{})
+		require.NoError(t, err)
+		st.Wait()
+	}
+
+	divergences := st.Divergences()
+	require.Len(t, divergences, 2)
+	assert.Equal(t, []string{"5", "6", "7", "8"}, divergences[0].ShadowIDs)
+	assert.Equal(t, []string{"1", "5", "6", "7"}, divergences[1].ShadowIDs)
+}
+
+func TestShadowStorage_Search_ShadowError(t *testing.T) {
+	primary := &backendMock{
+		Results: storage.SearchResults{IDs: []string{"1"}},
+	}
+	shadow := &backendMock{Error: errors.New("connection refused")}
+
+	st := storage.WithShadow(primary, shadow, storage.ShadowSettings{SampleRate: 1, MaxInFlight: 1, Timeout: time.Second})
+
+	res, err := st.Search(context.Background(), "query", storage.SearchOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, primary.Results, res)
+
+	st.Wait()
+	assert.EqualValues(t, 1, shadow.Calls)
+	assert.Empty(t, st.Divergences())
+}
+
+func TestShadowStorage_Search_NotMirrored(t *testing.T) {
+	examples := map[string]struct {
+		Primary    *backendMock
+		SampleRate float64
+	}{
+		"not sampled": {
+			Primary:    &backendMock{},
+			SampleRate: 0,
+		},
+		"primary error": {
+			Primary:    &backendMock{Error: errors.New("connection refused")},
+			SampleRate: 1,
+		},
+		"partial results": {
+			Primary:    &backendMock{Results: storage.SearchResults{TimedOut: true}},
+			SampleRate: 1,
+		},
+	}
+
+	for name, example := range examples {
+		example := example
+		t.Run(name, func(t *testing.T) {
+			shadow := &backendMock{}
+			st := storage.WithShadow(example.Primary, shadow, storage.ShadowSettings{
+				SampleRate:  example.SampleRate,
+				MaxInFlight: 1,
+				Timeout:     time.Second,
+			})
+
+			_, err := st.Search(context.Background(), "query", storage.SearchOptions{})
+			assert.Equal(t, example.Primary.Error, err)
+
+			st.Wait()
+			assert.EqualValues(t, 0, shadow.Calls)
+		})
+	}
+}
+
+func TestShadowStorage_Search_MaxInFlight(t *testing.T) {
+	primary := &backendMock{}
+	shadow := &backendMock{Delay: 100 * time.Millisecond}
+
+	st := storage.WithShadow(primary, shadow, storage.ShadowSettings{SampleRate: 1, MaxInFlight: 1, Timeout: time.Second})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := st.Search(context.Background(), "query", storage.SearchOptions{})
+		require.NoError(t, err)
+	}
+	// the caller does not wait for the shadow cluster to respond
+	assert.True(t, time.Since(start) < shadow.Delay)
+
+	st.Wait()
+	assert.EqualValues(t, 1, shadow.Calls)
+}
+
+func TestShadowStorage_Search_Detached(t *testing.T) {
+	primary := &backendMock{}
+	shadow := &shadowMock{
+		Results: []storage.SearchResults{{}},
+		Delay:   50 * time.Millisecond,
+	}
+
+	st := storage.WithShadow(primary, shadow, storage.ShadowSettings{SampleRate: 1, MaxInFlight: 1, Timeout: time.Second})
+
+	ctx, cancel := context.WithCancel(storage.WithOpaqueID(context.Background(), "req1"))
+	_, err := st.Search(ctx, "query", storage.SearchOptions{})
+	require.NoError(t, err)
+	cancel()
+
+	st.Wait()
+	// the shadow request is not cancelled along with the original one
+	assert.NoError(t, shadow.CtxErr)
+	assert.Equal(t, "req1", shadow.OpaqueID)
+}
+
+type shadowMock struct {
+	Results []storage.SearchResults
+	Delay   time.Duration
+
+	OpaqueID string
+	CtxErr   error
+
+	calls int32
+}
+
+func (m *shadowMock) Search(ctx context.Context, query string, opts storage.SearchOptions) (storage.SearchResults, error) {
+	n := atomic.AddInt32(&m.calls, 1)
+	time.Sleep(m.Delay)
+
+	m.OpaqueID, m.CtxErr = storage.OpaqueID(ctx), ctx.Err()
+
+	return m.Results[n-1], nil
+}
+
+func (m *shadowMock) Health(ctx context.Context) (storage.Health, error) {
+	return storage.Health{}, nil
+}
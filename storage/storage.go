@@ -3,12 +3,36 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+	"github.com/andrewslotin/es-search-service/tracing"
 
 	elasticsearch "github.com/elastic/go-elasticsearch/v7"
 	esapi "github.com/elastic/go-elasticsearch/v7/esapi"
 )
 
+var (
+	esRequestDuration = metrics.NewHistogramVec(
+		"search_service_elasticsearch_request_duration_seconds",
+		"Elasticsearch API call latency by operation.",
+		metrics.DefaultBuckets,
+		"operation",
+	)
+	esRequestErrors = metrics.NewCounterVec(
+		"search_service_elasticsearch_request_errors_total",
+		"Total number of failed Elasticsearch API calls by operation.",
+		"operation",
+	)
+)
+
+func init() {
+	metrics.Default.MustRegister(esRequestDuration, esRequestErrors)
+}
+
 // SearchOptions define the options to be passed to Elasticsearch API seach request
 type SearchOptions struct {
 	// From is the number of documents to skip before returning the result
@@ -19,30 +43,95 @@ type SearchOptions struct {
 	Sort []string
 	// Filter is the filter query in Lucene syntax. If provided, it's appended to the original query using AND operator
 	Filter string
+	// Timeout is the time Elasticsearch is allowed to spend on the query before returning the results
+	// collected so far. The request is cancelled if there is no response shortly after the timeout.
+	// A zero value means no timeout
+	Timeout time.Duration
+}
+
+// ShardFailure describes a failure to query an index shard
+type ShardFailure struct {
+	Index  string `json:"index"`
+	Shard  int    `json:"shard"`
+	Reason string `json:"reason"`
+}
+
+// Shards is a summary of shards involved into a search query
+type Shards struct {
+	Total      int            `json:"total"`
+	Successful int            `json:"successful"`
+	Skipped    int            `json:"skipped"`
+	Failed     int            `json:"failed"`
+	Failures   []ShardFailure `json:"failures,omitempty"`
+}
+
+// SearchResults is the outcome of a search query
+type SearchResults struct {
+	// Documents is the list of JSON documents matching the query
+	Documents []json.RawMessage
+	// IDs is the list of matching document IDs in the same order as Documents
+	IDs []string
+	// Total is the number of documents matching the query
+	Total int
+	// Took is the time Elasticsearch spent executing the query
+	Took time.Duration
+	// Cached is true if the results were served from cache
+	Cached bool
+	// Stale is true if the results were served from cache after they had expired, because
+	// Elasticsearch was not available
+	Stale bool
+	// Age is the time since stale results were fetched from Elasticsearch
+	Age time.Duration
+	// TimedOut is true if Elasticsearch has returned the results collected before the query timed out
+	TimedOut bool
+	// Shards is the summary of shards involved into the query
+	Shards Shards
+	// Cluster is the name of the cluster that served the request
+	Cluster string
+}
+
+// Partial returns true if the results are incomplete due to a timeout or shard failures
+func (res SearchResults) Partial() bool {
+	return res.TimedOut || res.Shards.Failed > 0
 }
 
+// ErrTimeout is returned when Elasticsearch does not respond within the search timeout
+var ErrTimeout = errors.New("search timed out")
+
+// timeoutGracePeriod is the time to wait for Elasticsearch to respond with partial results
+// after the search timeout expires
+const timeoutGracePeriod = 250 * time.Millisecond
+
 // Storage implements access to the Elasticsearch cluster
 type Storage struct {
-	es *elasticsearch.Client
+	es    *elasticsearch.Client
+	index string
+
+	lastSuccessfulQuery int64 // unix nanoseconds, accessed atomically
 }
 
-// New initializes a new instance of an Elasticsearch-backed storage
-func New(c *elasticsearch.Client) *Storage {
-	return &Storage{es: c}
+// New initializes a new instance of an Elasticsearch-backed storage that operates on
+// documents stored in index. If index is empty, the search is performed across all indices
+func New(c *elasticsearch.Client, index string) *Storage {
+	return &Storage{es: c, index: index}
 }
 
 // Search queries the Elasticsearch cluster and returns a list of JSON documents
 // matching the search query.
-func (st *Storage) Search(ctx context.Context, query string, opts SearchOptions) ([]json.RawMessage, error) {
+func (st *Storage) Search(ctx context.Context, query string, opts SearchOptions) (SearchResults, error) {
+	_, span := tracing.StartSpan(ctx, "storage.BuildQuery", tracing.SpanKindInternal)
 	if opts.Filter != "" {
 		query += " AND (" + opts.Filter + ")"
 	}
 
 	req := []func(*esapi.SearchRequest){
-		st.es.Search.WithContext(ctx),
 		st.es.Search.WithQuery(query),
 	}
 
+	if st.index != "" {
+		req = append(req, st.es.Search.WithIndex(st.index))
+	}
+
 	if opts.From > 0 {
 		req = append(req, st.es.Search.WithFrom(opts.From))
 	}
@@ -55,27 +144,154 @@ func (st *Storage) Search(ctx context.Context, query string, opts SearchOptions)
 		req = append(req, st.es.Search.WithSort(opts.Sort...))
 	}
 
+	if opts.Timeout > 0 {
+		req = append(req, st.es.Search.WithTimeout(opts.Timeout))
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout+timeoutGracePeriod)
+		defer cancel()
+	}
+	span.SetAttribute("db.statement", query)
+	span.End()
+
+	ctx, span = tracing.StartSpan(ctx, "elasticsearch.search", tracing.SpanKindClient)
+	defer span.End()
+
+	span.SetAttribute("db.system", "elasticsearch")
+	span.SetAttribute("db.operation", "search")
+	span.SetAttribute("db.elasticsearch.index", st.indexName())
+	span.SetAttribute("db.statement", query)
+
+	req = append(req, st.es.Search.WithContext(ctx), st.es.Search.WithHeader(requestHeaders(ctx)))
+
+	start := time.Now()
 	resp, err := st.es.Search(req...)
+	esRequestDuration.With("search").Observe(time.Since(start).Seconds())
 	if err != nil {
-		return nil, fmt.Errorf("failed to query elasticsearch: %s", err)
+		esRequestErrors.With("search").Inc()
+		span.SetError(err)
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return SearchResults{}, ErrTimeout
+		}
+
+		return SearchResults{}, fmt.Errorf("failed to query elasticsearch: %s", err)
 	}
 	defer resp.Body.Close()
 
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.IsError() {
+		esRequestErrors.With("search").Inc()
+		err := &ResponseError{StatusCode: resp.StatusCode, Status: resp.Status()}
+		span.SetError(err)
+		return SearchResults{}, err
+	}
+
 	var searchResults struct {
+		Took     int64 `json:"took"`
+		TimedOut bool  `json:"timed_out"`
+		Shards   struct {
+			Total      int `json:"total"`
+			Successful int `json:"successful"`
+			Skipped    int `json:"skipped"`
+			Failed     int `json:"failed"`
+			Failures   []struct {
+				Index  string `json:"index"`
+				Shard  int    `json:"shard"`
+				Reason struct {
+					Type   string `json:"type"`
+					Reason string `json:"reason"`
+				} `json:"reason"`
+			} `json:"failures"`
+		} `json:"_shards"`
 		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
 			Hits []struct {
+				ID     string          `json:"_id"`
 				Source json.RawMessage `json:"_source"`
 			} `json:"hits"`
 		} `json:"hits"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&searchResults); err != nil {
-		return nil, fmt.Errorf("failed to parse search results: %s", err)
+		return SearchResults{}, fmt.Errorf("failed to parse search results: %s", err)
 	}
 
-	var results []json.RawMessage
+	results := SearchResults{
+		Took:     time.Duration(searchResults.Took) * time.Millisecond,
+		Total:    searchResults.Hits.Total.Value,
+		TimedOut: searchResults.TimedOut,
+		Shards: Shards{
+			Total:      searchResults.Shards.Total,
+			Successful: searchResults.Shards.Successful,
+			Skipped:    searchResults.Shards.Skipped,
+			Failed:     searchResults.Shards.Failed,
+		},
+	}
+	for _, f := range searchResults.Shards.Failures {
+		results.Shards.Failures = append(results.Shards.Failures, ShardFailure{
+			Index:  f.Index,
+			Shard:  f.Shard,
+			Reason: f.Reason.Type + ": " + f.Reason.Reason,
+		})
+	}
 	for _, res := range searchResults.Hits.Hits {
-		results = append(results, res.Source)
+		results.Documents = append(results.Documents, res.Source)
+		results.IDs = append(results.IDs, res.ID)
 	}
+	span.SetAttribute("db.elasticsearch.hits", len(results.Documents))
+	span.SetAttribute("db.elasticsearch.timed_out", results.TimedOut)
+	span.SetAttribute("db.elasticsearch.shards.failed", results.Shards.Failed)
+	atomic.StoreInt64(&st.lastSuccessfulQuery, time.Now().UnixNano())
 
 	return results, nil
 }
+
+// ResponseError is returned when Elasticsearch responds with an error status
+type ResponseError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *ResponseError) Error() string {
+	return "elasticsearch responded with " + e.Status
+}
+
+func (st *Storage) indexName() string {
+	if st.index == "" {
+		return "_all"
+	}
+
+	return st.index
+}
+
+// requestHeaders returns the HTTP headers that propagate request origin and trace context
+// stored in ctx to Elasticsearch
+func requestHeaders(ctx context.Context) map[string]string {
+	headers := make(map[string]string)
+
+	if id := OpaqueID(ctx); id != "" {
+		headers["X-Opaque-Id"] = id
+	}
+
+	if sc := tracing.SpanFromContext(ctx).Context(); sc.IsValid() {
+		headers[tracing.TraceparentHeader] = sc.Traceparent()
+	}
+
+	return headers
+}
+
+type opaqueIDKey struct{}
+
+// WithOpaqueID returns a copy of ctx carrying the ID to be sent to Elasticsearch in X-Opaque-Id
+// header, so that the requests could be traced back to their origin in cluster logs
+func WithOpaqueID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, opaqueIDKey{}, id)
+}
+
+// OpaqueID returns the X-Opaque-Id value stored in ctx
+func OpaqueID(ctx context.Context) string {
+	id, _ := ctx.Value(opaqueIDKey{}).(string)
+	return id
+}
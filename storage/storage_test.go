@@ -8,8 +8,10 @@ import (
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/andrewslotin/es-search-service/storage"
+	"github.com/andrewslotin/es-search-service/tracing"
 
 	elasticsearch "github.com/elastic/go-elasticsearch/v7"
 	"github.com/stretchr/testify/assert"
@@ -67,6 +69,16 @@ func TestElasticsearchStorage_Search(t *testing.T) {
 				"q": []string{"search term AND (a:1 OR b:2)"},
 			},
 		},
+		"with timeout": {
+			Query: "search term",
+			Options: storage.SearchOptions{
+				Timeout: 1500 * time.Millisecond,
+			},
+			ExpectedParameters: url.Values{
+				"q":       []string{"search term"},
+				"timeout": []string{"1500ms"},
+			},
+		},
 	}
 	for name, testCase := range testCases {
 		t.Run(name, func(t *testing.T) {
@@ -94,20 +106,163 @@ func TestElasticsearchStorage_Search(t *testing.T) {
 			})
 			require.NoError(t, err)
 
-			st := storage.New(c)
+			st := storage.New(c, "")
 
 			results, err := st.Search(context.Background(), testCase.Query, testCase.Options)
 			require.NoError(t, err)
 
-			require.Len(t, results, 2)
-			assert.JSONEq(t, string(results[0]), `{"key": "value"}`)
-			assert.JSONEq(t, string(results[1]), `{"answer": 42}`)
+			require.Len(t, results.Documents, 2)
+			assert.JSONEq(t, string(results.Documents[0]), `{"key": "value"}`)
+			assert.JSONEq(t, string(results.Documents[1]), `{"answer": 42}`)
+			assert.Equal(t, []string{"1", "2"}, results.IDs)
+			assert.Equal(t, 2, results.Total)
+			assert.Equal(t, 10*time.Millisecond, results.Took)
 
 			assert.Equal(t, 1, numRequests)
 		})
 	}
 }
 
+func TestElasticsearchStorage_Search_OpaqueID(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	var opaqueID string
+	mux.Handle("/_search", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		opaqueID = req.Header.Get("X-Opaque-Id")
+		w.Write([]byte(`{"hits": {"hits": []}}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	ctx := storage.WithOpaqueID(context.Background(), "req-123")
+	_, err = storage.New(c, "").Search(ctx, "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "req-123", opaqueID)
+}
+
+func TestElasticsearchStorage_Search_Tracing(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	var traceparent string
+	mux.Handle("/_search", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		w.Write([]byte(`{"hits": {"hits": [{"_source": {}}]}}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	e := &tracing.InMemoryExporter{}
+	ctx, parent := tracing.NewTracer(e).Start(context.Background(), "server", tracing.SpanKindServer, tracing.SpanContext{})
+
+	_, err = storage.New(c, "").Search(ctx, "search term", storage.SearchOptions{Filter: "a:1"})
+	require.NoError(t, err)
+
+	spans := e.Spans()
+	require.Len(t, spans, 2)
+
+	assert.Equal(t, "storage.BuildQuery", spans[0].Name)
+	assert.Equal(t, parent.Context().SpanID, spans[0].Parent.SpanID)
+
+	assert.Equal(t, "elasticsearch.search", spans[1].Name)
+	assert.Equal(t, parent.Context().SpanID, spans[1].Parent.SpanID)
+	assert.Equal(t, "search term AND (a:1)", spans[1].Attributes["db.statement"])
+	assert.Equal(t, 1, spans[1].Attributes["db.elasticsearch.hits"])
+
+	assert.Equal(t, spans[1].Context.Traceparent(), traceparent)
+}
+
+func TestElasticsearchStorage_Search_ErrorResponse(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/_search", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"error": "search_phase_execution_exception"}`, http.StatusServiceUnavailable)
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	_, err = storage.New(c, "").Search(context.Background(), "search term", storage.SearchOptions{})
+	assert.Error(t, err)
+}
+
+func TestElasticsearchStorage_Search_PartialResults(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/_search", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{
+			"took": 100,
+			"timed_out": true,
+			"_shards": {
+				"total": 3,
+				"successful": 2,
+				"skipped": 0,
+				"failed": 1,
+				"failures": [{
+					"shard": 1,
+					"index": "products",
+					"reason": {"type": "query_shard_exception", "reason": "failed to create query"}
+				}]
+			},
+			"hits": {"hits": [{"_source": {"key": "value"}}]}
+		}`))
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	results, err := storage.New(c, "").Search(context.Background(), "search term", storage.SearchOptions{})
+	require.NoError(t, err)
+
+	assert.Len(t, results.Documents, 1)
+	assert.True(t, results.Partial())
+	assert.True(t, results.TimedOut)
+	assert.Equal(t, storage.Shards{
+		Total:      3,
+		Successful: 2,
+		Failed:     1,
+		Failures: []storage.ShardFailure{
+			{Index: "products", Shard: 1, Reason: "query_shard_exception: failed to create query"},
+		},
+	}, results.Shards)
+}
+
+func TestElasticsearchStorage_Search_Timeout(t *testing.T) {
+	node, mux, teardown := setupTS()
+	defer teardown()
+
+	mux.Handle("/_search", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{node},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = storage.New(c, "").Search(context.Background(), "search term", storage.SearchOptions{Timeout: 10 * time.Millisecond})
+	assert.Equal(t, storage.ErrTimeout, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
 func setupTS() (string, *http.ServeMux, func()) {
 	mux := http.NewServeMux()
 	ts := httptest.NewServer(mux)
@@ -0,0 +1,101 @@
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ClientOptions configure TLS for outgoing connections
+type ClientOptions struct {
+	// CAFile is a PEM-encoded CA bundle to verify server certificates against instead of system roots
+	CAFile string
+	// CertFingerprint is a hex-encoded SHA-256 fingerprint of the server certificate. If set, the server
+	// is trusted if its leaf certificate has this fingerprint regardless of the CA that issued it, so it
+	// can't be combined with CAFile
+	CertFingerprint string
+	// CertFile and KeyFile are the PEM-encoded client certificate and key to present to the server
+	CertFile, KeyFile string
+}
+
+// Empty returns true if no options were set
+func (opts ClientOptions) Empty() bool {
+	return opts == ClientOptions{}
+}
+
+// ClientConfig builds a client TLS configuration from the options
+func ClientConfig(opts ClientOptions) (*tls.Config, error) {
+	if opts.CAFile != "" && opts.CertFingerprint != "" {
+		return nil, errors.New("CA bundle and certificate fingerprint are mutually exclusive")
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if opts.CAFile != "" {
+		pool, err := LoadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA bundle: %s", err)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if opts.CertFingerprint != "" {
+		fingerprint, err := parseFingerprint(opts.CertFingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// the default verification is replaced with the fingerprint check
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = VerifyFingerprint(fingerprint)
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, errors.New("both client certificate and key files are required")
+		}
+
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// VerifyFingerprint returns a tls.Config.VerifyPeerCertificate function that accepts a certificate
+// chain if its leaf certificate has given SHA-256 fingerprint. The rest of the chain is ignored, since
+// the peer only proves the possession of the leaf certificate key
+func VerifyFingerprint(fingerprint []byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server did not present a certificate")
+		}
+
+		sum := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(sum[:], fingerprint) {
+			return errors.New("server certificate does not match the pinned fingerprint")
+		}
+
+		return nil
+	}
+}
+
+// parseFingerprint decodes a hex-encoded SHA-256 fingerprint, optionally delimited by colons
+func parseFingerprint(s string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("malformed certificate fingerprint %q, expected hex-encoded SHA-256 hash", s)
+	}
+
+	return fingerprint, nil
+}
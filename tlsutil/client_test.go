@@ -0,0 +1,122 @@
+package tlsutil_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/tlsutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientConfig_CertFingerprint(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	sum := sha256.Sum256(ts.Certificate().Raw)
+
+	testCases := map[string]struct {
+		Fingerprint string
+		ExpectError bool
+	}{
+		"matching fingerprint":    {Fingerprint: hex.EncodeToString(sum[:])},
+		"colon-delimited":         {Fingerprint: colonDelimited(hex.EncodeToString(sum[:]))},
+		"mismatching fingerprint": {Fingerprint: hex.EncodeToString(make([]byte, sha256.Size)), ExpectError: true},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := tlsutil.ClientConfig(tlsutil.ClientOptions{CertFingerprint: testCase.Fingerprint})
+			require.NoError(t, err)
+
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+			resp, err := c.Get(ts.URL)
+			if testCase.ExpectError {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestClientConfig_CAFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "tlsutil")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600))
+
+	cfg, err := tlsutil.ClientConfig(tlsutil.ClientOptions{CAFile: caFile})
+	require.NoError(t, err)
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+
+	resp, err := c.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	sum := sha256.Sum256(ts.Certificate().Raw)
+	_, err = tlsutil.ClientConfig(tlsutil.ClientOptions{CAFile: caFile, CertFingerprint: hex.EncodeToString(sum[:])})
+	assert.Error(t, err)
+}
+
+func TestClientConfig_ClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "client")
+
+	cfg, err := tlsutil.ClientConfig(tlsutil.ClientOptions{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	assert.Len(t, cfg.Certificates, 1)
+
+	_, err = tlsutil.ClientConfig(tlsutil.ClientOptions{CertFile: certFile})
+	assert.Error(t, err)
+}
+
+func TestVerifyFingerprint(t *testing.T) {
+	pinned, foreign := []byte("pinned certificate"), []byte("foreign certificate")
+	sum := sha256.Sum256(pinned)
+
+	verify := tlsutil.VerifyFingerprint(sum[:])
+
+	assert.NoError(t, verify([][]byte{pinned}, nil))
+	assert.NoError(t, verify([][]byte{pinned, foreign}, nil))
+	assert.Error(t, verify([][]byte{foreign, pinned}, nil))
+	assert.Error(t, verify(nil, nil))
+}
+
+func TestClientConfig_MalformedFingerprint(t *testing.T) {
+	_, err := tlsutil.ClientConfig(tlsutil.ClientOptions{CertFingerprint: "abc"})
+	assert.Error(t, err)
+}
+
+func colonDelimited(s string) string {
+	var res string
+	for i := 0; i < len(s); i += 2 {
+		if i > 0 {
+			res += ":"
+		}
+		res += s[i : i+2]
+	}
+
+	return res
+}
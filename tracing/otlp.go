@@ -0,0 +1,217 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	otlpQueueSize     = 2048
+	otlpMaxBatchSize  = 512
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector using OTLP/HTTP JSON protocol
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+
+	queue chan SpanData
+	flush chan chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewOTLPExporter starts an exporter sending spans to the OTLP/HTTP traces endpoint, i.e.
+// http://localhost:4318/v1/traces
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan SpanData, otlpQueueSize),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+
+	return e
+}
+
+// Export enqueues the span to be sent with the next batch. Spans are dropped if the queue is full
+func (e *OTLPExporter) Export(span SpanData) {
+	select {
+	case e.queue <- span:
+	default:
+		log.Printf("tracing: export queue is full, dropping span %s", span.Name)
+	}
+}
+
+// Shutdown sends all queued spans and stops the exporter
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	flushed := make(chan struct{})
+
+	select {
+	case e.flush <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	e.once.Do(func() { close(e.done) })
+
+	return nil
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpMaxBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case flushed := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.send(batch)
+			batch = nil
+			close(flushed)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) send(batch []SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		log.Printf("tracing: failed to encode spans: %s", err)
+		return
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("tracing: failed to export %d spans: %s", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("tracing: failed to export %d spans: collector responded with %s", len(batch), resp.Status)
+	}
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func (e *OTLPExporter) encode(batch []SpanData) interface{} {
+	spans := make([]otlpSpan, len(batch))
+	for i, data := range batch {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(data.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(data.Context.SpanID[:]),
+			Name:              data.Name,
+			Kind:              data.Kind,
+			StartTimeUnixNano: strconv.FormatInt(data.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(data.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(data.Attributes),
+		}
+
+		if data.Parent.IsValid() {
+			span.ParentSpanID = hex.EncodeToString(data.Parent.SpanID[:])
+		}
+
+		if data.Error != "" {
+			span.Status.Code = 2 // STATUS_CODE_ERROR
+			span.Status.Message = data.Error
+		}
+
+		spans[i] = span
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": encodeAttributes(map[string]interface{}{"service.name": e.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": e.serviceName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func encodeAttributes(attrs map[string]interface{}) []otlpAttribute {
+	var res []otlpAttribute
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		res = append(res, otlpAttribute{Key: k, Value: value})
+	}
+
+	return res
+}
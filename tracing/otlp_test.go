@@ -0,0 +1,72 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/tracing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "/v1/traces", req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+		var payload map[string]interface{}
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&payload))
+
+		received <- payload
+	}))
+	defer ts.Close()
+
+	e := tracing.NewOTLPExporter(ts.URL+"/v1/traces", "test-service")
+
+	parent, err := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+
+	_, span := tracing.NewTracer(e).Start(context.Background(), "GET /v1/products", tracing.SpanKindServer, parent)
+	span.SetAttribute("http.status_code", 200)
+	span.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, e.Shutdown(ctx))
+
+	var payload map[string]interface{}
+	select {
+	case payload = <-received:
+	default:
+		t.Fatal("collector has not received any spans")
+	}
+
+	rs := payload["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"attributes": []interface{}{
+			map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "test-service"}},
+		},
+	}, rs["resource"])
+
+	spans := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	require.Len(t, spans, 1)
+
+	exported := spans[0].(map[string]interface{})
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", exported["traceId"])
+	assert.Equal(t, span.Context().Traceparent()[36:52], exported["spanId"])
+	assert.Equal(t, "00f067aa0ba902b7", exported["parentSpanId"])
+	assert.Equal(t, "GET /v1/products", exported["name"])
+	assert.Equal(t, float64(tracing.SpanKindServer), exported["kind"])
+	assert.NotEmpty(t, exported["startTimeUnixNano"])
+	assert.NotEmpty(t, exported["endTimeUnixNano"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "http.status_code", "value": map[string]interface{}{"intValue": "200"}},
+	}, exported["attributes"])
+}
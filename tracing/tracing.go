@@ -0,0 +1,269 @@
+// Package tracing implements distributed tracing with W3C Trace Context propagation
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the name of W3C Trace Context header
+const TraceparentHeader = "traceparent"
+
+const flagSampled = 0x01
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// IsValid returns true if both trace and span IDs are non-zero
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// IsSampled returns true if the sampled flag is set
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// Traceparent returns the span context formatted as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+// ParseTraceparent parses W3C traceparent header value
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, errors.New("malformed traceparent")
+	}
+
+	// version 00 defines exactly 4 fields, future versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, errors.New("malformed traceparent")
+	}
+
+	var flags [1]byte
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, fmt.Errorf("malformed trace id: %s", err)
+	}
+
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, fmt.Errorf("malformed parent id: %s", err)
+	}
+
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, fmt.Errorf("malformed trace flags: %s", err)
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return sc, errors.New("invalid trace or parent id")
+	}
+
+	return sc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return fmt.Errorf("expected %d lowercase hex digits", 2*len(dst))
+	}
+
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// SpanKind describes the relationship between the span and its parent
+type SpanKind int
+
+// Span kinds as defined by OpenTelemetry
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// SpanData is a snapshot of a finished span passed to the Exporter
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanContext
+	Start, End time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+// Exporter sends finished spans to a tracing backend
+type Exporter interface {
+	Export(span SpanData)
+}
+
+// Tracer creates spans and passes them to the Exporter once finished
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a new tracer that exports spans using e. If e is nil, the tracer
+// only propagates the trace context without recording any spans
+func NewTracer(e Exporter) *Tracer {
+	return &Tracer{exporter: e}
+}
+
+// Start starts a new span as a child of remote parent. If the parent is not valid, a new trace is started
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, parent SpanContext) (context.Context, *Span) {
+	sc := SpanContext{
+		TraceID: parent.TraceID,
+		Flags:   parent.Flags,
+	}
+
+	if !parent.IsValid() {
+		sc.TraceID = newTraceID()
+		sc.Flags = flagSampled
+		parent = SpanContext{}
+	}
+	sc.SpanID = newSpanID()
+
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:       name,
+			Kind:       kind,
+			Context:    sc,
+			Parent:     parent,
+			Start:      time.Now(),
+			Attributes: make(map[string]interface{}),
+		},
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span stored in ctx or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a child span of the current span stored in ctx. If there is no span in ctx,
+// it returns a nil span that is safe to use and does not record anything
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	return parent.tracer.Start(ctx, name, kind, parent.data.Context)
+}
+
+// Span represents a single operation within a trace. All methods are safe to call on a nil span
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// Context returns the span context
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.data.Context
+}
+
+// SetAttribute sets a span attribute. Supported value types are string, bool, int, int64 and float64
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and passes it to the exporter if the trace is sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+
+	data := s.data
+	data.Attributes = make(map[string]interface{}, len(s.data.Attributes))
+	for k, v := range s.data.Attributes {
+		data.Attributes[k] = v
+	}
+	s.mu.Unlock()
+
+	if s.tracer.exporter != nil && data.Context.IsSampled() {
+		s.tracer.exporter.Export(data)
+	}
+}
+
+func newTraceID() (id [16]byte) {
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return id
+}
+
+// InMemoryExporter keeps exported spans in memory. It's intended to be used in tests
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// Export stores the span
+func (e *InMemoryExporter) Export(span SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns all exported spans in the order they were finished
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]SpanData(nil), e.spans...)
+}
@@ -0,0 +1,110 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/tracing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+
+	assert.True(t, sc.IsValid())
+	assert.True(t, sc.IsSampled())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+}
+
+func TestParseTraceparent_Malformed(t *testing.T) {
+	for name, s := range map[string]string{
+		"empty":           "",
+		"invalid version": "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"extra fields":    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-00",
+		"short trace id":  "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"uppercase":       "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"zero trace id":   "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"zero parent id":  "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := tracing.ParseTraceparent(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTracer_Start(t *testing.T) {
+	e := &tracing.InMemoryExporter{}
+	tr := tracing.NewTracer(e)
+
+	parent, err := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+
+	ctx, span := tr.Start(context.Background(), "server", tracing.SpanKindServer, parent)
+	span.SetAttribute("key", "value")
+
+	_, child := tracing.StartSpan(ctx, "client", tracing.SpanKindClient)
+	child.SetError(errors.New("failed"))
+	child.End()
+	span.End()
+	span.End() // ending span twice should not export it again
+
+	spans := e.Spans()
+	require.Len(t, spans, 2)
+
+	assert.Equal(t, "client", spans[0].Name)
+	assert.Equal(t, tracing.SpanKindClient, spans[0].Kind)
+	assert.Equal(t, parent.TraceID, spans[0].Context.TraceID)
+	assert.Equal(t, span.Context().SpanID, spans[0].Parent.SpanID)
+	assert.Equal(t, "failed", spans[0].Error)
+
+	assert.Equal(t, "server", spans[1].Name)
+	assert.Equal(t, parent, spans[1].Parent)
+	assert.Equal(t, parent.TraceID, spans[1].Context.TraceID)
+	assert.NotEqual(t, parent.SpanID, spans[1].Context.SpanID)
+	assert.Equal(t, map[string]interface{}{"key": "value"}, spans[1].Attributes)
+}
+
+func TestTracer_Start_NewTrace(t *testing.T) {
+	e := &tracing.InMemoryExporter{}
+
+	_, span := tracing.NewTracer(e).Start(context.Background(), "server", tracing.SpanKindServer, tracing.SpanContext{})
+	span.End()
+
+	spans := e.Spans()
+	require.Len(t, spans, 1)
+
+	assert.True(t, spans[0].Context.IsValid())
+	assert.True(t, spans[0].Context.IsSampled())
+	assert.False(t, spans[0].Parent.IsValid())
+}
+
+func TestTracer_Start_NotSampled(t *testing.T) {
+	e := &tracing.InMemoryExporter{}
+
+	parent, err := tracing.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	require.NoError(t, err)
+
+	_, span := tracing.NewTracer(e).Start(context.Background(), "server", tracing.SpanKindServer, parent)
+	span.End()
+
+	assert.Empty(t, e.Spans())
+	assert.True(t, span.Context().IsValid())
+}
+
+func TestStartSpan_WithoutParent(t *testing.T) {
+	ctx, span := tracing.StartSpan(context.Background(), "client", tracing.SpanKindClient)
+
+	assert.Nil(t, span)
+	assert.Nil(t, tracing.SpanFromContext(ctx))
+
+	// nil spans are safe to use
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+	assert.False(t, span.Context().IsValid())
+}
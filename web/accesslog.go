@@ -0,0 +1,130 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+const maxRequestIDLength = 128
+
+// RequestIDHeader is the name of an HTTP header carrying the request ID
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request being served
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDMiddleware assigns an ID to each request and echoes it in X-Request-ID response header.
+// A valid X-Request-ID provided by the client is preserved, otherwise a new random ID is generated.
+// The ID is also passed to Elasticsearch as X-Opaque-Id
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, req.WithContext(storage.WithOpaqueID(ctx, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("failed to generate request id: %s", err)
+	}
+
+	return hex.EncodeToString(b[:])
+}
+
+// accessLogEntry is a single record of the access log. Handlers down the chain
+// populate it with request details as they become known
+type accessLogEntry struct {
+	Time       string   `json:"time"`
+	RequestID  string   `json:"request_id,omitempty"`
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	Principal  string   `json:"principal,omitempty"`
+	Query      string   `json:"query,omitempty"`
+	Filter     string   `json:"filter,omitempty"`
+	DocumentID string   `json:"document_id,omitempty"`
+	Results    *int     `json:"results,omitempty"`
+	TookMs     *float64 `json:"es_took_ms,omitempty"`
+	Cached     bool     `json:"cached,omitempty"`
+	Stale      bool     `json:"stale,omitempty"`
+	Partial    bool     `json:"partial,omitempty"`
+	Cluster    string   `json:"cluster,omitempty"`
+	LatencyMs  float64  `json:"latency_ms"`
+	Status     int      `json:"status"`
+}
+
+type accessLogEntryKey struct{}
+
+// annotateAccessLog applies fn to the access log entry of the request, if there is one
+func annotateAccessLog(ctx context.Context, fn func(e *accessLogEntry)) {
+	if e, ok := ctx.Value(accessLogEntryKey{}).(*accessLogEntry); ok {
+		fn(e)
+	}
+}
+
+// AccessLogMiddleware writes a JSON access log record to w for each request served by next
+func AccessLogMiddleware(w io.Writer, next http.Handler) http.Handler {
+	var mu sync.Mutex
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			RequestID: RequestID(req.Context()),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+		}
+
+		rec := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), accessLogEntryKey{}, entry)))
+
+		entry.Status = rec.Status()
+		entry.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+
+		b, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("failed to marshal access log entry: %s", err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Write(append(b, '\n'))
+	})
+}
@@ -0,0 +1,104 @@
+package web_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/mapping"
+	"github.com/andrewslotin/es-search-service/storage"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	testCases := map[string]struct {
+		RequestID string
+		Preserved bool
+	}{
+		"provided by client": {RequestID: "abc-123", Preserved: true},
+		"missing":            {RequestID: ""},
+		"invalid":            {RequestID: "abc 123"},
+		"too long":           {RequestID: strings.Repeat("a", 129)},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if testCase.RequestID != "" {
+				req.Header.Set("X-Request-ID", testCase.RequestID)
+			}
+
+			var requestID, opaqueID string
+			h := web.RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				requestID = web.RequestID(req.Context())
+				opaqueID = storage.OpaqueID(req.Context())
+			}))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			require.NotEmpty(t, requestID)
+			assert.Equal(t, requestID, rec.Header().Get("X-Request-ID"))
+			assert.Equal(t, requestID, opaqueID)
+
+			if testCase.Preserved {
+				assert.Equal(t, testCase.RequestID, requestID)
+			} else {
+				assert.NotEqual(t, testCase.RequestID, requestID)
+			}
+		})
+	}
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+
+	m := &searcherMock{
+		Results: []json.RawMessage{json.RawMessage(`{"key": "value"}`)},
+	}
+	h := web.RequestIDMiddleware(web.AccessLogMiddleware(&buf, web.AuthMiddleware(web.SearchHandler(m, mapping.Products, 0, 0))))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/products?q=Nike&filter=price:1500", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	req.SetBasicAuth("user1", "password2")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+
+	assert.Equal(t, "req-1", entry["request_id"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/v1/products", entry["path"])
+	assert.Equal(t, "user1", entry["principal"])
+	assert.Equal(t, "Nike", entry["query"])
+	assert.Equal(t, "price:1500", entry["filter"])
+	assert.Equal(t, float64(1), entry["results"])
+	assert.Equal(t, float64(http.StatusOK), entry["status"])
+	assert.Contains(t, entry, "es_took_ms")
+	assert.Contains(t, entry, "latency_ms")
+	assert.Contains(t, entry, "time")
+}
+
+func TestAccessLogMiddleware_Unauthorized(t *testing.T) {
+	var buf bytes.Buffer
+
+	h := web.AccessLogMiddleware(&buf, web.AuthMiddleware(web.SearchHandler(&searcherMock{}, mapping.Products, 0, 0)))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/products?q=Nike", nil))
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+
+	assert.Equal(t, float64(http.StatusUnauthorized), entry["status"])
+	assert.NotContains(t, entry, "principal")
+	assert.NotContains(t, entry, "results")
+}
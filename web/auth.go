@@ -1,6 +1,9 @@
 package web
 
-import "net/http"
+import (
+	"crypto/subtle"
+	"net/http"
+)
 
 // AuthenticatedRequest is an http.Request with accompanied by the name of the user
 // on whose behalf it had been made
@@ -12,21 +15,114 @@ type AuthenticatedRequest struct {
 // SecureHandler is an http.Handler that requires requests to be authenticated first
 type SecureHandler func(w http.ResponseWriter, req AuthenticatedRequest)
 
+// Principal returns the name of the user on whose behalf the request is made. A verified TLS client
+// certificate takes precedence over the Basic credentials, in this case the certificate subject common
+// name is used as a principal name
+func Principal(req *http.Request) (string, bool) {
+	if name, ok := certificatePrincipal(req); ok {
+		return name, true
+	}
+
+	user, _, ok := req.BasicAuth()
+
+	return user, ok
+}
+
+// certificatePrincipal returns the name of the principal identified by a verified TLS client certificate
+func certificatePrincipal(req *http.Request) (string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName, true
+	}
+
+	return subject.String(), true
+}
+
+type authenticator interface {
+	Authenticate(user, password string) bool
+}
+
+// VerifiedPrincipal returns the name of the principal if their identity has been verified, i.e. they either
+// presented a verified TLS client certificate or used the password configured for the user. Unlike Principal,
+// it returns false for Basic credentials without a configured password
+func VerifiedPrincipal(req *http.Request, authn authenticator) (string, bool) {
+	if name, ok := certificatePrincipal(req); ok {
+		return name, true
+	}
+
+	user, pass, ok := req.BasicAuth()
+	if !ok || !authn.Authenticate(user, pass) {
+		return "", false
+	}
+
+	return user, true
+}
+
 // AuthMiddleware performs authentication before passing the request to
-// the underlying handler. It responds with HTTP 401 if there was no
-// Authorization header provided and stops request handling
+// the underlying handler. It responds with HTTP 401 if there was neither
+// Authorization header nor a verified client certificate provided and stops
+// request handling
 func AuthMiddleware(next SecureHandler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		user, _, ok := req.BasicAuth()
+		user, ok := Principal(req)
 		if !ok {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Please login"`)
 			writeError(w, http.StatusUnauthorized, "")
 			return
 		}
 
+		annotateAccessLog(req.Context(), func(e *accessLogEntry) { e.Principal = user })
+
 		next(w, AuthenticatedRequest{
 			Request:  req,
 			Username: user,
 		})
 	})
 }
+
+// CredentialsMiddleware protects next with HTTP Basic authentication using a single set of credentials.
+// It responds with HTTP 401 if provided credentials do not match
+func CredentialsMiddleware(username, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Please login"`)
+			writeError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+type scopeAuthorizer interface {
+	authenticator
+	Granted(principal, scope string) bool
+}
+
+// ScopeMiddleware passes the request to next only if the principal has been granted the scope. Since any
+// Basic credentials are accepted by AuthMiddleware, the principal must either present a verified TLS client
+// certificate or use the password configured for the user. It responds with HTTP 401 if the password does
+// not match and with HTTP 403 if the scope has not been granted
+func ScopeMiddleware(scope string, authz scopeAuthorizer, next SecureHandler) SecureHandler {
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		if _, ok := VerifiedPrincipal(req.Request, authz); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Please login"`)
+			writeError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		if !authz.Granted(req.Username, scope) {
+			writeError(w, http.StatusForbidden, "the "+scope+" scope is required")
+			return
+		}
+
+		next(w, req)
+	}
+}
@@ -1,6 +1,9 @@
 package web_test
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
@@ -45,3 +48,142 @@ func TestAuthMiddleware_WithoutAuthorizationHeader(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, rec.Code)
 	assert.Equal(t, 0, numRequests)
 }
+
+func TestCredentialsMiddleware(t *testing.T) {
+	testCases := map[string]struct {
+		Username, Password string
+		ExpectedCode       int
+	}{
+		"valid credentials": {"admin", "secret", http.StatusOK},
+		"wrong password":    {"admin", "password", http.StatusUnauthorized},
+		"wrong username":    {"user1", "secret", http.StatusUnauthorized},
+		"no credentials":    {"", "", http.StatusUnauthorized},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if testCase.Username != "" {
+				req.SetBasicAuth(testCase.Username, testCase.Password)
+			}
+
+			h := web.CredentialsMiddleware("admin", "secret", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+		})
+	}
+}
+
+func TestAuthMiddleware_WithClientCertificate(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("user1", "password2")
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{
+			{{Subject: pkix.Name{CommonName: "partner-service", Organization: []string{"ACME"}}}},
+		},
+	}
+
+	var numRequests int
+	h := web.AuthMiddleware(func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		numRequests++
+		assert.Equal(t, "partner-service", req.Username)
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, numRequests)
+}
+
+func TestAuthMiddleware_WithUnverifiedClientCertificate(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "partner-service"}},
+		},
+	}
+
+	var numRequests int
+	h := web.AuthMiddleware(func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		numRequests++
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, 0, numRequests)
+}
+
+func TestScopeMiddleware(t *testing.T) {
+	authz := &scopeAuthorizerMock{
+		Scopes:    map[string]string{"importer": "write", "partner-service": "write", "user1": "read"},
+		Passwords: map[string]string{"importer": "secret", "user1": "password2"},
+	}
+
+	testCases := map[string]struct {
+		Username, Password string
+		Certificate        string
+		ExpectedCode       int
+	}{
+		"granted":                    {Username: "importer", Password: "secret", ExpectedCode: http.StatusOK},
+		"wrong password":             {Username: "importer", Password: "password", ExpectedCode: http.StatusUnauthorized},
+		"no password configured":     {Username: "partner-service", Password: "secret", ExpectedCode: http.StatusUnauthorized},
+		"not granted":                {Username: "user1", Password: "password2", ExpectedCode: http.StatusForbidden},
+		"granted with certificate":   {Certificate: "partner-service", ExpectedCode: http.StatusOK},
+		"certificate, not granted":   {Certificate: "user1", ExpectedCode: http.StatusForbidden},
+		"certificate takes priority": {Username: "importer", Password: "secret", Certificate: "user1", ExpectedCode: http.StatusForbidden},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if testCase.Username != "" {
+				req.SetBasicAuth(testCase.Username, testCase.Password)
+			}
+
+			if testCase.Certificate != "" {
+				req.TLS = &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{
+						{{Subject: pkix.Name{CommonName: testCase.Certificate}}},
+					},
+				}
+			}
+
+			var numRequests int
+			h := web.AuthMiddleware(web.ScopeMiddleware("write", authz, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+				numRequests++
+			}))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			if testCase.ExpectedCode == http.StatusOK {
+				assert.Equal(t, 1, numRequests)
+			} else {
+				assert.Equal(t, 0, numRequests)
+			}
+		})
+	}
+}
+
+type scopeAuthorizerMock struct {
+	Scopes    map[string]string
+	Passwords map[string]string
+}
+
+func (m *scopeAuthorizerMock) Granted(principal, scope string) bool {
+	return m.Scopes[principal] == scope
+}
+
+func (m *scopeAuthorizerMock) Authenticate(user, password string) bool {
+	p, ok := m.Passwords[user]
+	return ok && p == password
+}
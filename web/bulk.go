@@ -0,0 +1,284 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/andrewslotin/es-search-service/ingest"
+	"github.com/andrewslotin/es-search-service/schema"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// errLineTooLong is returned by bulkReader when a line exceeds MaxDocumentSize
+var errLineTooLong = errors.New("line is too long")
+
+type bulkWriter interface {
+	Bulk(ctx context.Context, ops []storage.BulkOperation) ([]storage.BulkResult, error)
+}
+
+// bulkItem is the outcome of a single operation sent within a bulk request
+type bulkItem struct {
+	Line       int                `json:"line"`
+	Action     string             `json:"action,omitempty"`
+	ID         string             `json:"id,omitempty"`
+	Status     int                `json:"status"`
+	Result     string             `json:"result,omitempty"`
+	Version    int64              `json:"version,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Violations []schema.Violation `json:"violations,omitempty"`
+}
+
+// BulkHandler returns a SecureHandler that reads NDJSON from the request body and writes it to the storage
+// in batches of up to maxBatchDocuments operations and maxBatchSize bytes. Each line is either a product
+// document to be indexed with a generated ID or an action followed by the document on the next line, as
+// in the Elasticsearch bulk API. Invalid lines are reported as failed items without affecting the rest
+func BulkHandler(st bulkWriter, v documentValidator, maxBatchSize, maxBatchDocuments int) SecureHandler {
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		var (
+			items     []bulkItem
+			ops       []storage.BulkOperation
+			pending   []int // indices of items sent within ops
+			batchSize int
+		)
+
+		flush := func() {
+			if len(ops) == 0 {
+				return
+			}
+
+			results, err := st.Bulk(req.Context(), ops)
+			for i, n := range pending {
+				if err != nil {
+					items[n].Status, items[n].Error = http.StatusInternalServerError, "failed to write batch"
+					continue
+				}
+
+				item, res := &items[n], results[i]
+				item.ID, item.Result, item.Version = res.ID, res.Result, res.Version
+				item.Status, item.Error = res.Status, res.Error
+			}
+
+			if err != nil {
+				log.Printf("failed to write a batch of %d documents: %s", len(ops), err)
+			}
+
+			ops, pending, batchSize = ops[:0], pending[:0], 0
+		}
+
+		br := &bulkReader{r: bufio.NewReader(req.Body)}
+		for {
+			item, op, err := br.next(v)
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "failed to read request body")
+				return
+			}
+
+			if item.Status != 0 {
+				items = append(items, item)
+				continue
+			}
+
+			if batchSize+len(op.Doc) > maxBatchSize {
+				flush()
+			}
+
+			items = append(items, item)
+			ops = append(ops, op)
+			pending = append(pending, len(items)-1)
+			batchSize += len(op.Doc)
+
+			if len(ops) >= maxBatchDocuments {
+				flush()
+			}
+		}
+		flush()
+
+		var failed, written bool
+		for _, item := range items {
+			if item.Status >= http.StatusMultipleChoices {
+				failed = true
+			} else if item.Result != ingest.ResultQueued {
+				written = true
+			}
+		}
+
+		if written {
+			setConsistencyToken(req.Context(), w)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Status string     `json:"status"`
+			Errors bool       `json:"errors"`
+			Items  []bulkItem `json:"items"`
+		}{
+			Status: "success",
+			Errors: failed,
+			Items:  items,
+		})
+	}
+}
+
+// bulkReader reads operations from an NDJSON stream
+type bulkReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+// next reads the next operation and validates it. If the operation is invalid, the returned item
+// has the status set to the corresponding HTTP status code
+func (br *bulkReader) next(v documentValidator) (bulkItem, storage.BulkOperation, error) {
+	line, err := br.readLine()
+	item := bulkItem{Line: br.line}
+	if err == errLineTooLong {
+		item.Status, item.Error = http.StatusRequestEntityTooLarge, "line is too large"
+		return item, storage.BulkOperation{}, nil
+	}
+
+	if err != nil {
+		return item, storage.BulkOperation{}, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil || fields == nil {
+		item.Status, item.Error = http.StatusBadRequest, "malformed line, expected a JSON object"
+		return item, storage.BulkOperation{}, nil
+	}
+
+	action, ok := bulkAction(fields)
+	if !ok {
+		item.Action = storage.BulkIndex
+		return validateBulkDocument(item, storage.BulkOperation{Action: storage.BulkIndex, Doc: line}, v)
+	}
+
+	var meta struct {
+		ID string `json:"_id"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(fields[action]))
+	dec.DisallowUnknownFields()
+	metaErr := dec.Decode(&meta)
+
+	item.Action, item.ID = action, meta.ID
+	op := storage.BulkOperation{Action: action, ID: meta.ID}
+
+	// the document line is consumed even if the action turns out to be invalid, so that
+	// it's not mistaken for the next operation
+	if action != storage.BulkDelete {
+		doc, err := br.readLine()
+		switch err {
+		case nil:
+			op.Doc = doc
+		case errLineTooLong:
+			item.Status, item.Error = http.StatusRequestEntityTooLarge, "document is too large"
+			return item, op, nil
+		case io.EOF:
+			item.Status, item.Error = http.StatusBadRequest, "missing document"
+			return item, op, nil
+		default:
+			return item, op, err
+		}
+	}
+
+	if metaErr != nil {
+		item.Status, item.Error = http.StatusBadRequest, "malformed action, expected an object with optional _id"
+		return item, op, nil
+	}
+
+	if len(op.ID) > maxDocumentIDLength {
+		item.Status, item.Error = http.StatusBadRequest, "_id is too long"
+		return item, op, nil
+	}
+
+	if op.ID == "" && (action == storage.BulkUpdate || action == storage.BulkDelete) {
+		item.Status, item.Error = http.StatusBadRequest, "_id is required"
+		return item, op, nil
+	}
+
+	if action == storage.BulkDelete {
+		return item, op, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(op.Doc, &doc); err != nil || doc == nil {
+		item.Status, item.Error = http.StatusBadRequest, "malformed document, expected a JSON object"
+		return item, op, nil
+	}
+
+	return validateBulkDocument(item, op, v)
+}
+
+// readLine returns the next non-empty line. Lines exceeding MaxDocumentSize are discarded and reported
+// with errLineTooLong
+func (br *bulkReader) readLine() ([]byte, error) {
+	for {
+		var (
+			line    []byte
+			tooLong bool
+		)
+
+		for {
+			chunk, err := br.r.ReadSlice('\n')
+			if !tooLong {
+				if len(line)+len(chunk) > MaxDocumentSize {
+					line, tooLong = nil, true
+				} else {
+					line = append(line, chunk...)
+				}
+			}
+
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+
+			if err != nil && (err != io.EOF || (len(line) == 0 && !tooLong)) {
+				return nil, err
+			}
+
+			break
+		}
+		br.line++
+
+		if tooLong {
+			return nil, errLineTooLong
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// bulkAction returns the action name if fields contain a single index, create, update or delete key
+// with an object value
+func bulkAction(fields map[string]json.RawMessage) (string, bool) {
+	if len(fields) != 1 {
+		return "", false
+	}
+
+	for _, action := range [...]string{storage.BulkIndex, storage.BulkCreate, storage.BulkUpdate, storage.BulkDelete} {
+		if meta, ok := fields[action]; ok && bytes.HasPrefix(bytes.TrimSpace(meta), []byte("{")) {
+			return action, true
+		}
+	}
+
+	return "", false
+}
+
+// validateBulkDocument checks the document of an index, create or update operation against the schema
+func validateBulkDocument(item bulkItem, op storage.BulkOperation, v documentValidator) (bulkItem, storage.BulkOperation, error) {
+	if vs := v.Validate(op.Doc, op.Action == storage.BulkUpdate); len(vs) > 0 {
+		item.Status, item.Error, item.Violations = http.StatusUnprocessableEntity, "document does not match the schema", vs
+	}
+
+	return item, op, nil
+}
@@ -0,0 +1,180 @@
+package web_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/schema"
+	"github.com/andrewslotin/es-search-service/storage"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkHandler(t *testing.T) {
+	m := &bulkWriterMock{}
+	v := schema.Schema{
+		Fields: map[string]schema.Field{
+			"title": {Type: schema.TypeString, Required: true},
+			"price": {Type: schema.TypeInteger},
+		},
+	}
+
+	body := strings.Join([]string{
+		`{"title": "AirMax", "price": 1500}`,
+		`{"index": {"_id": "abc"}}`,
+		`{"title": "Superstar"}`,
+		``,
+		`{"prce": "1500"}`,
+		`{"update": {"_id": "def"}}`,
+		`{"price": 1200}`,
+		`{"delete": {"_id": "ghi"}}`,
+		`{"title": `,
+		`{"delete": {}}`,
+		`{"create": {"_id": "jkl"}}`,
+		`{"title": "Stan Smith"}`,
+	}, "\n")
+
+	rec := httptest.NewRecorder()
+	web.BulkHandler(m, v, 1<<20, 2)(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodPost, "/v1/products/_bulk", strings.NewReader(body)),
+		Username: "importer",
+	})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"status": "success",
+		"errors": true,
+		"items": [
+			{"line": 1, "action": "index", "id": "gen1", "status": 201, "result": "created", "version": 1},
+			{"line": 2, "action": "index", "id": "abc", "status": 201, "result": "created", "version": 1},
+			{"line": 5, "action": "index", "status": 422, "error": "document does not match the schema", "violations": [
+				{"pointer": "/prce", "message": "unknown field"},
+				{"pointer": "/title", "message": "is required"}
+			]},
+			{"line": 6, "action": "update", "id": "def", "status": 201, "result": "created", "version": 1},
+			{"line": 8, "action": "delete", "id": "ghi", "status": 201, "result": "created", "version": 1},
+			{"line": 9, "status": 400, "error": "malformed line, expected a JSON object"},
+			{"line": 10, "action": "delete", "status": 400, "error": "_id is required"},
+			{"line": 11, "action": "create", "id": "jkl", "status": 201, "result": "created", "version": 1}
+		]
+	}`, rec.Body.String())
+
+	require.Len(t, m.Batches, 3)
+	assert.Equal(t, []storage.BulkOperation{
+		{Action: storage.BulkIndex, Doc: []byte(`{"title": "AirMax", "price": 1500}`)},
+		{Action: storage.BulkIndex, ID: "abc", Doc: []byte(`{"title": "Superstar"}`)},
+	}, m.Batches[0])
+	assert.Equal(t, []storage.BulkOperation{
+		{Action: storage.BulkUpdate, ID: "def", Doc: []byte(`{"price": 1200}`)},
+		{Action: storage.BulkDelete, ID: "ghi"},
+	}, m.Batches[1])
+	assert.Equal(t, []storage.BulkOperation{
+		{Action: storage.BulkCreate, ID: "jkl", Doc: []byte(`{"title": "Stan Smith"}`)},
+	}, m.Batches[2])
+}
+
+func TestBulkHandler_MaxBatchSize(t *testing.T) {
+	m := &bulkWriterMock{}
+
+	body := strings.Repeat(`{"title": "AirMax"}`+"\n", 5)
+
+	rec := httptest.NewRecorder()
+	web.BulkHandler(m, schema.Schema{AdditionalFields: true}, 40, 100)(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodPost, "/v1/products/_bulk", strings.NewReader(body)),
+		Username: "importer",
+	})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, m.Batches, 3)
+	assert.Len(t, m.Batches[0], 2)
+	assert.Len(t, m.Batches[1], 2)
+	assert.Len(t, m.Batches[2], 1)
+}
+
+func TestBulkHandler_LineTooLong(t *testing.T) {
+	m := &bulkWriterMock{}
+
+	body := strings.Join([]string{
+		`{"title": "` + strings.Repeat("a", 2<<20) + `"}`,
+		`{"title": "AirMax"}`,
+	}, "\n")
+
+	rec := httptest.NewRecorder()
+	web.BulkHandler(m, schema.Schema{AdditionalFields: true}, 1<<20, 100)(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodPost, "/v1/products/_bulk", strings.NewReader(body)),
+		Username: "importer",
+	})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"status": "success",
+		"errors": true,
+		"items": [
+			{"line": 1, "status": 413, "error": "line is too large"},
+			{"line": 2, "action": "index", "id": "gen1", "status": 201, "result": "created", "version": 1}
+		]
+	}`, rec.Body.String())
+}
+
+func TestBulkHandler_StorageError(t *testing.T) {
+	m := &bulkWriterMock{Error: errors.New("connection refused")}
+
+	body := strings.Join([]string{
+		`{"index": {"_id": "abc"}}`,
+		`{"title": "AirMax"}`,
+		`{"update": {"_id": "def"}}`,
+	}, "\n")
+
+	rec := httptest.NewRecorder()
+	web.BulkHandler(m, schema.Schema{AdditionalFields: true}, 1<<20, 100)(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodPost, "/v1/products/_bulk", strings.NewReader(body)),
+		Username: "importer",
+	})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"status": "success",
+		"errors": true,
+		"items": [
+			{"line": 1, "action": "index", "id": "abc", "status": 500, "error": "failed to write batch"},
+			{"line": 3, "action": "update", "id": "def", "status": 400, "error": "missing document"}
+		]
+	}`, rec.Body.String())
+}
+
+type bulkWriterMock struct {
+	Batches [][]storage.BulkOperation
+	Error   error
+
+	generated int
+}
+
+func (m *bulkWriterMock) Bulk(ctx context.Context, ops []storage.BulkOperation) ([]storage.BulkResult, error) {
+	m.Batches = append(m.Batches, append([]storage.BulkOperation(nil), ops...))
+	if m.Error != nil {
+		return nil, m.Error
+	}
+
+	results := make([]storage.BulkResult, len(ops))
+	for i, op := range ops {
+		id := op.ID
+		if id == "" {
+			m.generated++
+			id = "gen" + strconv.Itoa(m.generated)
+		}
+
+		results[i] = storage.BulkResult{
+			WriteResult: storage.WriteResult{ID: id, Result: "created", Version: 1},
+			Status:      http.StatusCreated,
+		}
+	}
+
+	return results, nil
+}
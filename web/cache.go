@@ -0,0 +1,34 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type cachePurger interface {
+	Purge() int
+}
+
+// CachePurgeHandler removes all entries from the search cache in response to DELETE requests
+func CachePurgeHandler(p cachePurger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		n := p.Purge()
+		log.Printf("purged %d search cache entries", n)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Status string `json:"status"`
+			Purged int    `json:"purged"`
+		}{
+			Status: "success",
+			Purged: n,
+		})
+	})
+}
@@ -0,0 +1,44 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePurgeHandler(t *testing.T) {
+	p := &cachePurgerMock{Entries: 3}
+
+	rec := httptest.NewRecorder()
+	web.CachePurgeHandler(p).ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/cache", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status": "success", "purged": 3}`, rec.Body.String())
+	assert.Equal(t, 0, p.Entries)
+}
+
+func TestCachePurgeHandler_MethodNotAllowed(t *testing.T) {
+	p := &cachePurgerMock{Entries: 3}
+
+	rec := httptest.NewRecorder()
+	web.CachePurgeHandler(p).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/cache", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, http.MethodDelete, rec.Header().Get("Allow"))
+	assert.Equal(t, 3, p.Entries)
+}
+
+type cachePurgerMock struct {
+	Entries int
+}
+
+func (m *cachePurgerMock) Purge() int {
+	n := m.Entries
+	m.Entries = 0
+
+	return n
+}
@@ -0,0 +1,141 @@
+package web
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/authz"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// ConsistencyTokenHeader is the response header carrying the token issued for a write that is not yet
+// visible to search. Passing it to the search endpoint makes sure the search results reflect this write
+const ConsistencyTokenHeader = "Consistency-Token"
+
+type indexRefresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// RefreshMiddleware applies the refresh policy set by the refresh parameter, i.e. true, false or wait_for, to
+// the writes made by next. An empty value means true, as in Elasticsearch API. It responds with HTTP 400 if the
+// policy is unknown, or if it's other than false while the writes are queued, since queued writes are sent to
+// Elasticsearch after the response
+func RefreshMiddleware(queued bool, next SecureHandler) SecureHandler {
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		v, ok := req.URL.Query()["refresh"]
+		if !ok {
+			next(w, req)
+			return
+		}
+
+		policy := v[0]
+		switch policy {
+		case "":
+			policy = storage.RefreshTrue
+		case storage.RefreshTrue, storage.RefreshFalse, storage.RefreshWaitFor:
+		default:
+			writeError(w, http.StatusBadRequest, "malformed refresh parameter, expected true, false or wait_for")
+			return
+		}
+
+		if queued && policy != storage.RefreshFalse {
+			writeError(w, http.StatusBadRequest, "refresh is not supported for queued writes, expected false")
+			return
+		}
+
+		req.Request = req.WithContext(storage.WithRefreshPolicy(req.Context(), policy))
+		next(w, req)
+	}
+}
+
+// ConsistencyMiddleware makes sure that the results of a search sent with the consistency_token parameter
+// reflect the write the token has been issued for. Since writes become visible to search within refreshInterval,
+// the search either waits until this time has passed or, if the refresh parameter is set to true, refreshes the
+// index right away. Since refreshing is expensive, it's only allowed for verified principals granted the write
+// scope, others get HTTP 403. Consistent searches are never served from the cache
+func ConsistencyMiddleware(r indexRefresher, refreshInterval time.Duration, scopes scopeAuthorizer, next SecureHandler) SecureHandler {
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		token := req.URL.Query().Get("consistency_token")
+		if token == "" {
+			next(w, req)
+			return
+		}
+
+		writtenAt, ok := parseConsistencyToken(token)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "malformed consistency_token parameter")
+			return
+		}
+
+		var refresh bool
+		switch req.URL.Query().Get("refresh") {
+		case "", storage.RefreshWaitFor:
+		case storage.RefreshTrue:
+			refresh = true
+		default:
+			writeError(w, http.StatusBadRequest, "malformed refresh parameter, expected true or wait_for")
+			return
+		}
+
+		if refresh {
+			if user, ok := VerifiedPrincipal(req.Request, scopes); !ok || !scopes.Granted(user, authz.ScopeWrite) {
+				writeError(w, http.StatusForbidden, "the "+authz.ScopeWrite+" scope is required to refresh the index")
+				return
+			}
+		}
+
+		ctx := req.Context()
+
+		// the token might have been issued by another instance with a clock running ahead
+		wait := time.Until(writtenAt.Add(refreshInterval))
+		if wait > refreshInterval {
+			wait = refreshInterval
+		}
+
+		if wait > 0 && refresh {
+			if err := r.Refresh(ctx); err != nil {
+				log.Printf("failed to refresh index, waiting for the next scheduled refresh: %s", err)
+			} else {
+				wait = 0
+			}
+		}
+
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				writeError(w, http.StatusGatewayTimeout, "search timed out")
+				return
+			}
+		}
+
+		req.Request = req.WithContext(storage.WithConsistentRead(ctx))
+		next(w, req)
+	}
+}
+
+// setConsistencyToken issues a consistency token for a write made within ctx unless it has been made
+// visible to search already by refreshing the index
+func setConsistencyToken(ctx context.Context, w http.ResponseWriter) {
+	switch storage.RefreshPolicy(ctx) {
+	case storage.RefreshTrue, storage.RefreshWaitFor:
+		return
+	}
+
+	w.Header().Set(ConsistencyTokenHeader, strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 36))
+}
+
+// parseConsistencyToken returns the time of the write the token has been issued for
+func parseConsistencyToken(token string) (time.Time, bool) {
+	ms, err := strconv.ParseInt(token, 36, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
@@ -0,0 +1,228 @@
+package web_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/ingest"
+	"github.com/andrewslotin/es-search-service/schema"
+	"github.com/andrewslotin/es-search-service/storage"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshMiddleware(t *testing.T) {
+	testCases := map[string]struct {
+		Query          string
+		ExpectedCode   int
+		ExpectedPolicy string
+		ExpectedToken  bool
+	}{
+		"no refresh":       {Query: "", ExpectedCode: http.StatusCreated, ExpectedToken: true},
+		"refresh=false":    {Query: "?refresh=false", ExpectedCode: http.StatusCreated, ExpectedPolicy: storage.RefreshFalse, ExpectedToken: true},
+		"refresh=true":     {Query: "?refresh=true", ExpectedCode: http.StatusCreated, ExpectedPolicy: storage.RefreshTrue},
+		"refresh":          {Query: "?refresh", ExpectedCode: http.StatusCreated, ExpectedPolicy: storage.RefreshTrue},
+		"refresh=wait_for": {Query: "?refresh=wait_for", ExpectedCode: http.StatusCreated, ExpectedPolicy: storage.RefreshWaitFor},
+		"unknown policy":   {Query: "?refresh=later", ExpectedCode: http.StatusBadRequest},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &documentWriterMock{
+				Result: storage.WriteResult{ID: "abc", Result: "created", Version: 1},
+			}
+
+			var policy string
+			h := web.RefreshMiddleware(false, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+				policy = storage.RefreshPolicy(req.Context())
+				web.CreateHandler(m, schema.Schema{}, "/v1/products/")(w, req)
+			})
+
+			rec := httptest.NewRecorder()
+			h(rec, web.AuthenticatedRequest{
+				Request:  httptest.NewRequest(http.MethodPost, "/v1/products"+testCase.Query, strings.NewReader(`{"title": "AirMax"}`)),
+				Username: "importer",
+			})
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			assert.Equal(t, testCase.ExpectedPolicy, policy)
+			assert.Equal(t, testCase.ExpectedToken, rec.Header().Get(web.ConsistencyTokenHeader) != "")
+		})
+	}
+}
+
+func TestRefreshMiddleware_Queued(t *testing.T) {
+	testCases := map[string]struct {
+		Query        string
+		ExpectedCode int
+	}{
+		"no refresh":       {Query: "", ExpectedCode: http.StatusAccepted},
+		"refresh=false":    {Query: "?refresh=false", ExpectedCode: http.StatusAccepted},
+		"refresh=true":     {Query: "?refresh=true", ExpectedCode: http.StatusBadRequest},
+		"refresh":          {Query: "?refresh", ExpectedCode: http.StatusBadRequest},
+		"refresh=wait_for": {Query: "?refresh=wait_for", ExpectedCode: http.StatusBadRequest},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &documentWriterMock{
+				Result: storage.WriteResult{ID: "abc", Result: ingest.ResultQueued},
+			}
+
+			rec := httptest.NewRecorder()
+			web.RefreshMiddleware(true, web.CreateHandler(m, schema.Schema{}, "/v1/products/"))(rec, web.AuthenticatedRequest{
+				Request:  httptest.NewRequest(http.MethodPost, "/v1/products"+testCase.Query, strings.NewReader(`{"title": "AirMax"}`)),
+				Username: "importer",
+			})
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			assert.Empty(t, rec.Header().Get(web.ConsistencyTokenHeader))
+		})
+	}
+}
+
+func TestConsistencyMiddleware(t *testing.T) {
+	const refreshInterval = 200 * time.Millisecond
+
+	token := func(t time.Time) string {
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 36)
+	}
+
+	authz := &scopeAuthorizerMock{
+		Scopes:    map[string]string{"importer": "write", "merchandiser": "read"},
+		Passwords: map[string]string{"importer": "secret", "merchandiser": "secret"},
+	}
+
+	testCases := map[string]struct {
+		Query            string
+		Username         string
+		Password         string
+		WrittenAgo       time.Duration
+		RefreshError     error
+		ExpectedCode     int
+		ExpectedRefresh  bool
+		ExpectedWait     bool
+		ExpectConsistent bool
+	}{
+		"no token": {
+			Query:        "q=shoes",
+			ExpectedCode: http.StatusOK,
+		},
+		"recent write": {
+			Query:            "q=shoes&consistency_token={token}",
+			ExpectedCode:     http.StatusOK,
+			ExpectedWait:     true,
+			ExpectConsistent: true,
+		},
+		"recent write with refresh": {
+			Query:            "q=shoes&refresh=true&consistency_token={token}",
+			Username:         "importer",
+			Password:         "secret",
+			ExpectedCode:     http.StatusOK,
+			ExpectedRefresh:  true,
+			ExpectConsistent: true,
+		},
+		"failed refresh": {
+			Query:            "q=shoes&refresh=true&consistency_token={token}",
+			Username:         "importer",
+			Password:         "secret",
+			RefreshError:     errors.New("connection refused"),
+			ExpectedCode:     http.StatusOK,
+			ExpectedRefresh:  true,
+			ExpectedWait:     true,
+			ExpectConsistent: true,
+		},
+		"old write": {
+			Query:            "q=shoes&refresh=true&consistency_token={token}",
+			Username:         "importer",
+			Password:         "secret",
+			WrittenAgo:       time.Minute,
+			ExpectedCode:     http.StatusOK,
+			ExpectConsistent: true,
+		},
+		"refresh without write scope": {
+			Query:        "q=shoes&refresh=true&consistency_token={token}",
+			Username:     "merchandiser",
+			Password:     "secret",
+			ExpectedCode: http.StatusForbidden,
+		},
+		"refresh with unverified credentials": {
+			Query:        "q=shoes&refresh=true&consistency_token={token}",
+			Username:     "importer",
+			Password:     "password",
+			ExpectedCode: http.StatusForbidden,
+		},
+		"malformed token": {
+			Query:        "q=shoes&consistency_token=!",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		"unknown refresh policy": {
+			Query:        "q=shoes&refresh=false&consistency_token={token}",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r := &indexRefresherMock{Error: testCase.RefreshError}
+
+			var consistent bool
+			h := web.ConsistencyMiddleware(r, refreshInterval, authz, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+				consistent = storage.ConsistentRead(req.Context())
+			})
+
+			start := time.Now()
+			query := strings.Replace(testCase.Query, "{token}", token(start.Add(-testCase.WrittenAgo)), 1)
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/products?"+query, nil)
+			if testCase.Username != "" {
+				req.SetBasicAuth(testCase.Username, testCase.Password)
+			}
+
+			rec := httptest.NewRecorder()
+			h(rec, web.AuthenticatedRequest{
+				Request:  req,
+				Username: testCase.Username,
+			})
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			assert.Equal(t, testCase.ExpectedRefresh, r.Calls > 0)
+			assert.Equal(t, testCase.ExpectedWait, time.Since(start) >= refreshInterval/2)
+			assert.Equal(t, testCase.ExpectConsistent, consistent)
+		})
+	}
+}
+
+func TestConsistencyMiddleware_Timeout(t *testing.T) {
+	h := web.ConsistencyMiddleware(&indexRefresherMock{}, time.Minute, &scopeAuthorizerMock{}, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		t.Error("request should not be processed")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/products?q=shoes&consistency_token="+strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 36), nil)
+
+	rec := httptest.NewRecorder()
+	h(rec, web.AuthenticatedRequest{Request: req.WithContext(ctx), Username: "merchandiser"})
+
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+}
+
+type indexRefresherMock struct {
+	Calls int
+	Error error
+}
+
+func (m *indexRefresherMock) Refresh(ctx context.Context) error {
+	m.Calls++
+	return m.Error
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+const readinessCheckTimeout = 5 * time.Second
+
+type healthChecker interface {
+	Health(ctx context.Context) (storage.Health, error)
+}
+
+// LivenessHandler responds with HTTP 200 as long as the process is able to serve requests
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+}
+
+// ReadinessHandler reports whether the service is ready to serve search requests. It responds
+// with HTTP 503 if the cluster health status is worse than minStatus or the index does not exist
+func ReadinessHandler(hc healthChecker, minStatus string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), readinessCheckTimeout)
+		defer cancel()
+
+		resp := struct {
+			Status              string     `json:"status"`
+			ClusterStatus       string     `json:"cluster_status,omitempty"`
+			MinClusterStatus    string     `json:"min_cluster_status"`
+			Index               string     `json:"index,omitempty"`
+			IndexExists         bool       `json:"index_exists"`
+			LastSuccessfulQuery *time.Time `json:"last_successful_query,omitempty"`
+			CircuitBreaker      string     `json:"circuit_breaker,omitempty"`
+			Cluster             string     `json:"cluster,omitempty"`
+			Error               string     `json:"error,omitempty"`
+		}{
+			Status:           "ready",
+			MinClusterStatus: minStatus,
+		}
+
+		code := http.StatusOK
+
+		h, err := hc.Health(ctx)
+		if err != nil {
+			log.Printf("readiness check failed: %s", err)
+			resp.Error = err.Error()
+		}
+
+		resp.ClusterStatus, resp.Index, resp.IndexExists = h.ClusterStatus, h.Index, h.IndexExists
+		resp.CircuitBreaker, resp.Cluster = h.CircuitBreaker, h.Cluster
+		if !h.LastSuccessfulQuery.IsZero() {
+			resp.LastSuccessfulQuery = &h.LastSuccessfulQuery
+		}
+
+		if err != nil || !storage.StatusAtLeast(h.ClusterStatus, minStatus) || !h.IndexExists {
+			resp.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+var errShuttingDown = errors.New("service is shutting down")
+
+// ShutdownGuard is a health checker that reports the service as unhealthy once the shutdown
+// has been initiated, so that the load balancer stops routing new requests to this instance
+type ShutdownGuard struct {
+	hc           healthChecker
+	shuttingDown int32 // accessed atomically
+}
+
+// NewShutdownGuard wraps hc into a ShutdownGuard
+func NewShutdownGuard(hc healthChecker) *ShutdownGuard {
+	return &ShutdownGuard{hc: hc}
+}
+
+// Shutdown marks the service as shutting down
+func (g *ShutdownGuard) Shutdown() {
+	atomic.StoreInt32(&g.shuttingDown, 1)
+}
+
+// Health returns an error if the service is shutting down, otherwise it returns the result
+// of the underlying health check
+func (g *ShutdownGuard) Health(ctx context.Context) (storage.Health, error) {
+	if atomic.LoadInt32(&g.shuttingDown) == 1 {
+		return storage.Health{}, errShuttingDown
+	}
+
+	return g.hc.Health(ctx)
+}
@@ -0,0 +1,104 @@
+package web_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/storage"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLivenessHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	web.LivenessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, rec.Body.String())
+}
+
+func TestReadinessHandler(t *testing.T) {
+	lastQuery := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := map[string]struct {
+		Health       storage.Health
+		Error        error
+		MinStatus    string
+		ExpectedCode int
+		ExpectedBody string
+	}{
+		"ready": {
+			Health:       storage.Health{ClusterStatus: "green", Index: "products", IndexExists: true, LastSuccessfulQuery: lastQuery},
+			MinStatus:    "yellow",
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"status": "ready", "cluster_status": "green", "min_cluster_status": "yellow", "index": "products", "index_exists": true, "last_successful_query": "2019-09-01T12:00:00Z"}`,
+		},
+		"circuit breaker open": {
+			Health:       storage.Health{ClusterStatus: "green", Index: "products", IndexExists: true, CircuitBreaker: "open"},
+			MinStatus:    "yellow",
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: `{"status": "ready", "cluster_status": "green", "min_cluster_status": "yellow", "index": "products", "index_exists": true, "circuit_breaker": "open"}`,
+		},
+		"cluster status is too low": {
+			Health:       storage.Health{ClusterStatus: "yellow", Index: "products", IndexExists: true},
+			MinStatus:    "green",
+			ExpectedCode: http.StatusServiceUnavailable,
+			ExpectedBody: `{"status": "not ready", "cluster_status": "yellow", "min_cluster_status": "green", "index": "products", "index_exists": true}`,
+		},
+		"index missing": {
+			Health:       storage.Health{ClusterStatus: "green", Index: "products"},
+			MinStatus:    "yellow",
+			ExpectedCode: http.StatusServiceUnavailable,
+			ExpectedBody: `{"status": "not ready", "cluster_status": "green", "min_cluster_status": "yellow", "index": "products", "index_exists": false}`,
+		},
+		"cluster unavailable": {
+			Error:        errors.New("connection refused"),
+			MinStatus:    "yellow",
+			ExpectedCode: http.StatusServiceUnavailable,
+			ExpectedBody: `{"status": "not ready", "min_cluster_status": "yellow", "index_exists": false, "error": "connection refused"}`,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			hc := &healthCheckerMock{Result: testCase.Health, Error: testCase.Error}
+
+			rec := httptest.NewRecorder()
+			web.ReadinessHandler(hc, testCase.MinStatus).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			assert.JSONEq(t, testCase.ExpectedBody, rec.Body.String())
+		})
+	}
+}
+
+type healthCheckerMock struct {
+	Result storage.Health
+	Error  error
+}
+
+func (m *healthCheckerMock) Health(ctx context.Context) (storage.Health, error) {
+	return m.Result, m.Error
+}
+
+func TestShutdownGuard(t *testing.T) {
+	hc := &healthCheckerMock{Result: storage.Health{ClusterStatus: "green", Index: "products", IndexExists: true}}
+	g := web.NewShutdownGuard(hc)
+	h := web.ReadinessHandler(g, "yellow")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	g.Shutdown()
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.JSONEq(t, `{"status": "not ready", "min_cluster_status": "yellow", "index_exists": false, "error": "service is shutting down"}`, rec.Body.String())
+}
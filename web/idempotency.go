@@ -0,0 +1,157 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/andrewslotin/es-search-service/idempotency"
+)
+
+// maxIdempotencyKeyLength is the maximum length of the Idempotency-Key header value
+const maxIdempotencyKeyLength = 255
+
+// replayedHeaders is the list of response headers recorded along with the response body. Other headers,
+// such as rate limit ones, are set anew for each request
+var replayedHeaders = [...]string{"Content-Type", "Location", "ETag", "Allow", ConsistencyTokenHeader}
+
+// IdempotencyMiddleware makes write requests with the Idempotency-Key header safe to retry. The first response
+// for a key sent by a principal is recorded, and requests repeating the key get it replayed with the
+// Idempotent-Replayed header instead of being processed again. A key can only be reused for a request with
+// the same method, path and body. Server errors and conflicts are not recorded, so that the request can be retried.
+// The body is read up to maxBodySize bytes unless it's zero, larger requests are rejected with HTTP 413
+func IdempotencyMiddleware(store idempotency.Store, maxBodySize int64, next SecureHandler) SecureHandler {
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, req)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+			return
+		}
+
+		// keys are scoped by principal, so that clients can't get each other's responses. The principal name is
+		// prefixed with its length, since both the name and the key may contain the separator
+		key = strconv.Itoa(len(req.Username)) + ":" + req.Username + ":" + key
+
+		if maxBodySize > 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, maxBodySize)
+		}
+
+		resp, err := store.Begin(req.Context(), key)
+		if err == idempotency.ErrInProgress {
+			writeError(w, http.StatusConflict, "a request with the same Idempotency-Key is in progress")
+			return
+		}
+
+		if err != nil {
+			// fail closed, since processing the request could result in a duplicate write
+			log.Printf("failed to check idempotency key for %s: %s", req.Username, err)
+			writeError(w, http.StatusServiceUnavailable, "")
+			return
+		}
+
+		if resp != nil {
+			h := sha256.New()
+			if _, err := io.Copy(h, req.Body); err != nil {
+				writeError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+				return
+			}
+
+			if resp.Method != req.Method || resp.Path != req.URL.Path || resp.BodyHash != hex.EncodeToString(h.Sum(nil)) {
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key has already been used for another request")
+				return
+			}
+
+			for k, vs := range resp.Header {
+				w.Header()[k] = append([]string(nil), vs...)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.StatusCode)
+			w.Write(resp.Body)
+
+			return
+		}
+
+		completed := false
+		defer func() {
+			// release the key if the handler has panicked
+			if !completed {
+				store.Cancel(req.Context(), key)
+			}
+		}()
+
+		// the body is hashed as the handler reads it
+		body := &hashingReader{ReadCloser: req.Body, h: sha256.New()}
+		r := *req.Request
+		r.Body = body
+
+		rec := &responseRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next(rec, AuthenticatedRequest{Request: &r, Username: req.Username})
+		completed = true
+
+		// a conflicting write is expected to succeed once retried
+		if rec.Status() >= http.StatusInternalServerError || rec.Status() == http.StatusConflict {
+			if err := store.Cancel(req.Context(), key); err != nil {
+				log.Printf("failed to release idempotency key for %s: %s", req.Username, err)
+			}
+
+			return
+		}
+
+		// the rest of the body the handler did not read
+		io.Copy(ioutil.Discard, body)
+
+		recorded := idempotency.Response{
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			BodyHash:   hex.EncodeToString(body.h.Sum(nil)),
+			StatusCode: rec.Status(),
+			Header:     make(http.Header),
+			Body:       rec.body.Bytes(),
+		}
+
+		for _, k := range replayedHeaders {
+			if vs, ok := w.Header()[k]; ok {
+				recorded.Header[k] = vs
+			}
+		}
+
+		if err := store.Save(req.Context(), key, recorded); err != nil {
+			log.Printf("failed to save response for idempotency key for %s: %s", req.Username, err)
+		}
+	}
+}
+
+// hashingReader is an io.ReadCloser that calculates the hash of the data read
+type hashingReader struct {
+	io.ReadCloser
+	h hash.Hash
+}
+
+func (r *hashingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.h.Write(b[:n])
+
+	return n, err
+}
+
+// responseRecorder is an http.ResponseWriter that keeps a copy of the response status code and body
+type responseRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.statusRecorder.Write(b)
+}
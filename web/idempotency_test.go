@@ -0,0 +1,231 @@
+package web_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/idempotency"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	var calls int
+	h := web.IdempotencyMiddleware(idempotency.NewMemoryStore(1<<20, time.Minute), web.MaxDocumentSize, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		calls++
+		w.Header().Set("Location", "/v1/products/abc")
+		w.Header().Set("RateLimit-Remaining", "10")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status": "success", "id": "abc"}`))
+	})
+
+	newRequest := func(method, path, username, key string) web.AuthenticatedRequest {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"title": "AirMax"}`))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+
+		return web.AuthenticatedRequest{Request: req, Username: username}
+	}
+
+	rec := httptest.NewRecorder()
+	h(rec, newRequest(http.MethodPost, "/v1/products", "importer", "key1"))
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 1, calls)
+
+	// retry
+	rec = httptest.NewRecorder()
+	h(rec, newRequest(http.MethodPost, "/v1/products", "importer", "key1"))
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, "/v1/products/abc", rec.Header().Get("Location"))
+	assert.Empty(t, rec.Header().Get("RateLimit-Remaining"))
+	assert.JSONEq(t, `{"status": "success", "id": "abc"}`, rec.Body.String())
+	assert.Equal(t, 1, calls)
+
+	// same key used for another request
+	rec = httptest.NewRecorder()
+	h(rec, newRequest(http.MethodDelete, "/v1/products/abc", "importer", "key1"))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, 1, calls)
+
+	// same key used for a request with another body
+	req := newRequest(http.MethodPost, "/v1/products", "importer", "key1")
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"title": "Pegasus"}`))
+
+	rec = httptest.NewRecorder()
+	h(rec, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, 1, calls)
+
+	// same key sent by another principal
+	rec = httptest.NewRecorder()
+	h(rec, newRequest(http.MethodPost, "/v1/products", "merchandiser", "key1"))
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 2, calls)
+
+	// no key
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		h(rec, newRequest(http.MethodPost, "/v1/products", "importer", ""))
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	}
+	assert.Equal(t, 4, calls)
+}
+
+func TestIdempotencyMiddleware_PrincipalWithSeparator(t *testing.T) {
+	var calls int
+	h := web.IdempotencyMiddleware(idempotency.NewMemoryStore(1<<20, time.Minute), web.MaxDocumentSize, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		calls++
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// both requests would have the same key if the principal name was not delimited
+	for _, req := range []struct{ Username, Key string }{{"a:b", "c"}, {"a", "b:c"}} {
+		r := httptest.NewRequest(http.MethodDelete, "/v1/products/abc", nil)
+		r.Header.Set("Idempotency-Key", req.Key)
+
+		rec := httptest.NewRecorder()
+		h(rec, web.AuthenticatedRequest{Request: r, Username: req.Username})
+
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyMiddleware_TooLarge(t *testing.T) {
+	var calls int
+	h := web.IdempotencyMiddleware(idempotency.NewMemoryStore(1<<20, time.Minute), 16, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	newRequest := func(body string) web.AuthenticatedRequest {
+		req := httptest.NewRequest(http.MethodPost, "/v1/products", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", "key1")
+
+		return web.AuthenticatedRequest{Request: req, Username: "importer"}
+	}
+
+	rec := httptest.NewRecorder()
+	h(rec, newRequest(`{"title": "A"}`))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// the body of a retry is not read past the limit
+	rec = httptest.NewRecorder()
+	h(rec, newRequest(`{"title": "`+strings.Repeat("A", 1<<20)+`"}`))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Equal(t, 1, calls)
+}
+
+func TestIdempotencyMiddleware_ServerError(t *testing.T) {
+	var calls int
+	h := web.IdempotencyMiddleware(idempotency.NewMemoryStore(1<<20, time.Minute), web.MaxDocumentSize, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		calls++
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/products", nil)
+		req.Header.Set("Idempotency-Key", "key1")
+
+		rec := httptest.NewRecorder()
+		h(rec, web.AuthenticatedRequest{Request: req, Username: "importer"})
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	}
+
+	// failed requests are not recorded
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyMiddleware_Conflict(t *testing.T) {
+	var calls int
+	h := web.IdempotencyMiddleware(idempotency.NewMemoryStore(1<<20, time.Minute), web.MaxDocumentSize, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		calls++
+		ioutil.ReadAll(req.Body)
+
+		if calls == 1 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, expected := range []int{http.StatusConflict, http.StatusOK, http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPut, "/v1/products/abc", strings.NewReader(`{"title": "AirMax"}`))
+		req.Header.Set("Idempotency-Key", "key1")
+
+		rec := httptest.NewRecorder()
+		h(rec, web.AuthenticatedRequest{Request: req, Username: "importer"})
+
+		assert.Equal(t, expected, rec.Code)
+	}
+
+	// conflicts are not recorded, while the successful retry is
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyMiddleware_InProgress(t *testing.T) {
+	store := idempotency.NewMemoryStore(1<<20, time.Minute)
+	_, err := store.Begin(context.Background(), "8:importer:key1")
+	require.NoError(t, err)
+
+	h := web.IdempotencyMiddleware(store, web.MaxDocumentSize, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		t.Error("request should not be processed")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/products", nil)
+	req.Header.Set("Idempotency-Key", "key1")
+
+	rec := httptest.NewRecorder()
+	h(rec, web.AuthenticatedRequest{Request: req, Username: "importer"})
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestIdempotencyMiddleware_StoreError(t *testing.T) {
+	h := web.IdempotencyMiddleware(failingIdempotencyStore{}, web.MaxDocumentSize, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		t.Error("request should not be processed")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/products", nil)
+	req.Header.Set("Idempotency-Key", "key1")
+
+	rec := httptest.NewRecorder()
+	h(rec, web.AuthenticatedRequest{Request: req, Username: "importer"})
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+type failingIdempotencyStore struct{}
+
+func (failingIdempotencyStore) Begin(ctx context.Context, key string) (*idempotency.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingIdempotencyStore) Save(ctx context.Context, key string, resp idempotency.Response) error {
+	return errors.New("connection refused")
+}
+
+func (failingIdempotencyStore) Cancel(ctx context.Context, key string) error {
+	return errors.New("connection refused")
+}
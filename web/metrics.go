@@ -0,0 +1,106 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+)
+
+var (
+	httpRequestsTotal = metrics.NewCounterVec(
+		"search_service_http_requests_total",
+		"Total number of HTTP requests by route, status code and principal class.",
+		"route", "code", "principal_class",
+	)
+	httpRequestDuration = metrics.NewHistogramVec(
+		"search_service_http_request_duration_seconds",
+		"HTTP request latency by route, status code and principal class.",
+		metrics.DefaultBuckets,
+		"route", "code", "principal_class",
+	)
+	httpRequestsInFlight = metrics.NewGaugeVec(
+		"search_service_http_requests_in_flight",
+		"Number of HTTP requests currently being served.",
+	)
+	searchResultsCount = metrics.NewHistogramVec(
+		"search_service_search_results",
+		"Number of results returned per search request.",
+		[]float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	)
+	searchZeroResultsTotal = metrics.NewCounterVec(
+		"search_service_search_zero_results_total",
+		"Total number of search requests that returned no results.",
+	)
+)
+
+func init() {
+	metrics.Default.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpRequestsInFlight,
+		searchResultsCount,
+		searchZeroResultsTotal,
+	)
+}
+
+// PrincipalClassifier returns the class of a principal making the request to be used as a metric label,
+// i.e. their role
+type PrincipalClassifier func(req *http.Request) string
+
+// MetricsMiddleware records the number of requests, their latency and the number of in-flight requests
+// served by next labelled with the route name
+func MetricsMiddleware(route string, classify PrincipalClassifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		inFlight := httpRequestsInFlight.With()
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+
+		code, class := strconv.Itoa(rec.Status()), classify(req)
+		httpRequestsTotal.With(route, code, class).Inc()
+		httpRequestDuration.With(route, code, class).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder is an http.ResponseWriter that keeps track of the response status code
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	return rec.ResponseWriter.Write(b)
+}
+
+// Status returns the response status code
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+
+	return rec.status
+}
+
+func observeSearchResults(n int) {
+	searchResultsCount.With().Observe(float64(n))
+	if n == 0 {
+		searchZeroResultsTotal.With().Inc()
+	}
+}
@@ -0,0 +1,34 @@
+package web_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	h := web.MetricsMiddleware("/test-route", func(req *http.Request) string {
+		return "partner"
+	}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+
+	var buf bytes.Buffer
+	require.NoError(t, metrics.Default.Write(&buf))
+
+	assert.Contains(t, buf.String(), `search_service_http_requests_total{route="/test-route",code="418",principal_class="partner"} 1`)
+	assert.Contains(t, buf.String(), `search_service_http_request_duration_seconds_count{route="/test-route",code="418",principal_class="partner"} 1`)
+	assert.Contains(t, buf.String(), "search_service_http_requests_in_flight 0\n")
+}
@@ -0,0 +1,357 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andrewslotin/es-search-service/ingest"
+	"github.com/andrewslotin/es-search-service/schema"
+	"github.com/andrewslotin/es-search-service/storage"
+)
+
+// MaxDocumentSize is the maximum size of a document accepted by the write API
+const MaxDocumentSize = 1 << 20
+
+// blockedRetryAfter is the number of seconds clients are asked to wait before retrying a write rejected
+// while the index is being reindexed
+const blockedRetryAfter = 30
+
+// maxDocumentIDLength is the maximum length of a document ID allowed by Elasticsearch
+const maxDocumentIDLength = 512
+
+type documentReader interface {
+	Get(ctx context.Context, id string) (storage.Document, error)
+}
+
+type documentWriter interface {
+	Create(ctx context.Context, doc json.RawMessage) (storage.WriteResult, error)
+	Replace(ctx context.Context, id string, doc json.RawMessage, rev storage.Revision) (storage.WriteResult, error)
+	Update(ctx context.Context, id string, partial json.RawMessage, rev storage.Revision) (storage.WriteResult, error)
+	Delete(ctx context.Context, id string, rev storage.Revision) (storage.WriteResult, error)
+}
+
+type documentValidator interface {
+	Validate(doc []byte, partial bool) []schema.Violation
+}
+
+// Methods returns a SecureHandler that dispatches requests to handlers by HTTP method. It responds
+// with HTTP 405 to requests with methods there is no handler for
+func Methods(handlers map[string]SecureHandler) SecureHandler {
+	allowed := make([]string, 0, len(handlers))
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		h, ok := handlers[req.Method]
+		if !ok {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		h(w, req)
+	}
+}
+
+// CreateHandler returns a SecureHandler that adds the product sent in request body to the storage.
+// It responds with HTTP 201 and the Location header pointing to prefix followed by the new product ID.
+// Documents that do not pass validation are rejected with HTTP 422
+func CreateHandler(st documentWriter, v documentValidator, prefix string) SecureHandler {
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		doc, ok := readDocument(w, req, v, false)
+		if !ok {
+			return
+		}
+
+		res, err := st.Create(req.Context(), doc)
+		if err != nil {
+			writeStorageError(w, err, storage.Revision{})
+			return
+		}
+		annotateAccessLog(req.Context(), func(e *accessLogEntry) { e.DocumentID = res.ID })
+
+		w.Header().Set("Location", prefix+res.ID)
+		writeResult(req.Context(), w, http.StatusCreated, res)
+	}
+}
+
+// GetDocumentHandler returns a SecureHandler that responds with the product identified by the request path
+// following the prefix. The ETag header of the response identifies the product revision and can be sent back
+// in If-Match header to make sure the product is not modified concurrently
+func GetDocumentHandler(st documentReader, prefix string) SecureHandler {
+	return documentHandler(prefix, func(w http.ResponseWriter, req AuthenticatedRequest, id string) {
+		doc, err := st.Get(req.Context(), id)
+		if err != nil {
+			writeStorageError(w, err, storage.Revision{})
+			return
+		}
+
+		tag := etag(doc.Revision)
+		w.Header().Set("ETag", tag)
+		if req.Header.Get("If-None-Match") == tag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Status   string          `json:"status"`
+			ID       string          `json:"id"`
+			Version  int64           `json:"version"`
+			Document json.RawMessage `json:"document"`
+		}{
+			Status:   "success",
+			ID:       doc.ID,
+			Version:  doc.Version,
+			Document: doc.Source,
+		})
+	})
+}
+
+// DocumentHandler returns a SecureHandler that modifies the product identified by the request path
+// following the prefix. PUT replaces the product, PATCH merges the request body into it and DELETE removes it.
+// Documents that do not pass validation are rejected with HTTP 422. If the request has the If-Match header,
+// the product is only modified if its revision matches, otherwise the handler responds with HTTP 412
+func DocumentHandler(st documentWriter, v documentValidator, prefix string) SecureHandler {
+	return Methods(map[string]SecureHandler{
+		http.MethodPut: documentHandler(prefix, func(w http.ResponseWriter, req AuthenticatedRequest, id string) {
+			rev, ok := ifMatch(w, req)
+			if !ok {
+				return
+			}
+
+			doc, ok := readDocument(w, req, v, false)
+			if !ok {
+				return
+			}
+
+			res, err := st.Replace(req.Context(), id, doc, rev)
+			if err != nil {
+				writeStorageError(w, err, rev)
+				return
+			}
+
+			code := http.StatusOK
+			if res.Result == "created" {
+				code = http.StatusCreated
+			}
+			writeResult(req.Context(), w, code, res)
+		}),
+		http.MethodPatch: documentHandler(prefix, func(w http.ResponseWriter, req AuthenticatedRequest, id string) {
+			rev, ok := ifMatch(w, req)
+			if !ok {
+				return
+			}
+
+			doc, ok := readDocument(w, req, v, true)
+			if !ok {
+				return
+			}
+
+			res, err := st.Update(req.Context(), id, doc, rev)
+			if err != nil {
+				writeStorageError(w, err, rev)
+				return
+			}
+			writeResult(req.Context(), w, http.StatusOK, res)
+		}),
+		http.MethodDelete: documentHandler(prefix, func(w http.ResponseWriter, req AuthenticatedRequest, id string) {
+			rev, ok := ifMatch(w, req)
+			if !ok {
+				return
+			}
+
+			res, err := st.Delete(req.Context(), id, rev)
+			if err != nil {
+				writeStorageError(w, err, rev)
+				return
+			}
+			writeResult(req.Context(), w, http.StatusOK, res)
+		}),
+	})
+}
+
+// documentHandler extracts the document ID from the request path and passes it to fn. It responds
+// with HTTP 404 if the path does not contain a valid ID
+func documentHandler(prefix string, fn func(w http.ResponseWriter, req AuthenticatedRequest, id string)) SecureHandler {
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		id := strings.TrimPrefix(req.URL.Path, prefix)
+		if id == "" || id == req.URL.Path || strings.Contains(id, "/") || len(id) > maxDocumentIDLength {
+			writeError(w, http.StatusNotFound, "")
+			return
+		}
+		annotateAccessLog(req.Context(), func(e *accessLogEntry) { e.DocumentID = id })
+
+		fn(w, req, id)
+	}
+}
+
+// readDocument reads a JSON object from the request body and validates it. It responds with HTTP 400
+// if the body is not a JSON object, with HTTP 413 if it exceeds MaxDocumentSize and with HTTP 422 if
+// the document does not pass validation. Partial documents are validated as updates to existing ones
+func readDocument(w http.ResponseWriter, req AuthenticatedRequest, v documentValidator, partial bool) (json.RawMessage, bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, MaxDocumentSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "document is too large")
+		return nil, false
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		writeError(w, http.StatusBadRequest, "malformed document, expected a JSON object")
+		return nil, false
+	}
+
+	if vs := v.Validate(body, partial); len(vs) > 0 {
+		writeViolations(w, vs)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// writeViolations responds with HTTP 422 listing the schema violations
+func writeViolations(w http.ResponseWriter, vs []schema.Violation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+
+	json.NewEncoder(w).Encode(struct {
+		Status     string             `json:"status"`
+		Code       int                `json:"code"`
+		Error      string             `json:"error"`
+		Violations []schema.Violation `json:"violations"`
+	}{
+		Status:     "error",
+		Code:       http.StatusUnprocessableEntity,
+		Error:      "document does not match the schema",
+		Violations: vs,
+	})
+}
+
+// ifMatch returns the product revision requested in the If-Match header. A missing header or a wildcard
+// result in a zero revision. It responds with HTTP 412 if the header does not contain a single valid ETag,
+// since such a condition can never be met
+func ifMatch(w http.ResponseWriter, req AuthenticatedRequest) (storage.Revision, bool) {
+	h := strings.TrimSpace(req.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return storage.Revision{}, true
+	}
+
+	rev, ok := parseETag(h)
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, "product has been modified")
+		return storage.Revision{}, false
+	}
+
+	return rev, true
+}
+
+// etag returns a strong entity tag for the document revision
+func etag(rev storage.Revision) string {
+	return `"` + strconv.FormatInt(rev.SeqNo, 10) + "-" + strconv.FormatInt(rev.PrimaryTerm, 10) + `"`
+}
+
+// parseETag parses the entity tag returned by etag()
+func parseETag(s string) (storage.Revision, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return storage.Revision{}, false
+	}
+
+	fields := strings.Split(s[1:len(s)-1], "-")
+	if len(fields) != 2 {
+		return storage.Revision{}, false
+	}
+
+	seqNo, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || seqNo < 0 {
+		return storage.Revision{}, false
+	}
+
+	primaryTerm, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || primaryTerm <= 0 {
+		return storage.Revision{}, false
+	}
+
+	return storage.Revision{SeqNo: seqNo, PrimaryTerm: primaryTerm}, true
+}
+
+// writeStorageError responds with the HTTP status that corresponds to the storage error. Conflicts
+// caused by a mismatching revision requested by the client are reported with HTTP 412, writes rejected
+// while the index is being reindexed with HTTP 503
+func writeStorageError(w http.ResponseWriter, err error, rev storage.Revision) {
+	if err == storage.ErrNotFound {
+		writeError(w, http.StatusNotFound, "product not found")
+		return
+	}
+
+	if err == storage.ErrConflict {
+		if !rev.IsZero() {
+			writeError(w, http.StatusPreconditionFailed, "product has been modified")
+			return
+		}
+
+		writeError(w, http.StatusConflict, "product has been modified concurrently, retry the request")
+		return
+	}
+
+	if e, ok := err.(*storage.ResponseError); ok && e.StatusCode == http.StatusBadRequest {
+		writeError(w, http.StatusBadRequest, "document was rejected by the storage")
+		return
+	}
+
+	if err == storage.ErrIndexBlocked {
+		w.Header().Set("Retry-After", strconv.Itoa(blockedRetryAfter))
+		writeError(w, http.StatusServiceUnavailable, "product index is being reindexed, retry later")
+		return
+	}
+
+	if err == ingest.ErrConditionalWrite {
+		writeError(w, http.StatusBadRequest, "If-Match is not supported for queued writes")
+		return
+	}
+
+	if err == ingest.ErrClosed {
+		writeError(w, http.StatusServiceUnavailable, "service is shutting down")
+		return
+	}
+
+	log.Printf("failed to write document: %s", err)
+	writeError(w, http.StatusInternalServerError, "")
+}
+
+// writeResult responds with the write result along with the consistency token. Writes accepted by the ingest
+// queue are reported with HTTP 202 instead of the code
+func writeResult(ctx context.Context, w http.ResponseWriter, code int, res storage.WriteResult) {
+	if res.Result == ingest.ResultQueued {
+		code = http.StatusAccepted
+	} else {
+		setConsistencyToken(ctx, w)
+	}
+
+	if res.Result != "deleted" && !res.Revision.IsZero() {
+		w.Header().Set("ETag", etag(res.Revision))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(struct {
+		Status  string `json:"status"`
+		ID      string `json:"id"`
+		Result  string `json:"result"`
+		Version int64  `json:"version"`
+	}{
+		Status:  "success",
+		ID:      res.ID,
+		Result:  res.Result,
+		Version: res.Version,
+	})
+}
@@ -0,0 +1,480 @@
+package web_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/ingest"
+	"github.com/andrewslotin/es-search-service/schema"
+	"github.com/andrewslotin/es-search-service/storage"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateHandler(t *testing.T) {
+	m := &documentWriterMock{
+		Result: storage.WriteResult{ID: "abc", Result: "created", Version: 1},
+	}
+
+	rec := httptest.NewRecorder()
+	web.CreateHandler(m, schema.Schema{}, "/v1/products/")(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodPost, "/v1/products", strings.NewReader(`{"title": "AirMax"}`)),
+		Username: "importer",
+	})
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "/v1/products/abc", rec.Header().Get("Location"))
+	assert.JSONEq(t, `{"status": "success", "id": "abc", "result": "created", "version": 1}`, rec.Body.String())
+	assert.Equal(t, "create", m.Operation)
+	assert.JSONEq(t, `{"title": "AirMax"}`, string(m.Doc))
+}
+
+func TestCreateHandler_Queued(t *testing.T) {
+	m := &documentWriterMock{
+		Result: storage.WriteResult{ID: "abc", Result: ingest.ResultQueued},
+	}
+
+	rec := httptest.NewRecorder()
+	web.CreateHandler(m, schema.Schema{}, "/v1/products/")(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodPost, "/v1/products", strings.NewReader(`{"title": "AirMax"}`)),
+		Username: "importer",
+	})
+
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "/v1/products/abc", rec.Header().Get("Location"))
+	assert.Empty(t, rec.Header().Get("ETag"))
+	assert.JSONEq(t, `{"status": "success", "id": "abc", "result": "queued", "version": 0}`, rec.Body.String())
+}
+
+func TestCreateHandler_MalformedDocument(t *testing.T) {
+	for _, body := range []string{"", "[]", "null", `{"title": `} {
+		t.Run(body, func(t *testing.T) {
+			m := &documentWriterMock{}
+
+			rec := httptest.NewRecorder()
+			web.CreateHandler(m, schema.Schema{}, "/v1/products/")(rec, web.AuthenticatedRequest{
+				Request:  httptest.NewRequest(http.MethodPost, "/v1/products", strings.NewReader(body)),
+				Username: "importer",
+			})
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.JSONEq(t, `{"status": "error", "code": 400, "error": "malformed document, expected a JSON object"}`, rec.Body.String())
+			assert.Empty(t, m.Operation)
+		})
+	}
+}
+
+func TestCreateHandler_SchemaViolations(t *testing.T) {
+	m := &documentWriterMock{}
+	v := schema.Schema{
+		Fields: map[string]schema.Field{
+			"title": {Type: schema.TypeString, Required: true},
+			"price": {Type: schema.TypeInteger, Required: true},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	web.CreateHandler(m, v, "/v1/products/")(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodPost, "/v1/products", strings.NewReader(`{"title": 1, "prce": "1500"}`)),
+		Username: "importer",
+	})
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.JSONEq(t, `{
+		"status": "error",
+		"code": 422,
+		"error": "document does not match the schema",
+		"violations": [
+			{"pointer": "/prce", "message": "unknown field"},
+			{"pointer": "/price", "message": "is required"},
+			{"pointer": "/title", "message": "must be a string"}
+		]
+	}`, rec.Body.String())
+	assert.Empty(t, m.Operation)
+}
+
+func TestDocumentHandler_SchemaViolations(t *testing.T) {
+	v := schema.Schema{
+		Fields: map[string]schema.Field{
+			"title": {Type: schema.TypeString, Required: true},
+			"price": {Type: schema.TypeInteger, Required: true},
+		},
+	}
+
+	testCases := map[string]struct {
+		Method, Body      string
+		ExpectedCode      int
+		ExpectedOperation string
+	}{
+		"replace with missing fields": {Method: http.MethodPut, Body: `{"price": 1500}`, ExpectedCode: http.StatusUnprocessableEntity},
+		"update with missing fields":  {Method: http.MethodPatch, Body: `{"price": 1500}`, ExpectedCode: http.StatusOK, ExpectedOperation: "update"},
+		"update with wrong type":      {Method: http.MethodPatch, Body: `{"price": "1500"}`, ExpectedCode: http.StatusUnprocessableEntity},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &documentWriterMock{}
+
+			rec := httptest.NewRecorder()
+			web.DocumentHandler(m, v, "/v1/products/")(rec, web.AuthenticatedRequest{
+				Request:  httptest.NewRequest(testCase.Method, "/v1/products/abc", strings.NewReader(testCase.Body)),
+				Username: "importer",
+			})
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			assert.Equal(t, testCase.ExpectedOperation, m.Operation)
+		})
+	}
+}
+
+func TestDocumentHandler(t *testing.T) {
+	testCases := map[string]struct {
+		Method, Path, Body string
+		Result             storage.WriteResult
+		Error              error
+		ExpectedOperation  string
+		ExpectedID         string
+		ExpectedCode       int
+		ExpectedBody       string
+	}{
+		"replace": {
+			Method:            http.MethodPut,
+			Path:              "/v1/products/abc",
+			Body:              `{"title": "AirMax"}`,
+			Result:            storage.WriteResult{ID: "abc", Result: "updated", Version: 2},
+			ExpectedOperation: "replace",
+			ExpectedID:        "abc",
+			ExpectedCode:      http.StatusOK,
+			ExpectedBody:      `{"status": "success", "id": "abc", "result": "updated", "version": 2}`,
+		},
+		"replace missing": {
+			Method:            http.MethodPut,
+			Path:              "/v1/products/abc",
+			Body:              `{"title": "AirMax"}`,
+			Result:            storage.WriteResult{ID: "abc", Result: "created", Version: 1},
+			ExpectedOperation: "replace",
+			ExpectedID:        "abc",
+			ExpectedCode:      http.StatusCreated,
+			ExpectedBody:      `{"status": "success", "id": "abc", "result": "created", "version": 1}`,
+		},
+		"update": {
+			Method:            http.MethodPatch,
+			Path:              "/v1/products/abc",
+			Body:              `{"price": 1500}`,
+			Result:            storage.WriteResult{ID: "abc", Result: "updated", Version: 3},
+			ExpectedOperation: "update",
+			ExpectedID:        "abc",
+			ExpectedCode:      http.StatusOK,
+			ExpectedBody:      `{"status": "success", "id": "abc", "result": "updated", "version": 3}`,
+		},
+		"update missing": {
+			Method:            http.MethodPatch,
+			Path:              "/v1/products/abc",
+			Body:              `{"price": 1500}`,
+			Error:             storage.ErrNotFound,
+			ExpectedOperation: "update",
+			ExpectedID:        "abc",
+			ExpectedCode:      http.StatusNotFound,
+			ExpectedBody:      `{"status": "error", "code": 404, "error": "product not found"}`,
+		},
+		"delete": {
+			Method:            http.MethodDelete,
+			Path:              "/v1/products/abc",
+			Result:            storage.WriteResult{ID: "abc", Result: "deleted", Version: 4},
+			ExpectedOperation: "delete",
+			ExpectedID:        "abc",
+			ExpectedCode:      http.StatusOK,
+			ExpectedBody:      `{"status": "success", "id": "abc", "result": "deleted", "version": 4}`,
+		},
+		"delete missing": {
+			Method:            http.MethodDelete,
+			Path:              "/v1/products/abc",
+			Error:             storage.ErrNotFound,
+			ExpectedOperation: "delete",
+			ExpectedID:        "abc",
+			ExpectedCode:      http.StatusNotFound,
+			ExpectedBody:      `{"status": "error", "code": 404, "error": "product not found"}`,
+		},
+		"rejected by storage": {
+			Method:            http.MethodPut,
+			Path:              "/v1/products/abc",
+			Body:              `{"price": "abc"}`,
+			Error:             &storage.ResponseError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"},
+			ExpectedOperation: "replace",
+			ExpectedID:        "abc",
+			ExpectedCode:      http.StatusBadRequest,
+			ExpectedBody:      `{"status": "error", "code": 400, "error": "document was rejected by the storage"}`,
+		},
+		"storage error": {
+			Method:            http.MethodDelete,
+			Path:              "/v1/products/abc",
+			Error:             errors.New("connection refused"),
+			ExpectedOperation: "delete",
+			ExpectedID:        "abc",
+			ExpectedCode:      http.StatusInternalServerError,
+			ExpectedBody:      `{"status": "error", "code": 500, "error": "Internal Server Error"}`,
+		},
+		"no id": {
+			Method:       http.MethodDelete,
+			Path:         "/v1/products/",
+			ExpectedCode: http.StatusNotFound,
+			ExpectedBody: `{"status": "error", "code": 404, "error": "Not Found"}`,
+		},
+		"nested path": {
+			Method:       http.MethodDelete,
+			Path:         "/v1/products/abc/def",
+			ExpectedCode: http.StatusNotFound,
+			ExpectedBody: `{"status": "error", "code": 404, "error": "Not Found"}`,
+		},
+		"method not allowed": {
+			Method:       http.MethodPost,
+			Path:         "/v1/products/abc",
+			ExpectedCode: http.StatusMethodNotAllowed,
+			ExpectedBody: `{"status": "error", "code": 405, "error": "Method Not Allowed"}`,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &documentWriterMock{Result: testCase.Result, Error: testCase.Error}
+
+			rec := httptest.NewRecorder()
+			web.DocumentHandler(m, schema.Schema{}, "/v1/products/")(rec, web.AuthenticatedRequest{
+				Request:  httptest.NewRequest(testCase.Method, testCase.Path, strings.NewReader(testCase.Body)),
+				Username: "importer",
+			})
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			assert.JSONEq(t, testCase.ExpectedBody, rec.Body.String())
+			assert.Equal(t, testCase.ExpectedOperation, m.Operation)
+			assert.Equal(t, testCase.ExpectedID, m.ID)
+		})
+	}
+}
+
+func TestGetDocumentHandler(t *testing.T) {
+	m := &documentReaderMock{
+		Document: storage.Document{
+			ID:       "abc",
+			Source:   json.RawMessage(`{"title": "AirMax"}`),
+			Version:  3,
+			Revision: storage.Revision{SeqNo: 12, PrimaryTerm: 2},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	web.GetDocumentHandler(m, "/v1/products/")(rec, web.AuthenticatedRequest{
+		Request: httptest.NewRequest(http.MethodGet, "/v1/products/abc", nil),
+	})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"12-2"`, rec.Header().Get("ETag"))
+	assert.JSONEq(t, `{"status": "success", "id": "abc", "version": 3, "document": {"title": "AirMax"}}`, rec.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/products/abc", nil)
+	req.Header.Set("If-None-Match", `"12-2"`)
+
+	rec = httptest.NewRecorder()
+	web.GetDocumentHandler(m, "/v1/products/")(rec, web.AuthenticatedRequest{Request: req})
+
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+}
+
+func TestGetDocumentHandler_NotFound(t *testing.T) {
+	rec := httptest.NewRecorder()
+	web.GetDocumentHandler(&documentReaderMock{Error: storage.ErrNotFound}, "/v1/products/")(rec, web.AuthenticatedRequest{
+		Request: httptest.NewRequest(http.MethodGet, "/v1/products/abc", nil),
+	})
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.JSONEq(t, `{"status": "error", "code": 404, "error": "product not found"}`, rec.Body.String())
+}
+
+func TestDocumentHandler_IfMatch(t *testing.T) {
+	testCases := map[string]struct {
+		Method, IfMatch   string
+		Error             error
+		ExpectedOperation string
+		ExpectedRevision  storage.Revision
+		ExpectedCode      int
+		ExpectedETag      string
+	}{
+		"replace unconditionally": {
+			Method:            http.MethodPut,
+			ExpectedOperation: "replace",
+			ExpectedCode:      http.StatusOK,
+			ExpectedETag:      `"13-2"`,
+		},
+		"replace any revision": {
+			Method:            http.MethodPut,
+			IfMatch:           "*",
+			ExpectedOperation: "replace",
+			ExpectedCode:      http.StatusOK,
+			ExpectedETag:      `"13-2"`,
+		},
+		"replace matching revision": {
+			Method:            http.MethodPut,
+			IfMatch:           `"12-2"`,
+			ExpectedOperation: "replace",
+			ExpectedRevision:  storage.Revision{SeqNo: 12, PrimaryTerm: 2},
+			ExpectedCode:      http.StatusOK,
+			ExpectedETag:      `"13-2"`,
+		},
+		"update modified": {
+			Method:            http.MethodPatch,
+			IfMatch:           `"0-1"`,
+			Error:             storage.ErrConflict,
+			ExpectedOperation: "update",
+			ExpectedRevision:  storage.Revision{SeqNo: 0, PrimaryTerm: 1},
+			ExpectedCode:      http.StatusPreconditionFailed,
+		},
+		"update concurrently": {
+			Method:            http.MethodPatch,
+			Error:             storage.ErrConflict,
+			ExpectedOperation: "update",
+			ExpectedCode:      http.StatusConflict,
+		},
+		"delete matching revision": {
+			Method:            http.MethodDelete,
+			IfMatch:           `"12-2"`,
+			ExpectedOperation: "delete",
+			ExpectedRevision:  storage.Revision{SeqNo: 12, PrimaryTerm: 2},
+			ExpectedCode:      http.StatusOK,
+		},
+		"weak etag": {
+			Method:       http.MethodDelete,
+			IfMatch:      `W/"12-2"`,
+			ExpectedCode: http.StatusPreconditionFailed,
+		},
+		"malformed etag": {
+			Method:       http.MethodPut,
+			IfMatch:      `"12"`,
+			ExpectedCode: http.StatusPreconditionFailed,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &documentWriterMock{
+				Result: storage.WriteResult{ID: "abc", Result: "updated", Version: 4, Revision: storage.Revision{SeqNo: 13, PrimaryTerm: 2}},
+				Error:  testCase.Error,
+			}
+			if testCase.Method == http.MethodDelete {
+				m.Result.Result = "deleted"
+			}
+
+			req := httptest.NewRequest(testCase.Method, "/v1/products/abc", strings.NewReader(`{"title": "AirMax"}`))
+			if testCase.IfMatch != "" {
+				req.Header.Set("If-Match", testCase.IfMatch)
+			}
+
+			rec := httptest.NewRecorder()
+			web.DocumentHandler(m, schema.Schema{}, "/v1/products/")(rec, web.AuthenticatedRequest{
+				Request:  req,
+				Username: "importer",
+			})
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			assert.Equal(t, testCase.ExpectedETag, rec.Header().Get("ETag"))
+			assert.Equal(t, testCase.ExpectedOperation, m.Operation)
+			assert.Equal(t, testCase.ExpectedRevision, m.Revision)
+		})
+	}
+}
+
+func TestDocumentHandler_IfMatch_Queued(t *testing.T) {
+	m := &documentWriterMock{Error: ingest.ErrConditionalWrite}
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/products/abc", strings.NewReader(`{"title": "AirMax"}`))
+	req.Header.Set("If-Match", `"12-2"`)
+
+	rec := httptest.NewRecorder()
+	web.DocumentHandler(m, schema.Schema{}, "/v1/products/")(rec, web.AuthenticatedRequest{
+		Request:  req,
+		Username: "importer",
+	})
+
+	// the write is not acknowledged, since a revision mismatch would go unnoticed by the client
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.JSONEq(t, `{"status": "error", "code": 400, "error": "If-Match is not supported for queued writes"}`, rec.Body.String())
+}
+
+func TestDocumentHandler_IndexBlocked(t *testing.T) {
+	m := &documentWriterMock{Error: storage.ErrIndexBlocked}
+
+	rec := httptest.NewRecorder()
+	web.DocumentHandler(m, schema.Schema{}, "/v1/products/")(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodDelete, "/v1/products/abc", nil),
+		Username: "importer",
+	})
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"status": "error", "code": 503, "error": "product index is being reindexed, retry later"}`, rec.Body.String())
+}
+
+func TestMethods(t *testing.T) {
+	h := web.Methods(map[string]web.SecureHandler{
+		http.MethodGet:  func(w http.ResponseWriter, req web.AuthenticatedRequest) { w.Write([]byte("get")) },
+		http.MethodPost: func(w http.ResponseWriter, req web.AuthenticatedRequest) { w.Write([]byte("post")) },
+	})
+
+	rec := httptest.NewRecorder()
+	h(rec, web.AuthenticatedRequest{Request: httptest.NewRequest(http.MethodPost, "/", nil)})
+	assert.Equal(t, "post", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h(rec, web.AuthenticatedRequest{Request: httptest.NewRequest(http.MethodDelete, "/", nil)})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, POST", rec.Header().Get("Allow"))
+}
+
+type documentWriterMock struct {
+	Operation string
+	ID        string
+	Doc       json.RawMessage
+	Revision  storage.Revision
+
+	Result storage.WriteResult
+	Error  error
+}
+
+func (m *documentWriterMock) Create(ctx context.Context, doc json.RawMessage) (storage.WriteResult, error) {
+	m.Operation, m.Doc = "create", doc
+	return m.Result, m.Error
+}
+
+func (m *documentWriterMock) Replace(ctx context.Context, id string, doc json.RawMessage, rev storage.Revision) (storage.WriteResult, error) {
+	m.Operation, m.ID, m.Doc, m.Revision = "replace", id, doc, rev
+	return m.Result, m.Error
+}
+
+func (m *documentWriterMock) Update(ctx context.Context, id string, partial json.RawMessage, rev storage.Revision) (storage.WriteResult, error) {
+	m.Operation, m.ID, m.Doc, m.Revision = "update", id, partial, rev
+	return m.Result, m.Error
+}
+
+func (m *documentWriterMock) Delete(ctx context.Context, id string, rev storage.Revision) (storage.WriteResult, error) {
+	m.Operation, m.ID, m.Revision = "delete", id, rev
+	return m.Result, m.Error
+}
+
+type documentReaderMock struct {
+	Document storage.Document
+	Error    error
+}
+
+func (m *documentReaderMock) Get(ctx context.Context, id string) (storage.Document, error) {
+	if m.Error != nil {
+		return storage.Document{}, m.Error
+	}
+
+	return m.Document, nil
+}
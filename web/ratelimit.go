@@ -0,0 +1,82 @@
+package web
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+	"github.com/andrewslotin/es-search-service/ratelimit"
+)
+
+var rateLimitErrorsTotal = metrics.NewCounterVec(
+	"search_service_rate_limit_errors_total",
+	"Total number of requests let through because the rate limiter has failed.",
+)
+
+func init() {
+	metrics.Default.MustRegister(rateLimitErrorsTotal)
+}
+
+type policyResolver interface {
+	For(principal string) ratelimit.Policy
+}
+
+// RateLimitMiddleware limits the number of requests an authenticated principal can make according
+// to the policy of their role. Since any Basic credentials are accepted by AuthMiddleware, only principals
+// verified by authn are limited by their name, others are limited by their IP address with the default
+// policy. It sets RateLimit-* response headers and responds with HTTP 429 once the limit is exceeded
+func RateLimitMiddleware(l ratelimit.Limiter, policies policyResolver, authn authenticator, next SecureHandler) SecureHandler {
+	return func(w http.ResponseWriter, req AuthenticatedRequest) {
+		key, ok := VerifiedPrincipal(req.Request, authn)
+		policy := policies.For(key)
+		if !ok {
+			// the name is not used to look up the policy, so that one can't impersonate a principal with a
+			// more generous one
+			key, policy = "anonymous:"+remoteHost(req.Request), policies.For("")
+		}
+
+		if policy.Unlimited() {
+			next(w, req)
+			return
+		}
+
+		d, err := l.Allow(req.Context(), key, policy)
+		if err != nil {
+			// fail open to not let the limiter outage affect the service availability
+			rateLimitErrorsTotal.With().Inc()
+			log.Printf("failed to check rate limit for %s: %s", key, err)
+			next(w, req)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+
+		if !d.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+
+		next(w, req)
+	}
+}
+
+// remoteHost returns the IP address of the client without the port
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
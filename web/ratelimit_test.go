@@ -0,0 +1,165 @@
+package web_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/metrics"
+	"github.com/andrewslotin/es-search-service/ratelimit"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	testCases := map[string]struct {
+		Decision        ratelimit.Decision
+		Error           error
+		ExpectedCode    int
+		ExpectedHeaders map[string]string
+		ExpectedBody    string
+	}{
+		"allowed": {
+			Decision:     ratelimit.Decision{Allowed: true, Limit: 10, Remaining: 9, Reset: 1500 * time.Millisecond},
+			ExpectedCode: http.StatusOK,
+			ExpectedHeaders: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "9",
+				"RateLimit-Reset":     "2",
+			},
+		},
+		"rejected": {
+			Decision:     ratelimit.Decision{Limit: 10, Reset: 10 * time.Second, RetryAfter: 300 * time.Millisecond},
+			ExpectedCode: http.StatusTooManyRequests,
+			ExpectedHeaders: map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "10",
+				"Retry-After":         "1",
+			},
+			ExpectedBody: `{"status": "error", "code": 429, "error": "rate limit exceeded"}`,
+		},
+		"limiter error": {
+			Error:        errors.New("limiter is down"),
+			ExpectedCode: http.StatusOK,
+		},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			l := &limiterMock{Decision: testCase.Decision, Error: testCase.Error}
+			policies := ratelimit.Policies{Default: ratelimit.Policy{Rate: 10}}
+
+			var numRequests int
+			h := web.RateLimitMiddleware(l, policies, testAuthenticator, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+				numRequests++
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.SetBasicAuth("user1", "password1")
+
+			rec := httptest.NewRecorder()
+			h(rec, web.AuthenticatedRequest{
+				Request:  req,
+				Username: "user1",
+			})
+
+			assert.Equal(t, testCase.ExpectedCode, rec.Code)
+			assert.Equal(t, "user1", l.Key)
+			for k, v := range testCase.ExpectedHeaders {
+				assert.Equal(t, v, rec.Header().Get(k), k)
+			}
+
+			if testCase.Error != nil {
+				var buf bytes.Buffer
+				require.NoError(t, metrics.Default.Write(&buf))
+				assert.Contains(t, buf.String(), "\nsearch_service_rate_limit_errors_total ")
+			}
+
+			if testCase.ExpectedBody != "" {
+				assert.JSONEq(t, testCase.ExpectedBody, rec.Body.String())
+				assert.Equal(t, 0, numRequests)
+			} else {
+				assert.Equal(t, 1, numRequests)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware_Unlimited(t *testing.T) {
+	l := &limiterMock{}
+
+	var numRequests int
+	h := web.RateLimitMiddleware(l, ratelimit.Policies{}, testAuthenticator, func(w http.ResponseWriter, req web.AuthenticatedRequest) {
+		numRequests++
+	})
+
+	rec := httptest.NewRecorder()
+	h(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodGet, "/", nil),
+		Username: "user1",
+	})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, numRequests)
+	assert.Empty(t, l.Key)
+	assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+}
+
+func TestRateLimitMiddleware_Unverified(t *testing.T) {
+	policies := ratelimit.Policies{
+		Default: ratelimit.Policy{Rate: 1},
+		Roles:   map[string]ratelimit.Policy{"partner": {Rate: 100}},
+		Members: map[string]string{"user1": "partner"},
+	}
+
+	testCases := map[string]struct {
+		Username, Password string
+		ExpectedKey        string
+		ExpectedPolicy     ratelimit.Policy
+	}{
+		"verified":       {Username: "user1", Password: "password1", ExpectedKey: "user1", ExpectedPolicy: ratelimit.Policy{Rate: 100}},
+		"wrong password": {Username: "user1", Password: "password", ExpectedKey: "anonymous:192.0.2.1", ExpectedPolicy: ratelimit.Policy{Rate: 1}},
+		"no password":    {Username: "user2", Password: "password", ExpectedKey: "anonymous:192.0.2.1", ExpectedPolicy: ratelimit.Policy{Rate: 1}},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			l := &limiterMock{Decision: ratelimit.Decision{Allowed: true}}
+			h := web.RateLimitMiddleware(l, policies, testAuthenticator, func(w http.ResponseWriter, req web.AuthenticatedRequest) {})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.SetBasicAuth(testCase.Username, testCase.Password)
+
+			h(httptest.NewRecorder(), web.AuthenticatedRequest{
+				Request:  req,
+				Username: testCase.Username,
+			})
+
+			// unverified principals are limited by their address regardless of the name they use
+			assert.Equal(t, testCase.ExpectedKey, l.Key)
+			assert.Equal(t, testCase.ExpectedPolicy, l.Policy)
+		})
+	}
+}
+
+var testAuthenticator = &scopeAuthorizerMock{Passwords: map[string]string{"user1": "password1"}}
+
+type limiterMock struct {
+	Key      string
+	Policy   ratelimit.Policy
+	Decision ratelimit.Decision
+	Error    error
+}
+
+func (m *limiterMock) Allow(ctx context.Context, key string, p ratelimit.Policy) (ratelimit.Decision, error) {
+	m.Key, m.Policy = key, p
+
+	return m.Decision, m.Error
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/andrewslotin/es-search-service/reindex"
+)
+
+type reindexer interface {
+	Start() (reindex.Status, error)
+	Status() (reindex.Status, bool)
+}
+
+// ReindexHandler starts copying documents into a new index in response to POST requests and reports
+// the progress of the last reindex in response to GET requests
+func ReindexHandler(r reindexer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var (
+			status reindex.Status
+			code   = http.StatusOK
+		)
+
+		switch req.Method {
+		case http.MethodPost:
+			var err error
+			if status, err = r.Start(); err == reindex.ErrRunning {
+				writeError(w, http.StatusConflict, err.Error())
+				return
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			code = http.StatusAccepted
+		case http.MethodGet:
+			var ok bool
+			if status, ok = r.Status(); !ok {
+				writeError(w, http.StatusNotFound, "no reindex has been started")
+				return
+			}
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(struct {
+			Status  string         `json:"status"`
+			Reindex reindex.Status `json:"reindex"`
+		}{
+			Status:  "success",
+			Reindex: status,
+		})
+	})
+}
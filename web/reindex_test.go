@@ -0,0 +1,90 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrewslotin/es-search-service/reindex"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReindexHandler(t *testing.T) {
+	startedAt := time.Date(2019, 9, 1, 12, 0, 0, 0, time.UTC)
+	r := &reindexerMock{}
+
+	rec := httptest.NewRecorder()
+	web.ReindexHandler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/reindex", nil))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	r.Next = reindex.Status{State: reindex.StateRunning, Alias: "products", StartedAt: startedAt}
+
+	rec = httptest.NewRecorder()
+	web.ReindexHandler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/reindex", nil))
+
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.JSONEq(t, `{
+		"status": "success",
+		"reindex": {"state": "running", "alias": "products", "total": 0, "copied": 0, "started_at": "2019-09-01T12:00:00Z"}
+	}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	web.ReindexHandler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/reindex", nil))
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	r.Current.Source, r.Current.Target, r.Current.Total, r.Current.Copied = "products_v1", "products_v2", 10, 4
+
+	rec = httptest.NewRecorder()
+	web.ReindexHandler(r).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/reindex", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"status": "success",
+		"reindex": {
+			"state": "running",
+			"alias": "products",
+			"source": "products_v1",
+			"target": "products_v2",
+			"total": 10,
+			"copied": 4,
+			"started_at": "2019-09-01T12:00:00Z"
+		}
+	}`, rec.Body.String())
+}
+
+func TestReindexHandler_MethodNotAllowed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	web.ReindexHandler(&reindexerMock{}).ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/reindex", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, POST", rec.Header().Get("Allow"))
+}
+
+type reindexerMock struct {
+	Next    reindex.Status
+	Current *reindex.Status
+}
+
+func (m *reindexerMock) Start() (reindex.Status, error) {
+	if m.Current != nil && m.Current.State == reindex.StateRunning {
+		return reindex.Status{}, reindex.ErrRunning
+	}
+
+	status := m.Next
+	m.Current = &status
+
+	return status, nil
+}
+
+func (m *reindexerMock) Status() (reindex.Status, bool) {
+	if m.Current == nil {
+		return reindex.Status{}, false
+	}
+
+	return *m.Current, true
+}
@@ -7,17 +7,36 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/andrewslotin/es-search-service/breaker"
 	"github.com/andrewslotin/es-search-service/storage"
 )
 
+// ClusterHeader is the response header carrying the name of Elasticsearch cluster that served the request
+const ClusterHeader = "X-Search-Cluster"
+
 type searcher interface {
-	Search(ctx context.Context, query string, opts storage.SearchOptions) ([]json.RawMessage, error)
+	Search(ctx context.Context, query string, opts storage.SearchOptions) (storage.SearchResults, error)
+}
+
+// searchMeta describes the completeness of search results
+type searchMeta struct {
+	Partial  bool           `json:"partial"`
+	TimedOut bool           `json:"timed_out"`
+	Shards   storage.Shards `json:"shards"`
+}
+
+type sortFieldResolver interface {
+	SortField(name string) string
 }
 
 // SearchHandler returns an http.Handler that server search requests and responds
-// with a list of results
-func SearchHandler(s searcher) SecureHandler {
+// with a list of results. The search timeout can be set with the timeout parameter and
+// defaults to defaultTimeout. It's capped by maxTimeout unless it's zero. Sort fields are resolved using
+// the live index definition
+func SearchHandler(s searcher, def sortFieldResolver, defaultTimeout, maxTimeout time.Duration) SecureHandler {
 	return func(w http.ResponseWriter, req AuthenticatedRequest) {
 		q := req.URL.Query().Get("q")
 		if q == "" {
@@ -45,18 +64,71 @@ func SearchHandler(s searcher) SecureHandler {
 			size = v
 		}
 
-		results, err := s.Search(req.Context(), q, storage.SearchOptions{
-			From:   from,
-			Size:   size,
-			Sort:   req.URL.Query()["sort"], // allow multiple "sort" parameters
-			Filter: req.URL.Query().Get("filter"),
-		})
-		if err != nil {
+		timeout := defaultTimeout
+		if s := req.URL.Query().Get("timeout"); s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil || v <= 0 {
+				writeError(w, http.StatusBadRequest, "malformed timeout parameter")
+				return
+			}
+			timeout = v
+		}
+
+		if maxTimeout > 0 && (timeout == 0 || timeout > maxTimeout) {
+			timeout = maxTimeout
+		}
+
+		opts := storage.SearchOptions{
+			From:    from,
+			Size:    size,
+			Sort:    sortFields(def, req.URL.Query()["sort"]), // allow multiple "sort" parameters
+			Filter:  req.URL.Query().Get("filter"),
+			Timeout: timeout,
+		}
+		annotateAccessLog(req.Context(), func(e *accessLogEntry) { e.Query, e.Filter = q, opts.Filter })
+
+		// principals never share cached results, since they may be allowed to see different documents
+		results, err := s.Search(storage.WithSecurityScope(req.Context(), req.Username), q, opts)
+		if e, ok := err.(*breaker.OpenError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(e.RetryAfter)))
+			writeError(w, http.StatusServiceUnavailable, "search is temporarily unavailable")
+			return
+		} else if err == storage.ErrTimeout {
+			writeError(w, http.StatusGatewayTimeout, "search timed out")
+			return
+		} else if err != nil {
 			log.Printf("failed to perform search: %s", err)
 			writeError(w, http.StatusInternalServerError, "")
 			return
 		}
 
+		observeSearchResults(len(results.Documents))
+		annotateAccessLog(req.Context(), func(e *accessLogEntry) {
+			n, took := len(results.Documents), float64(results.Took)/float64(time.Millisecond)
+			e.Results, e.TookMs, e.Cached, e.Stale = &n, &took, results.Cached, results.Stale
+			e.Partial, e.Cluster = results.Partial(), results.Cluster
+		})
+
+		if results.Cluster != "" {
+			w.Header().Set(ClusterHeader, results.Cluster)
+		}
+
+		var meta *searchMeta
+		if results.Partial() {
+			meta = &searchMeta{
+				Partial:  true,
+				TimedOut: results.TimedOut,
+				Shards:   results.Shards,
+			}
+		}
+
+		var age *int
+		if results.Stale {
+			n := int(results.Age.Seconds())
+			age = &n
+			w.Header().Set("Age", strconv.Itoa(n))
+		}
+
 		enc := json.NewEncoder(w)
 		if req.URL.Query().Get("pretty") != "" {
 			enc.SetIndent("", "  ")
@@ -65,9 +137,17 @@ func SearchHandler(s searcher) SecureHandler {
 		enc.Encode(struct {
 			Status  string            `json:"status"`
 			Results []json.RawMessage `json:"results"`
+			Cached  bool              `json:"cached,omitempty"`
+			Stale   bool              `json:"stale,omitempty"`
+			Age     *int              `json:"age,omitempty"` // seconds since stale results were fetched
+			Meta    *searchMeta       `json:"meta,omitempty"`
 		}{
 			Status:  "success",
-			Results: append([]json.RawMessage{}, results...), // make sure "results" is always an array
+			Results: append([]json.RawMessage{}, results.Documents...), // make sure "results" is always an array
+			Cached:  results.Cached,
+			Stale:   results.Stale,
+			Age:     age,
+			Meta:    meta,
 		})
 	}
 }
@@ -83,3 +163,23 @@ func writeError(w http.ResponseWriter, code int, message string) {
 		code,
 	)
 }
+
+// sortFields replaces text fields in sort parameters with their keyword subfields, i.e. title:asc becomes
+// title.keyword:asc, if def has them
+func sortFields(def sortFieldResolver, params []string) []string {
+	if len(params) == 0 {
+		return nil
+	}
+
+	sort := make([]string, len(params))
+	for i, p := range params {
+		field, order := p, ""
+		if n := strings.LastIndexByte(p, ':'); n >= 0 {
+			field, order = p[:n], p[n:]
+		}
+
+		sort[i] = def.SortField(strings.TrimSpace(field)) + order
+	}
+
+	return sort
+}
@@ -6,17 +6,25 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/andrewslotin/es-search-service/breaker"
+	"github.com/andrewslotin/es-search-service/mapping"
 	"github.com/andrewslotin/es-search-service/storage"
 	"github.com/andrewslotin/es-search-service/web"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSearchHandler(t *testing.T) {
 	testCases := map[string]struct {
 		Request       *http.Request
 		SearchResult  []json.RawMessage
+		Cached        bool
+		Stale         bool
+		Age           time.Duration
+		TimedOut      bool
 		ExpectedCode  int
 		ExpectedBody  string
 		ExpectedQuery string
@@ -38,6 +46,38 @@ func TestSearchHandler(t *testing.T) {
 			ExpectedBody:  `{"status": "success", "results": []}`,
 			ExpectedQuery: "search term",
 		},
+		"cached": {
+			Request: httptest.NewRequest(http.MethodGet, "/?q=search+term", nil),
+			SearchResult: []json.RawMessage{
+				json.RawMessage(`{"key": "value"}`),
+			},
+			Cached:        true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedBody:  `{"status": "success", "results": [{"key": "value"}], "cached": true}`,
+			ExpectedQuery: "search term",
+		},
+		"stale": {
+			Request: httptest.NewRequest(http.MethodGet, "/?q=search+term", nil),
+			SearchResult: []json.RawMessage{
+				json.RawMessage(`{"key": "value"}`),
+			},
+			Cached:        true,
+			Stale:         true,
+			Age:           90 * time.Second,
+			ExpectedCode:  http.StatusOK,
+			ExpectedBody:  `{"status": "success", "results": [{"key": "value"}], "cached": true, "stale": true, "age": 90}`,
+			ExpectedQuery: "search term",
+		},
+		"partial": {
+			Request: httptest.NewRequest(http.MethodGet, "/?q=search+term", nil),
+			SearchResult: []json.RawMessage{
+				json.RawMessage(`{"key": "value"}`),
+			},
+			TimedOut:      true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedBody:  `{"status": "success", "results": [{"key": "value"}], "meta": {"partial": true, "timed_out": true, "shards": {"total": 0, "successful": 0, "skipped": 0, "failed": 0}}}`,
+			ExpectedQuery: "search term",
+		},
 		"with pagination": {
 			Request:       httptest.NewRequest(http.MethodGet, "/?q=search+term&from=11&size=123", nil),
 			ExpectedCode:  http.StatusOK,
@@ -52,6 +92,13 @@ func TestSearchHandler(t *testing.T) {
 			ExpectedQuery: "search term",
 			ExpectedOpts:  storage.SearchOptions{Sort: []string{"a:asc", "b:desc"}},
 		},
+		"with sort by text field": {
+			Request:       httptest.NewRequest(http.MethodGet, "/?q=search+term&sort=title:asc&sort=price:desc&sort=brand", nil),
+			ExpectedCode:  http.StatusOK,
+			ExpectedBody:  `{"status": "success", "results": []}`,
+			ExpectedQuery: "search term",
+			ExpectedOpts:  storage.SearchOptions{Sort: []string{"title.keyword:asc", "price:desc", "brand.keyword"}},
+		},
 		"with filter": {
 			Request:       httptest.NewRequest(http.MethodGet, "/?q=search+term&filter=a:1+OR+b:2+and+c:3", nil),
 			ExpectedCode:  http.StatusOK,
@@ -89,9 +136,13 @@ func TestSearchHandler(t *testing.T) {
 	for name, testCase := range testCases {
 		t.Run(name, func(t *testing.T) {
 			m := &searcherMock{
-				Results: testCase.SearchResult,
+				Results:  testCase.SearchResult,
+				Cached:   testCase.Cached,
+				Stale:    testCase.Stale,
+				Age:      testCase.Age,
+				TimedOut: testCase.TimedOut,
 			}
-			h := web.SearchHandler(m)
+			h := web.SearchHandler(m, mapping.Products, 0, 0)
 			rec := httptest.NewRecorder()
 
 			h(rec, web.AuthenticatedRequest{
@@ -107,15 +158,153 @@ func TestSearchHandler(t *testing.T) {
 	}
 }
 
+func TestSearchHandler_SortWithoutKeywordSubfield(t *testing.T) {
+	// an index created by dynamic mapping before the keyword subfield was added
+	def := mapping.Definition{
+		Properties: map[string]mapping.Field{"title": {Type: "text"}},
+	}
+
+	m := &searcherMock{}
+	web.SearchHandler(m, def, 0, 0)(httptest.NewRecorder(), web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodGet, "/?q=search+term&sort=title:asc", nil),
+		Username: "test1",
+	})
+
+	assert.Equal(t, []string{"title:asc"}, m.Opts.Sort)
+}
+
+func TestSearchHandler_CircuitBreakerOpen(t *testing.T) {
+	m := &searcherMock{
+		Error: &breaker.OpenError{RetryAfter: 1500 * time.Millisecond},
+	}
+
+	rec := httptest.NewRecorder()
+	web.SearchHandler(m, mapping.Products, 0, 0)(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodGet, "/?q=search+term", nil),
+		Username: "test1",
+	})
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"status": "error", "code": 503, "error": "search is temporarily unavailable"}`, rec.Body.String())
+}
+
+func TestSearchHandler_Cluster(t *testing.T) {
+	rec := httptest.NewRecorder()
+	web.SearchHandler(&searcherMock{Cluster: "dr"}, mapping.Products, 0, 0)(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodGet, "/?q=search+term", nil),
+		Username: "test1",
+	})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "dr", rec.Header().Get(web.ClusterHeader))
+}
+
+func TestSearchHandler_SecurityScope(t *testing.T) {
+	b := &scopedBackendMock{}
+	h := web.SearchHandler(storage.WithCache(b, 1<<20, time.Minute, 0), mapping.Products, 0, 0)
+
+	for _, user := range []string{"test1", "test2", "test1"} {
+		rec := httptest.NewRecorder()
+		h(rec, web.AuthenticatedRequest{
+			Request:  httptest.NewRequest(http.MethodGet, "/?q=search+term", nil),
+			Username: user,
+		})
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `{"visible_to":"`+user+`"}`)
+	}
+
+	assert.Equal(t, 2, b.Calls)
+}
+
+func TestSearchHandler_Timeout(t *testing.T) {
+	testCases := map[string]struct {
+		Query           string
+		DefaultTimeout  time.Duration
+		MaxTimeout      time.Duration
+		ExpectedTimeout time.Duration
+	}{
+		"default":           {Query: "q=search+term", DefaultTimeout: 5 * time.Second, MaxTimeout: 10 * time.Second, ExpectedTimeout: 5 * time.Second},
+		"provided":          {Query: "q=search+term&timeout=500ms", DefaultTimeout: 5 * time.Second, MaxTimeout: 10 * time.Second, ExpectedTimeout: 500 * time.Millisecond},
+		"above maximum":     {Query: "q=search+term&timeout=1m", DefaultTimeout: 5 * time.Second, MaxTimeout: 10 * time.Second, ExpectedTimeout: 10 * time.Second},
+		"no default":        {Query: "q=search+term", MaxTimeout: 10 * time.Second, ExpectedTimeout: 10 * time.Second},
+		"no maximum":        {Query: "q=search+term&timeout=1m", DefaultTimeout: 5 * time.Second, ExpectedTimeout: time.Minute},
+		"no timeouts given": {Query: "q=search+term"},
+	}
+
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &searcherMock{}
+
+			rec := httptest.NewRecorder()
+			web.SearchHandler(m, mapping.Products, testCase.DefaultTimeout, testCase.MaxTimeout)(rec, web.AuthenticatedRequest{
+				Request:  httptest.NewRequest(http.MethodGet, "/?"+testCase.Query, nil),
+				Username: "test1",
+			})
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, testCase.ExpectedTimeout, m.Opts.Timeout)
+		})
+	}
+}
+
+func TestSearchHandler_Timeout_Malformed(t *testing.T) {
+	for _, timeout := range []string{"abc", "-1s", "0"} {
+		t.Run(timeout, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			web.SearchHandler(&searcherMock{}, mapping.Products, 0, 0)(rec, web.AuthenticatedRequest{
+				Request:  httptest.NewRequest(http.MethodGet, "/?q=search+term&timeout="+timeout, nil),
+				Username: "test1",
+			})
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.JSONEq(t, `{"status": "error", "code": 400, "error": "malformed timeout parameter"}`, rec.Body.String())
+		})
+	}
+}
+
+func TestSearchHandler_Timeout_Exceeded(t *testing.T) {
+	rec := httptest.NewRecorder()
+	web.SearchHandler(&searcherMock{Error: storage.ErrTimeout}, mapping.Products, 0, 0)(rec, web.AuthenticatedRequest{
+		Request:  httptest.NewRequest(http.MethodGet, "/?q=search+term", nil),
+		Username: "test1",
+	})
+
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.JSONEq(t, `{"status": "error", "code": 504, "error": "search timed out"}`, rec.Body.String())
+}
+
+type scopedBackendMock struct {
+	Calls int
+}
+
+func (m *scopedBackendMock) Search(ctx context.Context, query string, opts storage.SearchOptions) (storage.SearchResults, error) {
+	m.Calls++
+
+	doc := `{"visible_to":"` + storage.SecurityScope(ctx) + `"}`
+	return storage.SearchResults{Documents: []json.RawMessage{json.RawMessage(doc)}}, nil
+}
+
+func (m *scopedBackendMock) Health(ctx context.Context) (storage.Health, error) {
+	return storage.Health{}, nil
+}
+
 type searcherMock struct {
-	Query   string
-	Opts    storage.SearchOptions
-	Results []json.RawMessage
+	Query    string
+	Opts     storage.SearchOptions
+	Results  []json.RawMessage
+	Cached   bool
+	Stale    bool
+	Age      time.Duration
+	TimedOut bool
+	Cluster  string
+	Error    error
 }
 
-func (m *searcherMock) Search(ctx context.Context, query string, opts storage.SearchOptions) ([]json.RawMessage, error) {
+func (m *searcherMock) Search(ctx context.Context, query string, opts storage.SearchOptions) (storage.SearchResults, error) {
 	m.Query = query
 	m.Opts = opts
 
-	return m.Results, nil
+	return storage.SearchResults{Documents: m.Results, Cached: m.Cached, Stale: m.Stale, Age: m.Age, TimedOut: m.TimedOut, Cluster: m.Cluster}, m.Error
 }
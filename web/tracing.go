@@ -0,0 +1,39 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/andrewslotin/es-search-service/tracing"
+)
+
+// TracingMiddleware starts a server span for each request served by next. If the request carries
+// a valid traceparent header, the span joins the caller's trace, otherwise a new trace is started
+func TracingMiddleware(t *tracing.Tracer, route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		parent, _ := tracing.ParseTraceparent(req.Header.Get(tracing.TraceparentHeader))
+
+		ctx, span := t.Start(req.Context(), req.Method+" "+route, tracing.SpanKindServer, parent)
+		defer span.End()
+
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", req.URL.RequestURI())
+		if id := RequestID(ctx); id != "" {
+			span.SetAttribute("http.request_id", id)
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", rec.Status())
+		if rec.Status() >= http.StatusInternalServerError {
+			span.SetError(errorStatus(rec.Status()))
+		}
+	})
+}
+
+type errorStatus int
+
+func (code errorStatus) Error() string {
+	return http.StatusText(int(code))
+}
@@ -0,0 +1,40 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewslotin/es-search-service/tracing"
+	"github.com/andrewslotin/es-search-service/web"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	e := &tracing.InMemoryExporter{}
+
+	var spanCtx tracing.SpanContext
+	h := web.TracingMiddleware(tracing.NewTracer(e), "/v1/products", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		spanCtx = tracing.SpanFromContext(req.Context()).Context()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/products?q=Nike", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	spans := e.Spans()
+	require.Len(t, spans, 1)
+
+	assert.Equal(t, "GET /v1/products", spans[0].Name)
+	assert.Equal(t, tracing.SpanKindServer, spans[0].Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", spans[0].Parent.Traceparent()[3:52])
+	assert.Equal(t, spanCtx, spans[0].Context)
+	assert.Equal(t, "/v1/products?q=Nike", spans[0].Attributes["http.target"])
+	assert.Equal(t, http.StatusBadGateway, spans[0].Attributes["http.status_code"])
+	assert.Equal(t, "Bad Gateway", spans[0].Error)
+}